@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"pion-webrtc-sfu/configuration"
+	"strings"
+	"time"
+)
+
+// prefix of the websocket subprotocol carrying the token, for browsers that can't set headers
+const SubprotocolPrefix = "token."
+
+// subprotocol the server answers with, browsers fail the connection if none of theirs is selected
+const Subprotocol = "sfu"
+
+// signing secret, tokens are not required if empty
+var secret []byte
+
+// allowed websocket origins as scheme://host[:port], all origins are allowed if empty
+var allowedOrigins []string
+
+// load secret and origin allowlist from configuration
+func InitAuth(config *configuration.Configuration) error {
+	secret = []byte(config.Http_ws_token_secret)
+	allowedOrigins = nil
+	for _, origin := range strings.Split(config.Http_ws_allowed_origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("invalid origin %q in HTTP_WS_ALLOWED_ORIGINS, must be like https://example.com", origin)
+			}
+		}
+		allowedOrigins = append(allowedOrigins, strings.ToLower(strings.TrimSuffix(origin, "/")))
+	}
+	return nil
+}
+
+// true if websocket connections need a token
+func TokensRequired() bool {
+	return len(secret) > 0
+}
+
+/*
+true if the origin of a websocket, whep or hls request is in the allowlist
+requests without origin header don't come from browsers and are allowed, they can't be used for cross site requests
+*/
+func OriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(allowedOrigins) == 0 || origin == "" {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// token of a websocket request, from the token query parameter or a "token.<jwt>" subprotocol
+func TokenFromRequest(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if token := strings.TrimPrefix(strings.TrimSpace(protocol), SubprotocolPrefix); token != strings.TrimSpace(protocol) {
+				return token
+			}
+		}
+	}
+	return ""
+}
+
+// token of a whep or hls request, from an "Authorization: Bearer <jwt>" header
+func BearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// verify a token with the configured secret and check that it is not revoked
+func Authenticate(token string) (Claims, error) {
+	if token == "" {
+		return Claims{}, fmt.Errorf("%w: no token provided", ErrMalformedToken)
+	}
+	claims, err := Verify(token, secret, time.Now())
+	if err != nil {
+		return Claims{}, err
+	}
+	if IsRevoked(claims) {
+		return Claims{}, ErrRevoked
+	}
+	return claims, nil
+}
+
+// sign claims with the configured secret
+func Issue(claims Claims) (string, error) {
+	return Sign(claims, secret)
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"pion-webrtc-sfu/configuration"
+	"testing"
+	"time"
+)
+
+// configure the secret and origin allowlist, restored when the test ends
+func testInitAuth(t *testing.T, origins string) {
+	t.Helper()
+	if err := InitAuth(&configuration.Configuration{Http_ws_token_secret: string(testSecret), Http_ws_allowed_origins: origins}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { secret, allowedOrigins = nil, nil })
+}
+
+func TestInitAuthInvalidOrigin(t *testing.T) {
+	for _, origins := range []string{"example.com", "https://", "://example.com", "https://example.com, localhost:8080"} {
+		if err := InitAuth(&configuration.Configuration{Http_ws_allowed_origins: origins}); err == nil {
+			t.Errorf("origins %q accepted", origins)
+		}
+	}
+	secret, allowedOrigins = nil, nil
+}
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins string
+		origin  string
+		want    bool
+	}{
+		{"no allowlist", "", "https://evil.example", true},
+		{"no allowlist without origin", "", "", true},
+		{"listed", "https://example.com, http://localhost:8080", "http://localhost:8080", true},
+		{"listed with trailing slash", "https://example.com/", "https://example.com", true},
+		{"listed in other case", "https://Example.com", "HTTPS://EXAMPLE.COM", true},
+		{"not listed", "https://example.com", "https://evil.example", false},
+		{"other scheme", "https://example.com", "http://example.com", false},
+		{"other port", "https://example.com", "https://example.com:8443", false},
+		{"subdomain", "https://example.com", "https://www.example.com", false},
+		{"suffix", "https://example.com", "https://example.com.evil.example", false},
+		{"opaque origin", "https://example.com", "null", false},
+		{"wildcard", "https://example.com,*", "https://evil.example", true},
+		// requests without origin header don't come from browsers
+		{"without origin", "https://example.com", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testInitAuth(t, test.origins)
+			r := httptest.NewRequest("GET", "/ws", nil)
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			if got := OriginAllowed(r); got != test.want {
+				t.Errorf("origin %q with allowlist %q: got %v, want %v", test.origin, test.origins, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		protocols []string
+		want      string
+	}{
+		{"query", "/ws?token=abc", nil, "abc"},
+		{"subprotocol", "/ws", []string{"sfu, token.abc"}, "abc"},
+		{"second header", "/ws", []string{"sfu", "token.abc"}, "abc"},
+		{"query first", "/ws?token=abc", []string{"token.def"}, "abc"},
+		{"other subprotocols", "/ws", []string{"sfu, tokenabc"}, ""},
+		{"none", "/ws", nil, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.target, nil)
+		for _, protocol := range test.protocols {
+			r.Header.Add("Sec-WebSocket-Protocol", protocol)
+		}
+		if got := TokenFromRequest(r); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"Bearer abc", "abc"},
+		{"bearer abc ", "abc"},
+		{"Basic abc", ""},
+		{"Bearer", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/whep/live", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if got := BearerToken(r); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+func TestAuthenticateRevoked(t *testing.T) {
+	testInitAuth(t, "")
+	t.Cleanup(func() { revocations = make(map[string]Revocation) })
+	issue := func(id, user string) string {
+		token, err := Issue(Claims{Session: "live", User: user, Expiry: time.Now().Add(time.Hour).Unix(), ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	revokedID, otherID, revokedUser := issue("token-1", "alice"), issue("token-2", "alice"), issue("token-3", "bob")
+	for _, r := range []Revocation{
+		{TokenID: "token-1"},
+		{User: "bob"},
+		{TokenID: "token-2", Expires: time.Now().Add(-time.Second).Unix()}, // expired, no longer applies
+	} {
+		if err := Revoke(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"revoked jti", revokedID, ErrRevoked},
+		{"other jti of the same user", otherID, nil},
+		{"revoked user", revokedUser, ErrRevoked},
+		{"no token", "", ErrMalformedToken},
+	}
+	for _, test := range tests {
+		if _, err := Authenticate(test.token); !errors.Is(err, test.wantErr) {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.wantErr)
+		}
+	}
+	if list := ListRevocations(); len(list) != 2 {
+		t.Errorf("revocations %+v, want the expired one dropped", list)
+	}
+	// tokens are accepted again once the revocation is removed
+	if !Unrevoke(Revocation{TokenID: "token-1"}) || Unrevoke(Revocation{TokenID: "token-1"}) {
+		t.Error("unrevoke did not remove the revocation exactly once")
+	}
+	if _, err := Authenticate(revokedID); err != nil {
+		t.Errorf("unrevoked token: %v", err)
+	}
+	if err := Revoke(Revocation{TokenID: "token-1", User: "alice"}); err == nil {
+		t.Error("revocation of both token id and user accepted")
+	}
+}
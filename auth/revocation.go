@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+revoked token id or user, tokens matching either are rejected
+an entry can expire, e.g. together with the tokens it revokes
+*/
+type Revocation struct {
+	TokenID string `json:"token_id,omitempty"`
+	User    string `json:"user,omitempty"`
+	Expires int64  `json:"expires,omitempty"` // unix time, kept until removed if 0
+}
+
+func (r Revocation) key() string {
+	if r.TokenID != "" {
+		return "jti:" + r.TokenID
+	}
+	return "user:" + r.User
+}
+
+func (r Revocation) expired(now time.Time) bool {
+	return r.Expires != 0 && !now.Before(time.Unix(r.Expires, 0))
+}
+
+// true if the revocation applies to a token with the claims
+func (r Revocation) Matches(claims Claims) bool {
+	if r.TokenID != "" {
+		return claims.ID == r.TokenID
+	}
+	return claims.User == r.User
+}
+
+// revocations by key
+var revocations = make(map[string]Revocation)
+
+// mutex for above map read/write
+var revocationsMutex sync.Mutex
+
+// add or replace a revocation
+func Revoke(r Revocation) error {
+	if (r.TokenID == "") == (r.User == "") {
+		return errors.New("exactly one of token_id and user must be set")
+	}
+	revocationsMutex.Lock()
+	defer revocationsMutex.Unlock()
+	revocations[r.key()] = r
+	return nil
+}
+
+// remove a revocation, returns false if it did not exist
+func Unrevoke(r Revocation) bool {
+	revocationsMutex.Lock()
+	defer revocationsMutex.Unlock()
+	if _, exists := revocations[r.key()]; !exists {
+		return false
+	}
+	delete(revocations, r.key())
+	return true
+}
+
+// active revocations, expired ones are dropped
+func ListRevocations() []Revocation {
+	revocationsMutex.Lock()
+	defer revocationsMutex.Unlock()
+	pruneRevocations(time.Now())
+	list := make([]Revocation, 0, len(revocations))
+	for _, r := range revocations {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+	return list
+}
+
+// true if the token id or user of the claims is revoked
+func IsRevoked(claims Claims) bool {
+	revocationsMutex.Lock()
+	defer revocationsMutex.Unlock()
+	pruneRevocations(time.Now())
+	for _, r := range revocations {
+		if r.Matches(claims) {
+			return true
+		}
+	}
+	return false
+}
+
+func pruneRevocations(now time.Time) {
+	for key, r := range revocations {
+		if r.expired(now) {
+			delete(revocations, key)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// roles a token can grant
+const (
+	RoleViewer    = "viewer"
+	RoleModerator = "moderator"
+)
+
+/*
+claims of a websocket token
+the token is a jwt signed with HS256 using HTTP_WS_TOKEN_SECRET
+*/
+type Claims struct {
+	Session string `json:"session"`       // session the token may join
+	User    string `json:"sub"`           // user id
+	Role    string `json:"role"`          // viewer or moderator, viewer if empty
+	Expiry  int64  `json:"exp"`           // unix time
+	ID      string `json:"jti,omitempty"` // token id, used to revoke single tokens
+}
+
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrSignature      = errors.New("invalid token signature")
+	ErrExpired        = errors.New("token expired")
+	ErrRevoked        = errors.New("token revoked")
+)
+
+// header of all tokens created and accepted
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// create a signed token, mainly for backends without a jwt library and testing
+func Sign(claims Claims, secret []byte) (string, error) {
+	header, err := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	return unsigned + "." + encoding.EncodeToString(signature(unsigned, secret)), nil
+}
+
+/*
+check signature and expiry of a token and return its claims
+only HS256 is accepted, the algorithm in the header is never trusted for anything else
+*/
+func Verify(token string, secret []byte, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrMalformedToken
+	}
+	var header tokenHeader
+	if err := decodePart(parts[0], &header); err != nil {
+		return Claims{}, err
+	}
+	if header.Alg != "HS256" {
+		return Claims{}, fmt.Errorf("%w: unsupported algorithm %q", ErrMalformedToken, header.Alg)
+	}
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrMalformedToken
+	}
+	if !hmac.Equal(sig, signature(parts[0]+"."+parts[1], secret)) {
+		return Claims{}, ErrSignature
+	}
+	var claims Claims
+	if err := decodePart(parts[1], &claims); err != nil {
+		return Claims{}, err
+	}
+	if claims.Expiry == 0 || !now.Before(time.Unix(claims.Expiry, 0)) {
+		return Claims{}, ErrExpired
+	}
+	if claims.Session == "" || claims.User == "" {
+		return Claims{}, fmt.Errorf("%w: session and sub are required", ErrMalformedToken)
+	}
+	switch claims.Role {
+	case "":
+		claims.Role = RoleViewer
+	case RoleViewer, RoleModerator:
+	default:
+		return Claims{}, fmt.Errorf("%w: unknown role %q", ErrMalformedToken, claims.Role)
+	}
+	return claims, nil
+}
+
+func decodePart(part string, v interface{}) error {
+	raw, err := encoding.DecodeString(part)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+func signature(unsigned string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
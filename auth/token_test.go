@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("secret")
+
+var testNow = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func testClaims() Claims {
+	return Claims{Session: "live", User: "alice", Expiry: testNow.Add(time.Hour).Unix(), ID: "token-1"}
+}
+
+// token with the header and claims as given, signed with the secret using HS256
+func testToken(header string, claims string, secret []byte) string {
+	unsigned := encoding.EncodeToString([]byte(header)) + "." + encoding.EncodeToString([]byte(claims))
+	return unsigned + "." + encoding.EncodeToString(signature(unsigned, secret))
+}
+
+func TestSignVerify(t *testing.T) {
+	token, err := Sign(testClaims(), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := Verify(token, testSecret, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the role defaults to viewer
+	want := testClaims()
+	want.Role = RoleViewer
+	if claims != want {
+		t.Errorf("got %+v, want %+v", claims, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	valid, err := Sign(testClaims(), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ".")
+	header := `{"alg":"HS256","typ":"JWT"}`
+	exp := testClaims().Expiry
+	claims := fmt.Sprintf(`{"session":"live","sub":"alice","exp":%v}`, exp)
+	// HS512 signature of the same content, only the header differs
+	hs512Unsigned := encoding.EncodeToString([]byte(`{"alg":"HS512"}`)) + "." + parts[1]
+	mac := hmac.New(sha512.New, testSecret)
+	mac.Write([]byte(hs512Unsigned))
+	hs512 := hs512Unsigned + "." + encoding.EncodeToString(mac.Sum(nil))
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", valid, nil},
+		{"other secret", testToken(header, claims, []byte("other")), ErrSignature},
+		{"changed claims", parts[0] + "." + encoding.EncodeToString([]byte(strings.Replace(claims, "live", "other", 1))) + "." + parts[2], ErrSignature},
+		{"truncated signature", parts[0] + "." + parts[1] + "." + parts[2][:10], ErrSignature},
+		{"empty signature", parts[0] + "." + parts[1] + ".", ErrSignature},
+		{"signature not base64", parts[0] + "." + parts[1] + ".!!", ErrMalformedToken},
+		{"alg none", encoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", ErrMalformedToken},
+		{"alg none with signature", testToken(`{"alg":"none"}`, claims, testSecret), ErrMalformedToken},
+		{"alg None", testToken(`{"alg":"None"}`, claims, testSecret), ErrMalformedToken},
+		{"alg hs256", testToken(`{"alg":"hs256"}`, claims, testSecret), ErrMalformedToken},
+		{"alg HS512", hs512, ErrMalformedToken},
+		{"alg RS256", testToken(`{"alg":"RS256"}`, claims, testSecret), ErrMalformedToken},
+		{"no alg", testToken(`{"typ":"JWT"}`, claims, testSecret), ErrMalformedToken},
+		{"expired", testToken(header, fmt.Sprintf(`{"session":"live","sub":"alice","exp":%v}`, testNow.Add(-time.Second).Unix()), testSecret), ErrExpired},
+		{"expires now", testToken(header, fmt.Sprintf(`{"session":"live","sub":"alice","exp":%v}`, testNow.Unix()), testSecret), ErrExpired},
+		{"no expiry", testToken(header, `{"session":"live","sub":"alice"}`, testSecret), ErrExpired},
+		{"no session", testToken(header, fmt.Sprintf(`{"sub":"alice","exp":%v}`, exp), testSecret), ErrMalformedToken},
+		{"no user", testToken(header, fmt.Sprintf(`{"session":"live","exp":%v}`, exp), testSecret), ErrMalformedToken},
+		{"moderator", testToken(header, fmt.Sprintf(`{"session":"live","sub":"alice","role":"moderator","exp":%v}`, exp), testSecret), nil},
+		{"unknown role", testToken(header, fmt.Sprintf(`{"session":"live","sub":"alice","role":"admin","exp":%v}`, exp), testSecret), ErrMalformedToken},
+		{"claims not json", testToken(header, `session=live`, testSecret), ErrMalformedToken},
+		{"header not json", testToken(`HS256`, claims, testSecret), ErrMalformedToken},
+		{"two parts", parts[0] + "." + parts[1], ErrMalformedToken},
+		{"four parts", valid + "." + parts[2], ErrMalformedToken},
+		{"empty", "", ErrMalformedToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Verify(test.token, testSecret, testNow); !errors.Is(err, test.wantErr) {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -4,8 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
+	"pion-webrtc-sfu/logging"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -18,26 +19,76 @@ type PortRange struct {
 }
 
 type Configuration struct {
-	Http_local_server_location      string
-	Http_local_htmlserver_enabled   bool
-	Http_tls_cert_file_location     string
-	Http_tls_key_file_location      string
-	Http_gin_is_debug               bool
-	Rtc_disconnect_timeout_seconds  uint
-	Rtc_video_tracks_receive_port   uint16
-	Rtc_audio_tracks_receive_port   uint16
-	Rtc_receive_rtp_buffsize        uint16
-	Rtc_video_codec                 string
-	Rtc_audio_codec                 string
-	Rtc_failed_timeout_seconds      uint
-	Rtc_keepalive_interval_seconds  uint
-	Server_ephemeral_udp_port_range PortRange
-	Server_NAT_1to1_IPs             string
+	Http_local_server_location       string
+	Http_local_htmlserver_enabled    bool
+	Http_tls_cert_file_location      string
+	Http_tls_key_file_location       string
+	Http_gin_is_debug                bool
+	Http_api_token                   string
+	Http_whip_token                  string
+	Http_hls_enabled                 bool
+	Http_hls_segment_duration_ms     uint
+	Http_hls_part_duration_ms        uint
+	Http_hls_segment_count           uint
+	Http_metrics_enabled             bool
+	Http_ws_token_secret             string
+	Http_ws_allowed_origins          string
+	Rtc_disconnect_timeout_seconds   uint
+	Rtc_video_tracks_receive_port    uint16
+	Rtc_audio_tracks_receive_port    uint16
+	Rtc_rtmp_receive_port            uint16
+	Rtc_rtmp_publish_token           string
+	Rtc_receive_rtp_buffsize         uint16
+	Rtc_video_codec                  string
+	Rtc_audio_codec                  string
+	Rtc_failed_timeout_seconds       uint
+	Rtc_keepalive_interval_seconds   uint
+	Rtc_keyframe_request_interval_ms uint
+	Rtc_gop_cache_max_packets        uint
+	Rtc_stream_keys                  string
+	Rtc_bwe_initial_bitrate          uint
+	Rtc_bwe_min_video_bitrate        uint
+	Rtc_rtsp_sources                 string
+	Rtc_rtsp_transport               string
+	Rtc_mpegts_sources               string
+	Rtc_record_directory             string
+	Rtc_record_sessions              string
+	Rtc_record_h264_format           string
+	Rtc_origin_url                   string
+	Rtc_session_idle_timeout_seconds uint
+	Rtc_stream_stall_timeout_ms      uint
+	Rtc_slates                       string
+	Rtc_failover_timeout_ms          uint
+	Rtc_slate_directory              string
+	Server_ephemeral_udp_port_range  PortRange
+	Server_NAT_1to1_IPs              string
+	Server_log_level                 string
+	Server_log_format                string
+	Server_shutdown_timeout_seconds  uint
+	Server_shutdown_reconnect_hint   string
 }
 
+// password part of urls with credentials
+var urlPasswords = regexp.MustCompile(`://([^:@/]*):[^@/]*@`)
+
 func PrintConfiguration(config *Configuration) {
-	s, _ := json.MarshalIndent(config, "", "\t")
-	log.Printf("Configuration: \n%s", string(s))
+	// hide secrets from logs
+	masked := *config
+	if masked.Http_api_token != "" {
+		masked.Http_api_token = "********"
+	}
+	if masked.Http_whip_token != "" {
+		masked.Http_whip_token = "********"
+	}
+	if masked.Rtc_rtmp_publish_token != "" {
+		masked.Rtc_rtmp_publish_token = "********"
+	}
+	if masked.Http_ws_token_secret != "" {
+		masked.Http_ws_token_secret = "********"
+	}
+	masked.Rtc_rtsp_sources = urlPasswords.ReplaceAllString(masked.Rtc_rtsp_sources, "://$1:********@")
+	s, _ := json.Marshal(masked)
+	logging.Infof("Configuration: %s", string(s))
 }
 
 // get value of env_key from loaded .env and return it
@@ -127,6 +178,14 @@ func CreateConfiguration() (*Configuration, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading HTTP_GIN_IS_DEBUG: %v", err)
 	}
+	http_api_token, err := valueFromEnv("HTTP_API_TOKEN", HTTP_API_TOKEN_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP_API_TOKEN: %v", err)
+	}
+	http_whip_token, err := valueFromEnv("HTTP_WHIP_TOKEN", HTTP_WHIP_TOKEN_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP_WHIP_TOKEN: %v", err)
+	}
 	rtc_video_tracks_receive_port, err := valueFromEnv("RTC_VIDEO_TRACKS_RECEIVE_PORT", RTC_VIDEO_TRACKS_RECEIVE_PORT_DEFAULT)
 	if err != nil {
 		return nil, fmt.Errorf("error reading RTC_VIDEO_TRACKS_RECEIVE_PORT: %v", err)
@@ -135,6 +194,14 @@ func CreateConfiguration() (*Configuration, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading RTC_AUDIO_TRACKS_RECEIVE_PORT: %v", err)
 	}
+	rtc_rtmp_receive_port, err := valueFromEnv("RTC_RTMP_RECEIVE_PORT", RTC_RTMP_RECEIVE_PORT_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_RTMP_RECEIVE_PORT: %v", err)
+	}
+	rtc_rtmp_publish_token, err := valueFromEnv("RTC_RTMP_PUBLISH_TOKEN", RTC_RTMP_PUBLISH_TOKEN_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_RTMP_PUBLISH_TOKEN: %v", err)
+	}
 	rtc_receive_rtp_buffsize, err := valueFromEnv("RTC_RECEIVE_RTP_BUFFSIZE", RTC_RECEIVE_RTP_BUFFSIZE_DEFAULT)
 	if err != nil {
 		return nil, fmt.Errorf("error reading RTC_RECEIVE_RTP_BUFFSIZE: %v", err)
@@ -147,6 +214,34 @@ func CreateConfiguration() (*Configuration, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading RTC_AUDIO_CODEC: %v", err)
 	}
+	http_hls_enabled, err := valueFromEnv("HTTP_HLS_ENABLED", HTTP_HLS_ENABLED_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP_HLS_ENABLED: %v", err)
+	}
+	http_hls_segment_duration_ms, err := valueFromEnv("HTTP_HLS_SEGMENT_DURATION_MS", HTTP_HLS_SEGMENT_DURATION_MS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP_HLS_SEGMENT_DURATION_MS: %v", err)
+	}
+	http_hls_part_duration_ms, err := valueFromEnv("HTTP_HLS_PART_DURATION_MS", HTTP_HLS_PART_DURATION_MS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP_HLS_PART_DURATION_MS: %v", err)
+	}
+	http_hls_segment_count, err := valueFromEnv("HTTP_HLS_SEGMENT_COUNT", HTTP_HLS_SEGMENT_COUNT_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP_HLS_SEGMENT_COUNT: %v", err)
+	}
+	http_metrics_enabled, err := valueFromEnv("HTTP_METRICS_ENABLED", HTTP_METRICS_ENABLED_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP_METRICS_ENABLED: %v", err)
+	}
+	http_ws_token_secret, err := valueFromEnv("HTTP_WS_TOKEN_SECRET", HTTP_WS_TOKEN_SECRET_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP_WS_TOKEN_SECRET: %v", err)
+	}
+	http_ws_allowed_origins, err := valueFromEnv("HTTP_WS_ALLOWED_ORIGINS", HTTP_WS_ALLOWED_ORIGINS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP_WS_ALLOWED_ORIGINS: %v", err)
+	}
 	rtc_disconnect_timeout_seconds, err := valueFromEnv("RTC_DISCONNECT_TIMEOUT_SECONDS", RTC_DISCONNECT_TIMEOUT_SECONDS_DEFAULT)
 	if err != nil {
 		return nil, fmt.Errorf("error reading RTC_DISCONNECT_TIMEOUT_SECONDS: %v", err)
@@ -159,6 +254,74 @@ func CreateConfiguration() (*Configuration, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading RTC_KEEPALIVE_INTERVAL_SECONDS: %v", err)
 	}
+	rtc_keyframe_request_interval_ms, err := valueFromEnv("RTC_KEYFRAME_REQUEST_INTERVAL_MS", RTC_KEYFRAME_REQUEST_INTERVAL_MS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_KEYFRAME_REQUEST_INTERVAL_MS: %v", err)
+	}
+	rtc_gop_cache_max_packets, err := valueFromEnv("RTC_GOP_CACHE_MAX_PACKETS", RTC_GOP_CACHE_MAX_PACKETS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_GOP_CACHE_MAX_PACKETS: %v", err)
+	}
+	rtc_stream_keys, err := valueFromEnv("RTC_STREAM_KEYS", RTC_STREAM_KEYS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_STREAM_KEYS: %v", err)
+	}
+	rtc_bwe_initial_bitrate, err := valueFromEnv("RTC_BWE_INITIAL_BITRATE", RTC_BWE_INITIAL_BITRATE_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_BWE_INITIAL_BITRATE: %v", err)
+	}
+	rtc_bwe_min_video_bitrate, err := valueFromEnv("RTC_BWE_MIN_VIDEO_BITRATE", RTC_BWE_MIN_VIDEO_BITRATE_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_BWE_MIN_VIDEO_BITRATE: %v", err)
+	}
+	rtc_rtsp_sources, err := valueFromEnv("RTC_RTSP_SOURCES", RTC_RTSP_SOURCES_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_RTSP_SOURCES: %v", err)
+	}
+	rtc_rtsp_transport, err := valueFromEnv("RTC_RTSP_TRANSPORT", RTC_RTSP_TRANSPORT_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_RTSP_TRANSPORT: %v", err)
+	}
+	rtc_mpegts_sources, err := valueFromEnv("RTC_MPEGTS_SOURCES", RTC_MPEGTS_SOURCES_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_MPEGTS_SOURCES: %v", err)
+	}
+	rtc_record_directory, err := valueFromEnv("RTC_RECORD_DIRECTORY", RTC_RECORD_DIRECTORY_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_RECORD_DIRECTORY: %v", err)
+	}
+	rtc_record_sessions, err := valueFromEnv("RTC_RECORD_SESSIONS", RTC_RECORD_SESSIONS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_RECORD_SESSIONS: %v", err)
+	}
+	rtc_record_h264_format, err := valueFromEnv("RTC_RECORD_H264_FORMAT", RTC_RECORD_H264_FORMAT_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_RECORD_H264_FORMAT: %v", err)
+	}
+	rtc_origin_url, err := valueFromEnv("RTC_ORIGIN_URL", RTC_ORIGIN_URL_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_ORIGIN_URL: %v", err)
+	}
+	rtc_session_idle_timeout_seconds, err := valueFromEnv("RTC_SESSION_IDLE_TIMEOUT_SECONDS", RTC_SESSION_IDLE_TIMEOUT_SECONDS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_SESSION_IDLE_TIMEOUT_SECONDS: %v", err)
+	}
+	rtc_stream_stall_timeout_ms, err := valueFromEnv("RTC_STREAM_STALL_TIMEOUT_MS", RTC_STREAM_STALL_TIMEOUT_MS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_STREAM_STALL_TIMEOUT_MS: %v", err)
+	}
+	rtc_slates, err := valueFromEnv("RTC_SLATES", RTC_SLATES_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_SLATES: %v", err)
+	}
+	rtc_failover_timeout_ms, err := valueFromEnv("RTC_FAILOVER_TIMEOUT_MS", RTC_FAILOVER_TIMEOUT_MS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_FAILOVER_TIMEOUT_MS: %v", err)
+	}
+	rtc_slate_directory, err := valueFromEnv("RTC_SLATE_DIRECTORY", RTC_SLATE_DIRECTORY_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RTC_SLATE_DIRECTORY: %v", err)
+	}
 	server_ephemeral_udp_port_range, err := valueFromEnv("SERVER_EPHEMERAL_UDP_PORT_RANGE", PortRange{SERVER_EPHEMERAL_UDP_PORT_RANGE_MIN_DEFAULT, SERVER_EPHEMERAL_UDP_PORT_RANGE_MAX_DEFAULT})
 	if err != nil {
 		return nil, fmt.Errorf("error reading SERVER_EPHEMERAL_UDP_PORT_RANGE: %v", err)
@@ -167,22 +330,70 @@ func CreateConfiguration() (*Configuration, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading SERVER_NAT_1TO1_IP: %v", err)
 	}
+	server_log_level, err := valueFromEnv("SERVER_LOG_LEVEL", SERVER_LOG_LEVEL_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SERVER_LOG_LEVEL: %v", err)
+	}
+	server_log_format, err := valueFromEnv("SERVER_LOG_FORMAT", SERVER_LOG_FORMAT_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SERVER_LOG_FORMAT: %v", err)
+	}
+	server_shutdown_timeout_seconds, err := valueFromEnv("SERVER_SHUTDOWN_TIMEOUT_SECONDS", SERVER_SHUTDOWN_TIMEOUT_SECONDS_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SERVER_SHUTDOWN_TIMEOUT_SECONDS: %v", err)
+	}
+	server_shutdown_reconnect_hint, err := valueFromEnv("SERVER_SHUTDOWN_RECONNECT_HINT", SERVER_SHUTDOWN_RECONNECT_HINT_DEFAULT)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SERVER_SHUTDOWN_RECONNECT_HINT: %v", err)
+	}
 
 	return &Configuration{
-		Http_local_server_location:      http_local_server_location.(string),
-		Http_local_htmlserver_enabled:   http_local_htmlserver_enabled.(bool),
-		Http_tls_cert_file_location:     http_tls_cert_file_location.(string),
-		Http_tls_key_file_location:      http_tls_key_file_location.(string),
-		Http_gin_is_debug:               http_gin_is_debug.(bool),
-		Rtc_video_tracks_receive_port:   rtc_video_tracks_receive_port.(uint16),
-		Rtc_audio_tracks_receive_port:   rtc_audio_tracks_receive_port.(uint16),
-		Rtc_receive_rtp_buffsize:        rtc_receive_rtp_buffsize.(uint16),
-		Rtc_video_codec:                 rtc_video_codec.(string),
-		Rtc_audio_codec:                 rtc_audio_codec.(string),
-		Rtc_disconnect_timeout_seconds:  rtc_disconnect_timeout_seconds.(uint),
-		Rtc_failed_timeout_seconds:      rtc_failed_timeout_seconds.(uint),
-		Rtc_keepalive_interval_seconds:  rtc_keepalive_interval_seconds.(uint),
-		Server_ephemeral_udp_port_range: server_ephemeral_udp_port_range.(PortRange),
-		Server_NAT_1to1_IPs:             server_nat_1to1_ips.(string),
+		Http_local_server_location:       http_local_server_location.(string),
+		Http_local_htmlserver_enabled:    http_local_htmlserver_enabled.(bool),
+		Http_tls_cert_file_location:      http_tls_cert_file_location.(string),
+		Http_tls_key_file_location:       http_tls_key_file_location.(string),
+		Http_gin_is_debug:                http_gin_is_debug.(bool),
+		Http_api_token:                   http_api_token.(string),
+		Http_whip_token:                  http_whip_token.(string),
+		Http_hls_enabled:                 http_hls_enabled.(bool),
+		Http_hls_segment_duration_ms:     http_hls_segment_duration_ms.(uint),
+		Http_hls_part_duration_ms:        http_hls_part_duration_ms.(uint),
+		Http_hls_segment_count:           http_hls_segment_count.(uint),
+		Http_metrics_enabled:             http_metrics_enabled.(bool),
+		Http_ws_token_secret:             http_ws_token_secret.(string),
+		Http_ws_allowed_origins:          http_ws_allowed_origins.(string),
+		Rtc_video_tracks_receive_port:    rtc_video_tracks_receive_port.(uint16),
+		Rtc_audio_tracks_receive_port:    rtc_audio_tracks_receive_port.(uint16),
+		Rtc_rtmp_receive_port:            rtc_rtmp_receive_port.(uint16),
+		Rtc_rtmp_publish_token:           rtc_rtmp_publish_token.(string),
+		Rtc_receive_rtp_buffsize:         rtc_receive_rtp_buffsize.(uint16),
+		Rtc_video_codec:                  rtc_video_codec.(string),
+		Rtc_audio_codec:                  rtc_audio_codec.(string),
+		Rtc_disconnect_timeout_seconds:   rtc_disconnect_timeout_seconds.(uint),
+		Rtc_failed_timeout_seconds:       rtc_failed_timeout_seconds.(uint),
+		Rtc_keepalive_interval_seconds:   rtc_keepalive_interval_seconds.(uint),
+		Rtc_keyframe_request_interval_ms: rtc_keyframe_request_interval_ms.(uint),
+		Rtc_gop_cache_max_packets:        rtc_gop_cache_max_packets.(uint),
+		Rtc_stream_keys:                  rtc_stream_keys.(string),
+		Rtc_bwe_initial_bitrate:          rtc_bwe_initial_bitrate.(uint),
+		Rtc_bwe_min_video_bitrate:        rtc_bwe_min_video_bitrate.(uint),
+		Rtc_rtsp_sources:                 rtc_rtsp_sources.(string),
+		Rtc_rtsp_transport:               rtc_rtsp_transport.(string),
+		Rtc_mpegts_sources:               rtc_mpegts_sources.(string),
+		Rtc_record_directory:             rtc_record_directory.(string),
+		Rtc_record_sessions:              rtc_record_sessions.(string),
+		Rtc_record_h264_format:           rtc_record_h264_format.(string),
+		Rtc_origin_url:                   rtc_origin_url.(string),
+		Rtc_session_idle_timeout_seconds: rtc_session_idle_timeout_seconds.(uint),
+		Rtc_stream_stall_timeout_ms:      rtc_stream_stall_timeout_ms.(uint),
+		Rtc_slates:                       rtc_slates.(string),
+		Rtc_failover_timeout_ms:          rtc_failover_timeout_ms.(uint),
+		Rtc_slate_directory:              rtc_slate_directory.(string),
+		Server_ephemeral_udp_port_range:  server_ephemeral_udp_port_range.(PortRange),
+		Server_NAT_1to1_IPs:              server_nat_1to1_ips.(string),
+		Server_log_level:                 server_log_level.(string),
+		Server_log_format:                server_log_format.(string),
+		Server_shutdown_timeout_seconds:  server_shutdown_timeout_seconds.(uint),
+		Server_shutdown_reconnect_hint:   server_shutdown_reconnect_hint.(string),
 	}, nil
 }
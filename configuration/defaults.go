@@ -4,22 +4,54 @@ package configuration
 const (
 	ENV_FILE = ".env"
 	// HTTP - WEBSOCKET
-	HTTP_LOCAL_SERVER_LOCATION_DEFAULT    = "0.0.0.0:8080"
-	HTTP_LOCAL_HTMLSERVER_ENABLED_DEFAULT = true
-	HTTP_TLS_CERT_FILE_LOCATION_DEFAULT   = ""
-	HTTP_TLS_KEY_FILE_LOCATION_DEFAULT    = ""
-	HTTP_GIN_IS_DEBUG_DEFAULT             = true
+	HTTP_LOCAL_SERVER_LOCATION_DEFAULT         = "0.0.0.0:8080"
+	HTTP_LOCAL_HTMLSERVER_ENABLED_DEFAULT      = true
+	HTTP_TLS_CERT_FILE_LOCATION_DEFAULT        = ""
+	HTTP_TLS_KEY_FILE_LOCATION_DEFAULT         = ""
+	HTTP_GIN_IS_DEBUG_DEFAULT                  = true
+	HTTP_API_TOKEN_DEFAULT                     = ""
+	HTTP_WHIP_TOKEN_DEFAULT                    = ""
+	HTTP_HLS_ENABLED_DEFAULT                   = false
+	HTTP_HLS_SEGMENT_DURATION_MS_DEFAULT  uint = 2000
+	HTTP_HLS_PART_DURATION_MS_DEFAULT     uint = 200
+	HTTP_HLS_SEGMENT_COUNT_DEFAULT        uint = 7
+	HTTP_METRICS_ENABLED_DEFAULT               = true
+	HTTP_WS_TOKEN_SECRET_DEFAULT               = ""
+	HTTP_WS_ALLOWED_ORIGINS_DEFAULT            = ""
 	// WEBRTC
-	RTC_VIDEO_TRACKS_RECEIVE_PORT_DEFAULT  uint16 = 5004
-	RTC_AUDIO_TRACKS_RECEIVE_PORT_DEFAULT  uint16 = 5005
-	RTC_RECEIVE_RTP_BUFFSIZE_DEFAULT       uint16 = 1200
-	RTC_VIDEO_CODEC_DEFAULT                       = "video/VP8"
-	RTC_AUDIO_CODEC_DEFAULT                       = "audio/opus"
-	RTC_DISCONNECT_TIMEOUT_SECONDS_DEFAULT uint   = 10
-	RTC_FAILED_TIMEOUT_SECONDS_DEFAULT     uint   = 30
-	RTC_KEEPALIVE_INTERVAL_SECONDS_DEFAULT uint   = 2
+	RTC_VIDEO_TRACKS_RECEIVE_PORT_DEFAULT    uint16 = 5004
+	RTC_AUDIO_TRACKS_RECEIVE_PORT_DEFAULT    uint16 = 5005
+	RTC_RTMP_RECEIVE_PORT_DEFAULT            uint16 = 0
+	RTC_RTMP_PUBLISH_TOKEN_DEFAULT                  = ""
+	RTC_RECEIVE_RTP_BUFFSIZE_DEFAULT         uint16 = 1200
+	RTC_VIDEO_CODEC_DEFAULT                         = "video/VP8"
+	RTC_AUDIO_CODEC_DEFAULT                         = "audio/opus"
+	RTC_DISCONNECT_TIMEOUT_SECONDS_DEFAULT   uint   = 10
+	RTC_FAILED_TIMEOUT_SECONDS_DEFAULT       uint   = 30
+	RTC_KEEPALIVE_INTERVAL_SECONDS_DEFAULT   uint   = 2
+	RTC_KEYFRAME_REQUEST_INTERVAL_MS_DEFAULT uint   = 500
+	RTC_GOP_CACHE_MAX_PACKETS_DEFAULT        uint   = 2048
+	RTC_STREAM_KEYS_DEFAULT                         = ""
+	RTC_BWE_INITIAL_BITRATE_DEFAULT          uint   = 1000000
+	RTC_BWE_MIN_VIDEO_BITRATE_DEFAULT        uint   = 150000
+	RTC_RTSP_SOURCES_DEFAULT                        = ""
+	RTC_RTSP_TRANSPORT_DEFAULT                      = "tcp"
+	RTC_MPEGTS_SOURCES_DEFAULT                      = ""
+	RTC_RECORD_DIRECTORY_DEFAULT                    = "recordings"
+	RTC_RECORD_SESSIONS_DEFAULT                     = ""
+	RTC_RECORD_H264_FORMAT_DEFAULT                  = "mp4"
+	RTC_ORIGIN_URL_DEFAULT                          = ""
+	RTC_SESSION_IDLE_TIMEOUT_SECONDS_DEFAULT uint   = 30
+	RTC_STREAM_STALL_TIMEOUT_MS_DEFAULT      uint   = 2000
+	RTC_SLATES_DEFAULT                              = ""
+	RTC_FAILOVER_TIMEOUT_MS_DEFAULT          uint   = 1000
+	RTC_SLATE_DIRECTORY_DEFAULT                     = "slates"
 	// SERVER PREFS
 	SERVER_EPHEMERAL_UDP_PORT_RANGE_MIN_DEFAULT uint16 = 4069
 	SERVER_EPHEMERAL_UDP_PORT_RANGE_MAX_DEFAULT uint16 = 65535
 	SERVER_NAT_1TO1_IPS_DEFAULT                        = ""
+	SERVER_LOG_LEVEL_DEFAULT                           = "info"
+	SERVER_LOG_FORMAT_DEFAULT                          = "logfmt"
+	SERVER_SHUTDOWN_TIMEOUT_SECONDS_DEFAULT     uint   = 10
+	SERVER_SHUTDOWN_RECONNECT_HINT_DEFAULT             = ""
 )
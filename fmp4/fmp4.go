@@ -0,0 +1,239 @@
+package fmp4
+
+import (
+	"encoding/binary"
+)
+
+// codecs of tracks
+const (
+	CodecH264 = "avc1"
+	CodecOpus = "Opus"
+	CodecAAC  = "mp4a"
+)
+
+// sample flags of trun entries
+const (
+	sampleFlagsSync    = 0x02000000 // depends on no other sample
+	sampleFlagsNonSync = 0x01010000 // depends on others, not a sync sample
+)
+
+/*
+track of a fragmented mp4 stream
+h264 tracks need the sps/pps of the stream, opus tracks use a 48kHz timescale
+and aac tracks their AudioSpecificConfig with the sample rate as timescale
+*/
+type Track struct {
+	ID        uint32
+	Codec     string
+	Timescale uint32
+	SPS       []byte // h264
+	PPS       []byte // h264
+	Channels  uint16 // opus and aac
+	AACConfig []byte // aac
+}
+
+// sample of a track fragment, h264 samples are length prefixed (avcc) nal units
+type Sample struct {
+	Duration uint32
+	Keyframe bool
+	Data     []byte
+}
+
+// samples of one track in a fragment, decode time of the first sample in the track timescale
+type TrackFragment struct {
+	Track          *Track
+	BaseDecodeTime uint64
+	Samples        []Sample
+}
+
+// ftyp and moov of the tracks
+func InitSegment(tracks []*Track) []byte {
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41cmfc"))
+	traks := make([][]byte, 0, len(tracks)+1)
+	trexs := make([][]byte, 0, len(tracks))
+	var nextID uint32 = 1
+	for _, track := range tracks {
+		traks = append(traks, trak(track))
+		// track id, default sample description index, duration, size and flags
+		trexs = append(trexs, fullBox("trex", 0, 0, u32(track.ID), u32(1), u32(0), u32(0), u32(0)))
+		if track.ID >= nextID {
+			nextID = track.ID + 1
+		}
+	}
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation and modification time
+		u32(1000), u32(0), // timescale and duration
+		u32(0x00010000), u16(0x0100), make([]byte, 10), // rate, volume, reserved
+		matrix(), make([]byte, 24), u32(nextID))
+	moov := box("moov", append([][]byte{mvhd}, append(traks, box("mvex", trexs...))...)...)
+	return append(ftyp, moov...)
+}
+
+func trak(track *Track) []byte {
+	var width, height uint16
+	var handler, mediaHeader, sampleEntry []byte
+	volume := uint16(0)
+	switch track.Codec {
+	case CodecH264:
+		width, height = h264Dimensions(track.SPS)
+		handler = hdlr("vide", "VideoHandler")
+		mediaHeader = fullBox("vmhd", 0, 1, make([]byte, 8))
+		sampleEntry = avc1(track, width, height)
+	case CodecAAC:
+		volume = 0x0100
+		handler = hdlr("soun", "SoundHandler")
+		mediaHeader = fullBox("smhd", 0, 0, make([]byte, 4))
+		sampleEntry = mp4a(track)
+	default:
+		volume = 0x0100
+		handler = hdlr("soun", "SoundHandler")
+		mediaHeader = fullBox("smhd", 0, 0, make([]byte, 4))
+		sampleEntry = opus(track)
+	}
+	tkhd := fullBox("tkhd", 0, 0x03,
+		u32(0), u32(0), u32(track.ID), u32(0), u32(0), // times, track id, reserved, duration
+		make([]byte, 8), u16(0), u16(0), u16(volume), u16(0), // reserved, layer, alternate group, volume, reserved
+		matrix(), u32(uint32(width)<<16), u32(uint32(height)<<16))
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(track.Timescale), u32(0), u16(0x55C4), u16(0)) // language und
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), sampleEntry),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)))
+	return box("trak", tkhd, box("mdia", mdhd, handler, box("minf", mediaHeader, dinf, stbl)))
+}
+
+func hdlr(handlerType string, name string) []byte {
+	return fullBox("hdlr", 0, 0, u32(0), []byte(handlerType), make([]byte, 12), []byte(name+"\x00"))
+}
+
+// visual sample entry with the avc decoder configuration record
+func avc1(track *Track, width uint16, height uint16) []byte {
+	avcC := []byte{1, 0x42, 0, 0x1F, 0xFF, 0xE1} // version, profile, compatibility, level, 4 byte lengths, 1 sps
+	if len(track.SPS) >= 4 {
+		copy(avcC[1:4], track.SPS[1:4])
+	}
+	avcC = append(append(avcC, u16(uint16(len(track.SPS)))...), track.SPS...)
+	avcC = append(append(append(avcC, 1), u16(uint16(len(track.PPS)))...), track.PPS...)
+	return box("avc1",
+		make([]byte, 6), u16(1), // reserved, data reference index
+		make([]byte, 16), u16(width), u16(height),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1), // 72 dpi, reserved, frame count
+		make([]byte, 32), u16(0x0018), u16(0xFFFF), // compressor name, depth, pre defined
+		box("avcC", avcC))
+}
+
+// audio sample entry with the opus specific box
+func opus(track *Track) []byte {
+	channels := track.Channels
+	if channels == 0 {
+		channels = 2
+	}
+	// version, output channels, pre skip, input sample rate, output gain, mapping family
+	dOps := []byte{0, byte(channels)}
+	dOps = append(append(append(dOps, u16(312)...), u32(48000)...), 0, 0, 0)
+	return box("Opus",
+		make([]byte, 6), u16(1), // reserved, data reference index
+		make([]byte, 8), u16(channels), u16(16), u32(0), // reserved, channels, sample size, reserved
+		u32(48000<<16), box("dOps", dOps))
+}
+
+// audio sample entry with the elementary stream descriptor carrying the aac configuration
+func mp4a(track *Track) []byte {
+	channels := track.Channels
+	if channels == 0 {
+		channels = 2
+	}
+	decoderConfig := append([]byte{0x40, 0x15}, make([]byte, 11)...) // mpeg-4 audio, audio stream, buffer size and bitrates
+	decoderConfig = append(decoderConfig, descriptor(0x05, track.AACConfig)...)
+	esDescriptor := append([]byte{0, 0, 0}, descriptor(0x04, decoderConfig)...) // es id, flags
+	esDescriptor = append(esDescriptor, descriptor(0x06, []byte{0x02})...)      // sl config
+	return box("mp4a",
+		make([]byte, 6), u16(1), // reserved, data reference index
+		make([]byte, 8), u16(channels), u16(16), u32(0), // reserved, channels, sample size, reserved
+		u32(track.Timescale<<16), fullBox("esds", 0, 0, descriptor(0x03, esDescriptor)))
+}
+
+// mpeg-4 descriptor with a single byte size, enough for the configurations written here
+func descriptor(tag byte, payload []byte) []byte {
+	return append([]byte{tag, byte(len(payload))}, payload...)
+}
+
+// moof and mdat of a fragment, the sample data of the tracks follows in order
+func Fragment(sequence uint32, fragments []TrackFragment) []byte {
+	// built twice, the data offsets depend on the size of the moof
+	moof := buildMoof(sequence, fragments, 0)
+	moof = buildMoof(sequence, fragments, uint32(len(moof)))
+	size := 8
+	for _, f := range fragments {
+		for _, s := range f.Samples {
+			size += len(s.Data)
+		}
+	}
+	mdat := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(mdat, uint32(size))
+	copy(mdat[4:], "mdat")
+	for _, f := range fragments {
+		for _, s := range f.Samples {
+			mdat = append(mdat, s.Data...)
+		}
+	}
+	return append(moof, mdat...)
+}
+
+func buildMoof(sequence uint32, fragments []TrackFragment, moofSize uint32) []byte {
+	trafs := [][]byte{fullBox("mfhd", 0, 0, u32(sequence))}
+	dataOffset := moofSize + 8
+	for _, f := range fragments {
+		// data offset, sample duration, size and flags present
+		entries := make([]byte, 0, 12*len(f.Samples))
+		for _, s := range f.Samples {
+			flags := uint32(sampleFlagsNonSync)
+			if s.Keyframe || f.Track.Codec != CodecH264 {
+				flags = sampleFlagsSync
+			}
+			entries = append(append(append(entries, u32(s.Duration)...), u32(uint32(len(s.Data)))...), u32(flags)...)
+		}
+		trun := fullBox("trun", 0, 0x000701, u32(uint32(len(f.Samples))), u32(dataOffset), entries)
+		tfhd := fullBox("tfhd", 0, 0x020000, u32(f.Track.ID)) // default base is moof
+		tfdt := fullBox("tfdt", 1, 0, u64(f.BaseDecodeTime))
+		trafs = append(trafs, box("traf", tfhd, tfdt, trun))
+		for _, s := range f.Samples {
+			dataOffset += uint32(len(s.Data))
+		}
+	}
+	return box("moof", trafs...)
+}
+
+func box(boxType string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], boxType)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func fullBox(boxType string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	return box(boxType, append([][]byte{u32(uint32(version)<<24 | flags&0xFFFFFF)}, payloads...)...)
+}
+
+// unity transformation matrix
+func matrix() []byte {
+	m := make([]byte, 0, 36)
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		m = append(m, u32(v)...)
+	}
+	return m
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
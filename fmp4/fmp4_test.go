@@ -0,0 +1,227 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type testBox struct {
+	boxType string
+	payload []byte
+}
+
+// bytes before the child boxes of container boxes, sample entries have their fields first
+var testContainers = map[string]int{
+	"moov": 0, "trak": 0, "mdia": 0, "minf": 0, "stbl": 0, "mvex": 0, "moof": 0, "traf": 0,
+	"stsd": 8, "avc1": 78, "Opus": 28, "mp4a": 28,
+}
+
+// boxes in data, fails the test if a box is cut short
+func testBoxes(t *testing.T, data []byte) []testBox {
+	t.Helper()
+	var boxes []testBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("box header cut short: %x", data)
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("%q box of %v bytes in %v bytes", data[4:8], size, len(data))
+		}
+		boxes = append(boxes, testBox{string(data[4:8]), data[8:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// the first box found along the path of box types
+func testFind(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+	for i, boxType := range path {
+		found := false
+		for _, b := range testBoxes(t, data) {
+			if b.boxType != boxType {
+				continue
+			}
+			data, found = b.payload, true
+			if i < len(path)-1 {
+				data = data[testContainers[boxType]:]
+			}
+			break
+		}
+		if !found {
+			t.Fatalf("no %v box in %v", boxType, path[:i])
+		}
+	}
+	return data
+}
+
+func TestInitSegment(t *testing.T) {
+	sps := testSPS(testSPSFields{profile: 100, level: 31, chromaFormat: 1, widthMbs: 80, heightMapUnits: 45, frameMbsOnly: true})
+	pps := []byte{0x68, 0xCE, 0x3C, 0x80}
+	tracks := []*Track{
+		{ID: 1, Codec: CodecH264, Timescale: 90000, SPS: sps, PPS: pps},
+		{ID: 2, Codec: CodecOpus, Timescale: 48000, Channels: 2},
+		{ID: 5, Codec: CodecAAC, Timescale: 44100, Channels: 1, AACConfig: []byte{0x12, 0x08}},
+	}
+	init := InitSegment(tracks)
+	boxes := testBoxes(t, init)
+	if len(boxes) != 2 || boxes[0].boxType != "ftyp" || boxes[1].boxType != "moov" || string(boxes[0].payload[:4]) != "iso5" {
+		t.Fatalf("boxes %+v, want ftyp and moov", boxes)
+	}
+	mvhd := testFind(t, init, "moov", "mvhd")
+	if nextID := binary.BigEndian.Uint32(mvhd[len(mvhd)-4:]); nextID != 6 {
+		t.Errorf("next track id %v, want 6", nextID)
+	}
+	var traks, trexs []testBox
+	for _, b := range testBoxes(t, boxes[1].payload) {
+		if b.boxType == "trak" {
+			traks = append(traks, b)
+		}
+		if b.boxType == "mvex" {
+			trexs = testBoxes(t, b.payload)
+		}
+	}
+	if len(traks) != len(tracks) || len(trexs) != len(tracks) {
+		t.Fatalf("%v traks and %v trexs for %v tracks", len(traks), len(trexs), len(tracks))
+	}
+	wants := []struct {
+		entry     string
+		handler   string
+		width     uint32
+		height    uint32
+		timescale uint32
+	}{
+		{"avc1", "vide", 1280, 720, 90000},
+		{"Opus", "soun", 0, 0, 48000},
+		{"mp4a", "soun", 0, 0, 44100},
+	}
+	for i, want := range wants {
+		trak := traks[i].payload
+		tkhd := testFind(t, trak, "tkhd")
+		if id := binary.BigEndian.Uint32(tkhd[12:]); id != tracks[i].ID {
+			t.Errorf("track %v: tkhd id %v", i, id)
+		}
+		if width, height := binary.BigEndian.Uint32(tkhd[76:])>>16, binary.BigEndian.Uint32(tkhd[80:])>>16; width != want.width || height != want.height {
+			t.Errorf("track %v: %vx%v, want %vx%v", i, width, height, want.width, want.height)
+		}
+		if id := binary.BigEndian.Uint32(trexs[i].payload[4:]); id != tracks[i].ID {
+			t.Errorf("track %v: trex id %v", i, id)
+		}
+		if timescale := binary.BigEndian.Uint32(testFind(t, trak, "mdia", "mdhd")[12:]); timescale != want.timescale {
+			t.Errorf("track %v: timescale %v, want %v", i, timescale, want.timescale)
+		}
+		if handler := string(testFind(t, trak, "mdia", "hdlr")[8:12]); handler != want.handler {
+			t.Errorf("track %v: handler %v, want %v", i, handler, want.handler)
+		}
+		testFind(t, trak, "mdia", "minf", "stbl", "stsd", want.entry)
+	}
+	// decoder configuration record with the profile of the sps and both parameter sets
+	avcC := testFind(t, traks[0].payload, "mdia", "minf", "stbl", "stsd", "avc1", "avcC")
+	want := append(append(append([]byte{1, 100, 0, 31, 0xFF, 0xE1, 0, byte(len(sps))}, sps...), 1, 0, byte(len(pps))), pps...)
+	if !bytes.Equal(avcC, want) {
+		t.Errorf("avcC %x, want %x", avcC, want)
+	}
+	dOps := testFind(t, traks[1].payload, "mdia", "minf", "stbl", "stsd", "Opus", "dOps")
+	if dOps[1] != 2 || binary.BigEndian.Uint16(dOps[2:]) != 312 || binary.BigEndian.Uint32(dOps[4:]) != 48000 {
+		t.Errorf("dOps %x", dOps)
+	}
+	esds := testFind(t, traks[2].payload, "mdia", "minf", "stbl", "stsd", "mp4a", "esds")
+	if !bytes.Contains(esds, []byte{0x05, 2, 0x12, 0x08}) {
+		t.Errorf("esds %x without the audio specific config", esds)
+	}
+}
+
+// sample entries of tracks without usable parameter sets are still complete boxes
+func TestInitSegmentWithoutParameterSets(t *testing.T) {
+	for _, track := range []*Track{
+		{ID: 1, Codec: CodecH264, Timescale: 90000},
+		{ID: 1, Codec: CodecH264, Timescale: 90000, SPS: []byte{0x67, 0xFF}, PPS: []byte{0x68}},
+		{ID: 2, Codec: CodecOpus, Timescale: 48000},
+		{ID: 3, Codec: CodecAAC, Timescale: 48000},
+	} {
+		init := InitSegment([]*Track{track})
+		trak := testFind(t, init, "moov", "trak")
+		tkhd := testFind(t, trak, "tkhd")
+		if width := binary.BigEndian.Uint32(tkhd[76:]); width != 0 {
+			t.Errorf("%v track with width %v", track.Codec, width>>16)
+		}
+		entries := testBoxes(t, testFind(t, trak, "mdia", "minf", "stbl", "stsd")[8:])
+		if len(entries) != 1 {
+			t.Fatalf("%v track with %v sample entries", track.Codec, len(entries))
+		}
+		testBoxes(t, entries[0].payload[testContainers[entries[0].boxType]:])
+	}
+}
+
+func TestFragment(t *testing.T) {
+	video := &Track{ID: 1, Codec: CodecH264, Timescale: 90000}
+	audio := &Track{ID: 2, Codec: CodecOpus, Timescale: 48000}
+	fragments := []TrackFragment{
+		{Track: video, BaseDecodeTime: 1 << 33, Samples: []Sample{
+			{Duration: 3000, Keyframe: true, Data: []byte{0, 0, 0, 2, 0x65, 1}},
+			{Duration: 3000, Data: []byte{0, 0, 0, 1, 0x41}},
+			{Duration: 3003, Data: []byte{0, 0, 0, 3, 0x41, 2, 3}},
+		}},
+		{Track: audio, BaseDecodeTime: 960, Samples: []Sample{
+			{Duration: 960, Data: []byte{0xFC, 1}},
+			{Duration: 960, Data: []byte{0xFC, 2, 3}},
+		}},
+	}
+	fragment := Fragment(7, fragments)
+	boxes := testBoxes(t, fragment)
+	if len(boxes) != 2 || boxes[0].boxType != "moof" || boxes[1].boxType != "mdat" {
+		t.Fatalf("boxes %+v, want moof and mdat", boxes)
+	}
+	if sequence := binary.BigEndian.Uint32(testFind(t, fragment, "moof", "mfhd")[4:]); sequence != 7 {
+		t.Errorf("sequence %v, want 7", sequence)
+	}
+	var trafs []testBox
+	for _, b := range testBoxes(t, boxes[0].payload) {
+		if b.boxType == "traf" {
+			trafs = append(trafs, b)
+		}
+	}
+	if len(trafs) != len(fragments) {
+		t.Fatalf("%v trafs for %v track fragments", len(trafs), len(fragments))
+	}
+	for i, f := range fragments {
+		traf := trafs[i].payload
+		if id := binary.BigEndian.Uint32(testFind(t, traf, "tfhd")[4:]); id != f.Track.ID {
+			t.Errorf("traf %v: track %v, want %v", i, id, f.Track.ID)
+		}
+		if base := binary.BigEndian.Uint64(testFind(t, traf, "tfdt")[4:]); base != f.BaseDecodeTime {
+			t.Errorf("traf %v: base decode time %v, want %v", i, base, f.BaseDecodeTime)
+		}
+		trun := testFind(t, traf, "trun")
+		if count := int(binary.BigEndian.Uint32(trun[4:])); count != len(f.Samples) {
+			t.Fatalf("traf %v: %v samples, want %v", i, count, len(f.Samples))
+		}
+		// data offsets are relative to the start of the moof
+		offset := int(binary.BigEndian.Uint32(trun[8:]))
+		for j, s := range f.Samples {
+			entry := trun[12+12*j:]
+			duration, size, flags := binary.BigEndian.Uint32(entry), int(binary.BigEndian.Uint32(entry[4:])), binary.BigEndian.Uint32(entry[8:])
+			wantFlags := uint32(sampleFlagsSync)
+			if f.Track.Codec == CodecH264 && !s.Keyframe {
+				wantFlags = sampleFlagsNonSync
+			}
+			if duration != s.Duration || flags != wantFlags || !bytes.Equal(fragment[offset:offset+size], s.Data) {
+				t.Errorf("traf %v sample %v: duration %v, flags %#x, data %x, want %v, %#x, %x", i, j, duration, flags, fragment[offset:offset+size], s.Duration, wantFlags, s.Data)
+			}
+			offset += size
+		}
+	}
+}
+
+func TestFragmentWithoutSamples(t *testing.T) {
+	fragment := Fragment(1, []TrackFragment{{Track: &Track{ID: 1, Codec: CodecH264, Timescale: 90000}}})
+	boxes := testBoxes(t, fragment)
+	if len(boxes) != 2 || len(boxes[1].payload) != 0 {
+		t.Errorf("boxes %+v, want moof and an empty mdat", boxes)
+	}
+	if count := binary.BigEndian.Uint32(testFind(t, fragment, "moof", "traf", "trun")[4:]); count != 0 {
+		t.Errorf("trun with %v samples", count)
+	}
+}
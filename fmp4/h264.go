@@ -0,0 +1,149 @@
+package fmp4
+
+// reads exp-golomb coded values of an sps
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.data)*8 {
+		r.pos++
+		return 0
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint32(b)
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bit() == 0 && zeros < 32 {
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32(v+1) / 2
+	}
+	return -int32(v / 2)
+}
+
+// remove emulation prevention bytes (00 00 03)
+func unescapeRbsp(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// width and height in pixels coded in an h264 sps, 0 if it can not be parsed
+func h264Dimensions(sps []byte) (uint16, uint16) {
+	if len(sps) < 4 {
+		return 0, 0
+	}
+	r := &bitReader{data: unescapeRbsp(sps[1:])}
+	profile := r.bits(8)
+	r.bits(16) // constraint flags and level
+	r.ue()     // sps id
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			r.bit() // separate colour planes
+		}
+		r.ue()  // luma bit depth
+		r.ue()  // chroma bit depth
+		r.bit() // transform bypass
+		if r.bit() == 1 {
+			// scaling lists
+			count := 8
+			if chromaFormat == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue() // log2 max frame num
+	switch r.ue() {
+	case 0:
+		r.ue() // log2 max poc lsb
+	case 1:
+		r.bit()
+		r.se()
+		r.se()
+		for i := r.ue(); i > 0 && i < 256; i-- {
+			r.se()
+		}
+	}
+	r.ue()  // max ref frames
+	r.bit() // gaps allowed
+	widthMbs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMbsOnly := r.bit()
+	if frameMbsOnly == 0 {
+		r.bit() // adaptive frame field
+	}
+	r.bit() // direct 8x8 inference
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.bit() == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.pos > len(r.data)*8 {
+		return 0, 0
+	}
+	// crop units depend on chroma subsampling
+	cropX, cropY := uint32(1), 2-frameMbsOnly
+	if chromaFormat == 1 || chromaFormat == 2 {
+		cropX = 2
+	}
+	if chromaFormat == 1 {
+		cropY *= 2
+	}
+	width := widthMbs*16 - (cropLeft+cropRight)*cropX
+	height := (2-frameMbsOnly)*heightMapUnits*16 - (cropTop+cropBottom)*cropY
+	if width > 0xFFFF || height > 0xFFFF {
+		return 0, 0
+	}
+	return uint16(width), uint16(height)
+}
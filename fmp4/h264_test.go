@@ -0,0 +1,208 @@
+package fmp4
+
+import (
+	"bytes"
+	"math/bits"
+	"testing"
+)
+
+// writes the exp-golomb coded values of an sps
+type testBitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *testBitWriter) bits(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(v>>i&1) << (7 - w.pos%8)
+		w.pos++
+	}
+}
+
+func (w *testBitWriter) ue(v uint32) {
+	length := bits.Len32(v + 1)
+	w.bits(length-1, 0)
+	w.bits(length, v+1)
+}
+
+func (w *testBitWriter) se(v int32) {
+	if v > 0 {
+		w.ue(uint32(2*v - 1))
+	} else {
+		w.ue(uint32(-2 * v))
+	}
+}
+
+// insert emulation prevention bytes
+func testEscapeRbsp(rbsp []byte) []byte {
+	nalu := make([]byte, 0, len(rbsp))
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			nalu = append(nalu, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		nalu = append(nalu, b)
+	}
+	return nalu
+}
+
+type testSPSFields struct {
+	profile        uint32
+	level          uint32
+	chromaFormat   uint32 // high profiles only
+	scalingLists   bool
+	pocType        uint32
+	widthMbs       uint32
+	heightMapUnits uint32
+	frameMbsOnly   bool
+	crop           [4]uint32 // left, right, top, bottom
+}
+
+// sps nal unit of the fields
+func testSPS(f testSPSFields) []byte {
+	w := &testBitWriter{}
+	w.bits(8, f.profile)
+	w.bits(8, 0) // constraint flags
+	w.bits(8, f.level)
+	w.ue(0) // sps id
+	switch f.profile {
+	case 100, 110, 122, 244:
+		w.ue(f.chromaFormat)
+		if f.chromaFormat == 3 {
+			w.bits(1, 0)
+		}
+		w.ue(0)
+		w.ue(0)
+		w.bits(1, 0)
+		if f.scalingLists {
+			w.bits(1, 1)
+			// a 4x4 list with deltas, the others not present
+			w.bits(1, 1)
+			for j := 0; j < 16; j++ {
+				w.se(int32(j%3) - 1)
+			}
+			count := 7
+			if f.chromaFormat == 3 {
+				count = 11
+			}
+			w.bits(count, 0)
+		} else {
+			w.bits(1, 0)
+		}
+	}
+	w.ue(0) // log2 max frame num
+	w.ue(f.pocType)
+	switch f.pocType {
+	case 0:
+		w.ue(2)
+	case 1:
+		w.bits(1, 1)
+		// offset for non-reference pictures long enough to need emulation prevention
+		w.se(-(1 << 23))
+		w.se(5)
+		w.ue(2)
+		w.se(1)
+		w.se(-1)
+	}
+	w.ue(4)      // max ref frames
+	w.bits(1, 0) // gaps allowed
+	w.ue(f.widthMbs - 1)
+	w.ue(f.heightMapUnits - 1)
+	if f.frameMbsOnly {
+		w.bits(1, 1)
+	} else {
+		w.bits(2, 0)
+	}
+	w.bits(1, 1) // direct 8x8 inference
+	if f.crop != [4]uint32{} {
+		w.bits(1, 1)
+		for _, c := range f.crop {
+			w.ue(c)
+		}
+	} else {
+		w.bits(1, 0)
+	}
+	w.bits(1, 0) // vui
+	w.bits(1, 1) // rbsp stop bit
+	return append([]byte{0x67}, testEscapeRbsp(w.data)...)
+}
+
+func TestH264Dimensions(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields testSPSFields
+		width  uint16
+		height uint16
+	}{
+		{"baseline 640x480", testSPSFields{profile: 66, level: 30, pocType: 2, widthMbs: 40, heightMapUnits: 30, frameMbsOnly: true}, 640, 480},
+		{"1080p cropped", testSPSFields{profile: 77, level: 40, widthMbs: 120, heightMapUnits: 68, frameMbsOnly: true, crop: [4]uint32{0, 0, 0, 4}}, 1920, 1080},
+		{"high 4:2:0", testSPSFields{profile: 100, level: 31, chromaFormat: 1, widthMbs: 80, heightMapUnits: 45, frameMbsOnly: true}, 1280, 720},
+		{"high with scaling lists", testSPSFields{profile: 100, level: 31, chromaFormat: 1, scalingLists: true, widthMbs: 80, heightMapUnits: 45, frameMbsOnly: true}, 1280, 720},
+		{"high 4:4:4 cropped", testSPSFields{profile: 244, level: 40, chromaFormat: 3, scalingLists: true, widthMbs: 120, heightMapUnits: 68, frameMbsOnly: true, crop: [4]uint32{1, 1, 0, 8}}, 1918, 1080},
+		{"interlaced", testSPSFields{profile: 77, level: 40, widthMbs: 120, heightMapUnits: 34, crop: [4]uint32{0, 0, 0, 2}}, 1920, 1080},
+		{"poc type 1", testSPSFields{profile: 66, level: 30, pocType: 1, widthMbs: 22, heightMapUnits: 18, frameMbsOnly: true}, 352, 288},
+		{"width beyond 16 bits", testSPSFields{profile: 66, widthMbs: 5000, heightMapUnits: 30, frameMbsOnly: true}, 0, 0},
+		{"crop larger than the picture", testSPSFields{profile: 66, widthMbs: 1, heightMapUnits: 1, frameMbsOnly: true, crop: [4]uint32{9, 0, 0, 0}}, 0, 0},
+	}
+	if sps := testSPS(tests[6].fields); !bytes.Contains(sps, []byte{0, 0, 3}) {
+		t.Errorf("sps %x of %v without emulation prevention bytes", sps, tests[6].name)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sps := testSPS(test.fields)
+			width, height := h264Dimensions(sps)
+			if width != test.width || height != test.height {
+				t.Errorf("sps %x: %vx%v, want %vx%v", sps, width, height, test.width, test.height)
+			}
+		})
+	}
+}
+
+// truncated and malformed parameter sets return 0 without panicking
+func TestH264DimensionsMalformed(t *testing.T) {
+	sps := testSPS(testSPSFields{profile: 100, level: 31, chromaFormat: 1, scalingLists: true, widthMbs: 80, heightMapUnits: 45, frameMbsOnly: true, crop: [4]uint32{0, 0, 0, 4}})
+	for size := 0; size < len(sps); size++ {
+		if width, height := h264Dimensions(sps[:size]); (width != 0 || height != 0) && (width != 1280 || height != 712) {
+			t.Errorf("%v of %v bytes: %vx%v", size, len(sps), width, height)
+		}
+	}
+	for _, malformed := range [][]byte{
+		nil,
+		{0x67},
+		{0x67, 100, 0, 31},
+		append([]byte{0x67}, make([]byte, 64)...), // exp-golomb values with more than 32 leading zeros
+		append([]byte{0x67, 100, 0, 31}, bytes.Repeat([]byte{0x00, 0x00, 0x03}, 20)...),
+	} {
+		if width, height := h264Dimensions(malformed); width != 0 || height != 0 {
+			t.Errorf("sps %x: %vx%v", malformed, width, height)
+		}
+	}
+}
+
+func TestUnescapeRbsp(t *testing.T) {
+	tests := []struct {
+		nalu []byte
+		want []byte
+	}{
+		{[]byte{0, 0, 3, 1}, []byte{0, 0, 1}},
+		{[]byte{0, 0, 3}, []byte{0, 0}},
+		{[]byte{0, 3, 1}, []byte{0, 3, 1}},
+		{[]byte{0, 0, 0, 3, 3}, []byte{0, 0, 0, 3}},
+		{[]byte{0, 0, 3, 0, 0, 3, 2}, []byte{0, 0, 0, 0, 2}},
+		{[]byte{}, []byte{}},
+	}
+	for _, test := range tests {
+		if got := unescapeRbsp(test.nalu); !bytes.Equal(got, test.want) {
+			t.Errorf("%x unescaped to %x, want %x", test.nalu, got, test.want)
+		}
+	}
+}
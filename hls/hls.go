@@ -0,0 +1,129 @@
+package hls
+
+import (
+	"errors"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// muxers of a broadcast are removed once no packets arrived for this long
+const idleTimeout = 10 * time.Second
+
+// returned for files that are not (or no longer) part of the playlist
+var ErrNotFound = errors.New("not found")
+
+// returned when a blocking request timed out, the broadcast probably stalled
+var ErrUnavailable = errors.New("not available yet")
+
+// returned for blocking requests of media sequence numbers far in the future
+var ErrBadRequest = errors.New("requested segment is too far ahead")
+
+// muxers by session name, created with the first packet of a session
+var muxers = make(map[string]*Muxer)
+
+// mutex for above map read/write
+var mutex sync.Mutex
+
+// configuration of all muxers
+var (
+	enabled         bool
+	audioCodec      string
+	segmentDuration time.Duration
+	partDuration    time.Duration
+	segmentCount    int
+)
+
+// enable hls for h264 sessions if configured
+func InitHls(config *configuration.Configuration) {
+	if !config.Http_hls_enabled {
+		return
+	}
+	if !strings.EqualFold(config.Rtc_video_codec, webrtc.MimeTypeH264) {
+		logging.Warnf("hls needs %v video, hls is disabled for %v", webrtc.MimeTypeH264, config.Rtc_video_codec)
+		return
+	}
+	mutex.Lock()
+	enabled = true
+	audioCodec = config.Rtc_audio_codec
+	segmentDuration = time.Duration(config.Http_hls_segment_duration_ms) * time.Millisecond
+	partDuration = time.Duration(config.Http_hls_part_duration_ms) * time.Millisecond
+	segmentCount = int(config.Http_hls_segment_count)
+	// playlists need at least a few segments to be playable
+	if segmentCount < 3 {
+		segmentCount = 3
+	}
+	if partDuration <= 0 || partDuration > segmentDuration {
+		partDuration = segmentDuration
+	}
+	mutex.Unlock()
+	go removeIdleMuxers()
+}
+
+// true if playlists are served
+func Enabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return enabled
+}
+
+// muxer of a session, nil if the session is not broadcasting
+func GetMuxer(sessionID string) *Muxer {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return muxers[sessionID]
+}
+
+/*
+tap a packet fed into a session, called by all ingest paths
+only the base layer of simulcast sessions is segmented. packet must not be modified afterwards
+*/
+func WriteRTP(sessionID string, kind webrtc.RTPCodecType, layer int, packet *rtp.Packet) {
+	if layer != 0 {
+		return
+	}
+	mutex.Lock()
+	if !enabled {
+		mutex.Unlock()
+		return
+	}
+	m, exists := muxers[sessionID]
+	if !exists {
+		m = newMuxer(sessionID, audioCodec, segmentDuration, partDuration, segmentCount)
+		muxers[sessionID] = m
+		logging.With("session_id", sessionID).Infof("started hls muxer")
+	}
+	mutex.Unlock()
+	m.writeRTP(kind, packet)
+}
+
+// like WriteRTP for a marshaled packet, the buffer can be reused after returning
+func Write(sessionID string, kind webrtc.RTPCodecType, layer int, b []byte) {
+	if layer != 0 || !Enabled() {
+		return
+	}
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(append([]byte(nil), b...)); err != nil {
+		return
+	}
+	WriteRTP(sessionID, kind, layer, packet)
+}
+
+// broadcasts that stopped are dropped, players get 404 until the session broadcasts again
+func removeIdleMuxers() {
+	for range time.Tick(time.Second) {
+		mutex.Lock()
+		for sessionID, m := range muxers {
+			if m.idleSince() > idleTimeout {
+				delete(muxers, sessionID)
+				logging.With("session_id", sessionID).Infof("removed idle hls muxer")
+			}
+		}
+		mutex.Unlock()
+	}
+}
@@ -0,0 +1,340 @@
+package hls
+
+import (
+	"encoding/binary"
+	"pion-webrtc-sfu/fmp4"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/sessions"
+	"pion-webrtc-sfu/tracks"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// h264 nal unit types
+const (
+	h264NaluIDR = 5
+	h264NaluSPS = 7
+	h264NaluPPS = 8
+	h264NaluAUD = 9
+)
+
+// packets a sample builder waits for missing packets before dropping a frame
+const (
+	maxLateVideo = 256
+	maxLateAudio = 64
+)
+
+// sampling frequencies of aac by index of the AudioSpecificConfig
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+/*
+segments the broadcast of a session into ll-hls partial segments and segments
+every part is an fmp4 fragment, a segment is the concatenation of its parts and starts at a keyframe.
+video is h264, audio opus or aac. audio is aligned to video by arrival time
+*/
+type Muxer struct {
+	sessionID       string
+	audioCodec      string
+	segmentDuration time.Duration
+	partDuration    time.Duration
+	segmentCount    int
+	mu              sync.Mutex
+	changed         chan struct{} // closed and replaced whenever a part was added
+	video           *muxerTrack
+	audio           *muxerTrack // nil if audio is not segmented
+	init            []byte      // nil until the first keyframe with sps/pps
+	start           time.Time   // arrival of the first video sample
+	sequence        uint32
+	segments        []*segment // completed segments of the playlist
+	current         *segment
+	lastPacket      time.Time
+	lastRequest     time.Time // keyframe request because of a long segment
+}
+
+// samples of one track waiting for the next part
+type muxerTrack struct {
+	track    *fmp4.Track
+	builder  *samplebuilder.SampleBuilder // nil for aac, access units are taken from the packets
+	started  bool                         // first keyframe was received (video)
+	timed    bool                         // first sample was placed on the timeline
+	lastTs   uint32
+	last     *fmp4.Sample // waiting for the next sample to know its duration
+	lastDur  uint32
+	samples  []fmp4.Sample
+	baseTime uint64 // decode time of the first queued sample
+	queued   uint64 // duration of the queued samples
+}
+
+// media segment, identified by its media sequence number
+type segment struct {
+	msn      uint64
+	start    time.Time // program date time
+	duration time.Duration
+	parts    []*part
+	data     []byte // concatenated parts once completed
+}
+
+type part struct {
+	duration    time.Duration
+	independent bool // starts with a keyframe
+	data        []byte
+}
+
+func newMuxer(sessionID string, audioCodec string, segmentDuration time.Duration, partDuration time.Duration, segmentCount int) *Muxer {
+	return &Muxer{
+		sessionID:       sessionID,
+		audioCodec:      audioCodec,
+		segmentDuration: segmentDuration,
+		partDuration:    partDuration,
+		segmentCount:    segmentCount,
+		changed:         make(chan struct{}),
+		video: &muxerTrack{
+			track:   &fmp4.Track{ID: 1, Codec: fmp4.CodecH264, Timescale: 90000},
+			builder: samplebuilder.New(maxLateVideo, &codecs.H264Packet{IsAVC: true}, 90000),
+		},
+		lastPacket: time.Now(),
+	}
+}
+
+func (m *Muxer) idleSince() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Since(m.lastPacket)
+}
+
+func (m *Muxer) writeRTP(kind webrtc.RTPCodecType, packet *rtp.Packet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastPacket = time.Now()
+	if kind == webrtc.RTPCodecTypeAudio {
+		// audio before the init segment is dropped
+		if m.audio == nil || m.init == nil {
+			return
+		}
+		if m.audio.builder == nil {
+			m.writeAAC(packet)
+			return
+		}
+		m.audio.builder.Push(packet)
+		for {
+			sample, timestamp := m.audio.builder.PopWithTimestamp()
+			if sample == nil {
+				return
+			}
+			m.writeSample(m.audio, timestamp, sample.Data, true)
+		}
+	}
+	if !m.video.started {
+		if !tracks.IsKeyframe(webrtc.MimeTypeH264, packet.Payload) {
+			return
+		}
+		m.video.started = true
+	}
+	m.video.builder.Push(packet)
+	for {
+		sample, timestamp := m.video.builder.PopWithTimestamp()
+		if sample == nil {
+			return
+		}
+		m.writeVideo(sample.Data, timestamp)
+	}
+}
+
+// avcc access unit, parameter sets go to the init segment
+func (m *Muxer) writeVideo(avcc []byte, timestamp uint32) {
+	data := make([]byte, 0, len(avcc))
+	keyframe := false
+	for offset := 0; offset+4 <= len(avcc); {
+		size := int(binary.BigEndian.Uint32(avcc[offset:]))
+		if size <= 0 || offset+4+size > len(avcc) {
+			break
+		}
+		nalu := avcc[offset+4 : offset+4+size]
+		switch nalu[0] & 0x1F {
+		case h264NaluSPS:
+			if m.init == nil {
+				m.video.track.SPS = append([]byte(nil), nalu...)
+			}
+		case h264NaluPPS:
+			if m.init == nil {
+				m.video.track.PPS = append([]byte(nil), nalu...)
+			}
+		case h264NaluAUD:
+		case h264NaluIDR:
+			keyframe = true
+			fallthrough
+		default:
+			data = append(data, avcc[offset:offset+4+size]...)
+		}
+		offset += 4 + size
+	}
+	if len(data) == 0 {
+		return
+	}
+	if m.init == nil {
+		if !keyframe || m.video.track.SPS == nil || m.video.track.PPS == nil {
+			return
+		}
+		m.createInit()
+	}
+	m.writeSample(m.video, timestamp, data, keyframe)
+}
+
+// init segment of the video and the audio track, if its codec can be segmented
+func (m *Muxer) createInit() {
+	m.start = time.Now()
+	m.current = &segment{start: m.start}
+	list := []*fmp4.Track{m.video.track}
+	switch {
+	case strings.EqualFold(m.audioCodec, webrtc.MimeTypeOpus):
+		m.audio = &muxerTrack{
+			track:   &fmp4.Track{ID: 2, Codec: fmp4.CodecOpus, Timescale: 48000, Channels: 2},
+			builder: samplebuilder.New(maxLateAudio, &codecs.OpusPacket{}, 48000),
+		}
+	case strings.EqualFold(m.audioCodec, "audio/mpeg4-generic"):
+		config := sessions.GetAACConfig(m.sessionID)
+		if len(config) < 2 || int(config[0]&0x07<<1|config[1]>>7) >= len(aacSampleRates) {
+			logging.With("session_id", m.sessionID).Warnf("aac configuration is unknown, hls has no audio")
+			break
+		}
+		m.audio = &muxerTrack{track: &fmp4.Track{
+			ID:        2,
+			Codec:     fmp4.CodecAAC,
+			Timescale: aacSampleRates[config[0]&0x07<<1|config[1]>>7],
+			Channels:  uint16(config[1] >> 3 & 0x0F),
+			AACConfig: config,
+		}}
+	default:
+		logging.With("session_id", m.sessionID).Warnf("audio codec %v can not be segmented, hls has no audio", m.audioCodec)
+	}
+	if m.audio != nil {
+		list = append(list, m.audio.track)
+	}
+	m.init = fmp4.InitSegment(list)
+}
+
+// RFC 3640 access units with 16 bit au headers, 1024 samples each
+func (m *Muxer) writeAAC(packet *rtp.Packet) {
+	payload := packet.Payload
+	if len(payload) < 2 {
+		return
+	}
+	headersLength := (int(binary.BigEndian.Uint16(payload)) + 7) / 8
+	if 2+headersLength > len(payload) {
+		return
+	}
+	headers := payload[2 : 2+headersLength]
+	data := payload[2+headersLength:]
+	timestamp := packet.Timestamp
+	for i := 0; i+2 <= len(headers); i += 2 {
+		size := int(binary.BigEndian.Uint16(headers[i:]) >> 3)
+		if size > len(data) {
+			return
+		}
+		m.writeSample(m.audio, timestamp, append([]byte(nil), data[:size]...), true)
+		data = data[size:]
+		timestamp += 1024
+	}
+}
+
+// queue a sample, the previous sample of the track gets its duration from the timestamp difference
+func (m *Muxer) writeSample(t *muxerTrack, timestamp uint32, data []byte, keyframe bool) {
+	if !t.timed {
+		t.timed = true
+		// tracks starting after the video are placed by their arrival
+		if t != m.video {
+			t.baseTime = uint64(time.Since(m.start).Seconds() * float64(t.track.Timescale))
+		}
+	}
+	if t.last != nil {
+		duration := timestamp - t.lastTs
+		// reordered or repeated timestamps
+		if int32(duration) <= 0 {
+			duration = t.lastDur
+		}
+		t.last.Duration, t.lastDur = duration, duration
+		t.samples = append(t.samples, *t.last)
+		t.queued += uint64(duration)
+	}
+	t.last = &fmp4.Sample{Keyframe: keyframe, Data: data}
+	t.lastTs = timestamp
+	// parts and segments are cut by video, before the new sample
+	if t != m.video || len(t.samples) == 0 {
+		return
+	}
+	queued := m.videoDuration(t.queued)
+	switch {
+	case keyframe && m.current.duration+queued >= m.segmentDuration:
+		m.cutPart()
+		m.cutSegment()
+	case queued+m.videoDuration(uint64(t.lastDur)) > m.partDuration:
+		m.cutPart()
+	}
+	// segments only end at keyframes, ask the source for one if it takes too long
+	if m.current.duration > 2*m.segmentDuration && time.Since(m.lastRequest) > m.segmentDuration {
+		m.lastRequest = time.Now()
+		if sess := sessions.ReturnSessionByIdIfExists(m.sessionID); sess != nil {
+			sess.RequestKeyframe()
+		}
+	}
+}
+
+func (m *Muxer) videoDuration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / time.Duration(m.video.track.Timescale)
+}
+
+// write the queued samples of both tracks as a part of the current segment
+func (m *Muxer) cutPart() {
+	if len(m.video.samples) == 0 {
+		return
+	}
+	p := &part{
+		duration:    m.videoDuration(m.video.queued),
+		independent: m.video.samples[0].Keyframe,
+	}
+	fragments := make([]fmp4.TrackFragment, 0, 2)
+	for _, t := range []*muxerTrack{m.video, m.audio} {
+		if t == nil || len(t.samples) == 0 {
+			continue
+		}
+		fragments = append(fragments, fmp4.TrackFragment{Track: t.track, BaseDecodeTime: t.baseTime, Samples: t.samples})
+		t.baseTime += t.queued
+		t.samples, t.queued = nil, 0
+	}
+	m.sequence++
+	p.data = fmp4.Fragment(m.sequence, fragments)
+	m.current.parts = append(m.current.parts, p)
+	m.current.duration += p.duration
+	m.notify()
+}
+
+// complete the current segment and start the next one, the oldest segment leaves the playlist
+func (m *Muxer) cutSegment() {
+	if len(m.current.parts) == 0 {
+		return
+	}
+	for _, p := range m.current.parts {
+		m.current.data = append(m.current.data, p.data...)
+	}
+	m.segments = append(m.segments, m.current)
+	if len(m.segments) > m.segmentCount {
+		m.segments = m.segments[len(m.segments)-m.segmentCount:]
+	}
+	m.current = &segment{
+		msn:   m.current.msn + 1,
+		start: m.current.start.Add(m.current.duration),
+	}
+	m.notify()
+}
+
+// wake up blocked playlist and part requests, must be called with lock held
+func (m *Muxer) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
@@ -0,0 +1,143 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"pion-webrtc-sfu/fmp4"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	testSPS   = []byte{0x67, 0x42, 0xC0, 0x1F, 0xDA}
+	testPPS   = []byte{0x68, 0xCE, 0x3C, 0x80}
+	testStapA = append(append(append([]byte{0x78, 0, byte(len(testSPS))}, testSPS...), 0, byte(len(testPPS))), testPPS...)
+	testIDR   = []byte{0x65, 0x88, 0x84}
+	testSlice = []byte{0x41, 0x9A, 0x02}
+)
+
+func testPacket(seq uint16, timestamp uint32, marker bool, payload []byte) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp, Marker: marker},
+		Payload: payload,
+	}
+}
+
+// base decode time of the first track fragment of a part
+func testBaseDecodeTime(t *testing.T, fragment []byte) uint64 {
+	index := bytes.Index(fragment, []byte("tfdt"))
+	if string(fragment[4:8]) != "moof" || index < 0 {
+		t.Fatalf("part %x is not a fragment", fragment)
+	}
+	return binary.BigEndian.Uint64(fragment[index+8:])
+}
+
+// 30 fps with a keyframe every two seconds cut into segments of four 500ms parts
+func TestMuxerSegments(t *testing.T) {
+	m := newMuxer("hls", "audio/PCMU", 2*time.Second, 500*time.Millisecond, 3)
+	// sequence numbers and rtp timestamps wrap
+	seq, timestamp := uint16(65000), uint32(0xFFFFFFFF-100000)
+	for frame := 0; frame <= 5*60+1; frame++ {
+		payloads := [][]byte{testSlice}
+		if frame%60 == 0 {
+			payloads = [][]byte{testStapA, testIDR}
+		}
+		for i, payload := range payloads {
+			seq++
+			m.writeRTP(webrtc.RTPCodecTypeVideo, testPacket(seq, timestamp, i == len(payloads)-1, payload))
+		}
+		timestamp += 3000
+	}
+	if m.init == nil || !bytes.Contains(m.init, testSPS) {
+		t.Fatal("no init segment with the sps")
+	}
+	// frame 301 released the keyframe completing the fifth segment, the oldest two left the playlist
+	if len(m.segments) != 3 || m.segments[0].msn != 2 || m.current.msn != 5 {
+		t.Fatalf("%v segments from %v, current %v", len(m.segments), m.segments[0].msn, m.current.msn)
+	}
+	for _, s := range m.segments {
+		if s.duration != 2*time.Second || len(s.parts) != 4 {
+			t.Errorf("segment %v: %v with %v parts, want 2s with 4", s.msn, s.duration, len(s.parts))
+		}
+		var data []byte
+		for i, p := range s.parts {
+			if p.duration != 500*time.Millisecond || p.independent != (i == 0) {
+				t.Errorf("segment %v part %v: %v independent %v", s.msn, i, p.duration, p.independent)
+			}
+			// decode times continue across parts and the rtp timestamp wrap
+			want := (s.msn*4 + uint64(i)) * 45000
+			if base := testBaseDecodeTime(t, p.data); base != want {
+				t.Errorf("segment %v part %v: base decode time %v, want %v", s.msn, i, base, want)
+			}
+			data = append(data, p.data...)
+		}
+		if !bytes.Equal(s.data, data) {
+			t.Errorf("segment %v is not the concatenation of its parts", s.msn)
+		}
+		if !s.start.Equal(m.start.Add(time.Duration(s.msn) * 2 * time.Second)) {
+			t.Errorf("segment %v starts at %v after the first", s.msn, s.start.Sub(m.start))
+		}
+	}
+}
+
+// frames before the first keyframe with parameter sets are dropped
+func TestMuxerStartsAtKeyframe(t *testing.T) {
+	m := newMuxer("hls", "audio/PCMU", 2*time.Second, 500*time.Millisecond, 3)
+	for i, payload := range [][]byte{testSlice, testIDR, testSlice, testSlice} {
+		m.writeRTP(webrtc.RTPCodecTypeVideo, testPacket(uint16(i), uint32(i)*3000, true, payload))
+		m.writeRTP(webrtc.RTPCodecTypeAudio, testPacket(uint16(i), uint32(i)*960, true, []byte{0xFC, 1}))
+	}
+	if m.init != nil || m.audio != nil || m.current != nil {
+		t.Error("muxer started without parameter sets")
+	}
+	for _, avcc := range [][]byte{
+		nil,
+		{0, 0, 0, 1},
+		{0, 0, 0, 9, 0x65, 1},
+		{0, 0, 0, 0, 0, 0, 0, 1, 0x65},
+		{0x80, 0, 0, 1, 0x65},
+		{0, 0, 0, 1, 0x65, 0, 0},
+		append(append([]byte{0, 0, 0, byte(len(testSPS))}, testSPS...), append([]byte{0, 0, 0, byte(len(testPPS))}, testPPS...)...),
+	} {
+		m.writeVideo(avcc, 0)
+		if m.init != nil {
+			t.Errorf("access unit %x started the muxer", avcc)
+		}
+	}
+}
+
+// RFC 3640 payloads with malformed au headers are dropped without panicking
+func TestMuxerAAC(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		samples int
+	}{
+		{"one access unit", []byte{0, 16, 0, 3 << 3, 1, 2, 3}, 1},
+		{"two access units", []byte{0, 32, 0, 2 << 3, 0, 1 << 3, 1, 2, 3}, 2},
+		{"empty", nil, 0},
+		{"headers length only", []byte{0, 16}, 0},
+		{"headers beyond the payload", []byte{0xFF, 0xFF, 0, 8}, 0},
+		{"access unit beyond the payload", []byte{0, 16, 0, 9 << 3, 1}, 0},
+		{"second access unit beyond the payload", []byte{0, 32, 0, 1 << 3, 0, 9 << 3, 1, 2}, 1},
+		{"odd headers length", []byte{0, 9, 0, 1 << 3, 1}, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMuxer("hls", "audio/mpeg4-generic", 2*time.Second, 500*time.Millisecond, 3)
+			m.init, m.start, m.current = []byte{}, time.Now(), &segment{}
+			m.audio = &muxerTrack{track: &fmp4.Track{ID: 2, Codec: fmp4.CodecAAC, Timescale: 48000}}
+			m.writeRTP(webrtc.RTPCodecTypeAudio, testPacket(1, 0, true, test.payload))
+			samples := len(m.audio.samples)
+			if m.audio.last != nil {
+				samples++
+			}
+			if samples != test.samples {
+				t.Errorf("%v samples, want %v", samples, test.samples)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+media playlist of the session
+with msn >= 0 the request blocks until the segment (or with part >= 0 its part) is available
+*/
+func (m *Muxer) Playlist(ctx context.Context, msn int64, part int64) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msn >= 0 {
+		if err := m.waitFor(ctx, func() (bool, error) {
+			// segments more than two ahead of the live edge are never waited for
+			if m.current != nil && uint64(msn) > m.current.msn+2 {
+				return false, ErrBadRequest
+			}
+			return m.current != nil && m.hasPart(uint64(msn), part), nil
+		}); err != nil {
+			return "", err
+		}
+	} else if err := m.waitFor(ctx, func() (bool, error) { return len(m.segments) > 0, nil }); err != nil {
+		return "", err
+	}
+	return m.playlist(), nil
+}
+
+/*
+init segment, completed segment (seg<msn>.m4s) or part (part<msn>.<index>.m4s)
+requests of the next part block until it is available (preload hint)
+*/
+func (m *Muxer) File(ctx context.Context, name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == "init.mp4" {
+		if m.init == nil {
+			return nil, ErrNotFound
+		}
+		return m.init, nil
+	}
+	if rawMsn, ok := trimAffixes(name, "seg", ".m4s"); ok {
+		msn, err := strconv.ParseUint(rawMsn, 10, 64)
+		if err != nil {
+			return nil, ErrNotFound
+		}
+		for _, s := range m.segments {
+			if s.msn == msn {
+				return s.data, nil
+			}
+		}
+		return nil, ErrNotFound
+	}
+	rawPart, ok := trimAffixes(name, "part", ".m4s")
+	if !ok {
+		return nil, ErrNotFound
+	}
+	rawMsn, rawIndex, _ := strings.Cut(rawPart, ".")
+	msn, err := strconv.ParseUint(rawMsn, 10, 64)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	index, err := strconv.Atoi(rawIndex)
+	if err != nil || index < 0 {
+		return nil, ErrNotFound
+	}
+	if m.current != nil && msn == m.current.msn && index == len(m.current.parts) {
+		if err := m.waitFor(ctx, func() (bool, error) { return m.findPart(msn, index) != nil || m.current.msn > msn, nil }); err != nil {
+			return nil, err
+		}
+	}
+	if p := m.findPart(msn, index); p != nil {
+		return p.data, nil
+	}
+	return nil, ErrNotFound
+}
+
+// true if the segment, or its part with index >= 0, is available
+func (m *Muxer) hasPart(msn uint64, index int64) bool {
+	if msn < m.current.msn {
+		return true
+	}
+	return msn == m.current.msn && index >= 0 && int64(len(m.current.parts)) > index
+}
+
+func (m *Muxer) findPart(msn uint64, index int) *part {
+	for _, s := range m.segments {
+		if s.msn == msn && index < len(s.parts) {
+			return s.parts[index]
+		}
+	}
+	if m.current != nil && m.current.msn == msn && index < len(m.current.parts) {
+		return m.current.parts[index]
+	}
+	return nil
+}
+
+/*
+wait until ready returns true, at most three target durations
+must be called with lock held, the lock is released while waiting
+*/
+func (m *Muxer) waitFor(ctx context.Context, ready func() (bool, error)) error {
+	timeout := time.NewTimer(3 * m.targetDuration())
+	defer timeout.Stop()
+	for {
+		ok, err := ready()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		changed := m.changed
+		m.mu.Unlock()
+		select {
+		case <-changed:
+			m.mu.Lock()
+		case <-timeout.C:
+			m.mu.Lock()
+			return ErrUnavailable
+		case <-ctx.Done():
+			m.mu.Lock()
+			return ctx.Err()
+		}
+	}
+}
+
+// longest segment of the playlist rounded up, at least the configured segment duration
+func (m *Muxer) targetDuration() time.Duration {
+	target := m.segmentDuration
+	for _, s := range m.segments {
+		if s.duration > target {
+			target = s.duration
+		}
+	}
+	return time.Duration(math.Ceil(target.Seconds())) * time.Second
+}
+
+// must be called with lock held
+func (m *Muxer) playlist() string {
+	target := m.targetDuration()
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(target.Seconds()))
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*m.partDuration.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", m.partDuration.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", m.segments[0].msn)
+	b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+	// parts are only listed close to the live edge
+	var recent time.Duration
+	withParts := len(m.segments)
+	for withParts > 0 && recent+m.segments[withParts-1].duration <= 3*target {
+		withParts--
+		recent += m.segments[withParts].duration
+	}
+	for i, s := range m.segments {
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", s.start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		if i >= withParts {
+			writeParts(&b, s)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg%d.m4s\n", s.duration.Seconds(), s.msn)
+	}
+	if len(m.current.parts) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", m.current.start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		writeParts(&b, m.current)
+	}
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s\"\n", m.current.msn, len(m.current.parts))
+	return b.String()
+}
+
+func writeParts(b *strings.Builder, s *segment) {
+	for i, p := range s.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"part%d.%d.m4s\"", p.duration.Seconds(), s.msn, i)
+		if p.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// value between prefix and suffix
+func trimAffixes(name string, prefix string, suffix string) (string, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || len(name) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
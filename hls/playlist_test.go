@@ -0,0 +1,228 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// segment of parts with the given durations in milliseconds, the first part is independent
+func testSegment(msn uint64, start time.Time, durations ...int) *segment {
+	s := &segment{msn: msn, start: start}
+	for i, duration := range durations {
+		p := &part{
+			duration:    time.Duration(duration) * time.Millisecond,
+			independent: i == 0,
+			data:        []byte{byte(msn), byte(i)},
+		}
+		s.parts = append(s.parts, p)
+		s.data = append(s.data, p.data...)
+		s.duration += p.duration
+	}
+	return s
+}
+
+// muxer with segments 2 to 6 and the first part of segment 7
+func testPlaylistMuxer() *Muxer {
+	m := newMuxer("hls", "audio/PCMU", 2*time.Second, time.Second, 5)
+	m.init = []byte("init")
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, durations := range [][]int{{1000, 1000}, {1000, 1000}, {1000, 1000}, {1000, 1000, 500}, {1000, 1000}} {
+		s := testSegment(uint64(len(m.segments)+2), start, durations...)
+		m.segments = append(m.segments, s)
+		start = start.Add(s.duration)
+	}
+	m.current = testSegment(7, start, 1000)
+	return m
+}
+
+func TestPlaylist(t *testing.T) {
+	// parts are listed for the segments within three target durations of the live edge
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:9",
+		"#EXT-X-TARGETDURATION:3",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000",
+		"#EXT-X-PART-INF:PART-TARGET=1.000",
+		"#EXT-X-MEDIA-SEQUENCE:2",
+		`#EXT-X-MAP:URI="init.mp4"`,
+		"#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:05.000Z",
+		"#EXTINF:2.000,",
+		"seg2.m4s",
+		"#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:07.000Z",
+		`#EXT-X-PART:DURATION=1.000,URI="part3.0.m4s",INDEPENDENT=YES`,
+		`#EXT-X-PART:DURATION=1.000,URI="part3.1.m4s"`,
+		"#EXTINF:2.000,",
+		"seg3.m4s",
+		"#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:09.000Z",
+		`#EXT-X-PART:DURATION=1.000,URI="part4.0.m4s",INDEPENDENT=YES`,
+		`#EXT-X-PART:DURATION=1.000,URI="part4.1.m4s"`,
+		"#EXTINF:2.000,",
+		"seg4.m4s",
+		"#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:11.000Z",
+		`#EXT-X-PART:DURATION=1.000,URI="part5.0.m4s",INDEPENDENT=YES`,
+		`#EXT-X-PART:DURATION=1.000,URI="part5.1.m4s"`,
+		`#EXT-X-PART:DURATION=0.500,URI="part5.2.m4s"`,
+		"#EXTINF:2.500,",
+		"seg5.m4s",
+		"#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:13.500Z",
+		`#EXT-X-PART:DURATION=1.000,URI="part6.0.m4s",INDEPENDENT=YES`,
+		`#EXT-X-PART:DURATION=1.000,URI="part6.1.m4s"`,
+		"#EXTINF:2.000,",
+		"seg6.m4s",
+		"#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:15.500Z",
+		`#EXT-X-PART:DURATION=1.000,URI="part7.0.m4s",INDEPENDENT=YES`,
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part7.1.m4s"`,
+		"",
+	}, "\n")
+	m := testPlaylistMuxer()
+	playlist, err := m.Playlist(context.Background(), -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlist != want {
+		t.Errorf("got playlist\n%v\nwant\n%v", playlist, want)
+	}
+	// a new segment without parts yet only has the preload hint
+	m.segments = append(m.segments[1:], m.current)
+	m.current = &segment{msn: 8, start: m.current.start.Add(m.current.duration)}
+	playlist, err = m.Playlist(context.Background(), -1, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(playlist, "#EXTINF:1.000,\nseg7.m4s\n#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part8.0.m4s\"\n") || !strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:3\n") {
+		t.Errorf("playlist after the segment was completed\n%v", playlist)
+	}
+}
+
+// blocking playlist requests of the live edge, parts and segments not available yet time out or fail
+func TestPlaylistBlocking(t *testing.T) {
+	m := testPlaylistMuxer()
+	tests := []struct {
+		name    string
+		msn     int64
+		part    int64
+		wantErr error
+	}{
+		{"completed segment", 4, -1, nil},
+		{"part of the current segment", 7, 0, nil},
+		{"part of a completed segment", 6, 5, nil},
+		{"next part", 7, 1, context.DeadlineExceeded},
+		{"current segment", 7, -1, context.DeadlineExceeded},
+		{"two segments ahead", 9, 0, context.DeadlineExceeded},
+		{"too far ahead", 10, 0, ErrBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if _, err := m.Playlist(ctx, test.msn, test.part); !errors.Is(err, test.wantErr) {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+	// a blocked request returns once the part was added
+	done := make(chan error)
+	go func() {
+		_, err := m.Playlist(context.Background(), 7, 1)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	m.mu.Lock()
+	m.current.parts = append(m.current.parts, &part{duration: time.Second})
+	m.notify()
+	m.mu.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("blocked playlist request did not return after the part was added")
+	}
+}
+
+// a muxer without a completed segment times out after three target durations
+func TestPlaylistUnavailable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the playlist timeout")
+	}
+	m := newMuxer("hls", "audio/PCMU", 100*time.Millisecond, 50*time.Millisecond, 3)
+	m.current = &segment{}
+	start := time.Now()
+	if _, err := m.Playlist(context.Background(), -1, -1); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("got %v, want %v", err, ErrUnavailable)
+	}
+	// the target duration is rounded up to a second
+	if elapsed := time.Since(start); elapsed < 3*time.Second || elapsed > 5*time.Second {
+		t.Errorf("timed out after %v, want 3s", elapsed)
+	}
+}
+
+func TestFile(t *testing.T) {
+	m := testPlaylistMuxer()
+	tests := []struct {
+		name    string
+		want    []byte
+		wantErr error
+	}{
+		{"init.mp4", []byte("init"), nil},
+		{"seg2.m4s", []byte{2, 0, 2, 1}, nil},
+		{"seg5.m4s", []byte{5, 0, 5, 1, 5, 2}, nil},
+		{"part5.2.m4s", []byte{5, 2}, nil},
+		{"part7.0.m4s", []byte{7, 0}, nil},
+		{"seg1.m4s", nil, ErrNotFound},
+		{"seg7.m4s", nil, ErrNotFound},
+		{"part1.0.m4s", nil, ErrNotFound},
+		{"part5.3.m4s", nil, ErrNotFound},
+		{"part8.0.m4s", nil, ErrNotFound},
+		{"part7.1.m4s", nil, context.DeadlineExceeded}, // preload hint blocks
+		{"seg.m4s", nil, ErrNotFound},
+		{"segx.m4s", nil, ErrNotFound},
+		{"seg-1.m4s", nil, ErrNotFound},
+		{"part.m4s", nil, ErrNotFound},
+		{"part5.m4s", nil, ErrNotFound},
+		{"part5.-1.m4s", nil, ErrNotFound},
+		{"part5.x.m4s", nil, ErrNotFound},
+		{"part18446744073709551616.0.m4s", nil, ErrNotFound},
+		{"seg5.mp4", nil, ErrNotFound},
+		{"playlist.m3u8", nil, ErrNotFound},
+		{"", nil, ErrNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			data, err := m.File(ctx, test.name)
+			if !errors.Is(err, test.wantErr) || string(data) != string(test.want) {
+				t.Errorf("got %x, %v, want %x, %v", data, err, test.want, test.wantErr)
+			}
+		})
+	}
+	// init segment before the first keyframe
+	if _, err := newMuxer("hls", "audio/PCMU", time.Second, time.Second, 3).File(context.Background(), "init.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("init segment of a new muxer returned %v", err)
+	}
+}
+
+func TestTrimAffixes(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		wantOk bool
+	}{
+		{"seg12.m4s", "12", true},
+		{"seg.m4s", "", true},
+		{"seg.m4", "", false},
+		{"segm4s", "", false},
+		{"se.m4s", "", false},
+		{"xseg1.m4s", "", false},
+	}
+	for _, test := range tests {
+		if value, ok := trimAffixes(test.name, "seg", ".m4s"); value != test.value || ok != test.wantOk {
+			t.Errorf("%q: got %q, %v, want %q, %v", test.name, value, ok, test.value, test.wantOk)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"pion-webrtc-sfu/sessions"
+)
+
+// GET /api/sessions -- sessions with the ws/rtc state of their users
+func listSessions(c *gin.Context) {
+	c.JSON(http.StatusOK, sessions.ListSessions())
+}
+
+// body of POST /api/sessions
+type sessionRequest struct {
+	ID string `json:"id" binding:"required"`
+}
+
+// POST /api/sessions -- create a session viewers can wait in before its stream starts, kept until deleted
+func createSession(c *gin.Context) {
+	var req sessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	created, err := sessions.CreatePersistentSession(req.ID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status, _ := sessions.GetSessionStatus(req.ID)
+	if created {
+		c.JSON(http.StatusCreated, status)
+	} else {
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+// GET /api/sessions/:session
+func getSession(c *gin.Context) {
+	status, ok := sessions.GetSessionStatus(c.Param("session"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// DELETE /api/sessions/:session -- disconnects all users, the session is removed once they left and it is idle
+func closeSession(c *gin.Context) {
+	if !sessions.CloseSession(c.Param("session")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /api/sessions/:session/users/:user -- kills the websocket and webrtc connection of the user
+func kickUser(c *gin.Context) {
+	sess := sessions.ReturnSessionByIdIfExists(c.Param("session"))
+	if sess == nil || !sess.KickUser(c.Param("user")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GET /api/ingest -- rtp streams received within the last minute by port and ssrc
+func listIngest(c *gin.Context) {
+	c.JSON(http.StatusOK, sessions.ListIngest())
+}
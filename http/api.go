@@ -0,0 +1,202 @@
+package http
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/sessions"
+)
+
+// register rest api endpoints, only enabled if an api token is configured
+func registerApi(router *gin.Engine, config *configuration.Configuration) {
+	if config.Http_api_token == "" {
+		logging.Infof("HTTP_API_TOKEN not set, api endpoints are disabled")
+		return
+	}
+	api := router.Group("/api", apiAuth(config.Http_api_token))
+	// sessions, their users and incoming streams
+	api.GET("/sessions", listSessions)
+	api.POST("/sessions", createSession)
+	api.GET("/sessions/:session", getSession)
+	api.DELETE("/sessions/:session", closeSession)
+	api.DELETE("/sessions/:session/users/:user", kickUser)
+	api.GET("/ingest", listIngest)
+	// stream keys mapping session names to incoming streams
+	api.GET("/streams", listStreamKeys)
+	api.POST("/streams", createStreamKey)
+	api.GET("/streams/:name", getStreamKey)
+	api.PUT("/streams/:name", putStreamKey)
+	api.PUT("/streams/:name/ssrcs", func(c *gin.Context) {
+		putStreamKeySSRCs(c, config)
+	})
+	api.DELETE("/streams/:name", deleteStreamKey)
+	// rtsp cameras pulled into sessions
+	api.GET("/rtsp", listRtspSources)
+	api.POST("/rtsp", func(c *gin.Context) {
+		createRtspSource(c, config)
+	})
+	api.GET("/rtsp/:name", getRtspSource)
+	api.DELETE("/rtsp/:name", deleteRtspSource)
+	// session recordings
+	api.GET("/recordings", listRecordings)
+	api.GET("/recordings/:session", getRecording)
+	api.POST("/recordings/:session", startRecording)
+	api.DELETE("/recordings/:session", stopRecording)
+	// rtp forwarding to other systems
+	api.GET("/relays", listRelayTargets)
+	api.GET("/relays/:session", getRelayTargets)
+	api.POST("/relays/:session", createRelayTarget)
+	api.DELETE("/relays/:session/:id", deleteRelayTarget)
+	// clips played while the ingest of a session stalls
+	api.GET("/slates", listSlates)
+	api.PUT("/slates/:session", putSlate)
+	api.DELETE("/slates/:session", deleteSlate)
+	// websocket tokens and their revocation
+	api.POST("/tokens", issueToken)
+	api.GET("/revocations", listRevocations)
+	api.POST("/revocations", createRevocation)
+	api.DELETE("/revocations/tokens/:id", deleteTokenRevocation)
+	api.DELETE("/revocations/users/:user", deleteUserRevocation)
+}
+
+// check bearer token of api requests
+func apiAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// GET /api/streams
+func listStreamKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, sessions.ListStreamKeys())
+}
+
+// POST /api/streams -- a random name is generated if none is given
+func createStreamKey(c *gin.Context) {
+	var key sessions.StreamKey
+	if err := c.ShouldBindJSON(&key); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if key.Name == "" {
+		name, err := sessions.NewStreamKeyName()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		key.Name = name
+	} else if _, exists := sessions.GetStreamKey(key.Name); exists {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "stream key already exists"})
+		return
+	}
+	if err := sessions.RegisterStreamKey(key); err != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, key)
+}
+
+// GET /api/streams/:name
+func getStreamKey(c *gin.Context) {
+	key, ok := sessions.GetStreamKey(c.Param("name"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "stream key not found"})
+		return
+	}
+	c.JSON(http.StatusOK, key)
+}
+
+// PUT /api/streams/:name -- replaces bindings of the stream key
+func putStreamKey(c *gin.Context) {
+	var key sessions.StreamKey
+	if err := c.ShouldBindJSON(&key); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	key.Name = c.Param("name")
+	if err := sessions.RegisterStreamKey(key); err != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, key)
+}
+
+// DELETE /api/streams/:name
+func deleteStreamKey(c *gin.Context) {
+	if !sessions.RemoveStreamKey(c.Param("name")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "stream key not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// body of PUT /api/streams/:name/ssrcs, kinds left out keep their bindings
+type ssrcBindingRequest struct {
+	Video []uint32 `json:"video"`
+	Audio []uint32 `json:"audio"`
+}
+
+// PUT /api/streams/:name/ssrcs -- rebind the video and/or audio ssrcs of a session, the key is created if needed
+func putStreamKeySSRCs(c *gin.Context, config *configuration.Configuration) {
+	var req ssrcBindingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Video == nil && req.Audio == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "at least one of video and audio must be set"})
+		return
+	}
+	key, _ := sessions.GetStreamKey(c.Param("name"))
+	key.Name = c.Param("name")
+	if req.Video != nil {
+		key.Bindings = withPortBindings(key.Bindings, config.Rtc_video_tracks_receive_port, req.Video)
+	}
+	if req.Audio != nil {
+		key.Bindings = withPortBindings(key.Bindings, config.Rtc_audio_tracks_receive_port, req.Audio)
+	}
+	if err := sessions.RegisterStreamKey(key); err != nil {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	logging.With("session_id", key.Name).Infof("ssrcs rebound through the api")
+	c.JSON(http.StatusOK, key)
+}
+
+// replace the bindings received on port with the given ssrcs
+func withPortBindings(bindings []sessions.IngestBinding, port uint16, ssrcs []uint32) []sessions.IngestBinding {
+	result := make([]sessions.IngestBinding, 0, len(bindings)+len(ssrcs))
+	for _, b := range bindings {
+		if b.Port != port {
+			result = append(result, b)
+		}
+	}
+	for _, ssrc := range ssrcs {
+		result = append(result, sessions.IngestBinding{Port: port, SSRC: ssrc})
+	}
+	return result
+}
+
+// parse comma separated list of ssrcs
+func parseSSRCList(list string) ([]uint32, error) {
+	ssrcs := make([]uint32, 0)
+	for _, s := range strings.Split(list, ",") {
+		ssrc, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		ssrcs = append(ssrcs, uint32(ssrc))
+	}
+	return ssrcs, nil
+}
@@ -0,0 +1,115 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"pion-webrtc-sfu/auth"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/hls"
+)
+
+// uri attributes of playlist tags
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+/*
+register ll-hls playlists and segments of broadcasting h264 sessions
+with HTTP_WS_TOKEN_SECRET set, requests need a token issued for the session as bearer token or token query parameter
+*/
+func registerHls(router *gin.Engine, config *configuration.Configuration) {
+	if !hls.Enabled() {
+		return
+	}
+	router.OPTIONS("/hls/:session/:file", preflightHls)
+	router.GET("/hls/:session/:file", authorizeViewer(true), serveHls)
+}
+
+// OPTIONS /hls/:session/:file -- browsers ask before sending the authorization header cross origin
+func preflightHls(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Access-Control-Allow-Methods", "GET")
+	c.Header("Access-Control-Allow-Headers", "Authorization")
+	c.Status(http.StatusNoContent)
+}
+
+// GET /hls/:session/index.m3u8 (_HLS_msn and _HLS_part block until available), init.mp4, seg<n>.m4s, part<n>.<i>.m4s
+func serveHls(c *gin.Context) {
+	// players are usually served from other origins
+	c.Header("Access-Control-Allow-Origin", "*")
+	muxer := hls.GetMuxer(c.Param("session"))
+	if muxer == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "session is not broadcasting"})
+		return
+	}
+	file := c.Param("file")
+	if file == "index.m3u8" {
+		msn, part := int64(-1), int64(-1)
+		if value := c.Query("_HLS_msn"); value != "" {
+			var err error
+			if msn, err = strconv.ParseInt(value, 10, 64); err != nil || msn < 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid _HLS_msn"})
+				return
+			}
+		}
+		if value := c.Query("_HLS_part"); value != "" {
+			var err error
+			if part, err = strconv.ParseInt(value, 10, 64); err != nil || part < 0 || msn < 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid _HLS_part"})
+				return
+			}
+		}
+		playlist, err := muxer.Playlist(c.Request.Context(), msn, part)
+		if err != nil {
+			abortHls(c, err)
+			return
+		}
+		// players don't pass the query of the playlist on to the files it lists
+		if token := c.Query("token"); token != "" && auth.TokensRequired() {
+			playlist = playlistWithToken(playlist, token)
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(playlist))
+		return
+	}
+	data, err := muxer.File(c.Request.Context(), file)
+	if err != nil {
+		abortHls(c, err)
+		return
+	}
+	// parts and segments never change once available
+	c.Header("Cache-Control", "max-age=60")
+	c.Data(http.StatusOK, "video/mp4", data)
+}
+
+// append the token to the uris of a playlist, both the uri lines and the URI attributes of tags
+func playlistWithToken(playlist string, token string) string {
+	query := "?token=" + url.QueryEscape(token)
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		switch {
+		case line == "":
+		case !strings.HasPrefix(line, "#"):
+			lines[i] = line + query
+		default:
+			lines[i] = uriAttribute.ReplaceAllString(line, `URI="${1}`+query+`"`)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func abortHls(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, hls.ErrBadRequest):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, hls.ErrUnavailable):
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	}
+}
@@ -1,19 +1,33 @@
 package http
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
-	"strconv"
+	"net/url"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"pion-webrtc-sfu/auth"
 	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
 	"pion-webrtc-sfu/sessions"
-	"pion-webrtc-sfu/tracks"
 	"pion-webrtc-sfu/user"
+	"pion-webrtc-sfu/webrtc"
 	"pion-webrtc-sfu/websocket"
+	"pion-webrtc-sfu/writer"
 )
 
+// http server, set by ServeHttp
+var server *http.Server
+
+// set once the server shuts down, new viewers and publishers are rejected
+var draining atomic.Bool
+
 // start http listener
 func ServeHttp(config *configuration.Configuration) {
 	// set mode
@@ -23,7 +37,9 @@ func ServeHttp(config *configuration.Configuration) {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	router := gin.Default()
+	// requests are logged at debug level in the format of all other log lines
+	router := gin.New()
+	router.Use(requestLogger(), gin.Recovery())
 	is_ssl := config.Http_tls_cert_file_location != "" && config.Http_tls_key_file_location != ""
 
 	// html test server enabled
@@ -37,57 +53,259 @@ func ServeHttp(config *configuration.Configuration) {
 	}
 
 	// websocket server - always served
-	router.GET("/ws", func(c *gin.Context) {
-		// get session ID and user ID from the user.
-		// this might need to be changed later since
-		// these values might come from an external API.
-		sid := c.Request.URL.Query().Get("sid")    // unique for every user
-		userID := c.Request.URL.Query().Get("uid") // unique for every streaming session (can contain multiple users)
+	router.GET("/ws", rejectWhileDraining, func(c *gin.Context) {
+		// get session ID and user ID from the user,
+		// with token auth they are taken from the token instead
+		sid := c.Request.URL.Query().Get("sid")    // name of the streaming session (can contain multiple users)
+		userID := c.Request.URL.Query().Get("uid") // unique for every user
+		// browsers may only connect from allowed pages
+		if !auth.OriginAllowed(c.Request) {
+			logging.With("origin", c.GetHeader("Origin")).Warnf("connection attempted from origin not allowed, declining")
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		var claims auth.Claims
+		if auth.TokensRequired() {
+			var err error
+			claims, err = auth.Authenticate(auth.TokenFromRequest(c.Request))
+			if err != nil {
+				logging.With("session_id", sid, "user_id", userID).Warnf("connection attempted without valid token, declining: %v", err)
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			// sid and uid are optional but must match the token if given
+			if (sid != "" && sid != claims.Session) || (userID != "" && userID != claims.User) {
+				logging.With("session_id", sid, "user_id", userID).Warnf("token was issued for session %v and user %v, declining", claims.Session, claims.User)
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			sid, userID = claims.Session, claims.User
+		}
 		if sid == "" || userID == "" {
-			log.Printf("connection attempted with no sid and uid provided, declining\n")
+			logging.Warnf("connection attempted with no sid and uid provided, declining")
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
-		// parse sessionID - uint32 to be
-		sessionID, err := strconv.ParseUint(sid, 10, 32)
-		if err != nil {
-			log.Printf("user %v did not provide a valid ssrc!, declining connection!\n", userID)
-			c.AbortWithStatus(http.StatusInternalServerError)
+		logger := logging.With("session_id", sid, "user_id", userID)
+		// optional explicit ssrcs of the video and audio streams feeding the session
+		if status, err := bindSSRCs(config, sid, claims, c.Request.URL.Query()); err != nil {
+			logger.Warnf("could not bind ssrcs, declining connection: %v", err)
+			c.AbortWithStatus(status)
 			return
 		}
 		// create user with id
 		u := user.NewUser(userID, config)
-		// create track group
-		trackGroup, err := tracks.NewTrackGroup(config)
-		if err != nil {
-			log.Printf("session %v, user %v: server could not create track group\n", sessionID, userID)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
+		u.Role, u.TokenID = claims.Role, claims.ID
 		// add user to session
-		sess := sessions.AddSession(uint32(sessionID), trackGroup)
-		// add user to session
-		if err := sess.AddUser(&u); err != nil {
-			log.Printf("session %v, user %v: user already exists in session\n", sessionID, userID)
-			c.AbortWithStatus(http.StatusBadRequest)
+		if status, err := joinSession(config, sid, &u); err != nil {
+			logger.Warnf("could not join session: %v", err)
+			c.AbortWithStatus(status)
 			return
 		}
 		// create websocket client
 		wsClient, err := websocket.NewWebsocketClient(c, &u)
 		if err != nil {
 			c.AbortWithStatus(http.StatusInternalServerError)
-			log.Printf("session %v, user %v could not create ws client: %v\n", sessionID, userID, err)
+			logger.Errorf("could not create ws client: %v", err)
 			// close ws
 			wsClient.Close()
 			return
 		}
 		// start websocket handler loop
-		go wsClient.Loop(config, uint32(sessionID))
+		go wsClient.Loop(config, sid)
 	})
-	// serve with ssl if specified
-	if is_ssl {
-		go router.RunTLS(config.Http_local_server_location, config.Http_tls_cert_file_location, config.Http_tls_key_file_location)
-	} else {
-		go router.Run(config.Http_local_server_location)
+	// rest api
+	registerApi(router, config)
+	// webrtc ingest
+	registerWhip(router, config)
+	// webrtc playback without websocket
+	registerWhep(router, config)
+	// hls playback for large audiences
+	registerHls(router, config)
+	// prometheus metrics
+	registerMetrics(router, config)
+	server = &http.Server{Addr: config.Http_local_server_location, Handler: router}
+	go func() {
+		var err error
+		// serve with ssl if specified
+		if is_ssl {
+			err = server.ListenAndServeTLS(config.Http_tls_cert_file_location, config.Http_tls_key_file_location)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatalf("http server stopped: %v", err)
+		}
+	}()
+}
+
+// stop accepting websocket, whep and whip connections, the rest of the api keeps working
+func Drain() {
+	draining.Store(true)
+}
+
+// close the listener and wait for running requests until ctx is done, hijacked websockets are not waited for
+func Shutdown(ctx context.Context) error {
+	Drain()
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(ctx)
+}
+
+// respond 503 to new connections while shutting down
+func rejectWhileDraining(c *gin.Context) {
+	if draining.Load() {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down"})
+		return
+	}
+	c.Next()
+}
+
+// context key of the token claims of a whep or hls request
+const claimsKey = "claims"
+
+/*
+check origin and token of whep and hls requests, the token has to be issued for the requested session
+it is taken from an "Authorization: Bearer" header, with fromQuery also from the token query parameter
+*/
+func authorizeViewer(fromQuery bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sid := c.Param("session")
+		if !auth.OriginAllowed(c.Request) {
+			logging.With("origin", c.GetHeader("Origin")).Warnf("request from origin not allowed, declining")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "origin not allowed"})
+			return
+		}
+		if !auth.TokensRequired() {
+			c.Next()
+			return
+		}
+		token := auth.BearerToken(c.Request)
+		if token == "" && fromQuery {
+			token = c.Query("token")
+		}
+		claims, err := auth.Authenticate(token)
+		if err != nil {
+			logging.With("session_id", sid).Warnf("request without valid token, declining: %v", err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+		if claims.Session != sid {
+			logging.With("session_id", sid, "user_id", claims.User).Warnf("token was issued for session %v, declining", claims.Session)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token was not issued for this session"})
+			return
+		}
+		c.Set(claimsKey, claims)
+		c.Next()
+	}
+}
+
+// claims set by authorizeViewer, empty if tokens are not required
+func viewerClaims(c *gin.Context) auth.Claims {
+	claims, _ := c.Get(claimsKey)
+	viewer, _ := claims.(auth.Claims)
+	return viewer
+}
+
+/*
+bind the ssrcs given with vssrc and assrc to the video and audio port of the session
+this changes the stream key of the session for everyone, so only moderators may do it if tokens are required
+returns the http status to respond with on failure
+*/
+func bindSSRCs(config *configuration.Configuration, sid string, claims auth.Claims, query url.Values) (int, error) {
+	vssrc, assrc := query.Get("vssrc"), query.Get("assrc")
+	if vssrc == "" && assrc == "" {
+		return http.StatusOK, nil
+	}
+	if auth.TokensRequired() && claims.Role != auth.RoleModerator {
+		return http.StatusForbidden, errors.New("only moderators may bind ssrcs")
+	}
+	key, _ := sessions.GetStreamKey(sid)
+	key.Name = sid
+	if vssrc != "" {
+		ssrcs, err := parseSSRCList(vssrc)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid video ssrcs: %v", err)
+		}
+		key.Bindings = withPortBindings(key.Bindings, config.Rtc_video_tracks_receive_port, ssrcs)
+	}
+	if assrc != "" {
+		ssrcs, err := parseSSRCList(assrc)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid audio ssrcs: %v", err)
+		}
+		key.Bindings = withPortBindings(key.Bindings, config.Rtc_audio_tracks_receive_port, ssrcs)
+	}
+	if err := sessions.RegisterStreamKey(key); err != nil {
+		return http.StatusConflict, err
+	}
+	logging.With("session_id", sid).Infof("ssrcs rebound through the websocket")
+	return http.StatusOK, nil
+}
+
+/*
+add user to session, creating the session if it is expected to be fed
+sessions of unknown names are only created by ingest or the api
+returns the http status to respond with on failure
+*/
+func joinSession(config *configuration.Configuration, sid string, u *user.User) (int, error) {
+	local := isLocalSession(sid)
+	var sess *sessions.Session
+	// retried once if the session was removed by the idle collector meanwhile
+	for attempt := 0; ; attempt++ {
+		sess = sessions.ReturnSessionByIdIfExists(sid)
+		if sess == nil {
+			if !local && config.Rtc_origin_url == "" {
+				return http.StatusNotFound, errors.New("session does not exist")
+			}
+			var err error
+			if sess, err = sessions.AddSession(sid); err != nil {
+				return http.StatusInternalServerError, err
+			}
+		}
+		err := sess.AddUser(u)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, sessions.ErrSessionRemoved) {
+			return http.StatusBadRequest, errors.New("user already exists in session")
+		}
+		if attempt > 0 {
+			return http.StatusServiceUnavailable, err
+		}
+	}
+	// edge mode, sessions not fed by this server are pulled from the origin
+	if config.Rtc_origin_url != "" && !local {
+		if err := sess.ConnectUpstream(func() (io.Closer, error) {
+			return webrtc.NewOriginLink(config, sid)
+		}); err != nil {
+			// remove the user again
+			u.State.SetWsState(user.Done)
+			u.State.SetRtcState(user.Done)
+			sessions.UpdateSessions()
+			return http.StatusBadGateway, fmt.Errorf("could not pull session from origin: %v", err)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// true if the session is fed by an ingest of this server
+func isLocalSession(sid string) bool {
+	if _, exists := sessions.GetStreamKey(sid); exists {
+		return true
+	}
+	if _, exists := writer.GetRtspSource(sid); exists {
+		return true
+	}
+	return writer.HasMpegtsSource(sid) || webrtc.HasWhipPublisher(sid)
+}
+
+// log method, path, status and latency of every request
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		logging.With("client", c.ClientIP(), "status", c.Writer.Status(), "latency", time.Since(start)).Debugf("%v %v", c.Request.Method, c.Request.URL.Path)
 	}
 }
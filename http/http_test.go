@@ -0,0 +1,170 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pion-webrtc-sfu/auth"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/sessions"
+	"pion-webrtc-sfu/user"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// whep and hls requests need a token of the requested session from an allowed origin
+func TestAuthorizeViewer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	if err := auth.InitAuth(&configuration.Configuration{Http_ws_token_secret: "secret", Http_ws_allowed_origins: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auth.InitAuth(&configuration.Configuration{}) })
+	token, err := auth.Issue(auth.Claims{Session: "live", User: "alice", Expiry: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.GET("/view/:session", authorizeViewer(true), func(c *gin.Context) {
+		c.String(http.StatusOK, viewerClaims(c).User)
+	})
+	tests := []struct {
+		name       string
+		target     string
+		header     string
+		origin     string
+		wantStatus int
+	}{
+		{"bearer token", "/view/live", "Bearer " + token, "", http.StatusOK},
+		{"query token", "/view/live?token=" + token, "", "", http.StatusOK},
+		{"allowed origin", "/view/live", "Bearer " + token, "https://example.com", http.StatusOK},
+		{"session mismatch", "/view/other", "Bearer " + token, "", http.StatusForbidden},
+		{"session mismatch with query token", "/view/other?token=" + token, "", "", http.StatusForbidden},
+		{"origin not allowed", "/view/live", "Bearer " + token, "https://evil.example", http.StatusForbidden},
+		{"no token", "/view/live", "", "", http.StatusUnauthorized},
+		{"invalid token", "/view/live", "Bearer " + token + "x", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.target, nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != test.wantStatus {
+				t.Errorf("got %v %v, want %v", w.Code, w.Body, test.wantStatus)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != "alice" {
+				t.Errorf("claims of user %q passed on", w.Body)
+			}
+		})
+	}
+}
+
+// vssrc and assrc rebind the stream key of the session, only for moderators if tokens are required
+func TestBindSSRCs(t *testing.T) {
+	config := &configuration.Configuration{Rtc_video_tracks_receive_port: 5004, Rtc_audio_tracks_receive_port: 5005}
+	t.Cleanup(func() { sessions.RemoveStreamKey("bind") })
+	tests := []struct {
+		name         string
+		tokens       bool
+		role         string
+		query        string
+		wantStatus   int
+		wantBindings []sessions.IngestBinding
+	}{
+		{"no ssrcs", true, auth.RoleViewer, "", http.StatusOK, nil},
+		{"viewer", true, auth.RoleViewer, "vssrc=1111", http.StatusForbidden, nil},
+		{"no role", true, "", "vssrc=1111", http.StatusForbidden, nil},
+		{"moderator", true, auth.RoleModerator, "vssrc=1111,2222&assrc=3333", http.StatusOK, []sessions.IngestBinding{{Port: 5004, SSRC: 1111}, {Port: 5004, SSRC: 2222}, {Port: 5005, SSRC: 3333}}},
+		{"audio kept", true, auth.RoleModerator, "vssrc=4444", http.StatusOK, []sessions.IngestBinding{{Port: 5005, SSRC: 3333}, {Port: 5004, SSRC: 4444}}},
+		{"invalid list", true, auth.RoleModerator, "assrc=1,x", http.StatusBadRequest, nil},
+		{"without tokens", false, "", "assrc=5555", http.StatusOK, []sessions.IngestBinding{{Port: 5004, SSRC: 4444}, {Port: 5005, SSRC: 5555}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret := ""
+			if test.tokens {
+				secret = "secret"
+			}
+			if err := auth.InitAuth(&configuration.Configuration{Http_ws_token_secret: secret}); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { auth.InitAuth(&configuration.Configuration{}) })
+			before, _ := sessions.GetStreamKey("bind")
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, err := bindSSRCs(config, "bind", auth.Claims{Session: "bind", User: "alice", Role: test.role}, query)
+			if status != test.wantStatus || (err == nil) != (status == http.StatusOK) {
+				t.Fatalf("got %v %v, want %v", status, err, test.wantStatus)
+			}
+			key, _ := sessions.GetStreamKey("bind")
+			want := test.wantBindings
+			if want == nil {
+				want = before.Bindings
+			}
+			if !reflect.DeepEqual(key.Bindings, want) {
+				t.Errorf("bindings %+v, want %+v", key.Bindings, want)
+			}
+		})
+	}
+}
+
+var initTestSessions sync.Once
+
+// sessions created with the default configuration
+func setupTestSessions(t *testing.T) *configuration.Configuration {
+	config, err := configuration.CreateConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initTestSessions.Do(func() {
+		if err := sessions.InitSessions(config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return config
+}
+
+// viewers only create sessions fed by this server, unknown names are not created
+func TestJoinSession(t *testing.T) {
+	config := setupTestSessions(t)
+	if err := sessions.RegisterStreamKey(sessions.StreamKey{Name: "keyed"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sessions.RemoveStreamKey("keyed") })
+	if _, err := sessions.CreatePersistentSession("api"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		sid         string
+		uid         string
+		wantStatus  int
+		wantSession bool
+	}{
+		{"unknown session", "typo", "a", http.StatusNotFound, false},
+		{"stream key", "keyed", "a", http.StatusOK, true},
+		{"created through the api", "api", "a", http.StatusOK, true},
+		{"user already joined", "api", "a", http.StatusBadRequest, true},
+	}
+	for _, test := range tests {
+		u := user.NewUser(test.uid, config)
+		status, err := joinSession(config, test.sid, &u)
+		if status != test.wantStatus || (err == nil) != (status == http.StatusOK) {
+			t.Errorf("%v: got %v %v, want %v", test.name, status, err, test.wantStatus)
+		}
+		if exists := sessions.ReturnSessionByIdIfExists(test.sid) != nil; exists != test.wantSession {
+			t.Errorf("%v: session exists %v, want %v", test.name, exists, test.wantSession)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package http
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/metrics"
+)
+
+// register prometheus metrics, protected by the api token if one is configured
+func registerMetrics(router *gin.Engine, config *configuration.Configuration) {
+	if !config.Http_metrics_enabled {
+		return
+	}
+	handlers := []gin.HandlerFunc{serveMetrics}
+	if config.Http_api_token != "" {
+		handlers = append([]gin.HandlerFunc{apiAuth(config.Http_api_token)}, handlers...)
+	}
+	router.GET("/metrics", handlers...)
+}
+
+// GET /metrics -- text exposition format
+func serveMetrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(c.Writer)
+}
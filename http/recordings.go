@@ -0,0 +1,48 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"pion-webrtc-sfu/recorder"
+)
+
+// GET /api/recordings
+func listRecordings(c *gin.Context) {
+	c.JSON(http.StatusOK, recorder.ListRecordings())
+}
+
+// GET /api/recordings/:session
+func getRecording(c *gin.Context) {
+	status, ok := recorder.GetRecording(c.Param("session"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "session is not recorded"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// POST /api/recordings/:session -- files are created once the session receives packets
+func startRecording(c *gin.Context) {
+	if err := recorder.StartRecording(c.Param("session")); err != nil {
+		if errors.Is(err, recorder.ErrRecording) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status, _ := recorder.GetRecording(c.Param("session"))
+	c.JSON(http.StatusCreated, status)
+}
+
+// DELETE /api/recordings/:session -- closes the files of the session
+func stopRecording(c *gin.Context) {
+	if err := recorder.StopRecording(c.Param("session")); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,43 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"pion-webrtc-sfu/relay"
+)
+
+// GET /api/relays
+func listRelayTargets(c *gin.Context) {
+	c.JSON(http.StatusOK, relay.ListTargets())
+}
+
+// GET /api/relays/:session
+func getRelayTargets(c *gin.Context) {
+	c.JSON(http.StatusOK, relay.SessionTargets(c.Param("session")))
+}
+
+// POST /api/relays/:session -- forwards every packet of the session to the target address
+func createRelayTarget(c *gin.Context) {
+	var target relay.Target
+	if err := c.ShouldBindJSON(&target); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	status, err := relay.AddTarget(c.Param("session"), target)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, status)
+}
+
+// DELETE /api/relays/:session/:id
+func deleteRelayTarget(c *gin.Context) {
+	if err := relay.RemoveTarget(c.Param("session"), c.Param("id")); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,54 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/writer"
+)
+
+// GET /api/rtsp
+func listRtspSources(c *gin.Context) {
+	c.JSON(http.StatusOK, writer.ListRtspSources())
+}
+
+// POST /api/rtsp -- starts pulling the camera into the session with the source name
+func createRtspSource(c *gin.Context, config *configuration.Configuration) {
+	var source writer.RtspSource
+	if err := c.ShouldBindJSON(&source); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := writer.AddRtspSource(config, source); err != nil {
+		if errors.Is(err, writer.ErrRtspSourceExists) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	status, _ := writer.GetRtspSource(source.Name)
+	c.JSON(http.StatusCreated, status)
+}
+
+// GET /api/rtsp/:name
+func getRtspSource(c *gin.Context) {
+	status, ok := writer.GetRtspSource(c.Param("name"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "rtsp source not found"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// DELETE /api/rtsp/:name
+func deleteRtspSource(c *gin.Context) {
+	if !writer.RemoveRtspSource(c.Param("name")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "rtsp source not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,38 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"pion-webrtc-sfu/slate"
+)
+
+// GET /api/slates
+func listSlates(c *gin.Context) {
+	c.JSON(http.StatusOK, slate.List())
+}
+
+// PUT /api/slates/:session -- files are read by the server, "*" sets the default slate
+func putSlate(c *gin.Context) {
+	var s slate.Slate
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.Session = c.Param("session")
+	if err := slate.Set(s); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// DELETE /api/slates/:session -- a slate already playing continues until the stream resumes
+func deleteSlate(c *gin.Context) {
+	if !slate.Remove(c.Param("session")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "slate not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,98 @@
+package http
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"pion-webrtc-sfu/auth"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/sessions"
+	"pion-webrtc-sfu/user"
+)
+
+// token lifetime if none is requested
+const defaultTokenTTL = time.Hour
+
+// body of POST /api/tokens
+type tokenRequest struct {
+	Session    string `json:"session" binding:"required"`
+	User       string `json:"user" binding:"required"`
+	Role       string `json:"role"`
+	ID         string `json:"id"`
+	TTLSeconds uint   `json:"ttl_seconds"`
+}
+
+// POST /api/tokens -- sign a /ws token for backends that can't create them themselves
+func issueToken(c *gin.Context) {
+	if !auth.TokensRequired() {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "HTTP_WS_TOKEN_SECRET not set"})
+		return
+	}
+	var req tokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	switch req.Role {
+	case "":
+		req.Role = auth.RoleViewer
+	case auth.RoleViewer, auth.RoleModerator:
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "role must be viewer or moderator"})
+		return
+	}
+	ttl := defaultTokenTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	expiry := time.Now().Add(ttl).Unix()
+	token, err := auth.Issue(auth.Claims{Session: req.Session, User: req.User, Role: req.Role, Expiry: expiry, ID: req.ID})
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"token": token, "expires": expiry})
+}
+
+// GET /api/revocations
+func listRevocations(c *gin.Context) {
+	c.JSON(http.StatusOK, auth.ListRevocations())
+}
+
+// POST /api/revocations -- reject a token id or user from now on, connected users holding it are kicked
+func createRevocation(c *gin.Context) {
+	var r auth.Revocation
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := auth.Revoke(r); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	kicked := sessions.KickUsers(func(u *user.User) bool {
+		return r.Matches(auth.Claims{User: u.Uuid, ID: u.TokenID}) && u.Role != ""
+	})
+	logging.With("token_id", r.TokenID, "user_id", r.User).Infof("revoked, kicked %v connected users", kicked)
+	c.JSON(http.StatusCreated, r)
+}
+
+// DELETE /api/revocations/tokens/:id
+func deleteTokenRevocation(c *gin.Context) {
+	deleteRevocation(c, auth.Revocation{TokenID: c.Param("id")})
+}
+
+// DELETE /api/revocations/users/:user
+func deleteUserRevocation(c *gin.Context) {
+	deleteRevocation(c, auth.Revocation{User: c.Param("user")})
+}
+
+func deleteRevocation(c *gin.Context, r auth.Revocation) {
+	if !auth.Unrevoke(r) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "revocation not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
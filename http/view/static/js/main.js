@@ -37,11 +37,14 @@ window.onload = function (){
 window.startWS = () => {
     let ssrc = document.getElementById("ssrc").value;
     if (ssrc == "") {
-        console.log("ssrc not provided!")
+        console.log("session name not provided!")
         return
     }
     let uuid = document.getElementById("uuid").innerText;
-    window.ws = new WebSocket(`${location.protocol === 'https:' ? 'wss' : 'ws'}://${window.location.hostname}:${window.location.port}/ws?sid=${ssrc}&uid=${uuid}`);
+    // a token in the page url is passed on instead, it carries session and user
+    let token = new URLSearchParams(window.location.search).get("token");
+    let query = token ? `token=${encodeURIComponent(token)}` : `sid=${encodeURIComponent(ssrc)}&uid=${uuid}`;
+    window.ws = new WebSocket(`${location.protocol === 'https:' ? 'wss' : 'ws'}://${window.location.hostname}:${window.location.port}/ws?${query}`);
     window.ws.onopen = function (evt) {
         console.log("OPENED WS");
         // enable rtc button
@@ -72,6 +75,16 @@ window.startWS = () => {
                 window.pc.addIceCandidate(responseJson.payload).then(() => {
                     console.log("Added new Ice candidate:");
                 });
+            } else if (responseJson.type == "waiting") { // session has no live stream yet
+                console.log("waiting for the stream to start");
+            } else if (responseJson.type == "streamstarted") {
+                console.log("stream started");
+            } else if (responseJson.type == "streamstalled") { // encoder stopped sending, the video freezes
+                console.log(responseJson.payload.kind + " stalled");
+            } else if (responseJson.type == "streamresumed") {
+                console.log(responseJson.payload.kind + " resumed");
+            } else if (responseJson.type == "streamended") {
+                console.log("stream ended");
             } else if (responseJson.type == "pong") {
             } else {
                 console.log("unknown type received: " + responseJson.type);
@@ -94,3 +107,15 @@ window.startRTC = () => {
         type: "startrtc",
     }));
 };
+
+// select simulcast layer, no argument for automatic selection
+window.setLayer = (layer) => {
+    if (window.ws === null) {
+        console.log("ws not created yet!")
+        return
+    }
+    window.ws.send(JSON.stringify({
+        type: "setlayer",
+        payload: layer === undefined ? {auto: true} : {layer: layer},
+    }));
+};
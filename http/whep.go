@@ -0,0 +1,120 @@
+package http
+
+import (
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/randutil"
+
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/sessions"
+	"pion-webrtc-sfu/user"
+	"pion-webrtc-sfu/webrtc"
+)
+
+// characters of generated whep user ids
+const whepIDCharset = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+/*
+register WHEP playback endpoints, viewers share sessions with websocket viewers
+with HTTP_WS_TOKEN_SECRET set, requests need a bearer token issued for the session
+*/
+func registerWhep(router *gin.Engine, config *configuration.Configuration) {
+	router.POST("/whep/:session", rejectWhileDraining, authorizeViewer(false), func(c *gin.Context) {
+		createWhepClient(c, config)
+	})
+	router.PATCH("/whep/:session/:id", authorizeViewer(false), patchWhepClient)
+	router.DELETE("/whep/:session/:id", authorizeViewer(false), deleteWhepClient)
+}
+
+// POST /whep/:session -- sdp offer in, sdp answer out
+func createWhepClient(c *gin.Context, config *configuration.Configuration) {
+	sid := c.Param("session")
+	if !hasContentType(c, "application/sdp") {
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "offer must be application/sdp"})
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSdpSize))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, err := randutil.GenerateCryptoRandomString(16, whepIDCharset)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// create user without websocket
+	u := user.NewUser(userID, config)
+	u.State.SetWsState(user.Done)
+	claims := viewerClaims(c)
+	u.Role, u.TokenID = claims.Role, claims.ID
+	if status, err := joinSession(config, sid, &u); err != nil {
+		logging.With("session_id", sid, "user_id", userID).Warnf("could not join session: %v", err)
+		c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	rtcClient, answer, err := webrtc.NewWhepClient(config, &u, sid, string(offer))
+	if err != nil {
+		logging.With("session_id", sid, "user_id", userID).Warnf("got error creating whep client: %v", err)
+		// remove user again
+		sessions.UpdateSessions()
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// start rtc loop
+	go rtcClient.Loop(config, sid)
+	c.Header("Location", "/whep/"+sid+"/"+userID)
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// PATCH /whep/:session/:id -- trickle ice candidates of the player
+func patchWhepClient(c *gin.Context) {
+	rtcClient := getWhepClient(c)
+	if rtcClient == nil {
+		return
+	}
+	if !hasContentType(c, "application/trickle-ice-sdpfrag") {
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "candidates must be application/trickle-ice-sdpfrag"})
+		return
+	}
+	fragment, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSdpSize))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rtcClient.AddRemoteCandidates(string(fragment)); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /whep/:session/:id -- stop playback and leave the session
+func deleteWhepClient(c *gin.Context) {
+	rtcClient := getWhepClient(c)
+	if rtcClient == nil {
+		return
+	}
+	rtcClient.Stop()
+	c.Status(http.StatusOK)
+}
+
+// return whep client of the request, aborts with 404 if it does not exist in the session
+func getWhepClient(c *gin.Context) *webrtc.WebrtcClient {
+	rtcClient := webrtc.GetWhepClient(c.Param("session"), c.Param("id"))
+	if rtcClient == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "viewer not found"})
+		return nil
+	}
+	return rtcClient
+}
+
+// check the media type of the request body
+func hasContentType(c *gin.Context, expected string) bool {
+	mediaType, _, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	return err == nil && mediaType == expected
+}
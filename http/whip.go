@@ -0,0 +1,88 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/webrtc"
+)
+
+// largest sdp offer accepted from publishers
+const maxSdpSize = 64 * 1024
+
+// register WHIP ingest endpoints, only enabled if a whip token is configured
+func registerWhip(router *gin.Engine, config *configuration.Configuration) {
+	if config.Http_whip_token == "" {
+		logging.Infof("HTTP_WHIP_TOKEN not set, whip ingest is disabled")
+		return
+	}
+	whip := router.Group("/whip", apiAuth(config.Http_whip_token))
+	whip.POST("/:session", rejectWhileDraining, func(c *gin.Context) {
+		createWhipPublisher(c, config)
+	})
+	whip.PATCH("/:session/:id", patchWhipPublisher)
+	whip.DELETE("/:session/:id", deleteWhipPublisher)
+}
+
+// POST /whip/:session -- sdp offer in, sdp answer out, ?backup=true publishes the backup of the session
+func createWhipPublisher(c *gin.Context, config *configuration.Configuration) {
+	sid := c.Param("session")
+	if !hasContentType(c, "application/sdp") {
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "offer must be application/sdp"})
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSdpSize))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	backup := c.Query("backup") == "true"
+	publisher, answer, err := webrtc.NewWhipPublisher(config, sid, backup, string(offer))
+	if err != nil {
+		logging.With("session_id", sid).Warnf("could not create whip publisher: %v", err)
+		if errors.Is(err, webrtc.ErrSessionPublished) || errors.Is(err, webrtc.ErrSessionBackupPublished) {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logging.With("session_id", sid, "publisher_id", publisher.ID, "backup", backup).Infof("whip publisher created")
+	c.Header("Location", "/whip/"+sid+"/"+publisher.ID)
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// PATCH /whip/:session/:id -- trickle ice is not supported, candidates are part of the offer and answer
+func patchWhipPublisher(c *gin.Context) {
+	if getWhipPublisher(c) == nil {
+		return
+	}
+	c.AbortWithStatus(http.StatusMethodNotAllowed)
+}
+
+// DELETE /whip/:session/:id -- stop ingesting
+func deleteWhipPublisher(c *gin.Context) {
+	publisher := getWhipPublisher(c)
+	if publisher == nil {
+		return
+	}
+	if err := publisher.Close(); err != nil {
+		logging.With("session_id", publisher.SessionID, "publisher_id", publisher.ID).Errorf("could not close whip publisher: %v", err)
+	}
+	c.Status(http.StatusOK)
+}
+
+// return publisher of the request, aborts with 404 if it does not exist in the session
+func getWhipPublisher(c *gin.Context) *webrtc.WhipPublisher {
+	publisher := webrtc.GetWhipPublisher(c.Param("id"))
+	if publisher == nil || publisher.SessionID != c.Param("session") {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "publisher not found"})
+		return nil
+	}
+	return publisher
+}
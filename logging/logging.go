@@ -0,0 +1,244 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// severity of a log line, lines below the configured level are dropped
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// parse a level name as used in the configuration
+func ParseLevel(name string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q, must be debug, info, warn or error", name)
+}
+
+// output settings shared by all loggers
+var (
+	mutex      sync.Mutex // serializes writes, protects below settings
+	output     io.Writer  = os.Stderr
+	level                 = LevelInfo
+	jsonFormat            = false
+)
+
+/*
+set level and format (logfmt or json) of all log lines
+the standard logger is redirected, its lines are written at info level
+*/
+func Init(levelName string, format string) error {
+	l, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	var useJSON bool
+	switch strings.ToLower(format) {
+	case "logfmt":
+	case "json":
+		useJSON = true
+	default:
+		return fmt.Errorf("invalid log format %q, must be logfmt or json", format)
+	}
+	mutex.Lock()
+	level, jsonFormat = l, useJSON
+	mutex.Unlock()
+	log.SetFlags(log.Lshortfile)
+	log.SetPrefix("")
+	log.SetOutput(stdWriter{})
+	return nil
+}
+
+// true if lines of the level are written, to skip building expensive debug messages
+func Enabled(l Level) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return l >= level
+}
+
+// key value pair attached to every line of a logger
+type field struct {
+	key   string
+	value interface{}
+}
+
+// writes lines carrying a fixed set of fields, like the session and user a line is about
+type Logger struct {
+	fields []field
+}
+
+// logger without fields
+var root = &Logger{}
+
+/*
+logger with additional fields, given as alternating keys and values
+e.g. logging.With("session_id", sid, "user_id", uid)
+*/
+func With(keyvals ...interface{}) *Logger {
+	return root.With(keyvals...)
+}
+
+// logger with the fields of l and the given ones
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+len(keyvals)/2)
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields = append(fields, field{key: fmt.Sprint(keyvals[i]), value: keyvals[i+1]})
+	}
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args...) }
+
+func Debugf(format string, args ...interface{}) { root.logf(LevelDebug, format, args...) }
+func Infof(format string, args ...interface{})  { root.logf(LevelInfo, format, args...) }
+func Warnf(format string, args ...interface{})  { root.logf(LevelWarn, format, args...) }
+func Errorf(format string, args ...interface{}) { root.logf(LevelError, format, args...) }
+
+// log at error level and exit
+func Fatalf(format string, args ...interface{}) {
+	root.logf(LevelError, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(lvl Level, format string, args ...interface{}) {
+	if !Enabled(lvl) {
+		return
+	}
+	// skip logf and the level method
+	caller := ""
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = shortPath(file) + ":" + strconv.Itoa(line)
+	}
+	write(lvl, caller, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"), l.fields)
+}
+
+// package directory and file name of a source file
+func shortPath(file string) string {
+	dir, name := filepath.Split(file)
+	return filepath.Base(dir) + "/" + name
+}
+
+func write(lvl Level, caller string, msg string, fields []field) {
+	var b bytes.Buffer
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	mutex.Lock()
+	defer mutex.Unlock()
+	if jsonFormat {
+		b.WriteString("{")
+		writeJSON(&b, "time", now)
+		b.WriteString(",")
+		writeJSON(&b, "level", lvl.String())
+		if caller != "" {
+			b.WriteString(",")
+			writeJSON(&b, "caller", caller)
+		}
+		b.WriteString(",")
+		writeJSON(&b, "msg", msg)
+		for _, f := range fields {
+			b.WriteString(",")
+			writeJSON(&b, f.key, f.value)
+		}
+		b.WriteString("}\n")
+	} else {
+		b.WriteString("time=" + now + " level=" + lvl.String())
+		if caller != "" {
+			b.WriteString(" caller=" + caller)
+		}
+		b.WriteString(" msg=")
+		writeLogfmtValue(&b, msg)
+		for _, f := range fields {
+			b.WriteString(" " + f.key + "=")
+			writeLogfmtValue(&b, fmt.Sprint(f.value))
+		}
+		b.WriteString("\n")
+	}
+	output.Write(b.Bytes())
+}
+
+func writeJSON(b *bytes.Buffer, key string, value interface{}) {
+	// errors and stringers would be marshaled as objects
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(k)
+	b.WriteString(":")
+	b.Write(v)
+}
+
+// values with spaces, quotes, equal signs or control characters are quoted
+func writeLogfmtValue(b *bytes.Buffer, value string) {
+	if value == "" {
+		b.WriteString(`""`)
+		return
+	}
+	for _, r := range value {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError {
+			b.WriteString(strconv.Quote(value))
+			return
+		}
+	}
+	b.WriteString(value)
+}
+
+// receives lines of the standard logger ("file.go:12: message") from packages logging without context
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	if !Enabled(LevelInfo) {
+		return len(p), nil
+	}
+	msg := strings.TrimSuffix(string(p), "\n")
+	caller := ""
+	if location, rest, ok := strings.Cut(msg, ": "); ok && strings.Contains(location, ".go:") {
+		caller, msg = location, rest
+	}
+	write(LevelInfo, caller, msg, nil)
+	return len(p), nil
+}
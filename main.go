@@ -1,35 +1,95 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"pion-webrtc-sfu/auth"
 	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/hls"
 	"pion-webrtc-sfu/http"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/recorder"
 	"pion-webrtc-sfu/sessions"
+	"pion-webrtc-sfu/slate"
+	"pion-webrtc-sfu/webrtc"
 	"pion-webrtc-sfu/writer"
-	"runtime"
+	"syscall"
 	"time"
 )
 
 func main() {
-	// set logger flags
-	log.SetFlags(log.Ldate | log.Ltime | log.Llongfile)
 	// load configuration from file
 	conf, err := configuration.CreateConfiguration()
 	if err != nil {
 		log.Fatal(err)
 	}
+	// structured log lines from here on
+	if err := logging.Init(conf.Server_log_level, conf.Server_log_format); err != nil {
+		log.Fatal(err)
+	}
 	configuration.PrintConfiguration(conf)
+	// websocket tokens and allowed origins
+	if err := auth.InitAuth(conf); err != nil {
+		logging.Fatalf("%v", err)
+	}
 	// initiate empty sessions
-	sessions.InitSessions()
+	if err := sessions.InitSessions(conf); err != nil {
+		logging.Fatalf("%v", err)
+	}
+	// clips for stalled sessions
+	if err := slate.InitSlates(conf); err != nil {
+		logging.Fatalf("%v", err)
+	}
+	// start recording sessions from configuration
+	if err := recorder.InitRecorder(conf); err != nil {
+		logging.Fatalf("%v", err)
+	}
+	// segment h264 sessions for hls playback
+	hls.InitHls(conf)
+	// start pulling rtsp cameras
+	if err := writer.StartRtspSources(conf); err != nil {
+		logging.Fatalf("%v", err)
+	}
+	// start listening for mpeg-ts streams
+	if err := writer.StartMpegtsSources(conf); err != nil {
+		logging.Fatalf("%v", err)
+	}
 	go writer.StartVideoWriterLoop(conf)
 	go writer.StartAudioWriterLoop(conf)
-	go http.ServeHttp(conf)
-	var m runtime.MemStats
-	for {
-		runtime.ReadMemStats(&m)
-		log.SetPrefix("\r") // to override goroutine counter if it exists
-		fmt.Printf("\rNumber of goroutines: %d, Alloc = %vB, TAlloc = %vB, Sys = %vB", runtime.NumGoroutine(), m.Alloc/1024, m.TotalAlloc/1024, m.Sys/1024)
-		time.Sleep(time.Second * 15)
+	go writer.StartRtmpServer(conf)
+	http.ServeHttp(conf)
+	// drain on SIGTERM (deploys) and ctrl-c, a second signal exits immediately
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	logging.Infof("received %v, shutting down", <-signals)
+	go func() {
+		logging.Warnf("received %v, exiting without draining", <-signals)
+		os.Exit(1)
+	}()
+	shutdown(conf)
+}
+
+/*
+stop ingest, tell viewers to reconnect and wait for them to disconnect
+recordings are closed after the sessions drained or the deadline passed
+*/
+func shutdown(conf *configuration.Configuration) {
+	timeout := time.Second * time.Duration(conf.Server_shutdown_timeout_seconds)
+	deadline := time.Now().Add(timeout)
+	http.Drain()
+	writer.StopIngest()
+	webrtc.CloseWhipPublishers()
+	sessions.Shutdown(conf.Server_shutdown_reconnect_hint)
+	if !sessions.WaitForDrain(time.Until(deadline)) {
+		logging.Warnf("sessions did not drain within %v, exiting anyway", timeout)
+	}
+	recorder.Shutdown()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := http.Shutdown(ctx); err != nil {
+		logging.Warnf("http server did not shut down cleanly: %v", err)
 	}
+	logging.Infof("shutdown complete")
 }
@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+minimal prometheus registry written in the text exposition format
+counters are updated by the pipeline, gauges are collected when scraped
+*/
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// registered metrics by name
+var registry = make(map[string]metric)
+
+// mutex for above map read/write
+var mutex sync.Mutex
+
+func register(m metric) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, exists := registry[m.name()]; exists {
+		panic("metric " + m.name() + " registered twice")
+	}
+	registry[m.name()] = m
+}
+
+// monotonically increasing value per combination of label values
+type CounterVec struct {
+	metricName string
+	help       string
+	labels     []string
+	mu         sync.Mutex // protects below values
+	values     map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// create and register a counter, label values are passed in the same order to Add
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		values:     make(map[string]*counterValue),
+	}
+	// counters without labels are exported as 0 before the first increment
+	if len(labels) == 0 {
+		c.values[""] = &counterValue{}
+	}
+	register(c)
+	return c
+}
+
+// increment the counter of the label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// increase the counter of the label values, negative values are ignored
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labelValues: append([]string(nil), labelValues...)}
+		c.values[key] = v
+	}
+	v.value += value
+}
+
+func (c *CounterVec) name() string { return c.metricName }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	samples := make([]Sample, 0, len(c.values))
+	for _, v := range c.values {
+		samples = append(samples, Sample{Value: v.value, LabelValues: v.labelValues})
+	}
+	c.mu.Unlock()
+	writeFamily(w, c.metricName, c.help, "counter", c.labels, samples)
+}
+
+// value of a collected metric
+type Sample struct {
+	Value       float64
+	LabelValues []string
+}
+
+// metric whose samples are collected by a function on every scrape
+type funcMetric struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+	collect    func() []Sample
+}
+
+// create and register a gauge, collect is called on every scrape and must be safe for concurrent use
+func NewGaugeFunc(name string, help string, labels []string, collect func() []Sample) {
+	register(&funcMetric{metricName: name, help: help, kind: "gauge", labels: labels, collect: collect})
+}
+
+// like NewGaugeFunc for values that only increase, like totals kept by the runtime
+func NewCounterFunc(name string, help string, labels []string, collect func() []Sample) {
+	register(&funcMetric{metricName: name, help: help, kind: "counter", labels: labels, collect: collect})
+}
+
+func (f *funcMetric) name() string { return f.metricName }
+
+func (f *funcMetric) write(w io.Writer) {
+	writeFamily(w, f.metricName, f.help, f.kind, f.labels, f.collect())
+}
+
+// write all registered metrics sorted by name
+func WriteTo(w io.Writer) {
+	mutex.Lock()
+	list := make([]metric, 0, len(registry))
+	for _, m := range registry {
+		list = append(list, m)
+	}
+	mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name() < list[j].name() })
+	for _, m := range list {
+		m.write(w)
+	}
+}
+
+func writeFamily(w io.Writer, name string, help string, kind string, labels []string, samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, "\xff") < strings.Join(samples[j].LabelValues, "\xff")
+	})
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		io.WriteString(w, name)
+		if len(labels) > 0 {
+			io.WriteString(w, "{")
+			for i, label := range labels {
+				value := ""
+				if i < len(s.LabelValues) {
+					value = s.LabelValues[i]
+				}
+				if i > 0 {
+					io.WriteString(w, ",")
+				}
+				fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabel(value))
+			}
+			io.WriteString(w, "}")
+		}
+		fmt.Fprintf(w, " %s\n", formatValue(s.Value))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	case value == math.Trunc(value) && math.Abs(value) < 1e15:
+		// counts without exponent
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,28 @@
+package metrics
+
+// counters updated along the pipeline, from ingest to the viewers
+var (
+	// rtp received on the udp ingest ports, session is empty for unbound ssrcs
+	IngestPackets = NewCounterVec("sfu_ingest_packets_total", "RTP packets received on the UDP ingest ports.", "port", "session")
+	IngestBytes   = NewCounterVec("sfu_ingest_bytes_total", "RTP bytes received on the UDP ingest ports.", "port", "session")
+	// datagrams too short to carry an rtp header
+	IngestMalformed = NewCounterVec("sfu_ingest_malformed_drops_total", "UDP datagrams dropped because they are too short for an RTP header.", "port")
+	// packets dropped because their ssrc is not bound to a stream key
+	IngestUnknownSSRC = NewCounterVec("sfu_ingest_unknown_ssrc_drops_total", "RTP packets dropped because their SSRC is not bound to a session.", "port")
+	// failed writes to viewer peerconnections by track kind
+	EgressWriteErrors = NewCounterVec("sfu_egress_write_errors_total", "Failed writes of RTP packets to viewer peerconnections.", "track")
+	// role is viewer, publisher (whip) or origin (edge link)
+	PeerConnectionStates = NewCounterVec("sfu_peerconnection_state_changes_total", "PeerConnection state transitions by role and new state.", "role", "state")
+	// rtcp of viewers read in processVRTCP/processARTCP
+	RTCPPackets = NewCounterVec("sfu_rtcp_packets_total", "RTCP packets received from viewers by track and type.", "track", "type")
+	// sequence numbers listed in NACKs of viewers
+	NackedPackets = NewCounterVec("sfu_nack_packets_total", "RTP packets requested for retransmission by viewers.", "track")
+	// combined and throttled PLI/FIR requests sent to the sources
+	KeyframeRequests = NewCounterVec("sfu_keyframe_requests_total", "Keyframe requests (PLI and FIR) sent to the sources of sessions.")
+	// streamstarted, streamstalled, streamresumed and streamended of all sessions
+	StreamEvents = NewCounterVec("sfu_stream_events_total", "Stream state changes of sessions told to their viewers.", "event")
+	// switches between the primary and backup ingest of sessions by the source switched to
+	IngestFailovers = NewCounterVec("sfu_ingest_failovers_total", "Switches between the primary and the backup ingest of sessions.", "kind", "source")
+	// slates started on session tracks while their ingest stalled
+	SlatesPlayed = NewCounterVec("sfu_slates_played_total", "Fallback slates played to viewers while the ingest of a session stalled.", "kind")
+)
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// memory statistics stop the world, they are read at most once per scrape interval
+const memStatsMaxAge = time.Second
+
+var (
+	memStats     runtime.MemStats
+	memStatsRead time.Time
+	memStatsMu   sync.Mutex
+)
+
+func readMemStats() runtime.MemStats {
+	memStatsMu.Lock()
+	defer memStatsMu.Unlock()
+	if time.Since(memStatsRead) > memStatsMaxAge {
+		runtime.ReadMemStats(&memStats)
+		memStatsRead = time.Now()
+	}
+	return memStats
+}
+
+func single(value float64) []Sample {
+	return []Sample{{Value: value}}
+}
+
+// goroutine and memory statistics of the process
+func init() {
+	NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", nil, func() []Sample {
+		return single(float64(runtime.NumGoroutine()))
+	})
+	NewGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", nil, func() []Sample {
+		return single(float64(readMemStats().Alloc))
+	})
+	NewCounterFunc("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", nil, func() []Sample {
+		return single(float64(readMemStats().TotalAlloc))
+	})
+	NewGaugeFunc("go_memstats_sys_bytes", "Number of bytes obtained from the system.", nil, func() []Sample {
+		return single(float64(readMemStats().Sys))
+	})
+	NewGaugeFunc("go_memstats_heap_objects", "Number of allocated objects.", nil, func() []Sample {
+		return single(float64(readMemStats().HeapObjects))
+	})
+	NewCounterFunc("go_gc_cycles_total", "Number of completed garbage collection cycles.", nil, func() []Sample {
+		return single(float64(readMemStats().NumGC))
+	})
+}
@@ -0,0 +1,120 @@
+package recorder
+
+import (
+	"errors"
+)
+
+// av1 obu types and header bits
+const (
+	av1ObuTemporalDelimiter = 2
+	av1ObuTileList          = 8
+	av1ObuHasSize           = 0x02
+	av1ObuHasExtension      = 0x04
+)
+
+var errAV1ShortPacket = errors.New("av1 packet too short")
+
+/*
+depacketizes av1 rtp payloads into the low overhead bitstream format stored in ivf files
+obus fragmented over several packets are joined, every obu gets a size field
+*/
+type av1Depacketizer struct {
+	fragment []byte // start of an obu continued in the next packet
+}
+
+func (d *av1Depacketizer) Unmarshal(payload []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		return nil, errAV1ShortPacket
+	}
+	// aggregation header: continuation of previous obu (Z), continued in next packet (Y), element count (W)
+	z, y, w := payload[0]&0x80 != 0, payload[0]&0x40 != 0, int(payload[0]>>4&0x03)
+	elements := make([][]byte, 0, 4)
+	for offset := 1; offset < len(payload); {
+		size := len(payload) - offset
+		// the last of W elements has no length field
+		if w == 0 || len(elements) < w-1 {
+			value, n := readLeb128(payload[offset:])
+			if n == 0 {
+				return nil, errAV1ShortPacket
+			}
+			offset += n
+			size = int(value)
+		}
+		if size > len(payload)-offset || size < 0 {
+			return nil, errAV1ShortPacket
+		}
+		elements = append(elements, payload[offset:offset+size])
+		offset += size
+	}
+	out := make([]byte, 0, len(payload)+8)
+	for i, element := range elements {
+		if i == 0 {
+			if z {
+				element = append(d.fragment, element...)
+			}
+			d.fragment = nil
+		}
+		if i == len(elements)-1 && y {
+			d.fragment = append([]byte(nil), element...)
+			continue
+		}
+		out = appendObu(out, element)
+	}
+	return out, nil
+}
+
+// start of a temporal unit if it does not continue an obu of the previous packet
+func (d *av1Depacketizer) IsPartitionHead(payload []byte) bool {
+	return len(payload) > 0 && payload[0]&0x80 == 0
+}
+
+func (d *av1Depacketizer) IsPartitionTail(marker bool, payload []byte) bool {
+	return marker
+}
+
+// append an obu with a size field, temporal delimiters and tile lists are dropped
+func appendObu(out []byte, obu []byte) []byte {
+	if len(obu) == 0 {
+		return out
+	}
+	obuType := obu[0] >> 3 & 0x0F
+	if obuType == av1ObuTemporalDelimiter || obuType == av1ObuTileList {
+		return out
+	}
+	if obu[0]&av1ObuHasSize != 0 {
+		return append(out, obu...)
+	}
+	headerSize := 1
+	if obu[0]&av1ObuHasExtension != 0 {
+		headerSize = 2
+	}
+	if len(obu) < headerSize {
+		return out
+	}
+	out = append(out, obu[0]|av1ObuHasSize)
+	out = append(out, obu[1:headerSize]...)
+	out = appendLeb128(out, uint64(len(obu)-headerSize))
+	return append(out, obu[headerSize:]...)
+}
+
+// value and number of bytes read, 0 bytes if the value is truncated
+func readLeb128(b []byte) (uint64, int) {
+	var value uint64
+	for i := 0; i < len(b) && i < 8; i++ {
+		value |= uint64(b[i]&0x7F) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+func appendLeb128(b []byte, value uint64) []byte {
+	for {
+		if value < 0x80 {
+			return append(b, byte(value))
+		}
+		b = append(b, byte(value&0x7F)|0x80)
+		value >>= 7
+	}
+}
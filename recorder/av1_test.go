@@ -0,0 +1,141 @@
+package recorder
+
+import (
+	"bytes"
+	"testing"
+)
+
+// obu headers and aggregation header bits used by the tests
+const (
+	testObuSequenceHeader = 1 << 3
+	testObuTemporal       = av1ObuTemporalDelimiter << 3
+	testObuFrame          = 6 << 3
+	testObuFrameWithSize  = testObuFrame | av1ObuHasSize
+	testObuFrameExtension = testObuFrame | av1ObuHasExtension
+	testAggregationZ      = 0x80 // continues an obu
+	testAggregationY      = 0x40 // continued in the next packet
+	testAggregationW1     = 1 << 4
+	testAggregationW2     = 2 << 4
+)
+
+func TestAV1Depacketizer(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets [][]byte
+		want    [][]byte // output of every packet
+	}{
+		{
+			"single obu",
+			[][]byte{{testAggregationW1, testObuFrame, 1, 2, 3}},
+			[][]byte{{testObuFrameWithSize, 3, 1, 2, 3}},
+		},
+		{
+			"two obus, the last without length",
+			[][]byte{{testAggregationW2, 4, testObuSequenceHeader, 9, 9, 9, testObuFrame, 1}},
+			[][]byte{{testObuSequenceHeader | av1ObuHasSize, 3, 9, 9, 9, testObuFrameWithSize, 1, 1}},
+		},
+		{
+			"obus with lengths, temporal delimiter dropped",
+			[][]byte{{0, 1, testObuTemporal, 2, testObuFrame, 7}},
+			[][]byte{{testObuFrameWithSize, 1, 7}},
+		},
+		{
+			"extension header",
+			[][]byte{{testAggregationW1, testObuFrameExtension, 0xE8, 5, 6}},
+			[][]byte{{testObuFrameExtension | av1ObuHasSize, 0xE8, 2, 5, 6}},
+		},
+		{
+			"obu with size field is kept",
+			[][]byte{{testAggregationW1, testObuFrameWithSize, 1, 5}},
+			[][]byte{{testObuFrameWithSize, 1, 5}},
+		},
+		{
+			"obu fragmented over three packets",
+			[][]byte{
+				{testAggregationY | testAggregationW1, testObuFrame, 1, 2},
+				{testAggregationZ | testAggregationY | testAggregationW1, 3},
+				{testAggregationZ | testAggregationW2, 2, 4, 5, testObuFrame, 6},
+			},
+			[][]byte{{}, {}, {testObuFrameWithSize, 5, 1, 2, 3, 4, 5, testObuFrameWithSize, 1, 6}},
+		},
+		{
+			"continuation without a start",
+			[][]byte{{testAggregationZ | testAggregationW1, testObuFrame, 1}},
+			[][]byte{{testObuFrameWithSize, 1, 1}},
+		},
+		{
+			"size above 127 uses two leb128 bytes",
+			[][]byte{{testAggregationW1, testObuFrame}},
+			[][]byte{{testObuFrameWithSize, 0x80 | 200&0x7F, 1}},
+		},
+	}
+	// 200 payload bytes for the leb128 case
+	tests[len(tests)-1].packets[0] = append(tests[len(tests)-1].packets[0], make([]byte, 200)...)
+	tests[len(tests)-1].want[0] = append(tests[len(tests)-1].want[0], make([]byte, 200)...)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &av1Depacketizer{}
+			for i, packet := range test.packets {
+				got, err := d.Unmarshal(packet)
+				if err != nil {
+					t.Fatalf("packet %v: %v", i, err)
+				}
+				if !bytes.Equal(got, test.want[i]) {
+					t.Errorf("packet %v: got %x, want %x", i, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAV1DepacketizerMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"aggregation header only", []byte{testAggregationW1}},
+		{"length beyond the packet", []byte{0, 9, testObuFrame}},
+		{"truncated length", []byte{0, 0x80}},
+		{"length of 2^56", []byte{0, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F, testObuFrame}},
+		{"length longer than 8 bytes", []byte{0, 0x81, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x00}},
+		{"second length beyond the packet", []byte{3 << 4, 1, testObuFrame, 5, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := (&av1Depacketizer{}).Unmarshal(test.packet); err == nil {
+				t.Error("unmarshaled without error")
+			}
+		})
+	}
+	// every prefix and corruption of valid packets, obus cut short are dropped
+	for _, packet := range [][]byte{
+		{testAggregationW2, 4, testObuSequenceHeader, 9, 9, 9, testObuFrameExtension, 1},
+		{0, 1, testObuTemporal, 2, testObuFrameExtension, 7},
+	} {
+		for size := 0; size <= len(packet); size++ {
+			(&av1Depacketizer{}).Unmarshal(packet[:size])
+		}
+		for i := range packet {
+			for _, b := range []byte{0, 0xFF, 0x80, 0x7F} {
+				corrupted := append([]byte{}, packet...)
+				corrupted[i] = b
+				d := &av1Depacketizer{fragment: []byte{testObuFrame}}
+				d.Unmarshal(corrupted)
+			}
+		}
+	}
+}
+
+func TestLeb128(t *testing.T) {
+	for _, value := range []uint64{0, 1, 127, 128, 200, 16383, 16384, 1<<32 + 5, 1<<56 - 1} {
+		encoded := appendLeb128(nil, value)
+		got, n := readLeb128(append(encoded, 0xAA))
+		if got != value || n != len(encoded) {
+			t.Errorf("%v encoded as %x read as %v from %v bytes", value, encoded, got, n)
+		}
+		if _, n := readLeb128(encoded[:len(encoded)-1]); n != 0 {
+			t.Errorf("%v truncated to %v bytes read %v bytes", value, len(encoded)-1, n)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/tracks"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// packets a sample builder waits for missing packets before dropping a frame
+const (
+	maxLateVideo = 256
+	maxLateAudio = 64
+)
+
+// writes the packets of one track to a file
+type trackWriter interface {
+	WriteRTP(packet *rtp.Packet) error
+	Close() error
+}
+
+/*
+a file per track: ivf for vp8/vp9/av1, annex b for h264 and ogg for opus
+tracks with other codecs are not recorded
+*/
+type trackFiles struct {
+	base       string
+	videoCodec string
+	audioCodec string
+	created    func(name string)
+	writers    map[webrtc.RTPCodecType]trackWriter
+	failed     map[webrtc.RTPCodecType]bool // codec not supported or file could not be created
+}
+
+func newTrackFiles(base string, videoCodec string, audioCodec string, created func(name string)) *trackFiles {
+	return &trackFiles{
+		base:       base,
+		videoCodec: videoCodec,
+		audioCodec: audioCodec,
+		created:    created,
+		writers:    make(map[webrtc.RTPCodecType]trackWriter),
+		failed:     make(map[webrtc.RTPCodecType]bool),
+	}
+}
+
+func (tf *trackFiles) write(kind webrtc.RTPCodecType, packet *rtp.Packet) error {
+	if tf.failed[kind] {
+		return nil
+	}
+	writer, exists := tf.writers[kind]
+	if !exists {
+		var name string
+		var err error
+		if writer, name, err = tf.create(kind); err != nil {
+			tf.failed[kind] = true
+			logging.Errorf("%v of recording %v is not recorded: %v", kind, tf.base, err)
+			return nil
+		}
+		tf.writers[kind] = writer
+		tf.created(name)
+	}
+	return writer.WriteRTP(packet)
+}
+
+// create the file of a track with the extension of its codec
+func (tf *trackFiles) create(kind webrtc.RTPCodecType) (trackWriter, string, error) {
+	codec := tf.videoCodec
+	if kind == webrtc.RTPCodecTypeAudio {
+		codec = tf.audioCodec
+	}
+	switch {
+	case strings.EqualFold(codec, webrtc.MimeTypeVP8):
+		return newFrameFile(tf.base+".ivf", codec, "VP80", &codecs.VP8Packet{})
+	case strings.EqualFold(codec, webrtc.MimeTypeVP9):
+		return newFrameFile(tf.base+".ivf", codec, "VP90", &codecs.VP9Packet{})
+	case strings.EqualFold(codec, webrtc.MimeTypeAV1):
+		return newFrameFile(tf.base+".ivf", codec, "AV01", &av1Depacketizer{})
+	case strings.EqualFold(codec, webrtc.MimeTypeH264):
+		return newFrameFile(tf.base+".h264", codec, "", &codecs.H264Packet{})
+	case strings.EqualFold(codec, webrtc.MimeTypeOpus):
+		writer, err := oggwriter.New(tf.base+".ogg", 48000, 2)
+		return writer, tf.base + ".ogg", err
+	}
+	return nil, "", fmt.Errorf("codec %v can not be recorded", codec)
+}
+
+func (tf *trackFiles) close() error {
+	var firstErr error
+	for _, writer := range tf.writers {
+		if err := writer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+/*
+depacketized video frames written as ivf (with fourcc) or as raw annex b stream (h264)
+writing starts at the first keyframe, ivf frames use the 90kHz rtp clock as timebase
+*/
+type frameFile struct {
+	file     *os.File
+	out      *bufio.Writer
+	builder  *samplebuilder.SampleBuilder
+	mimeType string
+	ivf      bool
+	started  bool // first keyframe was received
+	firstTs  uint32
+	lastPts  uint64
+	frames   uint32
+}
+
+func newFrameFile(name string, mimeType string, fourcc string, depacketizer rtp.Depacketizer) (*frameFile, string, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, "", err
+	}
+	ff := &frameFile{
+		file:     file,
+		out:      bufio.NewWriter(file),
+		builder:  samplebuilder.New(maxLateVideo, depacketizer, 90000),
+		mimeType: mimeType,
+		ivf:      fourcc != "",
+	}
+	if ff.ivf {
+		header := make([]byte, 32)
+		copy(header, "DKIF")
+		binary.LittleEndian.PutUint16(header[4:], 0)      // version
+		binary.LittleEndian.PutUint16(header[6:], 32)     // header size
+		copy(header[8:], fourcc)                          // dimensions are left to the decoder
+		binary.LittleEndian.PutUint32(header[16:], 90000) // timebase denominator
+		binary.LittleEndian.PutUint32(header[20:], 1)     // timebase numerator
+		if _, err := ff.out.Write(header); err != nil {
+			file.Close()
+			return nil, "", err
+		}
+	}
+	return ff, name, nil
+}
+
+func (ff *frameFile) WriteRTP(packet *rtp.Packet) error {
+	if !ff.started {
+		if !tracks.IsKeyframe(ff.mimeType, packet.Payload) {
+			return nil
+		}
+		ff.started = true
+		ff.firstTs = packet.Timestamp
+	}
+	ff.builder.Push(packet)
+	for {
+		sample, timestamp := ff.builder.PopWithTimestamp()
+		if sample == nil {
+			return nil
+		}
+		if err := ff.writeFrame(sample.Data, timestamp); err != nil {
+			return err
+		}
+	}
+}
+
+func (ff *frameFile) writeFrame(frame []byte, timestamp uint32) error {
+	if len(frame) == 0 {
+		return nil
+	}
+	if !ff.ivf {
+		_, err := ff.out.Write(frame)
+		return err
+	}
+	// every av1 temporal unit starts with a temporal delimiter
+	if strings.EqualFold(ff.mimeType, webrtc.MimeTypeAV1) {
+		frame = append([]byte{av1ObuTemporalDelimiter<<3 | av1ObuHasSize, 0}, frame...)
+	}
+	// timestamps only grow, wraps of the rtp clock are carried into the upper bits
+	pts := ff.lastPts&^0xFFFFFFFF | uint64(timestamp-ff.firstTs)
+	if pts+1<<31 < ff.lastPts {
+		pts += 1 << 32
+	}
+	ff.lastPts = pts
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header, uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], pts)
+	ff.frames++
+	if _, err := ff.out.Write(header); err != nil {
+		return err
+	}
+	_, err := ff.out.Write(frame)
+	return err
+}
+
+// flush and update the frame count of ivf files
+func (ff *frameFile) Close() error {
+	if err := ff.out.Flush(); err != nil {
+		ff.file.Close()
+		return err
+	}
+	if ff.ivf {
+		count := binary.LittleEndian.AppendUint32(nil, ff.frames)
+		if _, err := ff.file.WriteAt(count, 24); err != nil {
+			ff.file.Close()
+			return err
+		}
+	}
+	return ff.file.Close()
+}
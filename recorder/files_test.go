@@ -0,0 +1,239 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+func testPacket(seq uint16, timestamp uint32, marker bool, payload []byte) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp, Marker: marker},
+		Payload: payload,
+	}
+}
+
+// frames of an ivf file and its header fields
+func testReadIvf(t *testing.T, data []byte) (string, uint32, [][]byte, []uint64) {
+	if len(data) < 32 || string(data[:4]) != "DKIF" || binary.LittleEndian.Uint16(data[6:]) != 32 {
+		t.Fatalf("no ivf header in %x", data)
+	}
+	if binary.LittleEndian.Uint32(data[16:]) != 90000 || binary.LittleEndian.Uint32(data[20:]) != 1 {
+		t.Errorf("timebase %v/%v", binary.LittleEndian.Uint32(data[20:]), binary.LittleEndian.Uint32(data[16:]))
+	}
+	var frames [][]byte
+	var pts []uint64
+	for offset := 32; offset < len(data); {
+		if offset+12 > len(data) {
+			t.Fatalf("truncated frame header at %v", offset)
+		}
+		size := int(binary.LittleEndian.Uint32(data[offset:]))
+		pts = append(pts, binary.LittleEndian.Uint64(data[offset+4:]))
+		offset += 12
+		if offset+size > len(data) {
+			t.Fatalf("frame of %v bytes at %v beyond the file", size, offset)
+		}
+		frames = append(frames, data[offset:offset+size])
+		offset += size
+	}
+	return string(data[8:12]), binary.LittleEndian.Uint32(data[24:]), frames, pts
+}
+
+func TestFrameFile(t *testing.T) {
+	vp8Key, vp8Delta := []byte{0x10, 0x00, 0x9D, 0x01}, []byte{0x10, 0x01, 0x9E, 0x01}
+	av1Key := []byte{0x28, 2, 0x08, 1, 0x30, 2} // two obus: sequence header and frame
+	av1Delta := []byte{0x10, 0x30, 3}
+	tests := []struct {
+		name         string
+		mimeType     string
+		fourcc       string
+		depacketizer rtp.Depacketizer
+		packets      [][]byte // one frame per packet, each 3000 ticks apart
+		startTs      uint32
+		wantFrames   [][]byte
+		wantPts      []uint64
+	}{
+		{
+			"vp8 starts at the first keyframe",
+			webrtc.MimeTypeVP8, "VP80", &codecs.VP8Packet{},
+			[][]byte{vp8Delta, vp8Key, vp8Delta, vp8Delta},
+			1000,
+			[][]byte{{0x00, 0x9D, 0x01}, {0x01, 0x9E, 0x01}},
+			[]uint64{0, 3000},
+		},
+		{
+			"rtp timestamp wrap",
+			webrtc.MimeTypeVP8, "VP80", &codecs.VP8Packet{},
+			[][]byte{vp8Key, vp8Delta, vp8Delta, vp8Delta},
+			0xFFFFFFFF - 4000,
+			[][]byte{{0x00, 0x9D, 0x01}, {0x01, 0x9E, 0x01}, {0x01, 0x9E, 0x01}},
+			[]uint64{0, 3000, 6000},
+		},
+		{
+			"av1 temporal units start with a delimiter",
+			webrtc.MimeTypeAV1, "AV01", &av1Depacketizer{},
+			[][]byte{av1Key, av1Delta, av1Delta},
+			0,
+			[][]byte{{0x12, 0, 0x0A, 1, 1, 0x32, 1, 2}, {0x12, 0, 0x32, 1, 3}},
+			[]uint64{0, 3000},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "track.ivf")
+			ff, _, err := newFrameFile(name, test.mimeType, test.fourcc, test.depacketizer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the last frame is written once the packet after it arrived
+			for i, payload := range test.packets {
+				if err := ff.WriteRTP(testPacket(uint16(65530+i), test.startTs+uint32(i)*3000, true, payload)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ff.Close(); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fourcc, count, frames, pts := testReadIvf(t, data)
+			if fourcc != test.fourcc || int(count) != len(frames) {
+				t.Errorf("fourcc %v with frame count %v for %v frames", fourcc, count, len(frames))
+			}
+			if len(frames) != len(test.wantFrames) {
+				t.Fatalf("%v frames %x, want %x", len(frames), frames, test.wantFrames)
+			}
+			for i := range frames {
+				if !bytes.Equal(frames[i], test.wantFrames[i]) || pts[i] != test.wantPts[i] {
+					t.Errorf("frame %v is %x at %v, want %x at %v", i, frames[i], pts[i], test.wantFrames[i], test.wantPts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFrameFileAnnexB(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "track.h264")
+	ff, _, err := newFrameFile(name, webrtc.MimeTypeH264, "", &codecs.H264Packet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// slice before the first keyframe, stap-a with sps and pps, idr, slice
+	packets := []*rtp.Packet{
+		testPacket(1, 0, true, []byte{0x41, 1, 1}),
+		testPacket(2, 3000, false, []byte{0x78, 0, 2, 0x67, 2, 0, 2, 0x68, 3}),
+		testPacket(3, 3000, true, []byte{0x65, 4, 4}),
+		testPacket(4, 6000, true, []byte{0x41, 5, 5}),
+		testPacket(5, 9000, true, []byte{0x41, 6, 6}),
+	}
+	for _, packet := range packets {
+		if err := ff.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 0, 0, 1, 0x67, 2, 0, 0, 0, 1, 0x68, 3, 0, 0, 0, 1, 0x65, 4, 4, 0, 0, 0, 1, 0x41, 5, 5}
+	if !bytes.Equal(data, want) {
+		t.Errorf("got %x, want %x", data, want)
+	}
+}
+
+// malformed payloads are dropped without panicking, the file stays valid
+func TestFrameFileMalformed(t *testing.T) {
+	for _, test := range []struct {
+		mimeType     string
+		fourcc       string
+		depacketizer rtp.Depacketizer
+		key          []byte
+	}{
+		{webrtc.MimeTypeVP8, "VP80", &codecs.VP8Packet{}, []byte{0x90, 0x80, 0x00, 0x00, 0x9D}},
+		{webrtc.MimeTypeVP9, "VP90", &codecs.VP9Packet{}, []byte{0x8C, 0x80, 0x01, 0x00}},
+		{webrtc.MimeTypeAV1, "AV01", &av1Depacketizer{}, []byte{0x28, 2, 0x08, 1, 0x30, 2}},
+		{webrtc.MimeTypeH264, "", &codecs.H264Packet{}, []byte{0x7C, 0x85, 0x88, 0x84}},
+	} {
+		name := filepath.Join(t.TempDir(), "track")
+		ff, _, err := newFrameFile(name, test.mimeType, test.fourcc, test.depacketizer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq := uint16(0)
+		for size := 0; size <= len(test.key); size++ {
+			for i := range test.key {
+				for _, b := range []byte{0, 0xFF, test.key[i] ^ 0x80} {
+					payload := append([]byte{}, test.key[:size]...)
+					if i < size {
+						payload[i] = b
+					}
+					seq++
+					ff.WriteRTP(testPacket(seq, uint32(seq)*3000, seq%2 == 0, payload))
+				}
+			}
+		}
+		if err := ff.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(name); err != nil {
+			t.Fatal(err)
+		} else if test.fourcc != "" {
+			testReadIvf(t, data)
+		}
+	}
+}
+
+func TestTrackFiles(t *testing.T) {
+	tests := []struct {
+		videoCodec string
+		audioCodec string
+		wantFiles  []string
+	}{
+		{webrtc.MimeTypeVP8, webrtc.MimeTypeOpus, []string{"session.ivf", "session.ogg"}},
+		{webrtc.MimeTypeH264, webrtc.MimeTypeOpus, []string{"session.h264", "session.ogg"}},
+		{webrtc.MimeTypeH265, "audio/mpeg4-generic", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.videoCodec+" "+test.audioCodec, func(t *testing.T) {
+			dir := t.TempDir()
+			var created []string
+			tf := newTrackFiles(filepath.Join(dir, "session"), test.videoCodec, test.audioCodec, func(name string) {
+				created = append(created, filepath.Base(name))
+			})
+			for i := 0; i < 3; i++ {
+				if err := tf.write(webrtc.RTPCodecTypeVideo, testPacket(uint16(i), uint32(i)*3000, true, []byte{0x10, 0x00, 0x9D, 0x01})); err != nil {
+					t.Fatal(err)
+				}
+				if err := tf.write(webrtc.RTPCodecTypeAudio, testPacket(uint16(i), uint32(i)*960, true, []byte{0xFC, 1})); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tf.close(); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(test.wantFiles) || len(created) != len(test.wantFiles) {
+				t.Fatalf("created %v, %v files in the directory, want %v", created, len(entries), test.wantFiles)
+			}
+			for i, entry := range entries {
+				if entry.Name() != test.wantFiles[i] || created[i] != test.wantFiles[i] {
+					t.Errorf("file %v is %v, created %v, want %v", i, entry.Name(), created[i], test.wantFiles[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"pion-webrtc-sfu/fmp4"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/tracks"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// h264 nal unit types
+const (
+	h264NaluIDR = 5
+	h264NaluSPS = 7
+	h264NaluPPS = 8
+	h264NaluAUD = 9
+)
+
+// fragments are written at every keyframe, or once they got this long
+const maxFragmentDuration = 2 * time.Second
+
+/*
+h264 and opus interleaved in a fragmented mp4 file
+the file starts at the first keyframe with sps/pps, audio is aligned to video by arrival time.
+audio codecs other than opus are not recorded
+*/
+type mp4File struct {
+	name     string
+	created  func(name string)
+	file     *os.File
+	out      *bufio.Writer
+	video    *mp4Track
+	audio    *mp4Track // nil if audio is not recorded
+	start    time.Time // arrival of the first video frame
+	sequence uint32
+	failed   bool // file could not be created
+}
+
+// samples of one track waiting to be written
+type mp4Track struct {
+	track    *fmp4.Track
+	builder  *samplebuilder.SampleBuilder
+	started  bool // first keyframe was received (video)
+	timed    bool // first sample was placed on the timeline
+	lastTs   uint32
+	last     *fmp4.Sample // waiting for the next sample to know its duration
+	lastDur  uint32
+	samples  []fmp4.Sample
+	baseTime uint64 // decode time of the first queued sample
+	queued   uint64 // duration of the queued samples
+}
+
+func newMP4File(name string, audioCodec string, created func(name string)) *mp4File {
+	mf := &mp4File{
+		name:    name,
+		created: created,
+		video: &mp4Track{
+			track:   &fmp4.Track{ID: 1, Codec: fmp4.CodecH264, Timescale: 90000},
+			builder: samplebuilder.New(maxLateVideo, &codecs.H264Packet{IsAVC: true}, 90000),
+		},
+	}
+	if strings.EqualFold(audioCodec, webrtc.MimeTypeOpus) {
+		mf.audio = &mp4Track{
+			track:   &fmp4.Track{ID: 2, Codec: fmp4.CodecOpus, Timescale: 48000, Channels: 2},
+			builder: samplebuilder.New(maxLateAudio, &codecs.OpusPacket{}, 48000),
+		}
+	} else {
+		logging.Warnf("audio codec %v can not be recorded to mp4, recording %v without audio", audioCodec, name)
+	}
+	return mf
+}
+
+func (mf *mp4File) write(kind webrtc.RTPCodecType, packet *rtp.Packet) error {
+	if mf.failed {
+		return nil
+	}
+	if kind == webrtc.RTPCodecTypeAudio {
+		// audio before the first keyframe is dropped
+		if mf.audio == nil || mf.file == nil {
+			return nil
+		}
+		mf.audio.builder.Push(packet)
+		for {
+			sample, timestamp := mf.audio.builder.PopWithTimestamp()
+			if sample == nil {
+				return nil
+			}
+			if err := mf.writeSample(mf.audio, timestamp, sample.Data, true); err != nil {
+				return err
+			}
+		}
+	}
+	if !mf.video.started {
+		if !tracks.IsKeyframe(webrtc.MimeTypeH264, packet.Payload) {
+			return nil
+		}
+		mf.video.started = true
+	}
+	mf.video.builder.Push(packet)
+	for {
+		sample, timestamp := mf.video.builder.PopWithTimestamp()
+		if sample == nil {
+			return nil
+		}
+		if err := mf.writeVideo(sample.Data, timestamp); err != nil {
+			return err
+		}
+	}
+}
+
+// avcc access unit, parameter sets go to the init segment
+func (mf *mp4File) writeVideo(avcc []byte, timestamp uint32) error {
+	data := make([]byte, 0, len(avcc))
+	keyframe := false
+	for offset := 0; offset+4 <= len(avcc); {
+		size := int(binary.BigEndian.Uint32(avcc[offset:]))
+		if size <= 0 || offset+4+size > len(avcc) {
+			break
+		}
+		nalu := avcc[offset+4 : offset+4+size]
+		switch nalu[0] & 0x1F {
+		case h264NaluSPS:
+			mf.video.track.SPS = append([]byte(nil), nalu...)
+		case h264NaluPPS:
+			mf.video.track.PPS = append([]byte(nil), nalu...)
+		case h264NaluAUD:
+		case h264NaluIDR:
+			keyframe = true
+			fallthrough
+		default:
+			data = append(data, avcc[offset:offset+4+size]...)
+		}
+		offset += 4 + size
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if mf.file == nil {
+		if !keyframe || mf.video.track.SPS == nil || mf.video.track.PPS == nil {
+			return nil
+		}
+		if err := mf.create(); err != nil {
+			return err
+		}
+	}
+	return mf.writeSample(mf.video, timestamp, data, keyframe)
+}
+
+// write the init segment once the parameter sets are known
+func (mf *mp4File) create() error {
+	file, err := os.Create(mf.name)
+	if err != nil {
+		mf.failed = true
+		return err
+	}
+	mf.file, mf.out, mf.start = file, bufio.NewWriter(file), time.Now()
+	mf.created(mf.name)
+	list := []*fmp4.Track{mf.video.track}
+	if mf.audio != nil {
+		list = append(list, mf.audio.track)
+	}
+	_, err = mf.out.Write(fmp4.InitSegment(list))
+	return err
+}
+
+// queue a sample, the previous sample of the track gets its duration from the timestamp difference
+func (mf *mp4File) writeSample(t *mp4Track, timestamp uint32, data []byte, keyframe bool) error {
+	if !t.timed {
+		t.timed = true
+		// tracks starting after the video are placed by their arrival
+		if t != mf.video {
+			t.baseTime = uint64(time.Since(mf.start).Seconds() * float64(t.track.Timescale))
+		}
+	}
+	if t.last != nil {
+		duration := timestamp - t.lastTs
+		// reordered or repeated timestamps
+		if int32(duration) <= 0 {
+			duration = t.lastDur
+		}
+		t.last.Duration, t.lastDur = duration, duration
+		t.samples = append(t.samples, *t.last)
+		t.queued += uint64(duration)
+	}
+	// video fragments start at keyframes
+	var err error
+	if (t == mf.video && keyframe && len(t.samples) > 0) || time.Duration(t.queued)*time.Second/time.Duration(t.track.Timescale) >= maxFragmentDuration {
+		err = mf.flush()
+	}
+	t.last = &fmp4.Sample{Keyframe: keyframe, Data: data}
+	t.lastTs = timestamp
+	return err
+}
+
+// write the queued samples of both tracks as a fragment
+func (mf *mp4File) flush() error {
+	fragments := make([]fmp4.TrackFragment, 0, 2)
+	for _, t := range []*mp4Track{mf.video, mf.audio} {
+		if t == nil || len(t.samples) == 0 {
+			continue
+		}
+		fragments = append(fragments, fmp4.TrackFragment{Track: t.track, BaseDecodeTime: t.baseTime, Samples: t.samples})
+		t.baseTime += t.queued
+		t.samples, t.queued = nil, 0
+	}
+	if len(fragments) == 0 {
+		return nil
+	}
+	mf.sequence++
+	_, err := mf.out.Write(fmp4.Fragment(mf.sequence, fragments))
+	return err
+}
+
+// write the remaining samples and close the file
+func (mf *mp4File) close() error {
+	if mf.file == nil {
+		return nil
+	}
+	for _, t := range []*mp4Track{mf.video, mf.audio} {
+		if t != nil && t.last != nil {
+			t.last.Duration = t.lastDur
+			t.samples = append(t.samples, *t.last)
+			t.queued += uint64(t.lastDur)
+			t.last = nil
+		}
+	}
+	err := mf.flush()
+	if flushErr := mf.out.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := mf.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
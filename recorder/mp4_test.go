@@ -0,0 +1,249 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type testBox struct {
+	boxType string
+	payload []byte
+}
+
+// boxes in data, fails the test if a box is cut short
+func testBoxes(t *testing.T, data []byte) []testBox {
+	var boxes []testBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("box header cut short: %x", data)
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("%q box of %v bytes in %v bytes", data[4:8], size, len(data))
+		}
+		boxes = append(boxes, testBox{string(data[4:8]), data[8:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+// track fragment of a moof
+type testTraf struct {
+	trackID        uint32
+	baseDecodeTime uint64
+	durations      []uint32
+	flags          []uint32
+}
+
+// sequence number and track fragments of a moof
+func testMoof(t *testing.T, moof []byte) (uint32, []testTraf) {
+	var sequence uint32
+	var trafs []testTraf
+	for _, b := range testBoxes(t, moof) {
+		switch b.boxType {
+		case "mfhd":
+			sequence = binary.BigEndian.Uint32(b.payload[4:])
+		case "traf":
+			var traf testTraf
+			for _, child := range testBoxes(t, b.payload) {
+				switch child.boxType {
+				case "tfhd":
+					traf.trackID = binary.BigEndian.Uint32(child.payload[4:])
+				case "tfdt":
+					traf.baseDecodeTime = binary.BigEndian.Uint64(child.payload[4:])
+				case "trun":
+					count := int(binary.BigEndian.Uint32(child.payload[4:]))
+					for i := 0; i < count; i++ {
+						entry := child.payload[12+12*i:]
+						traf.durations = append(traf.durations, binary.BigEndian.Uint32(entry))
+						traf.flags = append(traf.flags, binary.BigEndian.Uint32(entry[8:]))
+					}
+				}
+			}
+			trafs = append(trafs, traf)
+		}
+	}
+	return sequence, trafs
+}
+
+// rtp packets of a track, frames are step ticks apart
+type testStream struct {
+	seq       uint16
+	timestamp uint32
+	step      uint32
+}
+
+// packets of a frame, the last has the marker bit set
+func (s *testStream) frame(mf *mp4File, kind webrtc.RTPCodecType, payloads ...[]byte) error {
+	for i, payload := range payloads {
+		s.seq++
+		if err := mf.write(kind, testPacket(s.seq, s.timestamp, i == len(payloads)-1, payload)); err != nil {
+			return err
+		}
+	}
+	s.timestamp += s.step
+	return nil
+}
+
+var (
+	testSPS   = []byte{0x67, 0x42, 0xC0, 0x1F, 0xDA}
+	testPPS   = []byte{0x68, 0xCE, 0x3C, 0x80}
+	testStapA = append(append(append([]byte{0x78, 0, byte(len(testSPS))}, testSPS...), 0, byte(len(testPPS))), testPPS...)
+	testIDR   = []byte{0x65, 0x88, 0x84}
+	testSlice = []byte{0x41, 0x9A, 0x02}
+)
+
+func TestMP4File(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "session.mp4")
+	var created []string
+	mf := newMP4File(name, "audio/PCMU", func(name string) { created = append(created, name) })
+	// sequence numbers and rtp timestamps wrap
+	stream := &testStream{seq: 65530, timestamp: 0xFFFFFFFF - 5000, step: 3000}
+	frames := [][][]byte{
+		{testSlice}, // before the first keyframe
+		{testStapA, testIDR},
+		{testSlice}, {testSlice}, {testSlice}, {testSlice},
+		{testIDR},
+		{testSlice},
+		{testSlice}, // waits for a following packet in the sample builder
+	}
+	for i, frame := range frames {
+		if err := stream.frame(mf, webrtc.RTPCodecTypeVideo, frame...); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && len(created) != 0 {
+			t.Fatal("file created before the first keyframe")
+		}
+	}
+	if err := mf.close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0] != name {
+		t.Errorf("created %v", created)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boxes := testBoxes(t, data)
+	var types []string
+	for _, b := range boxes {
+		types = append(types, b.boxType)
+	}
+	if len(boxes) != 6 || types[0] != "ftyp" || types[1] != "moov" || types[2] != "moof" || types[3] != "mdat" || types[4] != "moof" || types[5] != "mdat" {
+		t.Fatalf("boxes %v, want ftyp, moov and two fragments", types)
+	}
+	if !bytes.Contains(boxes[1].payload, testSPS) || !bytes.Contains(boxes[1].payload, testPPS) {
+		t.Error("moov without the parameter sets")
+	}
+	// fragments start at keyframes, the decode time continues across the rtp timestamp wrap
+	wants := []struct {
+		baseDecodeTime uint64
+		samples        int
+	}{{0, 5}, {15000, 2}}
+	for i, want := range wants {
+		sequence, trafs := testMoof(t, boxes[2+2*i].payload)
+		if sequence != uint32(i+1) || len(trafs) != 1 || trafs[0].trackID != 1 {
+			t.Fatalf("fragment %v: sequence %v with %+v", i, sequence, trafs)
+		}
+		traf := trafs[0]
+		if traf.baseDecodeTime != want.baseDecodeTime || len(traf.durations) != want.samples {
+			t.Errorf("fragment %v: %v samples at %v, want %v at %v", i, len(traf.durations), traf.baseDecodeTime, want.samples, want.baseDecodeTime)
+		}
+		for j := range traf.durations {
+			wantFlags := uint32(0x01010000)
+			if j == 0 {
+				wantFlags = 0x02000000
+			}
+			if traf.durations[j] != 3000 || traf.flags[j] != wantFlags {
+				t.Errorf("fragment %v sample %v: duration %v flags %#x, want 3000 and %#x", i, j, traf.durations[j], traf.flags[j], wantFlags)
+			}
+		}
+	}
+	// parameter sets are left out of the samples
+	wantSample := append([]byte{0, 0, 0, byte(len(testIDR))}, testIDR...)
+	if !bytes.HasPrefix(boxes[3].payload, wantSample) {
+		t.Errorf("first sample %x, want %x", boxes[3].payload[:len(wantSample)], wantSample)
+	}
+}
+
+// opus is interleaved once the file was created at the first keyframe
+func TestMP4FileAudio(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "session.mp4")
+	mf := newMP4File(name, webrtc.MimeTypeOpus, func(string) {})
+	video := &testStream{seq: 100, timestamp: 9000, step: 3000}
+	audio := &testStream{seq: 200, timestamp: 0, step: 960}
+	// audio is dropped until the sample builder released the first keyframe
+	if err := audio.frame(mf, webrtc.RTPCodecTypeAudio, []byte{0xFC, 1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		frame := [][]byte{testSlice}
+		if i%3 == 0 {
+			frame = [][]byte{testStapA, testIDR}
+		}
+		if err := video.frame(mf, webrtc.RTPCodecTypeVideo, frame...); err != nil {
+			t.Fatal(err)
+		}
+		if err := audio.frame(mf, webrtc.RTPCodecTypeAudio, []byte{0xFC, byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mf.close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audioSamples := 0
+	for _, b := range testBoxes(t, data) {
+		if b.boxType != "moof" {
+			continue
+		}
+		_, trafs := testMoof(t, b.payload)
+		for _, traf := range trafs {
+			if traf.trackID == 2 {
+				audioSamples += len(traf.durations)
+			}
+		}
+	}
+	// packets after the second video frame, the last waits in the sample builder
+	if audioSamples != 4 {
+		t.Errorf("%v audio samples, want 4", audioSamples)
+	}
+}
+
+// malformed access units are dropped without panicking
+func TestMP4WriteVideoMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		avcc []byte
+	}{
+		{"empty", nil},
+		{"length only", []byte{0, 0, 0, 1}},
+		{"length beyond the data", []byte{0, 0, 0, 9, 0x65, 1}},
+		{"zero length", []byte{0, 0, 0, 0, 0, 0, 0, 1, 0x65}},
+		{"length above 2^31", []byte{0x80, 0, 0, 1, 0x65}},
+		{"truncated length", []byte{0, 0, 0, 1, 0x65, 0, 0}},
+		{"keyframe without parameter sets", []byte{0, 0, 0, 2, 0x65, 1}},
+		{"parameter sets only", append(append([]byte{0, 0, 0, byte(len(testSPS))}, testSPS...), append([]byte{0, 0, 0, byte(len(testPPS))}, testPPS...)...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "session.mp4")
+			mf := newMP4File(name, "audio/PCMU", func(string) {})
+			if err := mf.writeVideo(test.avcc, 0); err != nil {
+				t.Fatal(err)
+			}
+			if mf.file != nil {
+				t.Error("file created without a keyframe and parameter sets")
+			}
+		})
+	}
+}
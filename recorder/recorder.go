@@ -0,0 +1,342 @@
+package recorder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/sessions"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// containers of h264 recordings
+const (
+	FormatMP4     = "mp4"
+	FormatAnnexB  = "h264"
+	recordAll     = "*"
+	idleTimeout   = 10 * time.Second // files of a broadcast are closed once no packets arrived for this long
+	packetBacklog = 1024             // packets waiting to be written, more are dropped
+)
+
+// returned when starting a recording of a session that is already recorded
+var ErrRecording = errors.New("session is already recorded")
+
+// returned when stopping a recording that does not exist
+var ErrNotRecording = errors.New("session is not recorded")
+
+// state of a recording as reported by the api
+type RecordingStatus struct {
+	Session string    `json:"session"`
+	Started time.Time `json:"started"`
+	Active  bool      `json:"active"` // a broadcast is currently written
+	Files   []string  `json:"files"`
+	Dropped uint64    `json:"dropped"` // packets dropped because writing fell behind
+}
+
+type recordedPacket struct {
+	kind   webrtc.RTPCodecType
+	packet *rtp.Packet
+}
+
+// recording of a session, every broadcast is written to new files
+type recording struct {
+	sessionID string
+	started   time.Time
+	packets   chan recordedPacket
+	stop      chan struct{}
+	done      chan struct{}
+	mu        sync.Mutex // protects below status
+	active    bool
+	files     []string
+	dropped   uint64
+}
+
+// recordings by session name
+var recordings = make(map[string]*recording)
+
+// mutex for above map read/write
+var mutex sync.Mutex
+
+// configuration of all recordings
+var (
+	directory  = "recordings"
+	h264Format = FormatMP4
+	videoCodec string
+	audioCodec string
+	recordAny  bool // record every session that receives packets
+)
+
+// sessions whose recording was stopped while every session is recorded
+var excluded = make(map[string]bool)
+
+// characters not allowed in file names of recordings
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// start the recordings from configuration
+func InitRecorder(config *configuration.Configuration) error {
+	if config.Rtc_record_h264_format != FormatMP4 && config.Rtc_record_h264_format != FormatAnnexB {
+		return fmt.Errorf("invalid h264 recording format %q", config.Rtc_record_h264_format)
+	}
+	mutex.Lock()
+	directory = config.Rtc_record_directory
+	h264Format = config.Rtc_record_h264_format
+	videoCodec = config.Rtc_video_codec
+	audioCodec = config.Rtc_audio_codec
+	mutex.Unlock()
+	for _, name := range strings.Split(config.Rtc_record_sessions, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == recordAll {
+			mutex.Lock()
+			recordAny = true
+			mutex.Unlock()
+			continue
+		}
+		if err := StartRecording(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record the session, files are created once packets arrive
+func StartRecording(sessionID string) error {
+	if sessionID == "" {
+		return errors.New("session name can not be empty")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, exists := recordings[sessionID]; exists {
+		return ErrRecording
+	}
+	delete(excluded, sessionID)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	startRecording(sessionID)
+	return nil
+}
+
+// must be called with lock held
+func startRecording(sessionID string) *recording {
+	r := &recording{
+		sessionID: sessionID,
+		started:   time.Now(),
+		packets:   make(chan recordedPacket, packetBacklog),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		files:     make([]string, 0),
+	}
+	recordings[sessionID] = r
+	go r.run()
+	logging.With("session_id", sessionID).Infof("started recording session into %v", directory)
+	return r
+}
+
+// stop recording the session and close its files
+func StopRecording(sessionID string) error {
+	mutex.Lock()
+	r, exists := recordings[sessionID]
+	if exists {
+		delete(recordings, sessionID)
+		if recordAny {
+			excluded[sessionID] = true
+		}
+	}
+	mutex.Unlock()
+	if !exists {
+		return ErrNotRecording
+	}
+	close(r.stop)
+	<-r.done
+	logging.With("session_id", sessionID).Infof("stopped recording session")
+	return nil
+}
+
+// stop all recordings and close their files, used on shutdown
+func Shutdown() {
+	mutex.Lock()
+	stopping := recordings
+	recordings = make(map[string]*recording)
+	// late packets must not start new recordings
+	recordAny = false
+	mutex.Unlock()
+	for sessionID, r := range stopping {
+		close(r.stop)
+		<-r.done
+		logging.With("session_id", sessionID).Infof("stopped recording session")
+	}
+}
+
+// status of all recordings, sorted by session
+func ListRecordings() []RecordingStatus {
+	mutex.Lock()
+	defer mutex.Unlock()
+	list := make([]RecordingStatus, 0, len(recordings))
+	for _, r := range recordings {
+		list = append(list, r.status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Session < list[j].Session })
+	return list
+}
+
+// status of the recording of a session
+func GetRecording(sessionID string) (RecordingStatus, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	r, exists := recordings[sessionID]
+	if !exists {
+		return RecordingStatus{}, false
+	}
+	return r.status(), true
+}
+
+func (r *recording) status() RecordingStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RecordingStatus{
+		Session: r.sessionID,
+		Started: r.started,
+		Active:  r.active,
+		Files:   append(make([]string, 0, len(r.files)), r.files...),
+		Dropped: r.dropped,
+	}
+}
+
+/*
+tap a packet fed into a session, called by all ingest paths
+only the base layer of simulcast sessions is recorded. packet must not be modified afterwards
+*/
+func WriteRTP(sessionID string, kind webrtc.RTPCodecType, layer int, packet *rtp.Packet) {
+	if layer != 0 {
+		return
+	}
+	mutex.Lock()
+	r, exists := recordings[sessionID]
+	if !exists && recordAny && !excluded[sessionID] {
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			mutex.Unlock()
+			return
+		}
+		r = startRecording(sessionID)
+	}
+	mutex.Unlock()
+	if r == nil {
+		return
+	}
+	select {
+	case r.packets <- recordedPacket{kind, packet}:
+	default:
+		r.mu.Lock()
+		r.dropped++
+		r.mu.Unlock()
+	}
+}
+
+// like WriteRTP for a marshaled packet, the buffer can be reused after returning
+func Write(sessionID string, kind webrtc.RTPCodecType, layer int, b []byte) {
+	if layer != 0 || !isRecorded(sessionID) {
+		return
+	}
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(append([]byte(nil), b...)); err != nil {
+		return
+	}
+	WriteRTP(sessionID, kind, layer, packet)
+}
+
+func isRecorded(sessionID string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, exists := recordings[sessionID]
+	return exists || (recordAny && !excluded[sessionID])
+}
+
+// write packets until stopped, files are closed when the broadcast goes idle
+func (r *recording) run() {
+	defer close(r.done)
+	var files fileSet
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+	closeFiles := func() {
+		if files == nil {
+			return
+		}
+		if err := files.close(); err != nil {
+			logging.With("session_id", r.sessionID).Errorf("recording could not close files: %v", err)
+		}
+		files = nil
+		r.mu.Lock()
+		r.active = false
+		r.mu.Unlock()
+	}
+	defer closeFiles()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-idle.C:
+			closeFiles()
+		case p := <-r.packets:
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(idleTimeout)
+			if files == nil {
+				files = r.openFiles()
+			}
+			if err := files.write(p.kind, p.packet); err != nil {
+				logging.With("session_id", r.sessionID).Errorf("recording could not write %v packet: %v", p.kind, err)
+			}
+		}
+	}
+}
+
+// create the files of a new broadcast, named by session and start time
+func (r *recording) openFiles() fileSet {
+	mutex.Lock()
+	base := filepath.Join(directory, fmt.Sprintf("%s_%s", unsafeFileChars.ReplaceAllString(r.sessionID, "_"), time.Now().Format("20060102-150405")))
+	format, video, audio := h264Format, videoCodec, audioCodec
+	mutex.Unlock()
+	// files of the tracks are created with their first packet
+	created := func(name string) {
+		logging.With("session_id", r.sessionID).Infof("recording session to %v", name)
+		r.mu.Lock()
+		r.files = append(r.files, name)
+		r.mu.Unlock()
+	}
+	var files fileSet
+	if strings.EqualFold(video, webrtc.MimeTypeH264) && format == FormatMP4 {
+		files = newMP4File(base+".mp4", audio, created)
+	} else {
+		files = newTrackFiles(base, video, audio, created)
+	}
+	r.mu.Lock()
+	r.active = true
+	r.mu.Unlock()
+	// recording starts at a keyframe
+	if sess := sessions.ReturnSessionByIdIfExists(r.sessionID); sess != nil {
+		sess.RequestKeyframe()
+	}
+	return files
+}
+
+// files a broadcast is written to
+type fileSet interface {
+	write(kind webrtc.RTPCodecType, packet *rtp.Packet) error
+	close() error
+}
@@ -0,0 +1,62 @@
+package recorder
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestRecording(t *testing.T) {
+	mutex.Lock()
+	directory, videoCodec, audioCodec = t.TempDir(), webrtc.MimeTypeVP8, webrtc.MimeTypeOpus
+	mutex.Unlock()
+	if err := StartRecording(""); err == nil {
+		t.Error("started a recording without a session")
+	}
+	if err := StopRecording("unknown"); !errors.Is(err, ErrNotRecording) {
+		t.Errorf("stopping an unknown recording returned %v", err)
+	}
+	sessionID := "show/1 ü"
+	if err := StartRecording(sessionID); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartRecording(sessionID); !errors.Is(err, ErrRecording) {
+		t.Errorf("starting a recording twice returned %v", err)
+	}
+	// simulcast layers other than the base layer are not recorded
+	WriteRTP(sessionID, webrtc.RTPCodecTypeVideo, 1, testPacket(1, 0, true, []byte{0x10, 0x00, 0x9D, 0x01}))
+	WriteRTP(sessionID, webrtc.RTPCodecTypeVideo, 0, testPacket(1, 0, true, []byte{0x10, 0x00, 0x9D, 0x01}))
+	WriteRTP(sessionID, webrtc.RTPCodecTypeAudio, 0, testPacket(1, 0, true, []byte{0xFC, 1}))
+	deadline := time.Now().Add(5 * time.Second)
+	var status RecordingStatus
+	for time.Now().Before(deadline) {
+		status, _ = GetRecording(sessionID)
+		if len(status.Files) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !status.Active || len(status.Files) != 2 {
+		t.Fatalf("recording %+v, want two active files", status)
+	}
+	// named by session and start time, characters unsafe in file names replaced
+	for _, file := range status.Files {
+		base := filepath.Base(file)
+		if !strings.HasPrefix(base, "show_1___") || (filepath.Ext(base) != ".ivf" && filepath.Ext(base) != ".ogg") {
+			t.Errorf("file %v", file)
+		}
+	}
+	if list := ListRecordings(); len(list) != 1 || list[0].Session != sessionID {
+		t.Errorf("recordings %+v", list)
+	}
+	if err := StopRecording(sessionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := GetRecording(sessionID); exists {
+		t.Error("recording exists after it was stopped")
+	}
+}
@@ -0,0 +1,287 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"pion-webrtc-sfu/logging"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/randutil"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// characters of generated target ids
+const targetIDCharset = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// packets waiting to be sent to a target, more are dropped
+const packetBacklog = 1024
+
+// returned when removing a target that does not exist
+var ErrTargetNotFound = errors.New("relay target not found")
+
+/*
+udp destination receiving a copy of the packets of a session
+kind limits the target to video or audio, ssrc and payload type are rewritten if not 0
+*/
+type Target struct {
+	Address     string `json:"address"` // host:port
+	Kind        string `json:"kind,omitempty"`
+	SSRC        uint32 `json:"ssrc,omitempty"`
+	PayloadType uint8  `json:"payload_type,omitempty"`
+}
+
+// state of a target as reported by the api
+type TargetStatus struct {
+	Target
+	ID        string    `json:"id"`
+	Session   string    `json:"session"`
+	Created   time.Time `json:"created"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+	Errors    uint64    `json:"errors"`
+	Dropped   uint64    `json:"dropped"` // packets dropped because sending fell behind
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type target struct {
+	Target
+	id      string
+	session string
+	created time.Time
+	kind    webrtc.RTPCodecType // 0 for both kinds
+	conn    *net.UDPConn
+	queue   chan []byte   // marshaled packets sent by run, the ingest never waits for the socket
+	stop    chan struct{} // closed when the target is removed
+	done    chan struct{} // closed once run returned and the socket is closed
+	mu      sync.Mutex    // protects below counters
+	packets uint64
+	bytes   uint64
+	errors  uint64
+	dropped uint64
+	lastErr string
+}
+
+// targets by session name
+var targets = make(map[string][]*target)
+
+// mutex for above map read/write
+var mutex sync.RWMutex
+
+// forward the packets of the session to a new target, its id is returned
+func AddTarget(sessionID string, t Target) (TargetStatus, error) {
+	if sessionID == "" {
+		return TargetStatus{}, errors.New("session name can not be empty")
+	}
+	var kind webrtc.RTPCodecType
+	switch strings.ToLower(t.Kind) {
+	case "":
+	case "video":
+		kind = webrtc.RTPCodecTypeVideo
+	case "audio":
+		kind = webrtc.RTPCodecTypeAudio
+	default:
+		return TargetStatus{}, fmt.Errorf("invalid kind %q, must be video or audio", t.Kind)
+	}
+	if t.PayloadType > 127 {
+		return TargetStatus{}, fmt.Errorf("invalid payload type %v", t.PayloadType)
+	}
+	addr, err := net.ResolveUDPAddr("udp", t.Address)
+	if err != nil {
+		return TargetStatus{}, fmt.Errorf("invalid address %q: %v", t.Address, err)
+	}
+	if addr.Port == 0 {
+		return TargetStatus{}, fmt.Errorf("address %q has no port", t.Address)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return TargetStatus{}, err
+	}
+	id, err := randutil.GenerateCryptoRandomString(8, targetIDCharset)
+	if err != nil {
+		conn.Close()
+		return TargetStatus{}, err
+	}
+	tg := &target{
+		Target:  t,
+		id:      id,
+		session: sessionID,
+		created: time.Now(),
+		kind:    kind,
+		conn:    conn,
+		queue:   make(chan []byte, packetBacklog),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go tg.run()
+	mutex.Lock()
+	targets[sessionID] = append(targets[sessionID], tg)
+	mutex.Unlock()
+	logging.With("session_id", sessionID).Infof("relaying session to %v (target %v)", t.Address, id)
+	return tg.status(), nil
+}
+
+// stop forwarding to a target of the session
+func RemoveTarget(sessionID string, id string) error {
+	mutex.Lock()
+	list := targets[sessionID]
+	var removed *target
+	for i, tg := range list {
+		if tg.id == id {
+			removed = tg
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if removed == nil {
+		mutex.Unlock()
+		return ErrTargetNotFound
+	}
+	if len(list) == 0 {
+		delete(targets, sessionID)
+	} else {
+		targets[sessionID] = list
+	}
+	mutex.Unlock()
+	close(removed.stop)
+	<-removed.done
+	logging.With("session_id", sessionID).Infof("stopped relaying session to %v (target %v)", removed.Address, id)
+	return nil
+}
+
+// status of all targets, sorted by session and creation
+func ListTargets() []TargetStatus {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	list := make([]TargetStatus, 0, len(targets))
+	for _, sessionTargets := range targets {
+		for _, tg := range sessionTargets {
+			list = append(list, tg.status())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Session != list[j].Session {
+			return list[i].Session < list[j].Session
+		}
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// status of the targets of a session
+func SessionTargets(sessionID string) []TargetStatus {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	list := make([]TargetStatus, 0, len(targets[sessionID]))
+	for _, tg := range targets[sessionID] {
+		list = append(list, tg.status())
+	}
+	return list
+}
+
+func (tg *target) status() TargetStatus {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	return TargetStatus{
+		Target:    tg.Target,
+		ID:        tg.id,
+		Session:   tg.session,
+		Created:   tg.created,
+		Packets:   tg.packets,
+		Bytes:     tg.bytes,
+		Errors:    tg.errors,
+		Dropped:   tg.dropped,
+		LastError: tg.lastErr,
+	}
+}
+
+/*
+tap a packet fed into a session, called by all ingest paths
+only the base layer of simulcast sessions is relayed. packet is not modified
+copies are queued, every target sends them from its own goroutine
+*/
+func WriteRTP(sessionID string, kind webrtc.RTPCodecType, layer int, packet *rtp.Packet) {
+	if layer != 0 {
+		return
+	}
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, tg := range targets[sessionID] {
+		if tg.kind == 0 || tg.kind == kind {
+			tg.write(packet)
+		}
+	}
+}
+
+// like WriteRTP for a marshaled packet, the buffer can be reused after returning
+func Write(sessionID string, kind webrtc.RTPCodecType, layer int, b []byte) {
+	if layer != 0 || !isRelayed(sessionID) {
+		return
+	}
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return
+	}
+	WriteRTP(sessionID, kind, layer, packet)
+}
+
+func isRelayed(sessionID string) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return len(targets[sessionID]) > 0
+}
+
+// queue a copy of the packet with rewritten header, dropped if the target fell behind
+func (tg *target) write(packet *rtp.Packet) {
+	out := *packet
+	if tg.SSRC != 0 {
+		out.SSRC = tg.SSRC
+	}
+	if tg.PayloadType != 0 {
+		out.PayloadType = tg.PayloadType
+	}
+	b, err := out.Marshal()
+	if err != nil {
+		tg.failed(err)
+		return
+	}
+	select {
+	case tg.queue <- b:
+	default:
+		tg.mu.Lock()
+		tg.dropped++
+		tg.mu.Unlock()
+	}
+}
+
+// send queued packets until the target is removed
+func (tg *target) run() {
+	defer close(tg.done)
+	defer tg.conn.Close()
+	for {
+		select {
+		case <-tg.stop:
+			return
+		case b := <-tg.queue:
+			if _, err := tg.conn.Write(b); err != nil {
+				tg.failed(err)
+				continue
+			}
+			tg.mu.Lock()
+			tg.packets++
+			tg.bytes += uint64(len(b))
+			tg.mu.Unlock()
+		}
+	}
+}
+
+func (tg *target) failed(err error) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	tg.errors++
+	tg.lastErr = err.Error()
+}
@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// udp listener standing in for a relay destination
+func testListener(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// read the next packet sent to the listener, nil if none arrives in time
+func testReceive(t *testing.T, conn net.PacketConn, timeout time.Duration) *rtp.Packet {
+	t.Helper()
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+	p := &rtp.Packet{}
+	if err := p.Unmarshal(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAddTargetInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		session string
+		target  Target
+	}{
+		{"no session", "", Target{Address: "127.0.0.1:5004"}},
+		{"invalid kind", "relay", Target{Address: "127.0.0.1:5004", Kind: "data"}},
+		{"invalid payload type", "relay", Target{Address: "127.0.0.1:5004", PayloadType: 128}},
+		{"no port", "relay", Target{Address: "127.0.0.1"}},
+		{"port 0", "relay", Target{Address: "127.0.0.1:0"}},
+	}
+	for _, test := range tests {
+		if status, err := AddTarget(test.session, test.target); err == nil {
+			RemoveTarget(test.session, status.ID)
+			t.Errorf("%v: target added", test.name)
+		}
+	}
+}
+
+/*
+targets receive the base layer of their kinds with ssrc and payload type rewritten if set
+the packets fed into the session are not modified
+*/
+func TestRelayRewrite(t *testing.T) {
+	video, both := testListener(t), testListener(t)
+	rewritten, err := AddTarget("relay", Target{Address: video.LocalAddr().String(), Kind: "Video", SSRC: 4321, PayloadType: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := AddTarget("relay", Target{Address: both.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveTarget("relay", kept.ID)
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 7, Timestamp: 9000, SSRC: 1111, PayloadType: 96, Marker: true}, Payload: []byte{1, 2, 3}}
+	WriteRTP("relay", webrtc.RTPCodecTypeVideo, 0, packet)
+	if packet.SSRC != 1111 || packet.PayloadType != 96 {
+		t.Fatalf("packet of the session rewritten to ssrc %v and payload type %v", packet.SSRC, packet.PayloadType)
+	}
+	tests := []struct {
+		name            string
+		conn            net.PacketConn
+		wantSSRC        uint32
+		wantPayloadType uint8
+	}{
+		{"rewritten", video, 4321, 100},
+		{"kept", both, 1111, 96},
+	}
+	for _, test := range tests {
+		p := testReceive(t, test.conn, time.Second)
+		if p == nil {
+			t.Fatalf("%v: nothing received", test.name)
+		}
+		if p.SSRC != test.wantSSRC || p.PayloadType != test.wantPayloadType {
+			t.Errorf("%v: ssrc %v and payload type %v, want %v and %v", test.name, p.SSRC, p.PayloadType, test.wantSSRC, test.wantPayloadType)
+		}
+		if p.SequenceNumber != 7 || p.Timestamp != 9000 || !p.Marker || string(p.Payload) != string(packet.Payload) {
+			t.Errorf("%v: packet changed to %+v", test.name, p)
+		}
+	}
+	// audio only reaches targets of both kinds, marshaled packets are relayed the same
+	audio := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 8, SSRC: 2222, PayloadType: 111}, Payload: []byte{0xFC}}
+	b, err := audio.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Write("relay", webrtc.RTPCodecTypeAudio, 0, b)
+	if p := testReceive(t, both, time.Second); p == nil || p.SSRC != 2222 || p.PayloadType != 111 {
+		t.Errorf("audio packet received as %+v", p)
+	}
+	// higher simulcast layers are not relayed
+	WriteRTP("relay", webrtc.RTPCodecTypeVideo, 1, packet)
+	if p := testReceive(t, video, 50*time.Millisecond); p != nil {
+		t.Errorf("audio or layer 1 packet relayed to the video target: %+v", p)
+	}
+	statuses := SessionTargets("relay")
+	if len(statuses) != 2 || statuses[0].Packets != 1 || statuses[0].Bytes != 15 || statuses[1].Packets != 2 {
+		t.Errorf("status %+v, want 1 packet of 15 bytes and 2 packets", statuses)
+	}
+	// removed targets receive nothing
+	if err := RemoveTarget("relay", rewritten.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveTarget("relay", rewritten.ID); !errors.Is(err, ErrTargetNotFound) {
+		t.Errorf("second removal: %v", err)
+	}
+	WriteRTP("relay", webrtc.RTPCodecTypeVideo, 0, packet)
+	if p := testReceive(t, video, 50*time.Millisecond); p != nil {
+		t.Error("packet relayed to a removed target")
+	}
+}
+
+// a target that can't keep up drops packets instead of blocking the ingest
+func TestTargetBacklog(t *testing.T) {
+	// no sender draining the queue
+	tg := &target{queue: make(chan []byte, packetBacklog)}
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{1}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < packetBacklog+10; i++ {
+			tg.write(packet)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked by a full queue")
+	}
+	if status := tg.status(); len(tg.queue) != packetBacklog || status.Dropped != 10 {
+		t.Errorf("%v packets queued and %v dropped, want %v and 10", len(tg.queue), status.Dropped, packetBacklog)
+	}
+}
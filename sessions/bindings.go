@@ -0,0 +1,194 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+incoming rtp stream identified by the port it is received on and its ssrc
+video streams can be one of several simulcast layers of the session, 0 being the lowest quality
+backup streams are only forwarded while the primary streams of their kind are silent
+*/
+type IngestBinding struct {
+	Port   uint16 `json:"port"`
+	SSRC   uint32 `json:"ssrc"`
+	Layer  int    `json:"layer,omitempty"`
+	Backup bool   `json:"backup,omitempty"`
+}
+
+// key of the ingest index, layers do not take part in stream identification
+type ingestKey struct {
+	port uint16
+	ssrc uint32
+}
+
+/*
+stream key mapping a session name to the rtp streams that feed it
+the kind of each stream (video/audio) follows from the port it is received on
+*/
+type StreamKey struct {
+	Name     string          `json:"name"`
+	Bindings []IngestBinding `json:"bindings"`
+}
+
+// max number of simulcast layers of a session
+const MaxLayers = 8
+
+// registered stream keys by session name
+var streamKeys = make(map[string]StreamKey)
+
+// reverse lookup of stream keys: incoming stream to the binding with its session name
+var ingestIndex = make(map[ingestKey]indexedBinding)
+
+type indexedBinding struct {
+	name    string
+	binding IngestBinding
+}
+
+// mutex for above maps read/write
+var keyMutex sync.RWMutex
+
+/*
+register a stream key, replacing the bindings of a key with the same name
+fails if any of the bindings already belongs to another key
+*/
+func RegisterStreamKey(key StreamKey) error {
+	if key.Name == "" {
+		return errors.New("stream key name can not be empty")
+	}
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	for _, b := range key.Bindings {
+		if b.Layer < 0 || b.Layer >= MaxLayers {
+			return fmt.Errorf("layer of ssrc %v on port %v needs to be between 0 and %v", b.SSRC, b.Port, MaxLayers-1)
+		}
+		if other, ok := ingestIndex[ingestKey{b.Port, b.SSRC}]; ok && other.name != key.Name {
+			return fmt.Errorf("ssrc %v on port %v is already bound to %q", b.SSRC, b.Port, other.name)
+		}
+	}
+	removeStreamKey(key.Name)
+	for _, b := range key.Bindings {
+		ingestIndex[ingestKey{b.Port, b.SSRC}] = indexedBinding{name: key.Name, binding: b}
+	}
+	streamKeys[key.Name] = key
+	return nil
+}
+
+// remove a stream key, returns false if it did not exist
+func RemoveStreamKey(name string) bool {
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	return removeStreamKey(name)
+}
+
+// remove stream key and index entries, must be called with lock held
+func removeStreamKey(name string) bool {
+	old, ok := streamKeys[name]
+	if !ok {
+		return false
+	}
+	for _, b := range old.Bindings {
+		delete(ingestIndex, ingestKey{b.Port, b.SSRC})
+	}
+	delete(streamKeys, name)
+	return true
+}
+
+// return stream key by session name
+func GetStreamKey(name string) (StreamKey, bool) {
+	keyMutex.RLock()
+	defer keyMutex.RUnlock()
+	key, ok := streamKeys[name]
+	return key, ok
+}
+
+// return all registered stream keys sorted by name
+func ListStreamKeys() []StreamKey {
+	keyMutex.RLock()
+	defer keyMutex.RUnlock()
+	keys := make([]StreamKey, 0, len(streamKeys))
+	for _, key := range streamKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
+
+// generate a random, hard to guess session name
+func NewStreamKeyName() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// return the session name and binding the rtp stream with ssrc received on port is bound to
+func ReturnIngestBinding(port uint16, ssrc uint32) (string, IngestBinding, bool) {
+	keyMutex.RLock()
+	defer keyMutex.RUnlock()
+	indexed, ok := ingestIndex[ingestKey{port, ssrc}]
+	if !ok {
+		return "", IngestBinding{}, false
+	}
+	return indexed.name, indexed.binding, true
+}
+
+/*
+parse stream keys from configuration
+format: name=port:ssrc,port:ssrc:layer,port:ssrc:backup;name=port:ssrc
+keys without bindings (name=) are only published to by rtmp encoders
+*/
+func parseStreamKeys(value string) ([]StreamKey, error) {
+	keys := make([]StreamKey, 0)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, list, found := strings.Cut(entry, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("stream key %q needs to be in the format name=port:ssrc,port:ssrc", entry)
+		}
+		key := StreamKey{Name: strings.TrimSpace(name), Bindings: make([]IngestBinding, 0)}
+		if strings.TrimSpace(list) == "" {
+			keys = append(keys, key)
+			continue
+		}
+		for _, b := range strings.Split(list, ",") {
+			fields := strings.Split(strings.TrimSpace(b), ":")
+			// a trailing backup marks the stream of a second encoder
+			backup := len(fields) > 2 && fields[len(fields)-1] == "backup"
+			if backup {
+				fields = fields[:len(fields)-1]
+			}
+			if len(fields) != 2 && len(fields) != 3 {
+				return nil, fmt.Errorf("binding %q of stream key %q needs to be in the format port:ssrc[:layer][:backup]", b, key.Name)
+			}
+			portValue, err := strconv.ParseUint(fields[0], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in stream key %q: %v", key.Name, err)
+			}
+			ssrcValue, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ssrc in stream key %q: %v", key.Name, err)
+			}
+			binding := IngestBinding{Port: uint16(portValue), SSRC: uint32(ssrcValue), Backup: backup}
+			if len(fields) == 3 {
+				if binding.Layer, err = strconv.Atoi(fields[2]); err != nil {
+					return nil, fmt.Errorf("invalid layer in stream key %q: %v", key.Name, err)
+				}
+			}
+			key.Bindings = append(key.Bindings, binding)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
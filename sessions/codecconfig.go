@@ -0,0 +1,33 @@
+package sessions
+
+import "sync"
+
+/*
+AudioSpecificConfig of the aac stream published to a session by name
+rtp does not carry it, egress repackaging the audio (hls) needs it for the init segment
+*/
+var aacConfigs = make(map[string][]byte)
+
+// mutex for above map read/write
+var aacMutex sync.RWMutex
+
+// set by publishers that know the aac configuration of their stream (rtmp, mpeg-ts)
+func SetAACConfig(sessionID string, config []byte) {
+	aacMutex.Lock()
+	defer aacMutex.Unlock()
+	aacConfigs[sessionID] = append([]byte(nil), config...)
+}
+
+// aac configuration of the session, nil if unknown
+func GetAACConfig(sessionID string) []byte {
+	aacMutex.RLock()
+	defer aacMutex.RUnlock()
+	return aacConfigs[sessionID]
+}
+
+// forget the aac configuration of a removed session
+func removeAACConfig(sessionID string) {
+	aacMutex.Lock()
+	defer aacMutex.Unlock()
+	delete(aacConfigs, sessionID)
+}
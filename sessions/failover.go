@@ -0,0 +1,197 @@
+package sessions
+
+import (
+	"encoding/binary"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/metrics"
+	"pion-webrtc-sfu/tracks"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// time without packets of the primary after which the backup is forwarded, set by InitSessions
+var failoverTimeout time.Duration
+
+// sources feeding a kind of a session, backups only reach the viewers while the primary is silent
+const (
+	sourcePrimary = iota
+	sourceBackup
+	sourceNone = -1
+)
+
+var sourceNames = [...]string{"primary", "backup"}
+
+/*
+output of one layer of a kind, forwarded from one source at a time
+sequence numbers and timestamps are offset so the output continues across source switches
+*/
+type failoverLayer struct {
+	source    int       // source currently forwarded, sourceNone before the first packet
+	seqOffset uint16    // added to sequence numbers of the current source
+	tsOffset  uint32    // added to timestamps of the current source
+	lastSeq   uint16    // last sequence number forwarded
+	lastTs    uint32    // last timestamp forwarded
+	lastWrite time.Time // time of the last forwarded packet
+}
+
+// primary/backup selection of one media kind of a session
+type failover struct {
+	mu          sync.Mutex
+	active      int          // source that should be forwarded
+	lastPacket  [2]time.Time // last packet of each source
+	primarySeen time.Time    // last packet actually received from the primary, zero once it stopped
+	layers      []*failoverLayer
+}
+
+func (s *Session) failover(kind webrtc.RTPCodecType) *failover {
+	if kind == webrtc.RTPCodecTypeVideo {
+		return &s.videoFailover
+	}
+	return &s.audioFailover
+}
+
+/*
+select a marshaled rtp packet of an ingest for forwarding, see FailoverRTP
+the sequence number and timestamp of the buffer are rewritten in place
+*/
+func (s *Session) FailoverPacket(kind webrtc.RTPCodecType, layer int, backup bool, packet []byte) bool {
+	var header rtp.Header
+	n, err := header.Unmarshal(packet)
+	if err != nil {
+		return false
+	}
+	seq, ts, forward := s.selectSource(kind, layer, backup, header.SequenceNumber, header.Timestamp, packet[n:])
+	if forward {
+		binary.BigEndian.PutUint16(packet[2:4], seq)
+		binary.BigEndian.PutUint32(packet[4:8], ts)
+	}
+	return forward
+}
+
+/*
+select a packet of an ingest for forwarding, returns false if it must be dropped
+a backup takes over at its next keyframe once the primary sent nothing for the failover timeout,
+the primary takes back over at its next keyframe once it recovers
+sequence number and timestamp of forwarded packets are rewritten so the output continues across switches
+*/
+func (s *Session) FailoverRTP(kind webrtc.RTPCodecType, layer int, backup bool, packet *rtp.Packet) bool {
+	seq, ts, forward := s.selectSource(kind, layer, backup, packet.SequenceNumber, packet.Timestamp, packet.Payload)
+	if forward {
+		packet.SequenceNumber, packet.Timestamp = seq, ts
+	}
+	return forward
+}
+
+func (s *Session) selectSource(kind webrtc.RTPCodecType, layer int, backup bool, seq uint16, ts uint32, payload []byte) (uint16, uint32, bool) {
+	source := sourcePrimary
+	if backup {
+		source = sourceBackup
+	}
+	mimeType := s.track(kind).Codec().MimeType
+	f := s.failover(kind)
+	f.mu.Lock()
+	now := time.Now()
+	// a primary starting a bit after its backup is not silent yet
+	if f.lastPacket[sourcePrimary].IsZero() {
+		f.lastPacket[sourcePrimary] = now
+	}
+	f.lastPacket[source] = now
+	if source == sourcePrimary {
+		f.primarySeen = now
+	}
+	switched := false
+	switch {
+	case f.active == sourcePrimary && source == sourceBackup && now.Sub(f.lastPacket[sourcePrimary]) > failoverTimeout:
+		f.active, switched = sourceBackup, true
+	case f.active == sourceBackup && source == sourcePrimary:
+		f.active, switched = sourcePrimary, true
+	}
+	for len(f.layers) <= layer {
+		f.layers = append(f.layers, &failoverLayer{source: sourceNone})
+	}
+	l := f.layers[layer]
+	forward, waiting := true, false
+	if l.source != source {
+		switch {
+		case source != f.active:
+			// the layer still forwards the other source
+			forward = false
+		case l.source == sourceNone:
+			// nothing forwarded yet, no keyframe needed to start
+			l.source = source
+		case !tracks.IsKeyframe(mimeType, payload) && kind == webrtc.RTPCodecTypeVideo:
+			forward, waiting = false, true
+		default:
+			// continue right after the last forwarded packet, advanced by the wall clock time since
+			elapsed := uint32(now.Sub(l.lastWrite).Milliseconds()) * (clockRate(kind, mimeType) / 1000)
+			if elapsed == 0 {
+				elapsed = 1
+			}
+			l.seqOffset = l.lastSeq + 1 - seq
+			l.tsOffset = l.lastTs + elapsed - ts
+			l.source = source
+		}
+	}
+	if forward {
+		seq += l.seqOffset
+		ts += l.tsOffset
+		l.lastSeq, l.lastTs, l.lastWrite = seq, ts, now
+	}
+	f.mu.Unlock()
+	if switched {
+		logger := logging.With("session_id", s.id, "kind", kind.String())
+		if source == sourceBackup {
+			logger.Warnf("primary sent nothing for %v, failing over to backup", failoverTimeout)
+		} else {
+			logger.Infof("primary recovered, switching back from backup")
+		}
+		metrics.IngestFailovers.Inc(kind.String(), sourceNames[source])
+	}
+	if waiting {
+		// the new source has to start with a keyframe, the one still forwarded doesn't need one
+		s.requestSourceKeyframe(source)
+	}
+	return seq, ts, forward
+}
+
+/*
+true if a primary ingest of any kind sent packets within the failover timeout
+ingests announcing themselves (like rtmp) use it to not interleave with a primary of another ingest
+*/
+func (s *Session) PrimaryLive() bool {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		f := s.failover(kind)
+		f.mu.Lock()
+		seen := f.primarySeen
+		f.mu.Unlock()
+		if !seen.IsZero() && time.Since(seen) <= failoverTimeout {
+			return true
+		}
+	}
+	return false
+}
+
+// forget the primary of the session, for ingests that know their primary publisher stopped
+func (s *Session) PrimaryStopped() {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		f := s.failover(kind)
+		f.mu.Lock()
+		f.primarySeen = time.Time{}
+		f.mu.Unlock()
+	}
+}
+
+// rtp clock rate of the codecs of a kind
+func clockRate(kind webrtc.RTPCodecType, mimeType string) uint32 {
+	switch {
+	case kind == webrtc.RTPCodecTypeVideo:
+		return 90000
+	case strings.EqualFold(mimeType, webrtc.MimeTypePCMU), strings.EqualFold(mimeType, webrtc.MimeTypePCMA), strings.EqualFold(mimeType, webrtc.MimeTypeG722):
+		return 8000
+	}
+	return 48000
+}
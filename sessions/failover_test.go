@@ -0,0 +1,238 @@
+package sessions
+
+import (
+	"pion-webrtc-sfu/tracks"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	testVP8Keyframe = []byte{0x10, 0x00, 0xAA, 0xBB}
+	testVP8Delta    = []byte{0x10, 0x01, 0xAA, 0xBB}
+)
+
+// session with vp8 and opus tracks and a short failover timeout, restored when the test ends
+func testFailoverSession(t *testing.T) *Session {
+	timeout := failoverTimeout
+	failoverTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { failoverTimeout = timeout })
+	return &Session{
+		TrackGroup: tracks.TrackGroup{
+			VideoTrack: tracks.NewRTPTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "failover", 0),
+			AudioTrack: tracks.NewRTPTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "failover", 0),
+		},
+		keyframes: newKeyframeRequester(),
+		id:        "failover",
+	}
+}
+
+// packets of one ingest of a session, step ticks apart
+type testIngest struct {
+	s      *Session
+	kind   webrtc.RTPCodecType
+	layer  int
+	backup bool
+	seq    uint16
+	ts     uint32
+	step   uint32
+}
+
+// forwarded packets with the ingest and original timestamp they came from
+type testForwarded struct {
+	packet *rtp.Packet
+	backup bool
+	ts     uint32
+}
+
+// send the next packet, appended to forwarded if it was selected
+func (in *testIngest) send(payload []byte, forwarded *[]testForwarded) bool {
+	in.seq++
+	in.ts += in.step
+	p := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: in.seq, Timestamp: in.ts}, Payload: payload}
+	if !in.s.FailoverRTP(in.kind, in.layer, in.backup, p) {
+		return false
+	}
+	*forwarded = append(*forwarded, testForwarded{p, in.backup, in.ts})
+	return true
+}
+
+/*
+check that the forwarded packets continue across switches
+sequence numbers increment by one, timestamps keep their distances within an ingest
+and advance by at least minGap ticks at a switch
+*/
+func testFailoverContinuity(t *testing.T, forwarded []testForwarded, minGap uint32) {
+	t.Helper()
+	for i := 1; i < len(forwarded); i++ {
+		p, last := forwarded[i], forwarded[i-1]
+		if p.packet.SequenceNumber != last.packet.SequenceNumber+1 {
+			t.Errorf("packet %v: sequence number %v after %v", i, p.packet.SequenceNumber, last.packet.SequenceNumber)
+		}
+		gap := p.packet.Timestamp - last.packet.Timestamp
+		if p.backup == last.backup {
+			if want := p.ts - last.ts; gap != want {
+				t.Errorf("packet %v: timestamp advanced by %v, want %v", i, gap, want)
+			}
+		} else if gap < minGap || gap > 90000 {
+			t.Errorf("packet %v: timestamp advanced by %v at the switch, want at least %v", i, gap, minGap)
+		}
+	}
+}
+
+/*
+the backup takes over at its first keyframe after the primary was silent for the failover timeout
+and the primary takes back over at its next keyframe, across sequence number and timestamp wraps
+*/
+func TestFailoverVideo(t *testing.T) {
+	s := testFailoverSession(t)
+	primary := &testIngest{s: s, kind: webrtc.RTPCodecTypeVideo, seq: 65530, ts: 0xFFFFFFFF - 6000, step: 3000}
+	backup := &testIngest{s: s, kind: webrtc.RTPCodecTypeVideo, backup: true, seq: 65000, ts: 12345, step: 3000}
+	var forwarded []testForwarded
+	// the primary is forwarded from its first packet on, the backup is dropped while it is live
+	for i := 0; i < 10; i++ {
+		if !primary.send(testVP8Delta, &forwarded) {
+			t.Fatalf("primary packet %v dropped", i)
+		}
+		if backup.send(testVP8Keyframe, &forwarded) {
+			t.Fatalf("backup packet %v forwarded while the primary is live", i)
+		}
+	}
+	if forwarded[0].packet.SequenceNumber != 65531 || forwarded[0].packet.Timestamp != 0xFFFFFFFF-3000 {
+		t.Errorf("first packet rewritten to %v/%v", forwarded[0].packet.SequenceNumber, forwarded[0].packet.Timestamp)
+	}
+	// the backup waits for a keyframe after the primary went silent
+	time.Sleep(2 * failoverTimeout)
+	for i := 0; i < 3; i++ {
+		if backup.send(testVP8Delta, &forwarded) {
+			t.Fatal("backup forwarded without a keyframe")
+		}
+	}
+	backupStart := len(forwarded)
+	// the backup sequence numbers wrap
+	for i := 0; i < 1000; i++ {
+		payload := testVP8Delta
+		if i%100 == 0 {
+			payload = testVP8Keyframe
+		}
+		if !backup.send(payload, &forwarded) {
+			t.Fatalf("backup packet %v dropped after the failover", i)
+		}
+	}
+	if !forwarded[backupStart].backup || backup.seq > 1000 {
+		t.Fatal("backup did not take over or its sequence numbers did not wrap")
+	}
+	// the recovered primary takes back over at its next keyframe, the backup is forwarded until then
+	for i := 0; i < 3; i++ {
+		if primary.send(testVP8Delta, &forwarded) || !backup.send(testVP8Delta, &forwarded) {
+			t.Fatal("primary forwarded or backup dropped while waiting for the keyframe of the primary")
+		}
+	}
+	primaryStart := len(forwarded)
+	for i := 0; i < 10; i++ {
+		payload := testVP8Delta
+		if i == 0 {
+			payload = testVP8Keyframe
+		}
+		if !primary.send(payload, &forwarded) {
+			t.Fatalf("primary packet %v dropped after recovering", i)
+		}
+		if backup.send(testVP8Keyframe, &forwarded) {
+			t.Fatalf("backup packet %v forwarded after the primary recovered", i)
+		}
+	}
+	if forwarded[primaryStart].backup {
+		t.Fatal("primary did not take back over")
+	}
+	// at least the time the primary was silent passed at the first switch
+	testFailoverContinuity(t, forwarded, 1)
+	if gap := forwarded[backupStart].packet.Timestamp - forwarded[backupStart-1].packet.Timestamp; gap < uint32(failoverTimeout.Milliseconds())*90 {
+		t.Errorf("timestamp advanced by %v ticks after %v without packets", gap, 2*failoverTimeout)
+	}
+}
+
+// audio switches right away and the layers of a kind keep their own offsets
+func TestFailoverAudio(t *testing.T) {
+	s := testFailoverSession(t)
+	var forwarded [2][]testForwarded
+	ingests := [2][2]*testIngest{}
+	for layer := range ingests {
+		ingests[layer] = [2]*testIngest{
+			{s: s, kind: webrtc.RTPCodecTypeAudio, layer: layer, seq: uint16(65500 + layer), ts: 48000, step: 960},
+			{s: s, kind: webrtc.RTPCodecTypeAudio, layer: layer, backup: true, seq: uint16(20000 * layer), ts: 0xFFFFFF00, step: 960},
+		}
+	}
+	send := func(backup int, packets int) {
+		for i := 0; i < packets; i++ {
+			for layer := range ingests {
+				ingests[layer][backup].send([]byte{0xFC}, &forwarded[layer])
+			}
+		}
+	}
+	send(0, 20)
+	time.Sleep(2 * failoverTimeout)
+	send(1, 50)
+	send(0, 20)
+	for layer := range forwarded {
+		if len(forwarded[layer]) != 90 || !forwarded[layer][20].backup || forwarded[layer][70].backup {
+			t.Fatalf("layer %v: %v packets forwarded, want 90 with 50 of the backup", layer, len(forwarded[layer]))
+		}
+		testFailoverContinuity(t, forwarded[layer], 1)
+		// the 40ms the primary was silent at 48kHz
+		if gap := forwarded[layer][20].packet.Timestamp - forwarded[layer][19].packet.Timestamp; gap < 1920 {
+			t.Errorf("layer %v: timestamp advanced by %v ticks after %v without packets", layer, gap, 2*failoverTimeout)
+		}
+	}
+}
+
+// marshaled packets are rewritten in place
+func TestFailoverPacket(t *testing.T) {
+	s := testFailoverSession(t)
+	packet := func(seq uint16, ts uint32) []byte {
+		p := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: ts, SSRC: 5}, Payload: testVP8Keyframe}
+		b, err := p.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if !s.FailoverPacket(webrtc.RTPCodecTypeVideo, 0, false, packet(65535, 1000)) {
+		t.Fatal("first primary packet dropped")
+	}
+	time.Sleep(2 * failoverTimeout)
+	b := packet(7, 500)
+	if !s.FailoverPacket(webrtc.RTPCodecTypeVideo, 0, true, b) {
+		t.Fatal("backup keyframe dropped after the failover timeout")
+	}
+	var p rtp.Packet
+	if err := p.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if p.SequenceNumber != 0 || p.Timestamp <= 1000 || p.SSRC != 5 || string(p.Payload) != string(testVP8Keyframe) {
+		t.Errorf("backup packet rewritten to %+v", p)
+	}
+	if s.FailoverPacket(webrtc.RTPCodecTypeVideo, 0, true, []byte{0x80}) {
+		t.Error("truncated packet forwarded")
+	}
+}
+
+func TestClockRate(t *testing.T) {
+	tests := []struct {
+		kind     webrtc.RTPCodecType
+		mimeType string
+		want     uint32
+	}{
+		{webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH264, 90000},
+		{webrtc.RTPCodecTypeAudio, webrtc.MimeTypeOpus, 48000},
+		{webrtc.RTPCodecTypeAudio, "audio/pcmu", 8000},
+		{webrtc.RTPCodecTypeAudio, webrtc.MimeTypePCMA, 8000},
+		{webrtc.RTPCodecTypeAudio, webrtc.MimeTypeG722, 8000},
+	}
+	for _, test := range tests {
+		if got := clockRate(test.kind, test.mimeType); got != test.want {
+			t.Errorf("%v %v: got %v, want %v", test.kind, test.mimeType, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package sessions
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// streams not received for this long are dropped from the ingest status
+const ingestStatsTimeout = time.Minute
+
+// max number of streams tracked, packets of further unknown ssrcs are not counted
+const maxIngestStats = 1024
+
+// state of an incoming rtp stream as reported by the api, unbound streams are dropped by the writer loops
+type IngestStatus struct {
+	Port       uint16    `json:"port"`
+	SSRC       uint32    `json:"ssrc"`
+	Session    string    `json:"session,omitempty"`
+	Layer      int       `json:"layer,omitempty"`
+	Backup     bool      `json:"backup,omitempty"`
+	Bound      bool      `json:"bound"`
+	Source     string    `json:"source"` // address the stream is received from
+	Packets    uint64    `json:"packets"`
+	Bytes      uint64    `json:"bytes"`
+	LastPacket time.Time `json:"last_packet"`
+}
+
+type ingestStats struct {
+	source     net.Addr
+	packets    uint64
+	bytes      uint64
+	lastPacket time.Time
+}
+
+// counters of incoming rtp streams by port and ssrc
+var ingestCounters = make(map[ingestKey]*ingestStats)
+
+// mutex for above map read/write
+var statsMutex sync.Mutex
+
+// count a packet received by the writer loops, bound to a session or not
+func RecordIngest(port uint16, ssrc uint32, source net.Addr, size int) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	key := ingestKey{port, ssrc}
+	stats, exists := ingestCounters[key]
+	if !exists {
+		if len(ingestCounters) >= maxIngestStats {
+			pruneIngestStats()
+			if len(ingestCounters) >= maxIngestStats {
+				return
+			}
+		}
+		stats = &ingestStats{}
+		ingestCounters[key] = stats
+	}
+	stats.source = source
+	stats.packets++
+	stats.bytes += uint64(size)
+	stats.lastPacket = time.Now()
+}
+
+// status of the streams received within the last minute, sorted by port and ssrc
+func ListIngest() []IngestStatus {
+	statsMutex.Lock()
+	pruneIngestStats()
+	list := make([]IngestStatus, 0, len(ingestCounters))
+	for key, stats := range ingestCounters {
+		status := IngestStatus{
+			Port:       key.port,
+			SSRC:       key.ssrc,
+			Packets:    stats.packets,
+			Bytes:      stats.bytes,
+			LastPacket: stats.lastPacket,
+		}
+		if stats.source != nil {
+			status.Source = stats.source.String()
+		}
+		list = append(list, status)
+	}
+	statsMutex.Unlock()
+	// bindings may have changed since the packets were received
+	for i := range list {
+		var binding IngestBinding
+		list[i].Session, binding, list[i].Bound = ReturnIngestBinding(list[i].Port, list[i].SSRC)
+		list[i].Layer, list[i].Backup = binding.Layer, binding.Backup
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Port != list[j].Port {
+			return list[i].Port < list[j].Port
+		}
+		return list[i].SSRC < list[j].SSRC
+	})
+	return list
+}
+
+// must be called with lock held
+func pruneIngestStats() {
+	for key, stats := range ingestCounters {
+		if time.Since(stats.lastPacket) > ingestStatsTimeout {
+			delete(ingestCounters, key)
+		}
+	}
+}
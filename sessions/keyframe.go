@@ -0,0 +1,207 @@
+package sessions
+
+import (
+	"net"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/metrics"
+	"sync"
+	"time"
+
+	"github.com/pion/randutil"
+	"github.com/pion/rtcp"
+)
+
+// minimum time between two keyframe requests sent to the same source
+var keyframeRequestInterval time.Duration
+
+// sources not sending anything for this long are forgotten
+const sourceTimeout = 5 * time.Second
+
+// anything rtcp feedback can be sent to, like a pion PeerConnection
+type RTCPWriter interface {
+	WriteRTCP(pkts []rtcp.Packet) error
+}
+
+// rtcp feedback to a plain rtp source, sent from the listener the stream is received on
+type udpFeedback struct {
+	conn net.PacketConn // listener the stream is received on
+	addr net.Addr       // address the stream is received from
+}
+
+func (uf *udpFeedback) WriteRTCP(pkts []rtcp.Packet) error {
+	payload, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return err
+	}
+	_, err = uf.conn.WriteTo(payload, uf.addr)
+	return err
+}
+
+/*
+remote rtp source of a session
+remembered so that rtcp feedback (PLI/FIR) can be sent back to the encoder
+*/
+type ingestSource struct {
+	feedback RTCPWriter // where keyframe requests are sent to
+	ssrc     uint32     // ssrc of the incoming stream
+	lastSeen time.Time  // time the last packet was received
+}
+
+// primary and backup may send with the same ssrc, so sources are told apart by both
+type sourceKey struct {
+	ssrc   uint32
+	backup bool
+}
+
+// set of sources (primary, backup) a keyframe request is sent to
+type keyframeTargets uint8
+
+const keyframeTargetsAll = keyframeTargets(1<<sourcePrimary | 1<<sourceBackup)
+
+/*
+keyframe request state of a session
+requests from all viewers are combined and throttled before reaching the source
+*/
+type keyframeRequester struct {
+	mu          sync.Mutex
+	sources     map[sourceKey]*ingestSource // video sources of the session (one per simulcast layer and primary/backup)
+	senderSSRC  uint32                      // ssrc used by the server as rtcp sender
+	firSequence uint8                       // FIR command sequence number, incremented for every new request
+	lastSent    time.Time                   // time of the last request sent to the sources
+	pending     keyframeTargets             // sources of the request scheduled after the throttle interval, 0 if none
+}
+
+func newKeyframeRequester() *keyframeRequester {
+	return &keyframeRequester{
+		sources:    make(map[sourceKey]*ingestSource),
+		senderSSRC: randutil.NewMathRandomGenerator().Uint32(),
+	}
+}
+
+/*
+remember the udp source of a video stream, called for every received packet
+a source that moved to another address is updated in place
+*/
+func (s *Session) SetVideoSource(conn net.PacketConn, addr net.Addr, ssrc uint32, backup bool) {
+	kr := s.keyframes
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	key := sourceKey{ssrc, backup}
+	if source, ok := kr.sources[key]; ok {
+		if uf, isUDP := source.feedback.(*udpFeedback); isUDP {
+			if !sameAddr(uf.addr, addr) {
+				uf.conn, uf.addr = conn, addr
+			}
+			source.lastSeen = time.Now()
+			return
+		}
+	}
+	kr.sources[key] = &ingestSource{
+		feedback: &udpFeedback{conn: conn, addr: addr},
+		ssrc:     ssrc,
+		lastSeen: time.Now(),
+	}
+}
+
+/*
+remember a video source receiving rtcp feedback through its own transport
+(e.g. a publishing peerconnection), called for every received packet
+*/
+func (s *Session) SetVideoFeedback(ssrc uint32, backup bool, feedback RTCPWriter) {
+	kr := s.keyframes
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	key := sourceKey{ssrc, backup}
+	if source, ok := kr.sources[key]; ok && source.feedback == feedback {
+		source.lastSeen = time.Now()
+		return
+	}
+	kr.sources[key] = &ingestSource{
+		feedback: feedback,
+		ssrc:     ssrc,
+		lastSeen: time.Now(),
+	}
+}
+
+/*
+ask the video sources of the session for a new keyframe
+requests arriving within the throttle interval are merged into a single one
+*/
+func (s *Session) RequestKeyframe() {
+	s.keyframes.request(keyframeTargetsAll)
+}
+
+// ask only the primary or only the backup sources for a keyframe, like the one a failover waits for
+func (s *Session) requestSourceKeyframe(source int) {
+	s.keyframes.request(keyframeTargets(1 << source))
+}
+
+func (kr *keyframeRequester) request(targets keyframeTargets) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	// already scheduled, this request is sent along
+	if kr.pending != 0 {
+		kr.pending |= targets
+		return
+	}
+	wait := time.Until(kr.lastSent.Add(keyframeRequestInterval))
+	if wait <= 0 {
+		kr.send(targets)
+		return
+	}
+	kr.pending = targets
+	time.AfterFunc(wait, func() {
+		kr.mu.Lock()
+		defer kr.mu.Unlock()
+		targets := kr.pending
+		kr.pending = 0
+		kr.send(targets)
+	})
+}
+
+// send PLI and FIR to the active sources among targets, must be called with lock held
+func (kr *keyframeRequester) send(targets keyframeTargets) {
+	kr.lastSent = time.Now()
+	kr.firSequence++
+	for key, source := range kr.sources {
+		if time.Since(source.lastSeen) > sourceTimeout {
+			delete(kr.sources, key)
+			continue
+		}
+		target := sourcePrimary
+		if key.backup {
+			target = sourceBackup
+		}
+		if targets&(1<<target) == 0 {
+			continue
+		}
+		err := source.feedback.WriteRTCP([]rtcp.Packet{
+			&rtcp.PictureLossIndication{
+				SenderSSRC: kr.senderSSRC,
+				MediaSSRC:  source.ssrc,
+			},
+			&rtcp.FullIntraRequest{
+				SenderSSRC: kr.senderSSRC,
+				FIR: []rtcp.FIREntry{{
+					SSRC:           source.ssrc,
+					SequenceNumber: kr.firSequence,
+				}},
+			},
+		})
+		if err != nil {
+			logging.Warnf("could not send keyframe request to ssrc %v: %v", source.ssrc, err)
+			continue
+		}
+		metrics.KeyframeRequests.Inc()
+	}
+}
+
+// compare two source addresses without allocating for udp addresses
+func sameAddr(a, b net.Addr) bool {
+	ua, okA := a.(*net.UDPAddr)
+	ub, okB := b.(*net.UDPAddr)
+	if okA && okB {
+		return ua.Port == ub.Port && ua.IP.Equal(ub.IP)
+	}
+	return a.String() == b.String()
+}
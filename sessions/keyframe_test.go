@@ -0,0 +1,96 @@
+package sessions
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// rtcp feedback of a source, counting the keyframe requests it received
+type testFeedback struct {
+	mu       sync.Mutex
+	requests int
+}
+
+func (f *testFeedback) WriteRTCP(pkts []rtcp.Packet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	return nil
+}
+
+func (f *testFeedback) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// primary and backup sending with the same ssrc keep their own feedback
+func TestKeyframeSources(t *testing.T) {
+	s := testFailoverSession(t)
+	primary, backup := &testFeedback{}, &testFeedback{}
+	s.SetVideoFeedback(1234, false, primary)
+	s.SetVideoFeedback(1234, true, backup)
+	s.RequestKeyframe()
+	if primary.count() != 1 || backup.count() != 1 {
+		t.Fatalf("primary got %v and backup %v requests, want 1 each", primary.count(), backup.count())
+	}
+	s.requestSourceKeyframe(sourceBackup)
+	if primary.count() != 1 || backup.count() != 2 {
+		t.Errorf("request for the backup sent to the primary %v times and the backup %v times", primary.count()-1, backup.count()-1)
+	}
+}
+
+// udp sources are remembered once per packet without allocating
+func TestSetVideoSource(t *testing.T) {
+	s := testFailoverSession(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	primary := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	backup := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6000}
+	allocs := testing.AllocsPerRun(100, func() {
+		s.SetVideoSource(conn, primary, 1234, false)
+		s.SetVideoSource(conn, backup, 1234, true)
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per packet", allocs)
+	}
+	if len(s.keyframes.sources) != 2 {
+		t.Fatalf("%v sources remembered, want the primary and the backup", len(s.keyframes.sources))
+	}
+	// a source sending from another address is updated
+	moved := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7000}
+	s.SetVideoSource(conn, moved, 1234, true)
+	if uf := s.keyframes.sources[sourceKey{1234, true}].feedback.(*udpFeedback); uf.addr != moved {
+		t.Errorf("backup address %v, want %v", uf.addr, moved)
+	}
+}
+
+// while waiting for the keyframe of the source switched to, only that source is asked for one
+func TestFailoverKeyframeRequest(t *testing.T) {
+	s := testFailoverSession(t)
+	primaryFeedback, backupFeedback := &testFeedback{}, &testFeedback{}
+	s.SetVideoFeedback(1234, false, primaryFeedback)
+	s.SetVideoFeedback(1234, true, backupFeedback)
+	primary := &testIngest{s: s, kind: webrtc.RTPCodecTypeVideo, step: 3000}
+	backup := &testIngest{s: s, kind: webrtc.RTPCodecTypeVideo, backup: true, step: 3000}
+	var forwarded []testForwarded
+	primary.send(testVP8Keyframe, &forwarded)
+	time.Sleep(2 * failoverTimeout)
+	backup.send(testVP8Delta, &forwarded)
+	if primaryFeedback.count() != 0 || backupFeedback.count() != 1 {
+		t.Fatalf("failing over: primary got %v and backup %v requests", primaryFeedback.count(), backupFeedback.count())
+	}
+	backup.send(testVP8Keyframe, &forwarded)
+	primary.send(testVP8Delta, &forwarded)
+	if primaryFeedback.count() != 1 || backupFeedback.count() != 1 {
+		t.Errorf("switching back: primary got %v and backup %v requests", primaryFeedback.count(), backupFeedback.count())
+	}
+}
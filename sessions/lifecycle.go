@@ -0,0 +1,234 @@
+package sessions
+
+import (
+	"encoding/json"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/metrics"
+	"pion-webrtc-sfu/user"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// time without packets and users after which a session is removed, set by InitSessions
+var idleTimeout time.Duration
+
+// time without packets of a kind after which viewers are told the stream stalled, set by InitSessions
+var stallTimeout time.Duration
+
+// configuration for the track groups of new sessions, set by InitSessions
+var trackConfig *configuration.Configuration
+
+// time the websocket loop of a user gets to pick up a notification
+const notificationTimeout = time.Second
+
+// how often live sessions are checked for stalls and idle sessions collected
+const watchInterval = 250 * time.Millisecond
+
+// notifications not yet delivered per session, more are dropped
+const notificationBacklog = 32
+
+// activity of one media kind of the source of a session
+type mediaActivity struct {
+	lastPacket atomic.Int64 // unix nanoseconds, 0 before the first packet
+	stalled    atomic.Bool  // no packets for the stall timeout, reset by the next packet
+}
+
+/*
+session fed by an ingest, created with the first packet
+marks the stream live and notifies viewers when it starts or resumes
+returns nil if the session could not be created
+*/
+func IngestSession(id string, kind webrtc.RTPCodecType) *Session {
+	sess := ReturnSessionByIdIfExists(id)
+	if sess == nil {
+		var err error
+		if sess, err = AddSession(id); err != nil {
+			logging.With("session_id", id).Errorf("could not create session for ingest: %v", err)
+			return nil
+		}
+	}
+	sess.packetReceived(kind)
+	return sess
+}
+
+/*
+create a session through the api, it is kept without users and packets until closed
+returns false if it existed already, it is made persistent then
+*/
+func CreatePersistentSession(id string) (bool, error) {
+	existing := ReturnSessionByIdIfExists(id)
+	sess, err := AddSession(id)
+	if err != nil {
+		return false, err
+	}
+	mutex.Lock()
+	sess.persistent = true
+	mutex.Unlock()
+	return existing == nil, nil
+}
+
+// true if the source of the session sent packets within the idle timeout
+func (s *Session) Live() bool {
+	return s.live.Load()
+}
+
+func (s *Session) activity(kind webrtc.RTPCodecType) *mediaActivity {
+	if kind == webrtc.RTPCodecTypeVideo {
+		return &s.video
+	}
+	return &s.audio
+}
+
+func (s *Session) packetReceived(kind webrtc.RTPCodecType) {
+	now := time.Now().UnixNano()
+	media := s.activity(kind)
+	media.lastPacket.Store(now)
+	s.lastPacket.Store(now)
+	s.lastActivity.Store(now)
+	if !s.live.Swap(true) {
+		// stalls of the previous broadcast are over with the new one, it may not have both kinds
+		for _, other := range []*mediaActivity{&s.video, &s.audio} {
+			other.stalled.Store(false)
+			if other != media {
+				other.lastPacket.Store(0)
+			}
+		}
+		s.streamEvent(user.MESSAGE_STREAMSTARTED, "")
+		return
+	}
+	if media.stalled.Swap(false) {
+		s.streamEvent(user.MESSAGE_STREAMRESUMED, kind.String())
+		s.endSlate(kind)
+	}
+}
+
+// end the stream of a session right away, for ingests that know their publisher stopped
+func EndStream(id string) {
+	sess := ReturnSessionByIdIfExists(id)
+	if sess == nil || !sess.live.Swap(false) {
+		return
+	}
+	sess.stopSlates()
+	sess.streamEvent(user.MESSAGE_STREAMENDED, "")
+}
+
+// remember activity, sessions are collected once idle for long enough
+func (s *Session) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// log, count and tell the viewers about a change of the stream, kind is empty for the whole stream
+func (s *Session) streamEvent(event user.MessageType, kind string) {
+	logger := logging.With("session_id", s.id)
+	var payload json.RawMessage
+	if kind != "" {
+		logger = logger.With("kind", kind)
+		payload, _ = json.Marshal(user.StreamEventPayload{Kind: kind})
+	}
+	logger.Infof("stream event %v", event)
+	metrics.StreamEvents.Inc(string(event))
+	s.notifyUsers(user.Message{Type: event, RawPayload: payload})
+}
+
+/*
+queue a message to the websocket of every user
+delivered by the notifier of the session, the ingest must not wait for slow websockets
+*/
+func (s *Session) notifyUsers(message user.Message) {
+	select {
+	case s.notifications <- message:
+	default:
+		logging.With("session_id", s.id).Warnf("notification backlog full, dropping %v", message.Type)
+	}
+}
+
+/*
+deliver queued notifications in order, users get them in parallel
+exits once the session is removed
+*/
+func (s *Session) notifier() {
+	for {
+		select {
+		case <-s.removed:
+			return
+		case message := <-s.notifications:
+			var wg sync.WaitGroup
+			s.RWMutex.RLock()
+			for _, u := range s.ConnectedUsers {
+				if u.State.GetWsState() != user.Connected {
+					continue
+				}
+				wg.Add(1)
+				go func(u *user.User) {
+					defer wg.Done()
+					u.WsMessageBuffer.TryPushToClientBuffer(message, notificationTimeout)
+				}(u)
+			}
+			s.RWMutex.RUnlock()
+			wg.Wait()
+		}
+	}
+}
+
+/*
+tell viewers about stalled and ended streams and remove idle sessions
+stalled kinds get the slate of the session until they resume
+a kind stalls without packets for the stall timeout, the stream ends without any for the idle timeout
+sessions are idle without users and without packets or user changes for the idle timeout
+*/
+func watchSessions() {
+	for now := range time.Tick(watchInterval) {
+		collectSessions(now)
+	}
+}
+
+func collectSessions(now time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for id, session := range sessions {
+		session.checkStream(now)
+		// decided under the user lock, users can't join once removed is closed
+		session.RWMutex.Lock()
+		idle := len(session.ConnectedUsers) == 0 && !session.persistent && now.Sub(time.Unix(0, session.lastActivity.Load())) > idleTimeout
+		if idle {
+			close(session.removed)
+		}
+		session.RWMutex.Unlock()
+		if !idle {
+			continue
+		}
+		delete(sessions, id)
+		session.stopSlates()
+		removeAACConfig(id)
+		go session.closeUpstream(id)
+		logging.With("session_id", id).Infof("removed idle session")
+	}
+}
+
+func (s *Session) checkStream(now time.Time) {
+	if !s.live.Load() {
+		return
+	}
+	if now.Sub(time.Unix(0, s.lastPacket.Load())) > idleTimeout {
+		s.live.Store(false)
+		s.stopSlates()
+		s.streamEvent(user.MESSAGE_STREAMENDED, "")
+		return
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		media := s.activity(kind)
+		last := media.lastPacket.Load()
+		// kinds the source never sent can't stall
+		if last == 0 || now.Sub(time.Unix(0, last)) <= stallTimeout {
+			continue
+		}
+		if !media.stalled.Swap(true) {
+			s.streamEvent(user.MESSAGE_STREAMSTALLED, kind.String())
+			s.startSlate(kind)
+		}
+	}
+}
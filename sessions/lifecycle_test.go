@@ -0,0 +1,157 @@
+package sessions
+
+import (
+	"errors"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/user"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// empty session map with vp8 and opus tracks and a short idle timeout, all restored when the test ends
+func testSessions(t *testing.T) {
+	mutex.Lock()
+	previous, config, idle := sessions, trackConfig, idleTimeout
+	sessions = make(map[string]*Session)
+	trackConfig = &configuration.Configuration{Rtc_video_codec: webrtc.MimeTypeVP8, Rtc_audio_codec: webrtc.MimeTypeOpus}
+	idleTimeout = 200 * time.Millisecond
+	mutex.Unlock()
+	t.Cleanup(func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		// stop the notifiers of the sessions left
+		for _, session := range sessions {
+			close(session.removed)
+		}
+		sessions, trackConfig, idleTimeout = previous, config, idle
+	})
+}
+
+// viewer with an open websocket
+func testViewer(t *testing.T, s *Session, uuid string) *user.User {
+	t.Helper()
+	u := testUser(uuid)
+	u.State.SetWsState(user.Connected)
+	if err := s.AddUser(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// check the next message delivered to the websocket of the viewer, no message is expected for an empty event
+func testDelivered(t *testing.T, u *user.User, event user.MessageType) {
+	t.Helper()
+	timeout := time.Second
+	if event == "" {
+		timeout = 50 * time.Millisecond
+	}
+	select {
+	case message := <-u.WsMessageBuffer.ReadFromClientBuffer():
+		if message.Type != event {
+			t.Fatalf("got %v, want %v", message.Type, event)
+		}
+	case <-time.After(timeout):
+		if event != "" {
+			t.Fatalf("no message, want %v", event)
+		}
+	}
+}
+
+/*
+viewers of a session created through the api wait until the first packet of the ingest starts the stream,
+a new broadcast after the end of the stream starts it again
+*/
+func TestStreamStarted(t *testing.T) {
+	testSessions(t)
+	if created, err := CreatePersistentSession("waiting"); !created || err != nil {
+		t.Fatalf("session not created: %v", err)
+	}
+	s := ReturnSessionByIdIfExists("waiting")
+	u := testViewer(t, s, "a")
+	// the websocket tells viewers to wait while the session is not live
+	if s.Live() {
+		t.Fatal("session live without packets")
+	}
+	testDelivered(t, u, "")
+	if IngestSession("waiting", webrtc.RTPCodecTypeVideo) != s {
+		t.Fatal("ingest fed another session")
+	}
+	testDelivered(t, u, user.MESSAGE_STREAMSTARTED)
+	if !s.Live() {
+		t.Fatal("session not live after the first packet")
+	}
+	// further packets of any kind don't start the stream again
+	IngestSession("waiting", webrtc.RTPCodecTypeVideo)
+	IngestSession("waiting", webrtc.RTPCodecTypeAudio)
+	testDelivered(t, u, "")
+	EndStream("waiting")
+	testDelivered(t, u, user.MESSAGE_STREAMENDED)
+	if s.Live() {
+		t.Fatal("session live after the end of the stream")
+	}
+	IngestSession("waiting", webrtc.RTPCodecTypeAudio)
+	testDelivered(t, u, user.MESSAGE_STREAMSTARTED)
+}
+
+/*
+sessions without users, packets or user changes for the idle timeout are removed,
+sessions created through the api are kept
+*/
+func TestCollectSessions(t *testing.T) {
+	testSessions(t)
+	ingest := IngestSession("ingest", webrtc.RTPCodecTypeVideo)
+	if ingest == nil {
+		t.Fatal("no session created for the ingest")
+	}
+	if _, err := CreatePersistentSession("api"); err != nil {
+		t.Fatal(err)
+	}
+	watched, err := AddSession("watched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := testViewer(t, watched, "a")
+	tests := []struct {
+		name string
+		at   time.Time
+		want []string
+	}{
+		{"within the idle timeout", time.Now(), []string{"ingest", "api", "watched"}},
+		{"after the idle timeout", time.Now().Add(2 * idleTimeout), []string{"api", "watched"}},
+	}
+	for _, test := range tests {
+		collectSessions(test.at)
+		mutex.Lock()
+		count := len(sessions)
+		mutex.Unlock()
+		if count != len(test.want) {
+			t.Errorf("%v: %v sessions, want %v", test.name, count, test.want)
+		}
+		for _, id := range test.want {
+			if ReturnSessionByIdIfExists(id) == nil {
+				t.Errorf("%v: session %v removed", test.name, id)
+			}
+		}
+	}
+	// nobody joins a removed session, the next packet of the ingest creates a new one
+	if err := ingest.AddUser(testUser("b")); !errors.Is(err, ErrSessionRemoved) {
+		t.Errorf("joined the removed session: %v", err)
+	}
+	if again := IngestSession("ingest", webrtc.RTPCodecTypeVideo); again == nil || again == ingest {
+		t.Error("no new session created for the ingest")
+	}
+	// creating an existing session through the api makes it persistent
+	if created, err := CreatePersistentSession("watched"); created || err != nil {
+		t.Fatalf("existing session created again: %v %v", created, err)
+	}
+	// the viewer left long ago
+	u.State.SetWsState(user.Done)
+	u.State.SetRtcState(user.Done)
+	UpdateSessions()
+	collectSessions(time.Now().Add(2 * idleTimeout))
+	if ReturnSessionByIdIfExists("watched") == nil || ReturnSessionByIdIfExists("api") == nil {
+		t.Error("persistent session removed")
+	}
+}
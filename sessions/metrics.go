@@ -0,0 +1,45 @@
+package sessions
+
+import (
+	"pion-webrtc-sfu/metrics"
+	"pion-webrtc-sfu/user"
+)
+
+// active sessions and their users by connection state, collected on every scrape
+func init() {
+	metrics.NewGaugeFunc("sfu_sessions", "Active sessions, a session exists while it is fed, has users or was created through the api.", nil, func() []metrics.Sample {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return []metrics.Sample{{Value: float64(len(sessions))}}
+	})
+	metrics.NewGaugeFunc("sfu_sessions_live", "Sessions receiving packets from their source.", nil, func() []metrics.Sample {
+		mutex.Lock()
+		defer mutex.Unlock()
+		live := 0
+		for _, session := range sessions {
+			if session.Live() {
+				live++
+			}
+		}
+		return []metrics.Sample{{Value: float64(live)}}
+	})
+	metrics.NewGaugeFunc("sfu_users", "Users of all sessions by connection (ws or rtc) and state.", []string{"connection", "state"}, func() []metrics.Sample {
+		counts := make(map[[2]string]int)
+		// common states are exported as 0 without users
+		for _, state := range []user.State{user.Disconnected, user.AwaitingConnection, user.Connected, user.Done} {
+			counts[[2]string{"ws", state.String()}] = 0
+			counts[[2]string{"rtc", state.String()}] = 0
+		}
+		for _, status := range ListSessions() {
+			for _, u := range status.Users {
+				counts[[2]string{"ws", u.WsState}]++
+				counts[[2]string{"rtc", u.RtcState}]++
+			}
+		}
+		samples := make([]metrics.Sample, 0, len(counts))
+		for labels, count := range counts {
+			samples = append(samples, metrics.Sample{Value: float64(count), LabelValues: []string{labels[0], labels[1]}})
+		}
+		return samples
+	})
+}
@@ -2,38 +2,85 @@ package sessions
 
 import (
 	"errors"
+	"io"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
 	"pion-webrtc-sfu/tracks"
 	"pion-webrtc-sfu/user"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Session struct {
-	TrackGroup     tracks.TrackGroup // RTP track shared between all users
-	ConnectedUsers []*user.User      // connected users
-	sync.RWMutex                     // mutex for user list read/write
+	TrackGroup     tracks.TrackGroup  // RTP track shared between all users
+	ConnectedUsers []*user.User       // connected users
+	sync.RWMutex                      // mutex for user list read/write
+	keyframes      *keyframeRequester // forwards viewer keyframe requests to the source
+	upstream       io.Closer          // link pulling the session from an origin server, nil if fed locally
+	upstreamMutex  sync.Mutex         // mutex for upstream and connecting
+	connecting     chan struct{}      // closed once the running upstream connect finished, nil if none runs
+	id             string             // key of the session in the sessions map
+	persistent     bool               // created through the api, kept until deleted there. protected by the map mutex
+	lastActivity   atomic.Int64       // unix nanoseconds of the last packet or user change, for idle collection
+	lastPacket     atomic.Int64       // unix nanoseconds of the last packet received from the source
+	live           atomic.Bool        // packets were received within the idle timeout
+	video          mediaActivity      // last video packet and stall state
+	audio          mediaActivity      // last audio packet and stall state
+	videoFailover  failover           // primary/backup selection of the video ingest
+	audioFailover  failover           // primary/backup selection of the audio ingest
+	notifications  chan user.Message  // stream events queued for the websockets of the users
+	removed        chan struct{}      // closed once the session is removed
 }
 
 /*
 session manager for http / sock / rtc
 map unique session ID to a session
-ID used is the ssrc of the incoming rtp stream
+ID used is the name of the stream key feeding the session
+sessions are created by ingest or the api, and by viewers of sessions that are expected to be fed
 */
-var sessions map[uint32]*Session
+var sessions map[string]*Session
 
 // mutex for above map read/write
 var mutex sync.Mutex
 
-// initiate session map
-func InitSessions() {
+// returned when a user joins a session that was removed meanwhile
+var ErrSessionRemoved = errors.New("session was removed")
+
+// initiate session map and register stream keys from configuration
+func InitSessions(config *configuration.Configuration) error {
 	mutex.Lock()
-	defer mutex.Unlock()
-	sessions = make(map[uint32]*Session)
+	sessions = make(map[string]*Session)
+	keyframeRequestInterval = time.Millisecond * time.Duration(config.Rtc_keyframe_request_interval_ms)
+	idleTimeout = time.Second * time.Duration(config.Rtc_session_idle_timeout_seconds)
+	stallTimeout = time.Millisecond * time.Duration(config.Rtc_stream_stall_timeout_ms)
+	failoverTimeout = time.Millisecond * time.Duration(config.Rtc_failover_timeout_ms)
+	trackConfig = config
+	mutex.Unlock()
+	go watchSessions()
+	keys, err := parseStreamKeys(config.Rtc_stream_keys)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := RegisterStreamKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // add user to a session
 func (s *Session) AddUser(usr *user.User) error {
 	s.RWMutex.Lock()
 	defer s.RWMutex.Unlock()
+	// removed by the idle collector after it was looked up
+	select {
+	case <-s.removed:
+		return ErrSessionRemoved
+	default:
+	}
 	// check if user exists already
 	for _, u := range s.ConnectedUsers {
 		if u.Uuid == usr.Uuid {
@@ -41,6 +88,7 @@ func (s *Session) AddUser(usr *user.User) error {
 		}
 	}
 	s.ConnectedUsers = append(s.ConnectedUsers, usr)
+	s.touch()
 	return nil
 }
 
@@ -48,7 +96,7 @@ func (s *Session) AddUser(usr *user.User) error {
 check if remote IP exists in current sessions
 return session if it does
 */
-func ReturnSessionByIdIfExists(id uint32) *Session {
+func ReturnSessionByIdIfExists(id string) *Session {
 	mutex.Lock()
 	defer mutex.Unlock()
 	session, ok := sessions[id]
@@ -58,41 +106,268 @@ func ReturnSessionByIdIfExists(id uint32) *Session {
 	return nil
 }
 
-// add a new session with id if it doesn't exist and return in
-func AddSession(id uint32, trackGroup tracks.TrackGroup) *Session {
+// add a new session with id if it doesn't exist and return it
+func AddSession(id string) (*Session, error) {
 	mutex.Lock()
 	defer mutex.Unlock()
 	old, exists := sessions[id]
 	// already exists, return old
 	if exists {
-		return old
+		return old, nil
+	}
+	// create track group
+	trackGroup, err := tracks.NewTrackGroup(trackConfig)
+	if err != nil {
+		return nil, errors.New("server could not create track group")
 	}
 	new := &Session{
 		TrackGroup:     trackGroup,
 		ConnectedUsers: make([]*user.User, 0),
+		keyframes:      newKeyframeRequester(),
+		id:             id,
+		notifications:  make(chan user.Message, notificationBacklog),
+		removed:        make(chan struct{}),
 	}
+	new.touch()
+	go new.notifier()
 	sessions[id] = new
-	return new
+	logging.With("session_id", id).Infof("session created")
+	return new, nil
 }
 
 /*
 update sessions (remove inactive users)
 run this once in a while or when user is disconnected
+sessions without users are removed by the idle collector
 */
 func UpdateSessions() {
 	mutex.Lock()
 	defer mutex.Unlock()
 	for is, session := range sessions {
-		for iu, u := range session.ConnectedUsers {
-			// if no activity
-			if u.State.GetRtcState() == user.Done && u.State.GetWsState() == user.Done {
-				// remove from users
-				session.ConnectedUsers = append(session.ConnectedUsers[:iu], session.ConnectedUsers[iu+1:]...)
+		session.RWMutex.Lock()
+		users := session.ConnectedUsers[:0]
+		for _, u := range session.ConnectedUsers {
+			// keep users with activity
+			if u.State.GetRtcState() != user.Done || u.State.GetWsState() != user.Done {
+				users = append(users, u)
 			}
 		}
-		// delete session if no more users in it
-		if len(session.ConnectedUsers) == 0 {
-			delete(sessions, is)
+		if len(users) != len(session.ConnectedUsers) {
+			session.touch()
+		}
+		session.ConnectedUsers = users
+		session.RWMutex.Unlock()
+		// nobody left to watch what the origin sends
+		if len(users) == 0 {
+			go session.closeUpstream(is)
+		}
+	}
+}
+
+/*
+pull the session from an origin server unless it is already pulled
+connect is called once, viewers joining meanwhile wait for it
+the mutex is not held while connecting, so status reads don't wait for the origin
+*/
+func (s *Session) ConnectUpstream(connect func() (io.Closer, error)) error {
+	s.upstreamMutex.Lock()
+	for s.connecting != nil {
+		connecting := s.connecting
+		s.upstreamMutex.Unlock()
+		<-connecting
+		s.upstreamMutex.Lock()
+	}
+	if s.upstream != nil {
+		s.upstreamMutex.Unlock()
+		return nil
+	}
+	connecting := make(chan struct{})
+	s.connecting = connecting
+	s.upstreamMutex.Unlock()
+	upstream, err := connect()
+	s.upstreamMutex.Lock()
+	defer s.upstreamMutex.Unlock()
+	s.connecting = nil
+	close(connecting)
+	if err != nil {
+		return err
+	}
+	// removed while connecting, nobody would close the link
+	select {
+	case <-s.removed:
+		upstream.Close()
+		return errors.New("session was removed while connecting to the origin")
+	default:
+	}
+	s.upstream = upstream
+	return nil
+}
+
+/*
+close the link to the origin once nobody watches the session anymore
+users are checked again under the upstream mutex, a viewer that joined meanwhile keeps the link
+viewers are added before they connect upstream, so either they are seen here or they reconnect
+*/
+func (s *Session) closeUpstream(id string) {
+	s.upstreamMutex.Lock()
+	defer s.upstreamMutex.Unlock()
+	if s.upstream == nil {
+		return
+	}
+	select {
+	case <-s.removed:
+	default:
+		s.RWMutex.RLock()
+		users := len(s.ConnectedUsers)
+		s.RWMutex.RUnlock()
+		if users > 0 {
+			return
+		}
+	}
+	if err := s.upstream.Close(); err != nil {
+		logging.With("session_id", id).Errorf("could not close upstream: %v", err)
+	}
+	s.upstream = nil
+}
+
+// state of a user as reported by the api
+type UserStatus struct {
+	ID       string `json:"id"`
+	Role     string `json:"role,omitempty"`
+	WsState  string `json:"ws_state"`
+	RtcState string `json:"rtc_state"`
+}
+
+// state of a session as reported by the api
+type SessionStatus struct {
+	ID         string       `json:"id"`
+	Users      []UserStatus `json:"users"`
+	Upstream   bool         `json:"upstream"`   // pulled from an origin server
+	Live       bool         `json:"live"`       // packets are received
+	Persistent bool         `json:"persistent"` // created through the api
+}
+
+/*
+status of all sessions, sorted by id
+the map mutex is only held to copy the sessions, it blocks the ingest
+*/
+func ListSessions() []SessionStatus {
+	mutex.Lock()
+	listed := make([]*Session, 0, len(sessions))
+	persistent := make([]bool, 0, len(sessions))
+	for _, session := range sessions {
+		listed = append(listed, session)
+		persistent = append(persistent, session.persistent)
+	}
+	mutex.Unlock()
+	list := make([]SessionStatus, 0, len(listed))
+	for i, session := range listed {
+		list = append(list, session.status(persistent[i]))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// status of a session
+func GetSessionStatus(id string) (SessionStatus, bool) {
+	mutex.Lock()
+	session, exists := sessions[id]
+	var persistent bool
+	if exists {
+		persistent = session.persistent
+	}
+	mutex.Unlock()
+	if !exists {
+		return SessionStatus{}, false
+	}
+	return session.status(persistent), true
+}
+
+// persistent is protected by the map mutex and passed in by the caller
+func (s *Session) status(persistent bool) SessionStatus {
+	s.RWMutex.RLock()
+	users := make([]UserStatus, 0, len(s.ConnectedUsers))
+	for _, u := range s.ConnectedUsers {
+		users = append(users, UserStatus{
+			ID:       u.Uuid,
+			Role:     u.Role,
+			WsState:  u.State.GetWsState().String(),
+			RtcState: u.State.GetRtcState().String(),
+		})
+	}
+	s.RWMutex.RUnlock()
+	s.upstreamMutex.Lock()
+	upstream := s.upstream != nil
+	s.upstreamMutex.Unlock()
+	return SessionStatus{ID: s.id, Users: users, Upstream: upstream, Live: s.live.Load(), Persistent: persistent}
+}
+
+/*
+disconnect a user from the session, its websocket and webrtc loops exit and remove it
+returns false if the user is not in the session
+*/
+func (s *Session) KickUser(userID string) bool {
+	s.RWMutex.RLock()
+	defer s.RWMutex.RUnlock()
+	for _, u := range s.ConnectedUsers {
+		if u.Uuid == userID {
+			kick(u)
+			return true
+		}
+	}
+	return false
+}
+
+// disconnect the users of all sessions matching the filter, returns how many were kicked
+func KickUsers(filter func(u *user.User) bool) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	kicked := 0
+	for _, session := range sessions {
+		session.RWMutex.RLock()
+		for _, u := range session.ConnectedUsers {
+			if filter(u) {
+				kick(u)
+				kicked++
+			}
 		}
+		session.RWMutex.RUnlock()
+	}
+	return kicked
+}
+
+/*
+disconnect all users of a session and drop its persistence
+the session is removed once their loops exited and it is idle
+*/
+func CloseSession(id string) bool {
+	mutex.Lock()
+	session, exists := sessions[id]
+	if exists {
+		session.persistent = false
+	}
+	mutex.Unlock()
+	if !exists {
+		return false
+	}
+	session.touch()
+	session.RWMutex.RLock()
+	defer session.RWMutex.RUnlock()
+	for _, u := range session.ConnectedUsers {
+		kick(u)
+	}
+	return true
+}
+
+/*
+end the websocket and webrtc loops of a user
+connections that are already done (like the websocket of whep viewers) must stay done for the user to be removed
+*/
+func kick(u *user.User) {
+	if u.State.GetWsState() != user.Done {
+		u.State.KillWs()
+	}
+	if u.State.GetRtcState() != user.Done {
+		u.State.KillRtc()
 	}
 }
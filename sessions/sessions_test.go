@@ -0,0 +1,71 @@
+package sessions
+
+import (
+	"errors"
+	"io"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/user"
+	"testing"
+)
+
+// origin link counting its closes
+type testUpstream struct {
+	closed int
+}
+
+func (u *testUpstream) Close() error {
+	u.closed++
+	return nil
+}
+
+func testUser(uuid string) *user.User {
+	u := user.NewUser(uuid, &configuration.Configuration{})
+	return &u
+}
+
+/*
+a queued close of the origin link keeps it if a viewer joined meanwhile,
+and closes it once nobody watches or the session was removed
+*/
+func TestCloseUpstream(t *testing.T) {
+	s := &Session{id: "upstream", removed: make(chan struct{})}
+	connect := func() *testUpstream {
+		t.Helper()
+		upstream := &testUpstream{}
+		if err := s.ConnectUpstream(func() (io.Closer, error) { return upstream, nil }); err != nil {
+			t.Fatal(err)
+		}
+		return upstream
+	}
+	first := connect()
+	// the last viewer left and the next one joined before the close ran
+	if err := s.AddUser(testUser("b")); err != nil {
+		t.Fatal(err)
+	}
+	if again := connect(); again.closed != 0 {
+		t.Fatal("link connected again while the session is pulled")
+	}
+	s.closeUpstream(s.id)
+	if first.closed != 0 || s.upstream == nil {
+		t.Fatal("link closed while a viewer is connected")
+	}
+	// nobody watches anymore
+	s.ConnectedUsers = nil
+	s.closeUpstream(s.id)
+	if first.closed != 1 || s.upstream != nil {
+		t.Fatalf("link closed %v times without viewers", first.closed)
+	}
+	// a removed session is closed with its users and takes no new ones
+	second := connect()
+	if err := s.AddUser(testUser("c")); err != nil {
+		t.Fatal(err)
+	}
+	close(s.removed)
+	if err := s.AddUser(testUser("d")); !errors.Is(err, ErrSessionRemoved) {
+		t.Errorf("user added to a removed session: %v", err)
+	}
+	s.closeUpstream(s.id)
+	if second.closed != 1 {
+		t.Error("link of a removed session not closed")
+	}
+}
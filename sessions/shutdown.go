@@ -0,0 +1,62 @@
+package sessions
+
+import (
+	"encoding/json"
+	"pion-webrtc-sfu/user"
+	"sync"
+	"time"
+)
+
+// time the websocket loop of a user gets to pick up the shutdown message
+const shutdownMessageTimeout = time.Second
+
+/*
+tell every user that the server is shutting down and close their connections
+users with a websocket get a shutdown message with the optional reconnect hint first,
+users are removed once their loops exited
+*/
+func Shutdown(reconnectHint string) {
+	payload, _ := json.Marshal(user.ShutdownPayload{Reconnect: reconnectHint})
+	mutex.Lock()
+	users := make([]*user.User, 0)
+	for _, session := range sessions {
+		session.RWMutex.RLock()
+		users = append(users, session.ConnectedUsers...)
+		session.RWMutex.RUnlock()
+	}
+	mutex.Unlock()
+	var wg sync.WaitGroup
+	for _, u := range users {
+		wg.Add(1)
+		go func(u *user.User) {
+			defer wg.Done()
+			if u.State.GetWsState() == user.Connected {
+				u.WsMessageBuffer.TryPushToClientBuffer(user.Message{
+					Type:       user.MESSAGE_SHUTDOWN,
+					RawPayload: payload,
+				}, shutdownMessageTimeout)
+			}
+			kick(u)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// wait until the users of all sessions left, returns false if some are left after timeout
+func WaitForDrain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		UpdateSessions()
+		left := 0
+		for _, status := range ListSessions() {
+			left += len(status.Users)
+		}
+		if left == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,61 @@
+package sessions
+
+import (
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/metrics"
+	"pion-webrtc-sfu/slate"
+	"pion-webrtc-sfu/tracks"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func (s *Session) track(kind webrtc.RTPCodecType) *tracks.RTPTrack {
+	if kind == webrtc.RTPCodecTypeVideo {
+		return s.TrackGroup.VideoTrack
+	}
+	return s.TrackGroup.AudioTrack
+}
+
+/*
+loop the slate of the session on the track of a stalled kind
+viewers switch to it at its first keyframe and back at the next live one
+*/
+func (s *Session) startSlate(kind webrtc.RTPCodecType) {
+	path, mimeType := slate.ForSession(s.id, kind == webrtc.RTPCodecTypeVideo)
+	if path == "" {
+		return
+	}
+	track := s.track(kind)
+	generation, started := track.StartSlate()
+	if !started {
+		return
+	}
+	logger := logging.With("session_id", s.id, "kind", kind.String())
+	logger.Infof("playing slate %v", path)
+	metrics.SlatesPlayed.Inc(kind.String())
+	go func() {
+		err := slate.Play(path, mimeType, func(p *rtp.Packet) bool {
+			playing, _ := track.WriteSlateRTP(generation, p)
+			return playing
+		})
+		if err != nil {
+			logger.Warnf("slate %v stopped: %v", path, err)
+			return
+		}
+		logger.Debugf("slate %v stopped", path)
+	}()
+}
+
+// the live stream of a kind resumed, video needs a keyframe to replace the slate soon
+func (s *Session) endSlate(kind webrtc.RTPCodecType) {
+	if kind == webrtc.RTPCodecTypeVideo && s.TrackGroup.VideoTrack.SlateActive() {
+		s.RequestKeyframe()
+	}
+}
+
+// stop the slates of both kinds, viewers keep the last frame until the stream starts again
+func (s *Session) stopSlates() {
+	s.TrackGroup.VideoTrack.StopSlate()
+	s.TrackGroup.AudioTrack.StopSlate()
+}
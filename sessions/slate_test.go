@@ -0,0 +1,130 @@
+package sessions
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/slate"
+	"pion-webrtc-sfu/tracks"
+	"pion-webrtc-sfu/user"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// configure a vp8 slate for session, a clip of keyframes 33ms apart in a temporary slate directory
+func testSlate(t *testing.T, session string) {
+	t.Helper()
+	dir := t.TempDir()
+	clip := make([]byte, 32)
+	copy(clip, "DKIF")
+	binary.LittleEndian.PutUint16(clip[6:], 32)
+	copy(clip[8:], "VP80")
+	binary.LittleEndian.PutUint32(clip[16:], 1000)
+	binary.LittleEndian.PutUint32(clip[20:], 1)
+	frame := []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}
+	for i := 0; i < 3; i++ {
+		header := make([]byte, 12)
+		binary.LittleEndian.PutUint32(header, uint32(len(frame)))
+		binary.LittleEndian.PutUint64(header[4:], uint64(i*33))
+		clip = append(append(clip, header...), frame...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "clip.ivf"), clip, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := slate.InitSlates(&configuration.Configuration{Rtc_video_codec: webrtc.MimeTypeVP8, Rtc_audio_codec: webrtc.MimeTypeOpus, Rtc_slate_directory: dir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := slate.Set(slate.Slate{Session: session, Video: "clip.ivf"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { slate.Remove(session) })
+}
+
+// session with vp8 and opus tracks and short stall and idle timeouts, restored when the test ends
+func testLifecycleSession(t *testing.T, id string) *Session {
+	stall, idle := stallTimeout, idleTimeout
+	stallTimeout, idleTimeout = 20*time.Millisecond, 200*time.Millisecond
+	t.Cleanup(func() { stallTimeout, idleTimeout = stall, idle })
+	return &Session{
+		TrackGroup: tracks.TrackGroup{
+			VideoTrack: tracks.NewRTPTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", id, 0),
+			AudioTrack: tracks.NewRTPTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", id, 0),
+		},
+		keyframes:     newKeyframeRequester(),
+		id:            id,
+		notifications: make(chan user.Message, notificationBacklog),
+		removed:       make(chan struct{}),
+	}
+}
+
+// check the next notification queued for the users of the session, payload is the kind or empty
+func testNotification(t *testing.T, s *Session, event user.MessageType, kind string) {
+	t.Helper()
+	select {
+	case message := <-s.notifications:
+		want := ""
+		if kind != "" {
+			want = `{"kind":"` + kind + `"}`
+		}
+		if message.Type != event || string(message.RawPayload) != want {
+			t.Fatalf("got %v %s, want %v %s", message.Type, message.RawPayload, event, want)
+		}
+	default:
+		t.Fatalf("no notification, want %v", event)
+	}
+}
+
+/*
+the slate replaces the stalled kind only, the resumed stream asks for a keyframe
+and takes back over with it, the end of the stream stops everything
+*/
+func TestSessionSlate(t *testing.T) {
+	s := testLifecycleSession(t, "slate")
+	testSlate(t, "slate")
+	feedback := &testFeedback{}
+	s.SetVideoFeedback(1234, false, feedback)
+	s.packetReceived(webrtc.RTPCodecTypeVideo)
+	s.packetReceived(webrtc.RTPCodecTypeAudio)
+	testNotification(t, s, user.MESSAGE_STREAMSTARTED, "")
+	// video stalls while audio keeps flowing
+	time.Sleep(2 * stallTimeout)
+	s.packetReceived(webrtc.RTPCodecTypeAudio)
+	s.checkStream(time.Now())
+	testNotification(t, s, user.MESSAGE_STREAMSTALLED, "video")
+	if !s.TrackGroup.VideoTrack.SlateActive() || s.TrackGroup.AudioTrack.SlateActive() {
+		t.Fatal("slate not started for the stalled video only")
+	}
+	s.checkStream(time.Now())
+	if len(s.notifications) != 0 {
+		t.Fatal("stall notified twice")
+	}
+	// the video is back, its next keyframe ends the slate
+	s.packetReceived(webrtc.RTPCodecTypeVideo)
+	testNotification(t, s, user.MESSAGE_STREAMRESUMED, "video")
+	if feedback.count() != 1 {
+		t.Errorf("%v keyframe requests after the video resumed, want 1", feedback.count())
+	}
+	if err := s.TrackGroup.VideoTrack.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2}, Payload: testVP8Keyframe}); err != nil {
+		t.Fatal(err)
+	}
+	if s.TrackGroup.VideoTrack.SlateActive() {
+		t.Fatal("slate still playing after the live keyframe")
+	}
+	// stalled again, then nothing for the idle timeout ends the stream and its slate
+	time.Sleep(2 * stallTimeout)
+	s.checkStream(time.Now())
+	testNotification(t, s, user.MESSAGE_STREAMSTALLED, "video")
+	testNotification(t, s, user.MESSAGE_STREAMSTALLED, "audio")
+	if !s.TrackGroup.VideoTrack.SlateActive() {
+		t.Fatal("slate not started again")
+	}
+	s.checkStream(time.Now().Add(idleTimeout))
+	testNotification(t, s, user.MESSAGE_STREAMENDED, "")
+	if s.Live() || s.TrackGroup.VideoTrack.SlateActive() {
+		t.Error("stream still live or slate playing after the idle timeout")
+	}
+}
@@ -0,0 +1,356 @@
+package slate
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+// mtu of slate packets
+const packetMTU = 1200
+
+// frame rate of h264 slates, annex b streams carry no timing
+const h264FrameRate = 30
+
+// rtp clock rates of video and opus
+const (
+	videoClockRate = 90000
+	opusClockRate  = 48000
+)
+
+// reads the frames of a clip once
+type frameReader interface {
+	// next frame and its duration in units of the clock rate, io.EOF after the last frame
+	nextFrame() ([]byte, uint32, error)
+	io.Closer
+}
+
+/*
+open a clip for the codec of a track
+vp8/vp9 slates are ivf files, h264 slates annex b streams (.h264) and opus slates ogg files
+*/
+func openClip(path string, mimeType string) (frameReader, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8), strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		if ext != ".ivf" {
+			return nil, fmt.Errorf("%v slates must be .ivf files", mimeType)
+		}
+		return openIVF(path, mimeType)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		if ext != ".h264" && ext != ".264" {
+			return nil, fmt.Errorf("%v slates must be annex b .h264 files", mimeType)
+		}
+		return openH264(path)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		if ext != ".ogg" && ext != ".opus" {
+			return nil, fmt.Errorf("%v slates must be .ogg files", mimeType)
+		}
+		return openOgg(path)
+	}
+	return nil, fmt.Errorf("slates are not supported for %v", mimeType)
+}
+
+/*
+check that a clip can be played on a track with the codec
+errors leave out the path, they are returned to api clients
+*/
+func validateClip(path string, mimeType string) error {
+	reader, err := openClip(path, mimeType)
+	if err != nil {
+		return withoutPath(err)
+	}
+	defer reader.Close()
+	if _, _, err := reader.nextFrame(); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("file has no frames")
+		}
+		return withoutPath(err)
+	}
+	return nil
+}
+
+// strip the path of file errors, e.g. "open slates/x.h264: no such file or directory" becomes "no such file or directory"
+func withoutPath(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+func newPayloader(mimeType string) rtp.Payloader {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return &codecs.VP8Payloader{EnablePictureID: true}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return &codecs.VP9Payloader{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return &codecs.H264Payloader{}
+	}
+	return &codecs.OpusPayloader{}
+}
+
+/*
+play a clip in a loop until write returns false
+frames are packetized and paced in real time, sequence numbers and timestamps continue across loops
+*/
+func Play(path string, mimeType string, write func(p *rtp.Packet) bool) error {
+	clockRate := uint32(videoClockRate)
+	if strings.HasPrefix(strings.ToLower(mimeType), "audio/") {
+		clockRate = opusClockRate
+	}
+	// ssrc and payload type are set by the track bindings
+	packetizer := rtp.NewPacketizer(packetMTU, 0, 0, newPayloader(mimeType), rtp.NewRandomSequencer(), clockRate)
+	start := time.Now()
+	var elapsed uint64
+	for {
+		reader, err := openClip(path, mimeType)
+		if err != nil {
+			return err
+		}
+		frames, err := playOnce(reader, packetizer, write, func(duration uint32) {
+			elapsed += uint64(duration)
+			time.Sleep(time.Until(start.Add(time.Duration(elapsed * uint64(time.Second) / uint64(clockRate)))))
+		})
+		reader.Close()
+		if err != nil || frames < 0 {
+			return err
+		}
+		if frames == 0 {
+			return fmt.Errorf("%v has no frames", path)
+		}
+	}
+}
+
+// write all frames of the clip, returns -1 if write returned false
+func playOnce(reader frameReader, packetizer rtp.Packetizer, write func(p *rtp.Packet) bool, pace func(duration uint32)) (int, error) {
+	frames := 0
+	for {
+		frame, duration, err := reader.nextFrame()
+		if errors.Is(err, io.EOF) {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames++
+		for _, p := range packetizer.Packetize(frame, duration) {
+			if !write(p) {
+				return -1, nil
+			}
+		}
+		pace(duration)
+	}
+}
+
+// vp8/vp9 frames of an ivf file, durations follow from the frame timestamps
+type ivfClip struct {
+	file         *os.File
+	reader       *ivfreader.IVFReader
+	header       *ivfreader.IVFFileHeader
+	pending      []byte // frame read ahead to know the duration of the current one
+	pendingTs    uint64
+	pendingErr   error
+	lastDuration uint32
+}
+
+func openIVF(path string, mimeType string) (*ivfClip, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if fourcc := strings.ToUpper(strings.TrimSpace(header.FourCC)); (strings.EqualFold(mimeType, webrtc.MimeTypeVP8) && fourcc != "VP80") || (strings.EqualFold(mimeType, webrtc.MimeTypeVP9) && fourcc != "VP90") {
+		file.Close()
+		return nil, fmt.Errorf("ivf file contains %v, not %v", header.FourCC, mimeType)
+	}
+	c := &ivfClip{file: file, reader: reader, header: header, lastDuration: videoClockRate / h264FrameRate}
+	c.readAhead()
+	return c, nil
+}
+
+func (c *ivfClip) readAhead() {
+	frame, frameHeader, err := c.reader.ParseNextFrame()
+	c.pending, c.pendingErr = frame, err
+	if err == nil {
+		c.pendingTs = frameHeader.Timestamp
+	}
+}
+
+func (c *ivfClip) nextFrame() ([]byte, uint32, error) {
+	if c.pendingErr != nil {
+		return nil, 0, c.pendingErr
+	}
+	frame, ts := c.pending, c.pendingTs
+	c.readAhead()
+	// the last frame lasts as long as the one before
+	if c.pendingErr == nil && c.header.TimebaseDenominator > 0 && c.pendingTs > ts {
+		c.lastDuration = uint32((c.pendingTs - ts) * videoClockRate * uint64(c.header.TimebaseNumerator) / uint64(c.header.TimebaseDenominator))
+	}
+	return frame, c.lastDuration, nil
+}
+
+func (c *ivfClip) Close() error {
+	return c.file.Close()
+}
+
+// access units of an annex b stream at h264FrameRate, one slice per frame
+type h264Clip struct {
+	file   *os.File
+	reader *h264reader.H264Reader
+}
+
+func openH264(path string) (*h264Clip, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := h264reader.NewReader(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &h264Clip{file: file, reader: reader}, nil
+}
+
+// parameter sets are sent together with the slice following them
+func (c *h264Clip) nextFrame() ([]byte, uint32, error) {
+	var frame []byte
+	for {
+		nal, err := c.reader.NextNAL()
+		if errors.Is(err, io.EOF) && len(frame) > 0 {
+			return frame, videoClockRate / h264FrameRate, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		frame = append(frame, 0, 0, 0, 1)
+		frame = append(frame, nal.Data...)
+		if nal.UnitType == h264reader.NalUnitTypeCodedSliceIdr || nal.UnitType == h264reader.NalUnitTypeCodedSliceNonIdr {
+			return frame, videoClockRate / h264FrameRate, nil
+		}
+	}
+}
+
+func (c *h264Clip) Close() error {
+	return c.file.Close()
+}
+
+/*
+opus packets of an ogg file, durations are read from the toc byte
+pion's ogg reader returns whole pages, so packets are split by their lacing values here
+*/
+type oggClip struct {
+	file    *os.File
+	reader  *bufio.Reader
+	packets [][]byte // complete packets of the current page
+	partial []byte   // packet continued on the next page
+}
+
+func openOgg(path string) (*oggClip, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &oggClip{file: file, reader: bufio.NewReader(file)}, nil
+}
+
+func (c *oggClip) nextFrame() ([]byte, uint32, error) {
+	for {
+		for len(c.packets) > 0 {
+			packet := c.packets[0]
+			c.packets = c.packets[1:]
+			// skip the identification and comment headers
+			if bytes.HasPrefix(packet, []byte("OpusHead")) || bytes.HasPrefix(packet, []byte("OpusTags")) {
+				continue
+			}
+			if samples := opusSamples(packet); samples > 0 {
+				return packet, samples, nil
+			}
+		}
+		if err := c.readPage(); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// read the next page and split it into packets
+func (c *oggClip) readPage() error {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return io.EOF
+		}
+		return err
+	}
+	if string(header[:4]) != "OggS" {
+		return errors.New("invalid ogg page")
+	}
+	lacing := make([]byte, header[26])
+	if _, err := io.ReadFull(c.reader, lacing); err != nil {
+		return io.EOF
+	}
+	for _, size := range lacing {
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, segment); err != nil {
+			return io.EOF
+		}
+		c.partial = append(c.partial, segment...)
+		// segments shorter than 255 bytes end a packet
+		if size < 255 {
+			c.packets = append(c.packets, c.partial)
+			c.partial = nil
+		}
+	}
+	return nil
+}
+
+func (c *oggClip) Close() error {
+	return c.file.Close()
+}
+
+// samples at 48khz of an opus packet, from the frame size and count of its toc byte (rfc 6716 3.1)
+func opusSamples(packet []byte) uint32 {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frameSize uint32
+	switch {
+	case config < 12: // silk 10, 20, 40, 60 ms
+		frameSize = []uint32{480, 960, 1920, 2880}[config%4]
+	case config < 16: // hybrid 10, 20 ms
+		frameSize = []uint32{480, 960}[config%2]
+	default: // celt 2.5, 5, 10, 20 ms
+		frameSize = []uint32{120, 240, 480, 960}[config%4]
+	}
+	frames := uint32(1)
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = uint32(packet[1] & 0x3f)
+	}
+	return frameSize * frames
+}
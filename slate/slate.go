@@ -0,0 +1,169 @@
+package slate
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"pion-webrtc-sfu/configuration"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// session name of the slate used by sessions without their own
+const DefaultSession = "*"
+
+// clips of a session, either may be empty to keep the kind frozen
+type Slate struct {
+	Session string `json:"session"`
+	Video   string `json:"video,omitempty"`
+	Audio   string `json:"audio,omitempty"`
+}
+
+// slates by session name
+var slates = make(map[string]Slate)
+
+// mutex for above map read/write
+var mutex sync.Mutex
+
+// codecs of the session tracks, clips are checked against them
+var (
+	videoCodec string
+	audioCodec string
+)
+
+// directory slate files are read from, set by InitSlates
+var directory string
+
+// files are given relative to the slate directory, the error does not repeat them as they may come from the api
+var errInvalidFile = errors.New("slate files must be relative to the slate directory and can not contain ..")
+
+// load slates from configuration, formatted as session=file[,file];*=file
+func InitSlates(config *configuration.Configuration) error {
+	mutex.Lock()
+	videoCodec = config.Rtc_video_codec
+	audioCodec = config.Rtc_audio_codec
+	directory = config.Rtc_slate_directory
+	mutex.Unlock()
+	for _, entry := range strings.Split(config.Rtc_slates, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		session, files, found := strings.Cut(entry, "=")
+		if !found {
+			return fmt.Errorf("invalid slate %q in RTC_SLATES, must be session=file[,file]", entry)
+		}
+		s := Slate{Session: strings.TrimSpace(session)}
+		for _, file := range strings.Split(files, ",") {
+			file = strings.TrimSpace(file)
+			if file == "" {
+				continue
+			}
+			// the kind follows from the container
+			switch strings.ToLower(filepath.Ext(file)) {
+			case ".ogg", ".opus":
+				s.Audio = file
+			default:
+				s.Video = file
+			}
+		}
+		if err := Set(s); err != nil {
+			return fmt.Errorf("invalid slate for %q in RTC_SLATES: %v", s.Session, err)
+		}
+	}
+	return nil
+}
+
+// add or replace the slate of a session after checking its clips
+func Set(s Slate) error {
+	if s.Session == "" {
+		return errors.New("session name can not be empty")
+	}
+	if s.Video == "" && s.Audio == "" {
+		return errors.New("at least one of video and audio must be set")
+	}
+	mutex.Lock()
+	video, audio, dir := videoCodec, audioCodec, directory
+	mutex.Unlock()
+	if s.Video != "" {
+		path, err := resolvePath(dir, s.Video)
+		if err != nil {
+			return err
+		}
+		if err := validateClip(path, video); err != nil {
+			return fmt.Errorf("video clip: %v", err)
+		}
+	}
+	if s.Audio != "" {
+		path, err := resolvePath(dir, s.Audio)
+		if err != nil {
+			return err
+		}
+		if err := validateClip(path, audio); err != nil {
+			return fmt.Errorf("audio clip: %v", err)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	slates[s.Session] = s
+	return nil
+}
+
+// path of a slate file inside the slate directory, absolute paths and paths leaving it are rejected
+func resolvePath(dir string, file string) (string, error) {
+	if filepath.IsAbs(file) || filepath.VolumeName(file) != "" || strings.HasPrefix(file, "/") {
+		return "", errInvalidFile
+	}
+	for _, element := range strings.Split(filepath.ToSlash(file), "/") {
+		if element == ".." {
+			return "", errInvalidFile
+		}
+	}
+	return filepath.Join(dir, filepath.Clean(file)), nil
+}
+
+// remove the slate of a session, returns false if it had none
+func Remove(session string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, exists := slates[session]; !exists {
+		return false
+	}
+	delete(slates, session)
+	return true
+}
+
+// configured slates sorted by session
+func List() []Slate {
+	mutex.Lock()
+	defer mutex.Unlock()
+	list := make([]Slate, 0, len(slates))
+	for _, s := range slates {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Session < list[j].Session })
+	return list
+}
+
+/*
+clip and codec to play on the track of a session while its ingest stalls
+the default slate applies to sessions without their own, returns an empty path if there is none
+*/
+func ForSession(session string, video bool) (string, string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	s, exists := slates[session]
+	if !exists {
+		s = slates[DefaultSession]
+	}
+	file, mimeType := s.Audio, audioCodec
+	if video {
+		file, mimeType = s.Video, videoCodec
+	}
+	if file == "" {
+		return "", mimeType
+	}
+	// files are checked when the slate is set
+	return filepath.Join(directory, filepath.Clean(file)), mimeType
+}
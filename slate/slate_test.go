@@ -0,0 +1,242 @@
+package slate
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"pion-webrtc-sfu/configuration"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// vp8 key frame header followed by some bytes
+var testVP8Frame = []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0xAA, 0xBB}
+
+// write an ivf file with frames timestampDelta milliseconds apart
+func testIVF(t *testing.T, path string, fourcc string, frames int, timestampDelta uint64) {
+	t.Helper()
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint16(header[12:], 64)
+	binary.LittleEndian.PutUint16(header[14:], 48)
+	binary.LittleEndian.PutUint32(header[16:], 1000)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(frames))
+	for i := 0; i < frames; i++ {
+		frameHeader := make([]byte, 12)
+		binary.LittleEndian.PutUint32(frameHeader, uint32(len(testVP8Frame)))
+		binary.LittleEndian.PutUint64(frameHeader[4:], uint64(i)*timestampDelta)
+		header = append(append(header, frameHeader...), testVP8Frame...)
+	}
+	if err := os.WriteFile(path, header, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// write an ogg file of a single page with the opus headers and packets
+func testOgg(t *testing.T, path string, packets ...[]byte) {
+	t.Helper()
+	packets = append([][]byte{[]byte("OpusHead\x01\x02"), []byte("OpusTags")}, packets...)
+	page := make([]byte, 27)
+	copy(page, "OggS")
+	page[26] = byte(len(packets))
+	for _, p := range packets {
+		page = append(page, byte(len(p)))
+	}
+	for _, p := range packets {
+		page = append(page, p...)
+	}
+	if err := os.WriteFile(path, page, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slate directory with a vp8 and an opus clip, slates and codecs are reset when the test ends
+func testSlateDirectory(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	testIVF(t, filepath.Join(dir, "clip.ivf"), "VP80", 3, 10)
+	testOgg(t, filepath.Join(dir, "sound.ogg"), []byte{0xFC, 0xFF}, []byte{0xFC, 0xFE})
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	testIVF(t, filepath.Join(dir, "sub", "vp9.ivf"), "VP90", 1, 10)
+	testIVF(t, filepath.Join(dir, "sub", "empty.ivf"), "VP80", 0, 10)
+	t.Cleanup(func() {
+		mutex.Lock()
+		slates = make(map[string]Slate)
+		videoCodec, audioCodec, directory = "", "", ""
+		mutex.Unlock()
+	})
+	return dir
+}
+
+func TestResolvePath(t *testing.T) {
+	tests := []struct {
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{"clip.ivf", "slates/clip.ivf", false},
+		{"sub/clip.ivf", "slates/sub/clip.ivf", false},
+		{"./sub//clip.ivf", "slates/sub/clip.ivf", false},
+		{"..clip.ivf", "slates/..clip.ivf", false},
+		{"../clip.ivf", "", true},
+		{"sub/../clip.ivf", "", true},
+		{"sub/../../clip.ivf", "", true},
+		{"sub\\..\\..\\clip.ivf", "slates/sub\\..\\..\\clip.ivf", false}, // no separator on linux
+		{"..", "", true},
+		{"/etc/passwd", "", true},
+		{"/slates/clip.ivf", "", true},
+	}
+	for _, test := range tests {
+		got, err := resolvePath("slates", test.file)
+		if test.wantErr {
+			if !errors.Is(err, errInvalidFile) {
+				t.Errorf("%q: got %q, %v, want it rejected", test.file, got, err)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(test.want) {
+			t.Errorf("%q: got %q, %v, want %q", test.file, got, err, test.want)
+		}
+	}
+}
+
+// slates are checked against the slate directory and the codecs of the tracks when set
+func TestSet(t *testing.T) {
+	dir := testSlateDirectory(t)
+	if err := InitSlates(&configuration.Configuration{
+		Rtc_video_codec:     webrtc.MimeTypeVP8,
+		Rtc_audio_codec:     webrtc.MimeTypeOpus,
+		Rtc_slate_directory: dir,
+		Rtc_slates:          "*=clip.ivf; live = clip.ivf, sound.ogg",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		slate   Slate
+		wantErr string
+	}{
+		{"outside the directory", Slate{Session: "s", Video: "../clip.ivf"}, errInvalidFile.Error()},
+		{"absolute", Slate{Session: "s", Audio: filepath.Join(dir, "sound.ogg")}, errInvalidFile.Error()},
+		{"missing file", Slate{Session: "s", Video: "missing.ivf"}, "video clip: no such file or directory"},
+		{"other codec", Slate{Session: "s", Video: "sub/vp9.ivf"}, "video clip: ivf file contains VP90, not video/VP8"},
+		{"other container", Slate{Session: "s", Audio: "clip.ivf"}, "audio clip: audio/opus slates must be .ogg files"},
+		{"no frames", Slate{Session: "s", Video: "sub/empty.ivf"}, "video clip: file has no frames"},
+		{"no clips", Slate{Session: "s"}, "at least one of video and audio must be set"},
+		{"no session", Slate{Video: "clip.ivf"}, "session name can not be empty"},
+		{"video only", Slate{Session: "video", Video: "./clip.ivf"}, ""},
+	}
+	for _, test := range tests {
+		err := Set(test.slate)
+		if (err == nil && test.wantErr != "") || (err != nil && err.Error() != test.wantErr) {
+			t.Errorf("%v: got %v, want %q", test.name, err, test.wantErr)
+		}
+		// errors are returned to api clients and must not leak the directory
+		if err != nil && strings.Contains(err.Error(), dir) {
+			t.Errorf("%v: error %q contains the slate directory", test.name, err)
+		}
+	}
+	if list := List(); len(list) != 3 || list[0].Session != DefaultSession || list[1].Session != "live" || list[2].Session != "video" {
+		t.Fatalf("slates %+v, want the default, live and video ones", list)
+	}
+	lookups := []struct {
+		session      string
+		video        bool
+		wantPath     string
+		wantMimeType string
+	}{
+		{"live", true, "clip.ivf", webrtc.MimeTypeVP8},
+		{"live", false, "sound.ogg", webrtc.MimeTypeOpus},
+		{"other", true, "clip.ivf", webrtc.MimeTypeVP8},
+		{"other", false, "", webrtc.MimeTypeOpus},
+		// sessions with their own slate don't fall back to the default one
+		{"video", false, "", webrtc.MimeTypeOpus},
+	}
+	for _, lookup := range lookups {
+		path, mimeType := ForSession(lookup.session, lookup.video)
+		want := ""
+		if lookup.wantPath != "" {
+			want = filepath.Join(dir, lookup.wantPath)
+		}
+		if path != want || mimeType != lookup.wantMimeType {
+			t.Errorf("%v video %v: got %q %v, want %q %v", lookup.session, lookup.video, path, mimeType, want, lookup.wantMimeType)
+		}
+	}
+	if !Remove("live") || Remove("live") {
+		t.Error("slate not removed exactly once")
+	}
+	if path, _ := ForSession("live", false); path != "" {
+		t.Errorf("removed slate still played: %q", path)
+	}
+}
+
+/*
+clips are looped until write returns false
+sequence numbers and timestamps continue across loops, the last frame lasts as long as the one before
+*/
+func TestPlay(t *testing.T) {
+	dir := testSlateDirectory(t)
+	tests := []struct {
+		file     string
+		mimeType string
+		duration uint32
+	}{
+		{"clip.ivf", webrtc.MimeTypeVP8, 900}, // 10ms at 90khz
+		{"sound.ogg", webrtc.MimeTypeOpus, 960},
+	}
+	for _, test := range tests {
+		t.Run(test.mimeType, func(t *testing.T) {
+			var packets []*rtp.Packet
+			err := Play(filepath.Join(dir, test.file), test.mimeType, func(p *rtp.Packet) bool {
+				packets = append(packets, p)
+				return len(packets) < 7
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packets) != 7 {
+				t.Fatalf("%v packets written, want 7", len(packets))
+			}
+			for i := 1; i < len(packets); i++ {
+				if packets[i].SequenceNumber != packets[i-1].SequenceNumber+1 {
+					t.Errorf("packet %v: sequence number %v after %v", i, packets[i].SequenceNumber, packets[i-1].SequenceNumber)
+				}
+				if gap := packets[i].Timestamp - packets[i-1].Timestamp; gap != test.duration {
+					t.Errorf("packet %v: timestamp advanced by %v, want %v", i, gap, test.duration)
+				}
+			}
+		})
+	}
+	if err := Play(filepath.Join(dir, "sub", "empty.ivf"), webrtc.MimeTypeVP8, func(p *rtp.Packet) bool { return true }); err == nil {
+		t.Error("clip without frames played")
+	}
+}
+
+func TestOpusSamples(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		want   uint32
+	}{
+		{[]byte{0xFC}, 960},        // celt 20ms
+		{[]byte{0xFD}, 1920},       // two frames
+		{[]byte{0xFF, 0x03}, 2880}, // three frames signaled in the second byte
+		{[]byte{0x08}, 960},        // silk 20ms
+		{[]byte{0x60}, 480},        // hybrid 10ms
+		{[]byte{0xFF}, 0},          // frame count missing
+		{nil, 0},
+	}
+	for _, test := range tests {
+		if got := opusSamples(test.packet); got != test.want {
+			t.Errorf("%x: got %v, want %v", test.packet, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package tracks
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// live packets queued for a binding while its gop replay is written
+const maxPendingPackets = 512
+
+/*
+a single bind of a track to a peerconnection
+every binding forwards exactly one layer of the track and rewrites sequence numbers,
+timestamps and vp8/vp9 picture IDs so the output stays continuous across layer switches
+*/
+type trackBinding struct {
+	id          string
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	clockRate   uint32
+	writeStream webrtc.TrackLocalWriter
+	started     bool          // transport is ready and cached packets were sent
+	replaying   bool          // the cached gop is written without the track lock, live packets are queued meanwhile
+	pending     []*rtp.Packet // live packets of the current layer received during the replay
+	overflowed  bool          // more live packets arrived during the replay than could be queued
+	paused      bool          // nothing is forwarded to the binding
+	layer       int           // layer currently forwarded, -1 while waiting for a keyframe to resume
+	target      int           // layer to switch to at its next keyframe
+	seqOffset   uint16        // added to incoming sequence numbers of the current layer
+	tsOffset    uint32        // added to incoming timestamps of the current layer
+	lastSeq     uint16        // last sequence number written
+	lastTs      uint32        // last timestamp written
+	lastWrite   time.Time     // time of the last write
+	temporal    temporalFilter
+}
+
+// write packet with the negotiated ssrc and payload type of this binding
+func (b *trackBinding) write(header *rtp.Header, payload []byte) (int, error) {
+	header.SSRC = uint32(b.ssrc)
+	header.PayloadType = uint8(b.payloadType)
+	n, err := b.writeStream.WriteRTP(header, payload)
+	if err == nil && n > 0 {
+		b.lastSeq = header.SequenceNumber
+		b.lastTs = header.Timestamp
+		b.lastWrite = time.Now()
+	}
+	return n, err
+}
+
+/*
+write packet of the current layer with rewritten sequence number and timestamp
+packets of dropped temporal layers are skipped and nothing is written
+*/
+func (b *trackBinding) forward(p *rtp.Packet, desc *payloadDescriptor, keyframe bool) (int, error) {
+	payload := p.Payload
+	if desc.valid {
+		if b.temporal.drop(desc, keyframe) {
+			// keep sequence numbers contiguous without the dropped packet
+			b.seqOffset--
+			return 0, nil
+		}
+		payload = b.temporal.rewrite(desc, payload)
+	}
+	header := p.Header
+	header.SequenceNumber += b.seqOffset
+	header.Timestamp += b.tsOffset
+	return b.write(&header, payload)
+}
+
+/*
+start forwarding another layer beginning with keyframe packet p
+offsets are chosen so that p directly follows the last written packet,
+its timestamp advances by the wall clock time since the last write
+*/
+func (b *trackBinding) switchLayer(layer int, p *rtp.Packet, desc *payloadDescriptor) {
+	elapsed := uint32(time.Since(b.lastWrite).Milliseconds()) * (b.clockRate / 1000)
+	if elapsed == 0 {
+		elapsed = 1
+	}
+	b.seqOffset = b.lastSeq + 1 - p.SequenceNumber
+	b.tsOffset = b.lastTs + elapsed - p.Timestamp
+	if desc.valid {
+		b.temporal.switchStream(desc)
+	}
+	b.layer = layer
+}
+
+/*
+write the cached gop to a binding whose transport is ready, called on a copy of the binding without the track lock
+packets go through the temporal filter like live ones, so the binding continues with the same picture IDs
+*/
+func (b *trackBinding) writeReplay(mimeType string, replay []rtp.Packet) error {
+	for i := range replay {
+		desc := parsePayloadDescriptor(mimeType, replay[i].Payload)
+		if _, err := b.forward(&replay[i], &desc, IsKeyframe(mimeType, replay[i].Payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queue a live packet arriving during the replay, the binding waits for a keyframe if too many arrive
+func (b *trackBinding) queue(p *rtp.Packet) {
+	if len(b.pending) >= maxPendingPackets {
+		b.overflowed = true
+		return
+	}
+	b.pending = append(b.pending, p)
+}
@@ -0,0 +1,113 @@
+package tracks
+
+import (
+	"github.com/pion/rtp"
+)
+
+/*
+cache of the packets of the current group of pictures
+starts at the latest keyframe so that new viewers can start decoding right away
+*/
+type gopCache struct {
+	maxPackets int           // cache is dropped if a gop gets larger than this
+	packets    []*rtp.Packet // packets since the latest keyframe
+	bytes      int           // payload bytes of the cached packets
+	valid      bool          // cache starts with a keyframe and has not overflowed
+}
+
+// cache is dropped if the payload of a gop gets larger than this, bounds the burst replayed to new viewers
+const maxGopBytes = 4 << 20
+
+func newGopCache(maxPackets int) *gopCache {
+	return &gopCache{
+		maxPackets: maxPackets,
+		packets:    make([]*rtp.Packet, 0, maxPackets),
+	}
+}
+
+/*
+add a packet to the cache, keyframe tells if the packet starts a keyframe
+a keyframe starts a new gop unless it belongs to the same frame as
+the start of the current one (sps/pps/idr sent in separate packets)
+*/
+func (gc *gopCache) push(p *rtp.Packet, keyframe bool) {
+	if keyframe {
+		if !gc.valid || len(gc.packets) == 0 || gc.packets[0].Timestamp != p.Timestamp {
+			gc.reset()
+			gc.valid = true
+		}
+	}
+	if !gc.valid {
+		return
+	}
+	// gop too large, wait for the next keyframe
+	if len(gc.packets) >= gc.maxPackets || gc.bytes+len(p.Payload) > maxGopBytes {
+		gc.reset()
+		return
+	}
+	gc.packets = append(gc.packets, p)
+	gc.bytes += len(p.Payload)
+}
+
+// drop all cached packets
+func (gc *gopCache) reset() {
+	for i := range gc.packets {
+		gc.packets[i] = nil
+	}
+	gc.packets = gc.packets[:0]
+	gc.bytes = 0
+	gc.valid = false
+}
+
+/*
+return the cached gop rewritten for instant playback
+sequence numbers are made contiguous and the timestamps of all frames are
+squeezed right before the latest one, so the decoder catches up immediately
+and the live stream that follows continues without a gap
+*/
+func (gc *gopCache) replay() []rtp.Packet {
+	if !gc.valid || len(gc.packets) == 0 {
+		return nil
+	}
+	frames := gc.frames()
+	replayed := make([]rtp.Packet, len(gc.packets))
+	frame := uint32(0)
+	for i := range gc.packets {
+		if i > 0 && gc.packets[i].Timestamp != gc.packets[i-1].Timestamp {
+			frame++
+		}
+		replayed[i] = gc.replayed(i, frame, frames)
+	}
+	return replayed
+}
+
+/*
+first packet of the replay, the keyframe the cached gop starts with
+cheap enough to find out if the transport of a new binding is ready with every live packet
+*/
+func (gc *gopCache) replayStart() (rtp.Packet, bool) {
+	if !gc.valid || len(gc.packets) == 0 {
+		return rtp.Packet{}, false
+	}
+	return gc.replayed(0, 0, gc.frames()), true
+}
+
+// number of distinct frames to spread the replayed timestamps over
+func (gc *gopCache) frames() uint32 {
+	frames := uint32(1)
+	for i := 1; i < len(gc.packets); i++ {
+		if gc.packets[i].Timestamp != gc.packets[i-1].Timestamp {
+			frames++
+		}
+	}
+	return frames
+}
+
+// cached packet i of the given frame rewritten for the replay
+func (gc *gopCache) replayed(i int, frame, frames uint32) rtp.Packet {
+	last := gc.packets[len(gc.packets)-1]
+	p := rtp.Packet{Header: gc.packets[i].Header.Clone(), Payload: gc.packets[i].Payload}
+	p.SequenceNumber = last.SequenceNumber - uint16(len(gc.packets)-1-i)
+	p.Timestamp = last.Timestamp - (frames - 1 - frame)
+	return p
+}
@@ -0,0 +1,268 @@
+package tracks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func testCachePacket(seq uint16, timestamp uint32, size int) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp}, Payload: make([]byte, size)}
+}
+
+func TestGopCachePush(t *testing.T) {
+	gc := newGopCache(8)
+	// nothing is cached before the first keyframe
+	gc.push(testCachePacket(1, 0, 10), false)
+	if gc.valid || len(gc.packets) != 0 || gc.replay() != nil {
+		t.Fatal("packets cached before a keyframe")
+	}
+	// parameter sets and the idr slice in separate packets of the same frame stay in one gop
+	gc.push(testCachePacket(2, 3000, 10), true)
+	gc.push(testCachePacket(3, 3000, 10), true)
+	gc.push(testCachePacket(4, 6000, 10), false)
+	if len(gc.packets) != 3 || gc.packets[0].SequenceNumber != 2 || gc.bytes != 30 {
+		t.Fatalf("%v packets of %v bytes cached, want 3 of 30 from the keyframe", len(gc.packets), gc.bytes)
+	}
+	// the next keyframe starts a new gop
+	gc.push(testCachePacket(5, 9000, 10), true)
+	if len(gc.packets) != 1 || gc.packets[0].SequenceNumber != 5 {
+		t.Fatalf("%v packets cached after the second keyframe", len(gc.packets))
+	}
+	// a gop with more packets than the cache holds is dropped until the next keyframe
+	for seq := uint16(6); seq < 20; seq++ {
+		gc.push(testCachePacket(seq, uint32(seq)*3000, 10), false)
+	}
+	if gc.valid || len(gc.packets) != 0 || gc.bytes != 0 || gc.replay() != nil {
+		t.Fatalf("overflowed gop still cached with %v packets", len(gc.packets))
+	}
+	gc.push(testCachePacket(20, 60000, 10), true)
+	if !gc.valid || len(gc.packets) != 1 {
+		t.Fatal("keyframe after the overflow not cached")
+	}
+	// as is a gop larger than maxGopBytes
+	gc.push(testCachePacket(21, 63000, maxGopBytes), false)
+	if gc.valid || len(gc.packets) != 0 {
+		t.Fatalf("gop of %v bytes cached", gc.bytes)
+	}
+}
+
+/*
+replayed gops have contiguous sequence numbers ending at the last cached packet and all
+frames squeezed right before its timestamp, across 16 bit sequence number and timestamp wraps
+*/
+func TestGopCacheReplay(t *testing.T) {
+	tests := []struct {
+		name      string
+		seq       uint16
+		timestamp uint32
+		lost      int // sequence numbers skipped after each frame
+	}{
+		{"contiguous", 1000, 90000, 0},
+		{"sequence number wrap", 65530, 90000, 0},
+		{"timestamp wrap", 1000, 0xFFFFFFFF - 9000, 0},
+		{"both wrap with losses", 65520, 0xFFFFFFFF - 9000, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gc := newGopCache(100)
+			var cached []*rtp.Packet
+			seq, timestamp := test.seq, test.timestamp
+			// 10 frames of 1 to 3 packets
+			for frame := 0; frame < 10; frame++ {
+				for i := 0; i <= frame%3; i++ {
+					p := testCachePacket(seq, timestamp, 1)
+					p.Payload[0] = byte(len(cached))
+					gc.push(p, frame == 0)
+					cached = append(cached, p)
+					seq++
+				}
+				seq += uint16(test.lost)
+				timestamp += 3000
+			}
+			replay := gc.replay()
+			if len(replay) != len(cached) {
+				t.Fatalf("%v packets replayed, want %v", len(replay), len(cached))
+			}
+			last := cached[len(cached)-1]
+			if replay[len(replay)-1].SequenceNumber != last.SequenceNumber || replay[len(replay)-1].Timestamp != last.Timestamp {
+				t.Errorf("replay ends at %v/%v, want the last cached packet %v/%v", replay[len(replay)-1].SequenceNumber, replay[len(replay)-1].Timestamp, last.SequenceNumber, last.Timestamp)
+			}
+			// the first frame starts 9 ticks before the last
+			if want := last.Timestamp - 9; replay[0].Timestamp != want {
+				t.Errorf("replay starts at timestamp %v, want %v", replay[0].Timestamp, want)
+			}
+			for i := range replay {
+				if replay[i].Payload[0] != byte(i) {
+					t.Errorf("packet %v: payload of packet %v", i, replay[i].Payload[0])
+				}
+				if i == 0 {
+					continue
+				}
+				if replay[i].SequenceNumber != replay[i-1].SequenceNumber+1 {
+					t.Errorf("packet %v: sequence number %v after %v", i, replay[i].SequenceNumber, replay[i-1].SequenceNumber)
+				}
+				// frames stay apart by a single tick, packets of a frame keep their common timestamp
+				want := replay[i-1].Timestamp
+				if cached[i].Timestamp != cached[i-1].Timestamp {
+					want++
+				}
+				if replay[i].Timestamp != want {
+					t.Errorf("packet %v: timestamp %v after %v, want %v", i, replay[i].Timestamp, replay[i-1].Timestamp, want)
+				}
+			}
+			// the cached packets are not modified
+			if cached[0].SequenceNumber != test.seq || cached[0].Timestamp != test.timestamp {
+				t.Errorf("cached packet changed to %v/%v", cached[0].SequenceNumber, cached[0].Timestamp)
+			}
+		})
+	}
+}
+
+// wait until the gop replay of the binding was written
+func testWaitReplay(t *testing.T, track *RTPTrack, b *trackBinding) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		track.mu.Lock()
+		replaying := b.replaying
+		track.mu.Unlock()
+		if !replaying {
+			return
+		}
+	}
+	t.Fatal("gop replay not written")
+}
+
+/*
+a binding joining mid gop receives the cached gop and continues with the live packets,
+while a binding bound before keeps receiving the live stream unchanged
+*/
+func TestRTPTrackReplay(t *testing.T) {
+	track := NewRTPTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "stream", 100)
+	stream := &testVideoStream{mimeType: webrtc.MimeTypeVP8, longPicID: true, seq: 65500, timestamp: 0xFFFFFFFF - 30000, picID: 0x7FF0}
+	// pictures in alternating temporal layers, the first is a keyframe if keyframe is set
+	write := func(pictures int, keyframe bool) {
+		for i := 0; i < pictures; i++ {
+			for _, p := range stream.picture(uint8(i%2), false, keyframe && i == 0) {
+				if err := track.WriteRTP(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	early, late := &testWriter{}, &testWriter{}
+	track.bindings = append(track.bindings, testBinding(early))
+	// sequence numbers and timestamps wrap within the cached gop
+	write(20, true)
+	b := testBinding(late)
+	track.mu.Lock()
+	track.bindings = append(track.bindings, b)
+	track.mu.Unlock()
+	write(1, false)
+	testWaitReplay(t, track, b)
+	write(30, false)
+	write(40, true)
+	if len(early.packets) != 91*2 {
+		t.Errorf("%v packets written to the early binding, want %v", len(early.packets), 91*2)
+	}
+	testContinuity(t, webrtc.MimeTypeVP8, early.packets)
+	// the cached 20 pictures, the one completing the replay and the live pictures
+	if len(late.packets) != 91*2 {
+		t.Errorf("%v packets written to the late binding, want %v", len(late.packets), 91*2)
+	}
+	if !IsKeyframe(webrtc.MimeTypeVP8, late.packets[0].Payload) {
+		t.Error("replay does not start with the keyframe")
+	}
+	testContinuity(t, webrtc.MimeTypeVP8, late.packets)
+	// the live packets after the replay keep their timestamps
+	if last := early.packets[len(early.packets)-1]; late.packets[len(late.packets)-1].Timestamp != last.Timestamp {
+		t.Errorf("live timestamp %v after the replay, want %v", late.packets[len(late.packets)-1].Timestamp, last.Timestamp)
+	}
+	for _, p := range late.packets {
+		if p.SSRC != 1234 || p.PayloadType != 96 {
+			t.Fatalf("packet written with ssrc %v and payload type %v", p.SSRC, p.PayloadType)
+		}
+	}
+}
+
+// live packets beyond the queue limit during a replay make the binding wait for the next keyframe
+func TestTrackBindingQueueOverflow(t *testing.T) {
+	b := testBinding(&testWriter{})
+	for i := 0; i <= maxPendingPackets; i++ {
+		b.queue(testCachePacket(uint16(i), 0, 1))
+	}
+	if len(b.pending) != maxPendingPackets || !b.overflowed {
+		t.Errorf("%v packets queued, overflowed %v", len(b.pending), b.overflowed)
+	}
+}
+
+// writer of a transport that drops everything until it is ready
+type testReadyWriter struct {
+	testWriter
+	ready bool
+}
+
+func (w *testReadyWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	if !w.ready {
+		return 0, nil
+	}
+	return w.testWriter.WriteRTP(header, payload)
+}
+
+/*
+the gop is only replayed once the transport of the binding accepts packets,
+and replayed pictures go through its temporal filter like the live ones
+*/
+func TestRTPTrackReplayTransportReady(t *testing.T) {
+	tests := []struct {
+		name        string
+		temporal    uint8
+		wantPackets int
+	}{
+		// 10 pictures cached while waiting, the one completing the replay and 20 live ones
+		{"all temporal layers", AllTemporalLayers, 31 * 2},
+		{"base layer", 0, 16 * 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			track := NewRTPTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "stream", 100)
+			stream := &testVideoStream{mimeType: webrtc.MimeTypeVP8, longPicID: true, seq: 100, timestamp: 90000, picID: 0x7FFA}
+			// pictures in alternating temporal layers, the first is a keyframe
+			written := 0
+			write := func(pictures int) {
+				for i := 0; i < pictures; i++ {
+					for _, p := range stream.picture(uint8(written%2), false, written == 0) {
+						if err := track.WriteRTP(p); err != nil {
+							t.Fatal(err)
+						}
+					}
+					written++
+				}
+			}
+			w := &testReadyWriter{}
+			b := testBinding(&w.testWriter)
+			b.writeStream = w
+			b.temporal.target = test.temporal
+			track.bindings = append(track.bindings, b)
+			for i := 0; i < 10; i++ {
+				write(1)
+				if b.replaying || b.started {
+					t.Fatalf("picture %v: replay started before the transport was ready", i)
+				}
+			}
+			w.ready = true
+			write(1)
+			testWaitReplay(t, track, b)
+			write(20)
+			if len(w.packets) != test.wantPackets {
+				t.Errorf("%v packets written, want %v", len(w.packets), test.wantPackets)
+			}
+			if !IsKeyframe(webrtc.MimeTypeVP8, w.packets[0].Payload) {
+				t.Error("replay does not start with the keyframe")
+			}
+			testContinuity(t, webrtc.MimeTypeVP8, w.packets)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package tracks
+
+import (
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// h264 nal unit types used for keyframe detection
+const (
+	h264NaluIDR   = 5
+	h264NaluSPS   = 7
+	h264NaluPPS   = 8
+	h264NaluSTAPA = 24
+	h264NaluFUA   = 28
+)
+
+// h265 nal unit types used for keyframe detection, irap slices are 16 to 23
+const (
+	h265NaluIRAPMin = 16
+	h265NaluIRAPMax = 23
+	h265NaluVPS     = 32
+	h265NaluPPS     = 34
+	h265NaluAP      = 48
+	h265NaluFU      = 49
+)
+
+/*
+check if rtp payload is the start of a keyframe for the given codec
+audio and unknown codecs never contain keyframes
+*/
+func IsKeyframe(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH265):
+		return isH265Keyframe(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		return isAV1Keyframe(payload)
+	}
+	return false
+}
+
+// first packet of the first partition with the P bit unset in the vp8 frame header
+func isVP8Keyframe(payload []byte) bool {
+	vp8 := codecs.VP8Packet{}
+	if _, err := vp8.Unmarshal(payload); err != nil {
+		return false
+	}
+	return vp8.S == 1 && vp8.PID == 0 && len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+}
+
+// start of a non inter-predicted frame in the base spatial layer
+func isVP9Keyframe(payload []byte) bool {
+	vp9 := codecs.VP9Packet{}
+	if _, err := vp9.Unmarshal(payload); err != nil {
+		return false
+	}
+	return vp9.B && !vp9.P && vp9.SID == 0
+}
+
+// SPS, PPS or the start of an IDR slice, also inside STAP-A and FU-A packets
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch naluType := payload[0] & 0x1F; naluType {
+	case h264NaluIDR, h264NaluSPS, h264NaluPPS:
+		return true
+	case h264NaluSTAPA:
+		// 1 byte stap-a header followed by 2 byte size prefixed nal units
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if offset >= len(payload) {
+				break
+			}
+			switch payload[offset] & 0x1F {
+			case h264NaluIDR, h264NaluSPS, h264NaluPPS:
+				return true
+			}
+			offset += size
+		}
+	case h264NaluFUA:
+		// start bit set and fragmented nal unit is an idr slice
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == h264NaluIDR
+	}
+	return false
+}
+
+// VPS/SPS/PPS or the start of an irap slice, also inside aggregation and fragmentation units
+func isH265Keyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	isKeyNalu := func(naluType byte) bool {
+		return (naluType >= h265NaluIRAPMin && naluType <= h265NaluIRAPMax) || (naluType >= h265NaluVPS && naluType <= h265NaluPPS)
+	}
+	switch naluType := payload[0] >> 1 & 0x3F; {
+	case naluType == h265NaluAP:
+		// 2 byte payload header followed by 2 byte size prefixed nal units
+		for offset := 2; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if offset >= len(payload) {
+				break
+			}
+			if isKeyNalu(payload[offset] >> 1 & 0x3F) {
+				return true
+			}
+			offset += size
+		}
+	case naluType == h265NaluFU:
+		// start bit set and fragmented nal unit is an irap slice
+		return len(payload) > 2 && payload[2]&0x80 != 0 && isKeyNalu(payload[2]&0x3F)
+	default:
+		return isKeyNalu(naluType)
+	}
+	return false
+}
+
+// N bit of the aggregation header marks the first packet of a coded video sequence
+func isAV1Keyframe(payload []byte) bool {
+	return len(payload) > 0 && payload[0]&0x08 != 0
+}
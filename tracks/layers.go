@@ -0,0 +1,166 @@
+package tracks
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// interval the bitrate of each layer is measured over
+const layerBitrateWindow = time.Second
+
+/*
+a single encoding of the track (simulcast layer)
+layers are numbered from 0 (lowest quality) upwards
+*/
+type trackLayer struct {
+	cache            *gopCache                 // nil if caching is disabled or track is audio
+	bytes            uint64                    // bytes received in the current window
+	temporalBytes    [maxTemporalLayers]uint64 // bytes received in the current window by temporal layer
+	windowStart      time.Time                 // start of the current measuring window
+	bitrate          uint64                    // bits per second measured in the last window
+	temporalBitrates [maxTemporalLayers]uint64 // bits per second of each temporal layer in the last window
+}
+
+// count received payload bytes and update the measured bitrates
+func (l *trackLayer) account(size int, desc *payloadDescriptor) {
+	now := time.Now()
+	l.bytes += uint64(size)
+	tid := 0
+	if desc.hasTID {
+		tid = int(desc.tid)
+	}
+	if tid >= maxTemporalLayers {
+		tid = maxTemporalLayers - 1
+	}
+	l.temporalBytes[tid] += uint64(size)
+	if elapsed := now.Sub(l.windowStart); elapsed >= layerBitrateWindow {
+		l.bitrate = l.bytes * 8 * uint64(time.Second) / uint64(elapsed)
+		for i := range l.temporalBytes {
+			l.temporalBitrates[i] = l.temporalBytes[i] * 8 * uint64(time.Second) / uint64(elapsed)
+			l.temporalBytes[i] = 0
+		}
+		l.bytes = 0
+		l.windowStart = now
+	}
+}
+
+// return layer, creating it and all lower ones if they do not exist yet
+func (t *RTPTrack) getLayer(layer int) *trackLayer {
+	for len(t.layers) <= layer {
+		l := &trackLayer{windowStart: time.Now()}
+		if t.cacheSize > 0 && t.Kind() == webrtc.RTPCodecTypeVideo {
+			l.cache = newGopCache(t.cacheSize)
+		}
+		t.layers = append(t.layers, l)
+	}
+	return t.layers[layer]
+}
+
+// number of layers the track has received packets for
+func (t *RTPTrack) Layers() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.layers)
+}
+
+// measured bitrate of every layer in bits per second, indexed by layer
+func (t *RTPTrack) LayerBitrates() []uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bitrates := make([]uint64, len(t.layers))
+	for i, l := range t.layers {
+		bitrates[i] = l.bitrate
+	}
+	return bitrates
+}
+
+/*
+select the layer forwarded to the binding with ssrc
+the switch happens at the next keyframe of the layer, returns false if no such binding exists
+*/
+func (t *RTPTrack) SetLayer(ssrc webrtc.SSRC, layer int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if layer < 0 {
+		layer = 0
+	}
+	if len(t.layers) > 0 && layer >= len(t.layers) {
+		layer = len(t.layers) - 1
+	}
+	for _, b := range t.bindings {
+		if b.ssrc == ssrc {
+			b.target = layer
+			return true
+		}
+	}
+	return false
+}
+
+// return layer currently forwarded and the one selected for the binding with ssrc
+func (t *RTPTrack) GetLayer(ssrc webrtc.SSRC) (current, target int, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.bindings {
+		if b.ssrc == ssrc {
+			return b.layer, b.target, true
+		}
+	}
+	return 0, 0, false
+}
+
+/*
+pause or resume forwarding to the binding with ssrc
+forwarding resumes at the next keyframe of the selected layer, returns false if no such binding exists
+*/
+func (t *RTPTrack) SetPaused(ssrc webrtc.SSRC, paused bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.bindings {
+		if b.ssrc != ssrc {
+			continue
+		}
+		if b.paused && !paused && b.started {
+			// no current layer, the keyframe of the target layer switches to it
+			b.layer = -1
+		}
+		b.paused = paused
+		return true
+	}
+	return false
+}
+
+/*
+measured bitrate of a layer when forwarding temporal layers up to index i, in bits per second
+all values are equal for streams without temporal layers
+*/
+func (t *RTPTrack) TemporalBitrates(layer int) []uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bitrates := make([]uint64, maxTemporalLayers)
+	if layer < 0 || layer >= len(t.layers) {
+		return bitrates
+	}
+	sum := uint64(0)
+	for i, bitrate := range t.layers[layer].temporalBitrates {
+		sum += bitrate
+		bitrates[i] = sum
+	}
+	return bitrates
+}
+
+/*
+select the highest temporal layer forwarded to the binding with ssrc (vp8/vp9 only)
+AllTemporalLayers forwards everything, returns false if no such binding exists
+*/
+func (t *RTPTrack) SetTemporalLayer(ssrc webrtc.SSRC, temporal uint8) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.bindings {
+		if b.ssrc == ssrc {
+			b.temporal.target = temporal
+			return true
+		}
+	}
+	return false
+}
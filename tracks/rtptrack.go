@@ -0,0 +1,292 @@
+package tracks
+
+import (
+	"errors"
+	"fmt"
+	"pion-webrtc-sfu/metrics"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+track written to by the rtp writer loops and shared between all users of a session
+works like webrtc.TrackLocalStaticRTP, except that newly bound peerconnections
+first receive the cached gop of the stream (video only) and then the live packets.
+a track can be fed with several layers (simulcast), each binding forwards one of them
+*/
+type RTPTrack struct {
+	mu        sync.Mutex
+	bindings  []*trackBinding
+	layers    []*trackLayer
+	codec     webrtc.RTPCodecCapability
+	id        string
+	streamID  string
+	cacheSize int    // max packets of the gop cache of each layer, 0 disables caching
+	slate     bool   // a slate is forwarded instead of the stalled live stream
+	slateGen  uint64 // incremented by every started slate, old players stop writing
+}
+
+// create new track, gop caching is enabled for video tracks if cacheSize > 0
+func NewRTPTrack(codec webrtc.RTPCodecCapability, id, streamID string, cacheSize int) *RTPTrack {
+	return &RTPTrack{
+		bindings:  make([]*trackBinding, 0),
+		layers:    make([]*trackLayer, 0),
+		codec:     codec,
+		id:        id,
+		streamID:  streamID,
+		cacheSize: cacheSize,
+	}
+}
+
+// called by the peerconnection after negotiation, picks the negotiated codec matching the track
+func (t *RTPTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	codec, err := t.matchCodec(ctx.CodecParameters())
+	if err != nil {
+		return webrtc.RTPCodecParameters{}, err
+	}
+	t.bindings = append(t.bindings, &trackBinding{
+		id:          ctx.ID(),
+		ssrc:        ctx.SSRC(),
+		payloadType: codec.PayloadType,
+		clockRate:   codec.ClockRate,
+		writeStream: ctx.WriteStream(),
+		temporal:    newTemporalFilter(),
+	})
+	return codec, nil
+}
+
+// called when the track is no longer sent to a peerconnection
+func (t *RTPTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.bindings {
+		if t.bindings[i].id == ctx.ID() {
+			t.bindings[i] = t.bindings[len(t.bindings)-1]
+			t.bindings = t.bindings[:len(t.bindings)-1]
+			return nil
+		}
+	}
+	return webrtc.ErrUnbindFailed
+}
+
+// unique identifier of the track
+func (t *RTPTrack) ID() string { return t.id }
+
+// group this track belongs to
+func (t *RTPTrack) StreamID() string { return t.streamID }
+
+// rtp stream identifier, not used
+func (t *RTPTrack) RID() string { return "" }
+
+// audio or video depending on codec
+func (t *RTPTrack) Kind() webrtc.RTPCodecType {
+	switch {
+	case strings.HasPrefix(t.codec.MimeType, "audio/"):
+		return webrtc.RTPCodecTypeAudio
+	case strings.HasPrefix(t.codec.MimeType, "video/"):
+		return webrtc.RTPCodecTypeVideo
+	default:
+		return webrtc.RTPCodecType(0)
+	}
+}
+
+// codec of the track
+func (t *RTPTrack) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+/*
+write a marshaled rtp packet of the base layer to all bound peerconnections
+the buffer can be reused by the caller after returning
+*/
+func (t *RTPTrack) Write(b []byte) (int, error) {
+	return t.WriteLayer(0, b)
+}
+
+// write a marshaled rtp packet of a layer, the buffer can be reused after returning
+func (t *RTPTrack) WriteLayer(layer int, b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	// copy since cached packets outlive the buffer
+	if err := packet.Unmarshal(append([]byte(nil), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), t.WriteLayerRTP(layer, packet)
+}
+
+// write rtp packet of the base layer, packet must not be modified afterwards
+func (t *RTPTrack) WriteRTP(p *rtp.Packet) error {
+	return t.WriteLayerRTP(0, p)
+}
+
+/*
+write rtp packet of a layer to all peerconnections forwarding that layer
+bindings waiting for this layer switch to it if the packet starts a keyframe
+packet must not be modified afterwards
+*/
+func (t *RTPTrack) WriteLayerRTP(layer int, p *rtp.Packet) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.getLayer(layer)
+	desc := parsePayloadDescriptor(t.codec.MimeType, p.Payload)
+	l.account(len(p.Payload), &desc)
+	keyframe := IsKeyframe(t.codec.MimeType, p.Payload)
+	if l.cache != nil {
+		l.cache.push(p, keyframe)
+	}
+	// the live stream is back, bindings on the slate switch to it with this packet
+	if t.slate && t.switchPoint(keyframe) {
+		t.slate = false
+	}
+	var writeErrs writeErrors
+	for _, b := range t.bindings {
+		if b.paused {
+			continue
+		}
+		if b.replaying {
+			if b.layer == layer {
+				b.queue(p)
+			}
+			continue
+		}
+		if !b.started {
+			// nothing sent yet, no keyframe needed to change layers
+			b.layer = b.target
+			if b.layer != layer {
+				continue
+			}
+			// send the cached gop first, it already contains the current packet
+			if l.cache != nil {
+				if start, ok := l.cache.replayStart(); ok {
+					// its keyframe is written right away, the rest only once that showed the transport is ready
+					startDesc := parsePayloadDescriptor(t.codec.MimeType, start.Payload)
+					n, err := b.forward(&start, &startDesc, true)
+					if err != nil {
+						writeErrs = append(writeErrs, err)
+					}
+					if n == 0 {
+						continue
+					}
+					replay := l.cache.replay()[1:]
+					if len(replay) == 0 {
+						b.started = true
+						continue
+					}
+					b.replaying = true
+					// the replay goroutine works on a copy of the binding, the lock is not held while writing
+					replayer := *b
+					go t.replay(b, &replayer, layer, replay)
+					continue
+				}
+			}
+			// nothing written while the transport is not ready yet
+			n, err := b.forward(p, &desc, keyframe)
+			if err != nil {
+				writeErrs = append(writeErrs, err)
+			}
+			b.started = n > 0
+			continue
+		}
+		if b.target == layer && b.layer != layer && t.switchPoint(keyframe) {
+			b.switchLayer(layer, p, &desc)
+		}
+		if b.layer != layer {
+			continue
+		}
+		if _, err := b.forward(p, &desc, keyframe); err != nil {
+			writeErrs = append(writeErrs, err)
+		}
+	}
+	if len(writeErrs) > 0 {
+		metrics.EgressWriteErrors.Add(float64(len(writeErrs)), t.Kind().String())
+		return writeErrs
+	}
+	return nil
+}
+
+/*
+write the cached gop to a new binding without holding the lock, so the other bindings keep receiving
+replayer is a copy of the binding, its offsets and temporal filter are taken over once the replay is written
+live packets queued meanwhile are forwarded afterwards
+*/
+func (t *RTPTrack) replay(b, replayer *trackBinding, layer int, replay []rtp.Packet) {
+	err := replayer.writeReplay(t.codec.MimeType, replay)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pending := b.pending
+	b.pending = nil
+	b.replaying = false
+	overflowed := b.overflowed
+	b.overflowed = false
+	if err != nil {
+		metrics.EgressWriteErrors.Inc(t.Kind().String())
+	}
+	b.seqOffset = replayer.seqOffset
+	b.lastSeq, b.lastTs, b.lastWrite = replayer.lastSeq, replayer.lastTs, replayer.lastWrite
+	// the temporal layer may have been selected meanwhile
+	target := b.temporal.target
+	b.temporal = replayer.temporal
+	b.temporal.target = target
+	b.started = true
+	if overflowed {
+		// live packets were lost, the next keyframe of the target layer resumes the binding
+		b.layer = -1
+		return
+	}
+	for _, p := range pending {
+		if b.paused || b.layer != layer {
+			return
+		}
+		desc := parsePayloadDescriptor(t.codec.MimeType, p.Payload)
+		if _, err := b.forward(p, &desc, IsKeyframe(t.codec.MimeType, p.Payload)); err != nil {
+			metrics.EgressWriteErrors.Inc(t.Kind().String())
+		}
+	}
+}
+
+// errors of a write to multiple bindings, matches any of the contained errors with errors.Is
+type writeErrors []error
+
+func (we writeErrors) Error() string {
+	msgs := make([]string, len(we))
+	for i, err := range we {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (we writeErrors) Is(target error) bool {
+	for _, err := range we {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+find negotiated codec matching the track codec
+exact fmtp matches are preferred over mime type only matches
+*/
+func (t *RTPTrack) matchCodec(negotiated []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, error) {
+	var partial *webrtc.RTPCodecParameters
+	for i, c := range negotiated {
+		if !strings.EqualFold(c.MimeType, t.codec.MimeType) {
+			continue
+		}
+		if t.codec.SDPFmtpLine == "" || c.SDPFmtpLine == t.codec.SDPFmtpLine {
+			return c, nil
+		}
+		if partial == nil {
+			partial = &negotiated[i]
+		}
+	}
+	if partial != nil {
+		return *partial, nil
+	}
+	return webrtc.RTPCodecParameters{}, fmt.Errorf("%w: %s", webrtc.ErrUnsupportedCodec, t.codec.MimeType)
+}
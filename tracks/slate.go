@@ -0,0 +1,90 @@
+package tracks
+
+import (
+	"pion-webrtc-sfu/metrics"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// layer of bindings forwarding the slate
+const slateLayer = -2
+
+/*
+bindings can switch streams at keyframes, audio at any packet
+the rewritten sequence numbers and timestamps keep the output continuous
+*/
+func (t *RTPTrack) switchPoint(keyframe bool) bool {
+	return keyframe || t.Kind() == webrtc.RTPCodecTypeAudio
+}
+
+/*
+forward a slate instead of the live stream until its next keyframe
+returns the generation to write the slate with, false if a slate is already playing
+*/
+func (t *RTPTrack) StartSlate() (uint64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.slate {
+		return 0, false
+	}
+	t.slate = true
+	t.slateGen++
+	return t.slateGen, true
+}
+
+// stop the slate, bindings forwarding it freeze until the next live keyframe
+func (t *RTPTrack) StopSlate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.slate = false
+}
+
+// true while a slate is forwarded instead of the live stream
+func (t *RTPTrack) SlateActive() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.slate
+}
+
+/*
+write a slate packet to all bindings, they switch to the slate at its keyframes
+returns false once the slate of the generation ended, the live stream took over or it was stopped
+packet must not be modified afterwards
+*/
+func (t *RTPTrack) WriteSlateRTP(generation uint64, p *rtp.Packet) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.slate || t.slateGen != generation {
+		return false, nil
+	}
+	desc := parsePayloadDescriptor(t.codec.MimeType, p.Payload)
+	switchPoint := t.switchPoint(IsKeyframe(t.codec.MimeType, p.Payload))
+	var writeErrs writeErrors
+	for _, b := range t.bindings {
+		if b.paused || b.replaying {
+			continue
+		}
+		if b.layer != slateLayer {
+			if !switchPoint {
+				continue
+			}
+			if b.started {
+				b.switchLayer(slateLayer, p, &desc)
+			} else {
+				// viewers joining during the slate start with it
+				b.layer = slateLayer
+			}
+		}
+		n, err := b.forward(p, &desc, switchPoint)
+		if err != nil {
+			writeErrs = append(writeErrs, err)
+		}
+		b.started = b.started || n > 0
+	}
+	if len(writeErrs) > 0 {
+		metrics.EgressWriteErrors.Add(float64(len(writeErrs)), t.Kind().String())
+		return true, writeErrs
+	}
+	return true, nil
+}
@@ -0,0 +1,132 @@
+package tracks
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+bindings switch from the stalled live stream to the slate at its first keyframe and back at the next
+live keyframe, sequence numbers, timestamps and picture IDs continue across both switches
+*/
+func TestRTPTrackSlate(t *testing.T) {
+	track := NewRTPTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "stream", 0)
+	live := &testVideoStream{mimeType: webrtc.MimeTypeVP8, longPicID: true, seq: 65500, timestamp: 0xFFFFFFFF - 9000, picID: 100}
+	slate := &testVideoStream{mimeType: webrtc.MimeTypeVP8, longPicID: true, seq: 10, timestamp: 5000, picID: 7000}
+	writeLive := func(pictures int, keyframe bool) {
+		for i := 0; i < pictures; i++ {
+			for _, p := range live.picture(0, false, keyframe && i == 0) {
+				if err := track.WriteRTP(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	writeSlate := func(generation uint64, pictures int, keyframe bool) bool {
+		playing := true
+		for i := 0; i < pictures; i++ {
+			for _, p := range slate.picture(0, false, keyframe && i == 0) {
+				var err error
+				if playing, err = track.WriteSlateRTP(generation, p); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return playing
+	}
+	early, late := &testWriter{}, &testWriter{}
+	track.bindings = append(track.bindings, testBinding(early))
+	writeLive(10, true)
+	// the live stream stalled
+	generation, started := track.StartSlate()
+	if !started || !track.SlateActive() {
+		t.Fatal("slate not started")
+	}
+	if _, again := track.StartSlate(); again {
+		t.Fatal("second slate started while one is playing")
+	}
+	// viewers joining during the slate start with it
+	track.bindings = append(track.bindings, testBinding(late))
+	if !writeSlate(generation, 2, false) || len(early.packets) != 20 || len(late.packets) != 0 {
+		t.Fatalf("slate forwarded before its keyframe: %v and %v packets", len(early.packets), len(late.packets))
+	}
+	writeSlate(generation, 6, true)
+	// live packets that don't start a keyframe don't end the slate
+	writeLive(1, false)
+	if !track.SlateActive() || len(early.packets) != 32 || len(late.packets) != 12 {
+		t.Fatalf("%v and %v packets written during the slate, want 32 and 12", len(early.packets), len(late.packets))
+	}
+	// the live stream is back at its next keyframe
+	writeLive(6, true)
+	if track.SlateActive() || writeSlate(generation, 1, true) {
+		t.Fatal("slate still playing after a live keyframe")
+	}
+	if len(early.packets) != 44 || len(late.packets) != 24 {
+		t.Errorf("%v and %v packets written, want 44 and 24", len(early.packets), len(late.packets))
+	}
+	testContinuity(t, webrtc.MimeTypeVP8, early.packets)
+	testContinuity(t, webrtc.MimeTypeVP8, late.packets)
+
+	// a stopped slate freezes the bindings until the next live keyframe
+	generation, started = track.StartSlate()
+	if !started {
+		t.Fatal("slate not started again")
+	}
+	writeSlate(generation, 2, true)
+	track.StopSlate()
+	if writeSlate(generation, 1, true) {
+		t.Fatal("stopped slate still playing")
+	}
+	writeLive(2, false)
+	if len(early.packets) != 48 {
+		t.Fatalf("%v packets written, want 48 without the live ones after the stopped slate", len(early.packets))
+	}
+	writeLive(2, true)
+	if len(early.packets) != 52 {
+		t.Errorf("%v packets written, want 52 with the live keyframe", len(early.packets))
+	}
+	testContinuity(t, webrtc.MimeTypeVP8, early.packets)
+}
+
+// audio switches to the slate and back at any packet
+func TestRTPTrackSlateAudio(t *testing.T) {
+	track := NewRTPTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "stream", 0)
+	w := &testWriter{}
+	b := testBinding(w)
+	b.clockRate = 48000
+	track.bindings = append(track.bindings, b)
+	packet := func(seq uint16, ts uint32) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: ts}, Payload: []byte{0xFC, 0xFF}}
+	}
+	for i := 0; i < 10; i++ {
+		if err := track.WriteRTP(packet(uint16(65530+i), uint32(960*i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generation, _ := track.StartSlate()
+	for i := 0; i < 10; i++ {
+		if playing, err := track.WriteSlateRTP(generation, packet(uint16(30000+i), 0xFFFFFF00+uint32(960*i))); !playing || err != nil {
+			t.Fatalf("slate packet %v: playing %v, %v", i, playing, err)
+		}
+	}
+	for i := 10; i < 20; i++ {
+		if err := track.WriteRTP(packet(uint16(65530+i), uint32(960*i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.packets) != 30 || track.SlateActive() {
+		t.Fatalf("%v packets written, slate active %v", len(w.packets), track.SlateActive())
+	}
+	for i := 1; i < len(w.packets); i++ {
+		p, last := w.packets[i], w.packets[i-1]
+		if p.SequenceNumber != last.SequenceNumber+1 {
+			t.Errorf("packet %v: sequence number %v after %v", i, p.SequenceNumber, last.SequenceNumber)
+		}
+		// within a stream packets keep their distance, at a switch the timestamp advances
+		if gap := p.Timestamp - last.Timestamp; gap == 0 || gap > 48000 || (i != 10 && i != 20 && gap != 960) {
+			t.Errorf("packet %v: timestamp advanced by %v", i, gap)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package tracks
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// temporal layers tracked for bitrate measurements, higher layers are counted as the highest one
+const maxTemporalLayers = 4
+
+// forward all temporal layers
+const AllTemporalLayers = 0xFF
+
+/*
+parsed vp8/vp9 payload descriptor
+keeps byte positions of the fields rewritten when forwarding a subset of temporal layers
+*/
+type payloadDescriptor struct {
+	valid      bool   // payload is vp8/vp9 and the descriptor could be parsed
+	frameStart bool   // first packet of a frame
+	hasPicID   bool   // picture ID present
+	picIDLong  bool   // picture ID is 15 bits long instead of 7
+	picIDPos   int    // byte position of the picture ID
+	picID      uint16 // picture ID
+	hasTl0     bool   // TL0PICIDX present
+	tl0Pos     int    // byte position of TL0PICIDX
+	tl0        uint8  // temporal layer zero index
+	hasTID     bool   // temporal layer ID present
+	tid        uint8  // temporal layer ID
+	switchUp   bool   // switching up point (vp8 layer sync / vp9 U bit)
+}
+
+// parse payload descriptor of vp8/vp9 packets, other codecs return an invalid descriptor
+func parsePayloadDescriptor(mimeType string, payload []byte) payloadDescriptor {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return parseVP8Descriptor(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return parseVP9Descriptor(payload)
+	}
+	return payloadDescriptor{}
+}
+
+// parse picture ID at position, returns position after it
+func (d *payloadDescriptor) parsePicID(payload []byte, pos int) (int, bool) {
+	if pos >= len(payload) {
+		return pos, false
+	}
+	d.hasPicID = true
+	d.picIDPos = pos
+	if payload[pos]&0x80 != 0 {
+		if pos+1 >= len(payload) {
+			return pos, false
+		}
+		d.picIDLong = true
+		d.picID = uint16(payload[pos]&0x7F)<<8 | uint16(payload[pos+1])
+		return pos + 2, true
+	}
+	d.picID = uint16(payload[pos] & 0x7F)
+	return pos + 1, true
+}
+
+/*
+vp8 payload descriptor (RFC 7741)
+X|R|N|S|R|PID, then if X: I|L|T|K|RSV, picture ID, TL0PICIDX, TID|Y|KEYIDX
+*/
+func parseVP8Descriptor(payload []byte) payloadDescriptor {
+	d := payloadDescriptor{}
+	if len(payload) < 1 {
+		return d
+	}
+	d.frameStart = payload[0]&0x10 != 0 && payload[0]&0x07 == 0
+	pos := 1
+	if payload[0]&0x80 != 0 {
+		if pos >= len(payload) {
+			return d
+		}
+		ext := payload[pos]
+		pos++
+		var ok bool
+		if ext&0x80 != 0 {
+			if pos, ok = d.parsePicID(payload, pos); !ok {
+				return d
+			}
+		}
+		if ext&0x40 != 0 {
+			if pos >= len(payload) {
+				return d
+			}
+			d.hasTl0 = true
+			d.tl0Pos = pos
+			d.tl0 = payload[pos]
+			pos++
+		}
+		if ext&0x30 != 0 {
+			if pos >= len(payload) {
+				return d
+			}
+			if ext&0x20 != 0 {
+				d.hasTID = true
+				d.tid = payload[pos] >> 6
+				d.switchUp = payload[pos]&0x20 != 0
+			}
+		}
+	}
+	d.valid = true
+	return d
+}
+
+/*
+vp9 payload descriptor (RFC draft-ietf-payload-vp9)
+I|P|L|F|B|E|V|Z, then picture ID, then if L: TID|U|SID|D and TL0PICIDX in non-flexible mode
+*/
+func parseVP9Descriptor(payload []byte) payloadDescriptor {
+	d := payloadDescriptor{}
+	if len(payload) < 1 {
+		return d
+	}
+	header := payload[0]
+	d.frameStart = header&0x08 != 0
+	pos := 1
+	var ok bool
+	if header&0x80 != 0 {
+		if pos, ok = d.parsePicID(payload, pos); !ok {
+			return d
+		}
+	}
+	if header&0x20 != 0 {
+		if pos >= len(payload) {
+			return d
+		}
+		d.hasTID = true
+		d.tid = payload[pos] >> 5
+		d.switchUp = payload[pos]&0x10 != 0
+		pos++
+		// TL0PICIDX only present in non-flexible mode
+		if header&0x10 == 0 {
+			if pos >= len(payload) {
+				return d
+			}
+			d.hasTl0 = true
+			d.tl0Pos = pos
+			d.tl0 = payload[pos]
+		}
+	}
+	d.valid = true
+	return d
+}
+
+// copy payload with picture ID and TL0PICIDX replaced, keeping the picture ID length
+func (d *payloadDescriptor) rewrite(payload []byte, picID uint16, tl0 uint8) []byte {
+	rewritten := append([]byte(nil), payload...)
+	if d.hasPicID {
+		if d.picIDLong {
+			rewritten[d.picIDPos] = 0x80 | byte(picID>>8)&0x7F
+			rewritten[d.picIDPos+1] = byte(picID)
+		} else {
+			rewritten[d.picIDPos] = byte(picID) & 0x7F
+		}
+	}
+	if d.hasTl0 {
+		rewritten[d.tl0Pos] = tl0
+	}
+	return rewritten
+}
+
+// mask of the picture ID depending on its length
+func (d *payloadDescriptor) picIDMask() uint16 {
+	if d.picIDLong {
+		return 0x7FFF
+	}
+	return 0x7F
+}
+
+/*
+temporal layer filter of a binding
+dropped pictures are removed from the picture ID sequence, so decoders do not
+see them as lost. TL0PICIDX only changes on base layer pictures, which are never dropped
+*/
+type temporalFilter struct {
+	target      uint8  // highest temporal layer requested
+	current     uint8  // highest temporal layer currently forwarded
+	dropping    bool   // the current picture is dropped
+	havePicture bool   // a picture was received already
+	lastInPicID uint16 // picture ID of the last received picture
+	picOffset   uint16 // added to incoming picture IDs
+	tl0Offset   uint8  // added to incoming TL0PICIDX
+	lastPicID   uint16 // last picture ID written
+	lastTl0     uint8  // last TL0PICIDX written
+}
+
+func newTemporalFilter() temporalFilter {
+	return temporalFilter{
+		target:  AllTemporalLayers,
+		current: AllTemporalLayers,
+	}
+}
+
+/*
+check if the packet has to be dropped
+temporal layers are lowered at any picture and raised at switching up points or keyframes
+*/
+func (tf *temporalFilter) drop(d *payloadDescriptor, keyframe bool) bool {
+	newPicture := d.frameStart
+	if d.hasPicID {
+		newPicture = !tf.havePicture || d.picID != tf.lastInPicID
+		tf.lastInPicID = d.picID
+		tf.havePicture = true
+	}
+	if newPicture {
+		if tf.target < tf.current {
+			tf.current = tf.target
+		} else if tf.target > tf.current && (keyframe || (d.switchUp && d.tid <= tf.target)) {
+			tf.current = tf.target
+		}
+		tf.dropping = d.hasTID && d.tid > tf.current && !keyframe
+		// remove the dropped picture from the picture ID sequence
+		if tf.dropping && d.hasPicID {
+			tf.picOffset--
+		}
+	}
+	return tf.dropping
+}
+
+// rewrite picture ID and TL0PICIDX of a forwarded packet
+func (tf *temporalFilter) rewrite(d *payloadDescriptor, payload []byte) []byte {
+	picID := (d.picID + tf.picOffset) & d.picIDMask()
+	tl0 := d.tl0 + tf.tl0Offset
+	tf.lastPicID = picID
+	tf.lastTl0 = tl0
+	if tf.picOffset&d.picIDMask() == 0 && tf.tl0Offset == 0 {
+		return payload
+	}
+	return d.rewrite(payload, picID, tl0)
+}
+
+// continue picture ID and TL0PICIDX sequences with a new stream (layer switch)
+func (tf *temporalFilter) switchStream(d *payloadDescriptor) {
+	tf.picOffset = tf.lastPicID + 1 - d.picID
+	tf.tl0Offset = tf.lastTl0 + 1 - d.tl0
+	tf.lastInPicID = d.picID
+	tf.havePicture = false
+}
@@ -0,0 +1,341 @@
+package tracks
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// collects the packets written to a binding
+type testWriter struct {
+	packets []rtp.Packet
+}
+
+func (w *testWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.packets = append(w.packets, rtp.Packet{Header: header.Clone(), Payload: append([]byte(nil), payload...)})
+	return header.MarshalSize() + len(payload), nil
+}
+
+func (w *testWriter) Write(b []byte) (int, error) {
+	p := rtp.Packet{}
+	if err := p.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&p.Header, p.Payload)
+}
+
+// binding writing to w, bound like by RTPTrack.Bind
+func testBinding(w *testWriter) *trackBinding {
+	return &trackBinding{
+		id:          "binding",
+		ssrc:        1234,
+		payloadType: 96,
+		clockRate:   90000,
+		writeStream: w,
+		temporal:    newTemporalFilter(),
+	}
+}
+
+// vp8/vp9 picture of a stream
+type testPicture struct {
+	picID    uint16
+	tl0      uint8
+	tid      uint8
+	switchUp bool
+	keyframe bool
+}
+
+/*
+payload descriptor and some payload bytes of a packet of the picture
+vp8 always has the extension with picture ID, TL0PICIDX and TID, vp9 is in non-flexible mode
+*/
+func testPayload(mimeType string, longPicID bool, pic testPicture, start bool) []byte {
+	picID := []byte{byte(pic.picID & 0x7F)}
+	if longPicID {
+		picID = []byte{0x80 | byte(pic.picID>>8)&0x7F, byte(pic.picID)}
+	}
+	var payload []byte
+	if mimeType == webrtc.MimeTypeVP9 {
+		header := byte(0xA0) // I and L
+		if !pic.keyframe {
+			header |= 0x40
+		}
+		if start {
+			header |= 0x08
+		}
+		layer := pic.tid << 5
+		if pic.switchUp {
+			layer |= 0x10
+		}
+		payload = append(append([]byte{header}, picID...), layer, pic.tl0)
+	} else {
+		header := byte(0x80) // X
+		if start {
+			header |= 0x10
+		}
+		layer := pic.tid << 6
+		if pic.switchUp {
+			layer |= 0x20
+		}
+		payload = append(append([]byte{header, 0xE0}, picID...), pic.tl0, layer)
+	}
+	frame := byte(0x01) // vp8 inter frame
+	if pic.keyframe {
+		frame = 0x00
+	}
+	return append(payload, frame, 0xAA, 0xBB)
+}
+
+// stream of pictures of two packets each
+type testVideoStream struct {
+	mimeType  string
+	longPicID bool
+	seq       uint16
+	timestamp uint32
+	picID     uint16
+	tl0       uint8
+}
+
+/*
+packets of the next picture in temporal layer tid
+tl0 is incremented by base layer pictures, picture IDs wrap at 7 or 15 bits
+*/
+func (s *testVideoStream) picture(tid uint8, switchUp, keyframe bool) []*rtp.Packet {
+	if tid == 0 {
+		s.tl0++
+	}
+	s.picID++
+	if s.longPicID {
+		s.picID &= 0x7FFF
+	} else {
+		s.picID &= 0x7F
+	}
+	s.timestamp += 3000
+	pic := testPicture{picID: s.picID, tl0: s.tl0, tid: tid, switchUp: switchUp, keyframe: keyframe}
+	var packets []*rtp.Packet
+	for i := 0; i < 2; i++ {
+		s.seq++
+		packets = append(packets, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: s.seq, Timestamp: s.timestamp, Marker: i == 1},
+			Payload: testPayload(s.mimeType, s.longPicID, pic, i == 0),
+		})
+	}
+	return packets
+}
+
+/*
+check that the written packets form a continuous stream
+sequence numbers increment by one, timestamps never go back, picture IDs increment
+with every picture and TL0PICIDX with every base layer picture
+*/
+func testContinuity(t *testing.T, mimeType string, packets []rtp.Packet) {
+	t.Helper()
+	var last *rtp.Packet
+	var lastDesc payloadDescriptor
+	for i := range packets {
+		p := &packets[i]
+		desc := parsePayloadDescriptor(mimeType, p.Payload)
+		if !desc.valid {
+			t.Fatalf("packet %v: invalid payload descriptor %x", i, p.Payload)
+		}
+		if last == nil {
+			last, lastDesc = p, desc
+			continue
+		}
+		if p.SequenceNumber != last.SequenceNumber+1 {
+			t.Errorf("packet %v: sequence number %v after %v", i, p.SequenceNumber, last.SequenceNumber)
+		}
+		if int32(p.Timestamp-last.Timestamp) < 0 {
+			t.Errorf("packet %v: timestamp %v after %v", i, p.Timestamp, last.Timestamp)
+		}
+		if desc.picID != lastDesc.picID {
+			if want := (lastDesc.picID + 1) & desc.picIDMask(); desc.picID != want {
+				t.Errorf("packet %v: picture ID %v after %v, want %v", i, desc.picID, lastDesc.picID, want)
+			}
+			if p.Timestamp == last.Timestamp {
+				t.Errorf("packet %v: new picture %v with the timestamp of the last one", i, desc.picID)
+			}
+			want := lastDesc.tl0
+			if desc.tid == 0 {
+				want++
+			}
+			if desc.tl0 != want {
+				t.Errorf("packet %v: TL0PICIDX %v of temporal layer %v after %v, want %v", i, desc.tl0, desc.tid, lastDesc.tl0, want)
+			}
+		} else if desc.tl0 != lastDesc.tl0 || p.Timestamp != last.Timestamp {
+			t.Errorf("packet %v: TL0PICIDX %v or timestamp %v changed within picture %v", i, desc.tl0, p.Timestamp, desc.picID)
+		}
+		last, lastDesc = p, desc
+	}
+}
+
+// count the written pictures by temporal layer
+func testTemporalLayers(mimeType string, packets []rtp.Packet) [maxTemporalLayers]int {
+	var counts [maxTemporalLayers]int
+	for _, p := range packets {
+		if desc := parsePayloadDescriptor(mimeType, p.Payload); desc.frameStart {
+			counts[desc.tid]++
+		}
+	}
+	return counts
+}
+
+func TestParsePayloadDescriptor(t *testing.T) {
+	pic := testPicture{picID: 0x1234, tl0: 200, tid: 2, switchUp: true}
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     payloadDescriptor
+	}{
+		{"vp8", webrtc.MimeTypeVP8, testPayload(webrtc.MimeTypeVP8, true, pic, true),
+			payloadDescriptor{valid: true, frameStart: true, hasPicID: true, picIDLong: true, picIDPos: 2, picID: 0x1234, hasTl0: true, tl0Pos: 4, tl0: 200, hasTID: true, tid: 2, switchUp: true}},
+		{"vp8 short picture id", webrtc.MimeTypeVP8, testPayload(webrtc.MimeTypeVP8, false, pic, false),
+			payloadDescriptor{valid: true, hasPicID: true, picIDPos: 2, picID: 0x34, hasTl0: true, tl0Pos: 3, tl0: 200, hasTID: true, tid: 2, switchUp: true}},
+		{"vp8 without extension", webrtc.MimeTypeVP8, []byte{0x10, 0x00},
+			payloadDescriptor{valid: true, frameStart: true}},
+		{"vp8 continued partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00},
+			payloadDescriptor{valid: true}},
+		{"vp8 key index only", webrtc.MimeTypeVP8, []byte{0x90, 0x10, 0x05, 0x00},
+			payloadDescriptor{valid: true, frameStart: true}},
+		{"vp9", webrtc.MimeTypeVP9, testPayload(webrtc.MimeTypeVP9, true, pic, true),
+			payloadDescriptor{valid: true, frameStart: true, hasPicID: true, picIDLong: true, picIDPos: 1, picID: 0x1234, hasTl0: true, tl0Pos: 4, tl0: 200, hasTID: true, tid: 2, switchUp: true}},
+		{"vp9 short picture id", webrtc.MimeTypeVP9, testPayload(webrtc.MimeTypeVP9, false, pic, false),
+			payloadDescriptor{valid: true, hasPicID: true, picIDPos: 1, picID: 0x34, hasTl0: true, tl0Pos: 3, tl0: 200, hasTID: true, tid: 2, switchUp: true}},
+		{"vp9 flexible mode", webrtc.MimeTypeVP9, []byte{0xB8, 0x05, 0x40},
+			payloadDescriptor{valid: true, frameStart: true, hasPicID: true, picIDPos: 1, picID: 5, hasTID: true, tid: 2}},
+		{"h264", webrtc.MimeTypeH264, []byte{0x65, 0x88}, payloadDescriptor{}},
+		{"empty", webrtc.MimeTypeVP8, nil, payloadDescriptor{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parsePayloadDescriptor(test.mimeType, test.payload); got != test.want {
+				t.Errorf("%x: got %+v, want %+v", test.payload, got, test.want)
+			}
+		})
+	}
+}
+
+// descriptors cut short are invalid and never rewritten
+func TestParsePayloadDescriptorTruncated(t *testing.T) {
+	pic := testPicture{picID: 0x1234, tl0: 200, tid: 2}
+	for _, mimeType := range []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9} {
+		payload := testPayload(mimeType, true, pic, true)
+		// the descriptor ends before the three payload bytes
+		for size := 0; size < len(payload)-3; size++ {
+			if desc := parsePayloadDescriptor(mimeType, payload[:size]); desc.valid {
+				t.Errorf("%v descriptor of %v bytes %x is valid", mimeType, size, payload[:size])
+			}
+		}
+	}
+}
+
+func TestPayloadDescriptorRewrite(t *testing.T) {
+	for _, mimeType := range []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9} {
+		for _, long := range []bool{true, false} {
+			payload := testPayload(mimeType, long, testPicture{picID: 0x1234, tl0: 200, tid: 1, switchUp: true}, true)
+			desc := parsePayloadDescriptor(mimeType, payload)
+			rewritten := desc.rewrite(payload, 0x7FFF, 7)
+			got := parsePayloadDescriptor(mimeType, rewritten)
+			want := desc
+			want.picID, want.tl0 = 0x7FFF&desc.picIDMask(), 7
+			if got != want {
+				t.Errorf("%v long %v: rewritten to %+v, want %+v", mimeType, long, got, want)
+			}
+			// the payload after the descriptor and the original are left alone
+			if string(rewritten[len(rewritten)-3:]) != string(payload[len(payload)-3:]) || parsePayloadDescriptor(mimeType, payload) != desc {
+				t.Errorf("%v long %v: %x rewritten to %x", mimeType, long, payload, rewritten)
+			}
+		}
+	}
+}
+
+/*
+temporal layers are dropped and added back on a L1T3 stream
+picture IDs, TL0PICIDX and sequence numbers stay continuous across the drops and their wraps
+*/
+func TestTemporalFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		mimeType  string
+		longPicID bool
+	}{
+		{"vp8 15 bit picture id", webrtc.MimeTypeVP8, true},
+		{"vp8 7 bit picture id", webrtc.MimeTypeVP8, false},
+		{"vp9 15 bit picture id", webrtc.MimeTypeVP9, true},
+		{"vp9 7 bit picture id", webrtc.MimeTypeVP9, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &testWriter{}
+			b := testBinding(w)
+			// picture IDs, TL0PICIDX and sequence numbers wrap within the first pictures
+			stream := &testVideoStream{mimeType: test.mimeType, longPicID: test.longPicID, seq: 65520, picID: 0x7FF8, tl0: 250}
+			// temporal layers of a L1T3 stream, all but the picture right after the base layer are switching up points
+			pattern := []uint8{0, 2, 1, 2}
+			write := func(pictures int) {
+				for i := 0; i < pictures; i++ {
+					tid := pattern[i%len(pattern)]
+					for _, p := range stream.picture(tid, tid != 0 && i%len(pattern) != 1, false) {
+						desc := parsePayloadDescriptor(test.mimeType, p.Payload)
+						if _, err := b.forward(p, &desc, false); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+			}
+			phases := []struct {
+				target uint8
+				want   [maxTemporalLayers]int
+			}{
+				{AllTemporalLayers, [maxTemporalLayers]int{8, 8, 16}},
+				{0, [maxTemporalLayers]int{8}},
+				{1, [maxTemporalLayers]int{8, 8}},
+				// raising waits for the next switching up point of the layer
+				{2, [maxTemporalLayers]int{8, 8, 15}},
+				{AllTemporalLayers, [maxTemporalLayers]int{8, 8, 16}},
+			}
+			for i, phase := range phases {
+				written := len(w.packets)
+				b.temporal.target = phase.target
+				write(32)
+				if got := testTemporalLayers(test.mimeType, w.packets[written:]); got != phase.want {
+					t.Errorf("phase %v: pictures by temporal layer %v, want %v", i, got, phase.want)
+				}
+			}
+			testContinuity(t, test.mimeType, w.packets)
+		})
+	}
+}
+
+// the picture ID and TL0PICIDX sequences continue when the binding switches to another stream
+func TestTemporalFilterSwitchStream(t *testing.T) {
+	for _, longPicID := range []bool{true, false} {
+		w := &testWriter{}
+		b := testBinding(w)
+		b.temporal.target = 0
+		streams := []*testVideoStream{
+			{mimeType: webrtc.MimeTypeVP8, longPicID: longPicID, seq: 100, timestamp: 5000, picID: 0x7FF0, tl0: 3},
+			{mimeType: webrtc.MimeTypeVP8, longPicID: longPicID, seq: 65500, timestamp: 0xFFFFF000, picID: 10, tl0: 250},
+			{mimeType: webrtc.MimeTypeVP8, longPicID: longPicID, seq: 7, timestamp: 90000, picID: 0x7FFE, tl0: 0},
+		}
+		for i, stream := range streams {
+			for j := 0; j < 20; j++ {
+				for k, p := range stream.picture(uint8(j%2), false, j == 0) {
+					desc := parsePayloadDescriptor(webrtc.MimeTypeVP8, p.Payload)
+					if i > 0 && j == 0 && k == 0 {
+						b.switchLayer(i, p, &desc)
+					}
+					if _, err := b.forward(p, &desc, j == 0 && k == 0); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+		}
+		if len(w.packets) != 3*10*2 {
+			t.Errorf("long %v: %v packets written, want %v", longPicID, len(w.packets), 3*10*2)
+		}
+		testContinuity(t, webrtc.MimeTypeVP8, w.packets)
+	}
+}
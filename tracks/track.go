@@ -15,32 +15,28 @@ a track group contains all the information that should be
 known about incoming stream group (video/audio)
 */
 type TrackGroup struct {
-	VideoTrack *webrtc.TrackLocalStaticRTP
-	AudioTrack *webrtc.TrackLocalStaticRTP
+	VideoTrack *RTPTrack
+	AudioTrack *RTPTrack
 }
 
 /*
 create new track group for video/audio streams
-extracts audio/video codec types from configuration
+extracts audio/video codec types and gop cache size from configuration
 */
 func NewTrackGroup(conf *configuration.Configuration) (TrackGroup, error) {
 	rand.Seed(time.Now().UTC().UnixNano())
-	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
+	videoTrack := NewRTPTrack(
 		webrtc.RTPCodecCapability{MimeType: conf.Rtc_video_codec},
 		fmt.Sprintf("video-%d", randutil.NewMathRandomGenerator().Uint32()),
 		fmt.Sprintf("video-%d", randutil.NewMathRandomGenerator().Uint32()),
+		int(conf.Rtc_gop_cache_max_packets),
 	)
-	if err != nil {
-		return TrackGroup{}, err
-	}
-	audioTrack, err := webrtc.NewTrackLocalStaticRTP(
+	audioTrack := NewRTPTrack(
 		webrtc.RTPCodecCapability{MimeType: conf.Rtc_audio_codec},
 		fmt.Sprintf("audio-%d", randutil.NewMathRandomGenerator().Uint32()),
 		fmt.Sprintf("audio-%d", randutil.NewMathRandomGenerator().Uint32()),
+		0,
 	)
-	if err != nil {
-		return TrackGroup{}, err
-	}
 	return TrackGroup{
 		VideoTrack: videoTrack,
 		AudioTrack: audioTrack,
@@ -2,6 +2,7 @@ package user
 
 import (
 	"encoding/json"
+	"time"
 )
 
 type MessageType string
@@ -13,6 +14,15 @@ const (
 	MESSAGE_STARTRTC     MessageType = "startrtc"
 	MESSAGE_SDP          MessageType = "sdp"
 	MESSAGE_ICECANDIDATE MessageType = "icecandidate"
+	MESSAGE_SETLAYER     MessageType = "setlayer"
+	MESSAGE_SHUTDOWN     MessageType = "shutdown"
+	// the session has no live stream (yet), followed by streamstarted once it does
+	MESSAGE_WAITING       MessageType = "waiting"
+	MESSAGE_STREAMSTARTED MessageType = "streamstarted"
+	// video or audio of the live stream stopped or came back, the stream ended without packets for the idle timeout
+	MESSAGE_STREAMSTALLED MessageType = "streamstalled"
+	MESSAGE_STREAMRESUMED MessageType = "streamresumed"
+	MESSAGE_STREAMENDED   MessageType = "streamended"
 )
 
 // generic serializable message type for all communications
@@ -21,6 +31,29 @@ type Message struct {
 	RawPayload json.RawMessage `json:"payload"`
 }
 
+/*
+payload of setlayer messages, auto switches back to bandwidth based layer selection
+temporal limits the forwarded temporal layers (vp8/vp9), all are forwarded if omitted
+*/
+type SetLayerPayload struct {
+	Layer    int  `json:"layer"`
+	Temporal *int `json:"temporal,omitempty"`
+	Auto     bool `json:"auto"`
+}
+
+/*
+payload of shutdown messages, sent before the server closes the connection
+reconnect is an optional hint where (or when) to reconnect, e.g. the url of another server
+*/
+type ShutdownPayload struct {
+	Reconnect string `json:"reconnect,omitempty"`
+}
+
+// payload of streamstalled and streamresumed messages, kind is video or audio
+type StreamEventPayload struct {
+	Kind string `json:"kind"`
+}
+
 // 2-way message buffer structure
 type messageBuffer struct {
 	serverToClientMsgBuffer chan Message
@@ -45,6 +78,16 @@ func (mb *messageBuffer) PushToClientBuffer(message Message) {
 	mb.serverToClientMsgBuffer <- message
 }
 
+// push to the client buffer unless nobody reads it within timeout, returns false if it was not pushed
+func (mb *messageBuffer) TryPushToClientBuffer(message Message, timeout time.Duration) bool {
+	select {
+	case mb.serverToClientMsgBuffer <- message:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 // read from server buffer of 2-way communication
 func (mb *messageBuffer) ReadFromServerBuffer() <-chan Message {
 	return mb.clientToServerMsgBuffer
@@ -16,6 +16,23 @@ const (
 	killed // only used internally
 )
 
+// names of the states as reported by the api
+func (s State) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case AwaitingConnection:
+		return "awaiting"
+	case Connected:
+		return "connected"
+	case Done:
+		return "done"
+	case killed:
+		return "killed"
+	}
+	return "unknown"
+}
+
 // TODO: in case user rtc/sock wants to reconnect after being killed or stopped or whatever ; need to reset boolean values and re open chans
 // user state struct storing webrtc and websocket states of the user
 type userState struct {
@@ -72,9 +89,11 @@ func (us *userState) RtcKilled() <-chan bool {
 func (us *userState) KillWs() {
 	us.wsMu.Lock()
 	defer us.wsMu.Unlock()
-	// already killed, ignoring
-	if us.wsState == killed {
+	// already killed, ignoring. the state might have been set to done since
+	select {
+	case <-us.wsKilled:
 		return
+	default:
 	}
 	// close this channel, which allows it to be read from indefinitely
 	close(us.wsKilled)
@@ -85,9 +104,11 @@ func (us *userState) KillWs() {
 func (us *userState) KillRtc() {
 	us.rtcMu.Lock()
 	defer us.rtcMu.Unlock()
-	// already killed, ignoring
-	if us.rtcState == killed {
+	// already killed, ignoring. the state might have been set to done since
+	select {
+	case <-us.rtcKilled:
 		return
+	default:
 	}
 	// close this channel, which allows it to be read from indefinitely
 	close(us.rtcKilled)
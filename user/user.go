@@ -7,6 +7,8 @@ import (
 // user preferences and message buffers
 type User struct {
 	Uuid             string        // unique user id
+	Role             string        // role granted by the token of the user, empty without token auth
+	TokenID          string        // id of the token the user connected with, to kick it when revoked
 	Settings         userSettings  // user settings
 	State            userState     // user activity status,
 	WsMessageBuffer  messageBuffer // client-ws message buffer
@@ -0,0 +1,113 @@
+package webrtc
+
+import (
+	"pion-webrtc-sfu/configuration"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/sdp/v3"
+)
+
+// estimate has to exceed the minimum video bitrate by this factor before paused video resumes
+const videoResumeHysteresis = 1.5
+
+/*
+send side bandwidth estimator of a client, fed by transport-wide congestion control feedback
+streams without negotiated transport-cc extension bypass the estimator
+*/
+type twccEstimator struct {
+	*gcc.SendSideBWE
+}
+
+func (e twccEstimator) AddStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	for _, ext := range info.RTPHeaderExtensions {
+		if ext.URI == sdp.TransportCCURI {
+			return e.SendSideBWE.AddStream(info, writer)
+		}
+	}
+	return writer
+}
+
+/*
+register congestion control interceptors
+the estimator of the created peerconnection is stored in the client
+*/
+func (wc *WebrtcClient) registerCongestionControl(config *configuration.Configuration, interceptorRegistry *interceptor.Registry) error {
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		bwe, err := gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(int(config.Rtc_bwe_initial_bitrate)),
+			// packets are forwarded as they arrive, the estimate only drives layer selection
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return twccEstimator{bwe}, nil
+	})
+	if err != nil {
+		return err
+	}
+	congestionController.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
+		wc.estimatorMutex.Lock()
+		wc.estimator = estimator
+		wc.estimatorMutex.Unlock()
+		estimator.OnTargetBitrateChange(func(bitrate int) {
+			wc.onBandwidthEstimate(uint64(bitrate))
+		})
+	})
+	interceptorRegistry.Add(congestionController)
+	return nil
+}
+
+// latest bandwidth estimate of the client in bits per second (transport-cc or REMB)
+func (wc *WebrtcClient) BandwidthEstimate() uint64 {
+	return wc.bandwidthEstimate.Load()
+}
+
+// statistics of the transport-cc estimator, nil if none was created
+func (wc *WebrtcClient) BandwidthStats() map[string]interface{} {
+	wc.estimatorMutex.Lock()
+	estimator := wc.estimator
+	wc.estimatorMutex.Unlock()
+	if estimator == nil {
+		return nil
+	}
+	return estimator.GetStats()
+}
+
+/*
+bandwidth estimate of the client changed
+video is paused below the minimum video bitrate, otherwise the highest simulcast
+layer and temporal layers fitting into the estimate are picked unless the user selected them
+*/
+func (wc *WebrtcClient) onBandwidthEstimate(bitrate uint64) {
+	wc.bandwidthEstimate.Store(bitrate)
+	video := wc.video.Load()
+	// not bound to tracks yet
+	if video == nil {
+		return
+	}
+	if minBitrate := wc.minVideoBitrate; minBitrate > 0 {
+		if bitrate < minBitrate && !wc.videoPaused.Load() {
+			if video.track.SetPaused(video.ssrc, true) {
+				wc.videoPaused.Store(true)
+			}
+			return
+		}
+		if wc.videoPaused.Load() {
+			if float64(bitrate) < float64(minBitrate)*videoResumeHysteresis {
+				return
+			}
+			if video.track.SetPaused(video.ssrc, false) {
+				wc.videoPaused.Store(false)
+				video.requestKeyframe()
+			}
+		}
+	}
+	if !wc.manualLayer.Load() {
+		layer := video.layerForBitrate(bitrate)
+		video.selectLayer(layer)
+		video.track.SetTemporalLayer(video.ssrc, video.temporalForBitrate(layer, bitrate))
+	}
+}
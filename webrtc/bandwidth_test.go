@@ -0,0 +1,94 @@
+package webrtc
+
+import (
+	"pion-webrtc-sfu/tracks"
+	"testing"
+
+	pwrtc "github.com/pion/webrtc/v3"
+)
+
+// video track with fixed layer bitrates, layers switch right away
+type testVideoLayers struct {
+	layerBitrates    []uint64
+	temporalBitrates [][]uint64
+	layer            int
+	temporal         uint8
+	paused           bool
+}
+
+func (v *testVideoLayers) LayerBitrates() []uint64 { return v.layerBitrates }
+
+func (v *testVideoLayers) TemporalBitrates(layer int) []uint64 { return v.temporalBitrates[layer] }
+
+func (v *testVideoLayers) GetLayer(ssrc pwrtc.SSRC) (int, int, bool) { return v.layer, v.layer, true }
+
+func (v *testVideoLayers) SetLayer(ssrc pwrtc.SSRC, layer int) bool {
+	v.layer = layer
+	return true
+}
+
+func (v *testVideoLayers) SetPaused(ssrc pwrtc.SSRC, paused bool) bool {
+	v.paused = paused
+	return true
+}
+
+func (v *testVideoLayers) SetTemporalLayer(ssrc pwrtc.SSRC, temporal uint8) bool {
+	v.temporal = temporal
+	return true
+}
+
+/*
+video pauses below the minimum bitrate and resumes above it times the hysteresis,
+otherwise the highest simulcast and temporal layers fitting into the estimate are selected
+*/
+func TestOnBandwidthEstimate(t *testing.T) {
+	track := &testVideoLayers{
+		layerBitrates: []uint64{300000, 800000, 2000000},
+		temporalBitrates: [][]uint64{
+			{100000, 200000, 300000, 300000},
+			{200000, 400000, 800000, 800000},
+			{500000, 1000000, 2000000, 2000000},
+		},
+		temporal: tracks.AllTemporalLayers,
+	}
+	keyframes := 0
+	wc := &WebrtcClient{minVideoBitrate: 200000}
+	// estimates before the video is bound are only stored
+	wc.onBandwidthEstimate(3000000)
+	if wc.BandwidthEstimate() != 3000000 || track.layer != 0 {
+		t.Fatal("estimate not stored or applied before the video was bound")
+	}
+	wc.video.Store(&videoSender{track: track, ssrc: 1234, requestKeyframe: func() { keyframes++ }})
+	tests := []struct {
+		name          string
+		bitrate       uint64
+		manual        bool
+		wantPaused    bool
+		wantLayer     int
+		wantTemporal  uint8
+		wantKeyframes int
+	}{
+		{"highest layer fits", 3000000, false, false, 2, tracks.AllTemporalLayers, 1},
+		{"middle layer", 1000000, false, false, 1, tracks.AllTemporalLayers, 2},
+		{"lowest layer", 700000, false, false, 0, tracks.AllTemporalLayers, 3},
+		{"lower temporal layers", 250000, false, false, 0, 1, 3},
+		{"below the minimum", 150000, false, true, 0, 1, 3},
+		{"above the minimum within the hysteresis", 250000, false, true, 0, 1, 3},
+		{"above the hysteresis", 320000, false, false, 0, 1, 4},
+		{"selected by the user", 3000000, true, false, 0, 1, 4},
+		{"back to automatic", 3000000, false, false, 2, tracks.AllTemporalLayers, 5},
+	}
+	for _, test := range tests {
+		wc.manualLayer.Store(test.manual)
+		wc.onBandwidthEstimate(test.bitrate)
+		if track.paused != test.wantPaused || wc.videoPaused.Load() != test.wantPaused {
+			t.Errorf("%v: paused %v, want %v", test.name, track.paused, test.wantPaused)
+		}
+		if track.layer != test.wantLayer || track.temporal != test.wantTemporal {
+			t.Errorf("%v: layer %v/%v, want %v/%v", test.name, track.layer, track.temporal, test.wantLayer, test.wantTemporal)
+		}
+		if keyframes != test.wantKeyframes {
+			t.Errorf("%v: %v keyframe requests, want %v", test.name, keyframes, test.wantKeyframes)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package webrtc
+
+import (
+	"fmt"
+	"strings"
+
+	pwrtc "github.com/pion/webrtc/v3"
+)
+
+// feedback accepted for ingested video, keyframe requests and retransmissions
+var ingestVideoRTCPFeedback = []pwrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+
+/*
+codecs that can be received from publishers
+same as the pion defaults, without retransmission streams (nacked packets arrive on the media ssrc)
+and with more h264 profiles since encoders rarely use constrained baseline
+*/
+var ingestCodecs = []struct {
+	parameters pwrtc.RTPCodecParameters
+	kind       pwrtc.RTPCodecType
+}{
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}, PayloadType: 111}, pwrtc.RTPCodecTypeAudio},
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypeG722, ClockRate: 8000}, PayloadType: 9}, pwrtc.RTPCodecTypeAudio},
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: 0}, pwrtc.RTPCodecTypeAudio},
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypePCMA, ClockRate: 8000}, PayloadType: 8}, pwrtc.RTPCodecTypeAudio},
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: ingestVideoRTCPFeedback}, PayloadType: 96}, pwrtc.RTPCodecTypeVideo},
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0", RTCPFeedback: ingestVideoRTCPFeedback}, PayloadType: 98}, pwrtc.RTPCodecTypeVideo},
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", RTCPFeedback: ingestVideoRTCPFeedback}, PayloadType: 102}, pwrtc.RTPCodecTypeVideo},
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", RTCPFeedback: ingestVideoRTCPFeedback}, PayloadType: 125}, pwrtc.RTPCodecTypeVideo},
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f", RTCPFeedback: ingestVideoRTCPFeedback}, PayloadType: 127}, pwrtc.RTPCodecTypeVideo},
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032", RTCPFeedback: ingestVideoRTCPFeedback}, PayloadType: 123}, pwrtc.RTPCodecTypeVideo},
+	{pwrtc.RTPCodecParameters{RTPCodecCapability: pwrtc.RTPCodecCapability{MimeType: pwrtc.MimeTypeAV1, ClockRate: 90000, RTCPFeedback: ingestVideoRTCPFeedback}, PayloadType: 45}, pwrtc.RTPCodecTypeVideo},
+}
+
+/*
+register only the configured video and audio codecs
+so a publisher offering several codecs is answered with the one viewers expect
+*/
+func registerIngestCodecs(mediaEngine *pwrtc.MediaEngine, videoCodec, audioCodec string) error {
+	registered := map[pwrtc.RTPCodecType]bool{}
+	for _, codec := range ingestCodecs {
+		mimeType := videoCodec
+		if codec.kind == pwrtc.RTPCodecTypeAudio {
+			mimeType = audioCodec
+		}
+		if !strings.EqualFold(codec.parameters.MimeType, mimeType) {
+			continue
+		}
+		if err := mediaEngine.RegisterCodec(codec.parameters, codec.kind); err != nil {
+			return err
+		}
+		registered[codec.kind] = true
+	}
+	if !registered[pwrtc.RTPCodecTypeVideo] {
+		return fmt.Errorf("video codec %v can not be ingested", videoCodec)
+	}
+	if !registered[pwrtc.RTPCodecTypeAudio] {
+		return fmt.Errorf("audio codec %v can not be ingested", audioCodec)
+	}
+	return nil
+}
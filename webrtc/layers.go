@@ -0,0 +1,72 @@
+package webrtc
+
+import (
+	"pion-webrtc-sfu/tracks"
+
+	pwrtc "github.com/pion/webrtc/v3"
+)
+
+// share of the estimated bandwidth a layer may use when selected automatically
+const layerBandwidthShare = 0.85
+
+// layer selection of the video track of a session, implemented by tracks.RTPTrack
+type videoLayers interface {
+	LayerBitrates() []uint64
+	TemporalBitrates(layer int) []uint64
+	GetLayer(ssrc pwrtc.SSRC) (current, target int, ok bool)
+	SetLayer(ssrc pwrtc.SSRC, layer int) bool
+	SetPaused(ssrc pwrtc.SSRC, paused bool) bool
+	SetTemporalLayer(ssrc pwrtc.SSRC, temporal uint8) bool
+}
+
+/*
+video of the session sent to a client
+set once the video track was added to the peerconnection, the estimator may report before that
+*/
+type videoSender struct {
+	track           videoLayers // video track of the session
+	ssrc            pwrtc.SSRC  // ssrc of the video sender, identifies the client in the video track
+	requestKeyframe func()      // asks the source of the session for a keyframe
+}
+
+// highest simulcast layer fitting into the bandwidth estimate
+func (v *videoSender) layerForBitrate(bitrate uint64) int {
+	available := uint64(float64(bitrate) * layerBandwidthShare)
+	layer := 0
+	for i, layerBitrate := range v.track.LayerBitrates() {
+		if layerBitrate > 0 && layerBitrate <= available {
+			layer = i
+		}
+	}
+	return layer
+}
+
+/*
+highest temporal layer of a simulcast layer fitting into the bandwidth estimate
+all temporal layers are forwarded if the whole layer fits
+*/
+func (v *videoSender) temporalForBitrate(layer int, bitrate uint64) uint8 {
+	available := uint64(float64(bitrate) * layerBandwidthShare)
+	bitrates := v.track.TemporalBitrates(layer)
+	if full := bitrates[len(bitrates)-1]; full <= available {
+		return tracks.AllTemporalLayers
+	}
+	for temporal := len(bitrates) - 2; temporal > 0; temporal-- {
+		if bitrates[temporal] <= available {
+			return uint8(temporal)
+		}
+	}
+	return 0
+}
+
+// switch the forwarded simulcast layer at its next keyframe
+func (v *videoSender) selectLayer(layer int) {
+	current, target, ok := v.track.GetLayer(v.ssrc)
+	if !ok || target == layer {
+		return
+	}
+	if v.track.SetLayer(v.ssrc, layer) && layer != current {
+		// get the new layer started as soon as possible
+		v.requestKeyframe()
+	}
+}
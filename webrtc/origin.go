@@ -0,0 +1,276 @@
+package webrtc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"pion-webrtc-sfu/auth"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/metrics"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	pwrtc "github.com/pion/webrtc/v3"
+)
+
+// reconnect delays of origin links, doubled after every failed attempt
+const (
+	originMinBackoff = time.Second
+	originMaxBackoff = 30 * time.Second
+)
+
+// timeout of whep requests to the origin, including ice gathering on the origin
+const originRequestTimeout = 10 * time.Second
+
+// max size of the sdp answer of the origin
+const maxOriginAnswerSize = 64 * 1024
+
+/*
+edge side of a cascade, pulls a session from the origin sfu as a whep viewer and feeds the local session
+keyframe requests of local viewers reach the origin as PLI through the peerconnection,
+packets lost between origin and edge are nacked by its interceptors.
+the link reconnects with backoff until it is closed
+*/
+type OriginLink struct {
+	SessionID      string
+	config         *configuration.Configuration
+	mu             sync.Mutex            // protects below connection
+	peerConnection *pwrtc.PeerConnection // nil while reconnecting
+	resource       string                // whep resource url on the origin, deleted when closing
+	failed         chan struct{}         // closed when the current connection failed
+	stop           chan struct{}
+	closeOnce      sync.Once
+	logger         *logging.Logger // carries session and origin
+}
+
+// connect to the origin, the link keeps reconnecting in the background once connected
+func NewOriginLink(config *configuration.Configuration, sessionID string) (*OriginLink, error) {
+	link := &OriginLink{
+		SessionID: sessionID,
+		config:    config,
+		stop:      make(chan struct{}),
+		logger:    logging.With("session_id", sessionID, "origin", config.Rtc_origin_url),
+	}
+	if err := link.connect(); err != nil {
+		return nil, err
+	}
+	link.logger.Infof("pulling session from origin")
+	go link.run()
+	return link, nil
+}
+
+// reconnect whenever the connection fails, until the link is closed
+func (l *OriginLink) run() {
+	backoff := originMinBackoff
+	for {
+		l.mu.Lock()
+		failed := l.failed
+		l.mu.Unlock()
+		select {
+		case <-l.stop:
+			return
+		case <-failed:
+		}
+		l.disconnect()
+		for {
+			l.logger.Warnf("link to origin failed, reconnecting in %v", backoff)
+			select {
+			case <-l.stop:
+				return
+			case <-time.After(backoff):
+			}
+			err := l.connect()
+			if err == nil {
+				backoff = originMinBackoff
+				break
+			}
+			l.logger.Errorf("could not connect to origin: %v", err)
+			backoff *= 2
+			if backoff > originMaxBackoff {
+				backoff = originMaxBackoff
+			}
+		}
+	}
+}
+
+// create a receive only peerconnection and exchange sdp with the whep endpoint of the origin
+func (l *OriginLink) connect() error {
+	config := l.config
+	settingsEngine := newSettingEngine(
+		config,
+		time.Second*time.Duration(config.Rtc_disconnect_timeout_seconds),
+		time.Second*time.Duration(config.Rtc_failed_timeout_seconds),
+		time.Second*time.Duration(config.Rtc_keepalive_interval_seconds),
+	)
+	mediaEngine := &pwrtc.MediaEngine{}
+	if err := registerIngestCodecs(mediaEngine, config.Rtc_video_codec, config.Rtc_audio_codec); err != nil {
+		return err
+	}
+	interceptorRegistry := &interceptor.Registry{}
+	// register default(all) interceptors - receiver reports, NACK generation and transport-cc feedback
+	if err := pwrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return err
+	}
+	api := pwrtc.NewAPI(pwrtc.WithMediaEngine(mediaEngine), pwrtc.WithSettingEngine(*settingsEngine), pwrtc.WithInterceptorRegistry(interceptorRegistry))
+	peerConnection, err := api.NewPeerConnection(pwrtc.Configuration{
+		BundlePolicy:  pwrtc.BundlePolicyMaxBundle,
+		RTCPMuxPolicy: pwrtc.RTCPMuxPolicyRequire,
+	})
+	if err != nil {
+		return err
+	}
+	for _, kind := range []pwrtc.RTPCodecType{pwrtc.RTPCodecTypeVideo, pwrtc.RTPCodecTypeAudio} {
+		if _, err = peerConnection.AddTransceiverFromKind(kind, pwrtc.RTPTransceiverInit{Direction: pwrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			peerConnection.Close()
+			return err
+		}
+	}
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	peerConnection.OnTrack(func(track *pwrtc.TrackRemote, receiver *pwrtc.RTPReceiver) {
+		go l.readTrack(track, peerConnection)
+	})
+	peerConnection.OnConnectionStateChange(func(s pwrtc.PeerConnectionState) {
+		l.logger.Infof("link to origin pc state has changed: %v", s.String())
+		metrics.PeerConnectionStates.Inc("origin", s.String())
+		if s == pwrtc.PeerConnectionStateFailed || s == pwrtc.PeerConnectionStateClosed {
+			failOnce.Do(func() { close(failed) })
+		}
+	})
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		peerConnection.Close()
+		return err
+	}
+	// trickle ice is not used, the offer carries all candidates
+	gatheringComplete := pwrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		peerConnection.Close()
+		return err
+	}
+	<-gatheringComplete
+	answer, resource, err := l.requestAnswer(peerConnection.LocalDescription().SDP)
+	if err != nil {
+		peerConnection.Close()
+		return err
+	}
+	if err = peerConnection.SetRemoteDescription(pwrtc.SessionDescription{Type: pwrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		peerConnection.Close()
+		deleteOriginResource(l.SessionID, resource)
+		return err
+	}
+	l.mu.Lock()
+	l.peerConnection, l.resource, l.failed = peerConnection, resource, failed
+	l.mu.Unlock()
+	return nil
+}
+
+// post the offer to the whep endpoint of the session, returns the answer and the resource url
+func (l *OriginLink) requestAnswer(offer string) (string, string, error) {
+	base, err := url.Parse(strings.TrimSuffix(l.config.Rtc_origin_url, "/") + "/whep/" + url.PathEscape(l.SessionID))
+	if err != nil {
+		return "", "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), originRequestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, base.String(), strings.NewReader(offer))
+	if err != nil {
+		return "", "", err
+	}
+	request.Header.Set("Content-Type", "application/sdp")
+	authorizeOriginRequest(request, l.SessionID)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", "", err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxOriginAnswerSize))
+	if err != nil {
+		return "", "", err
+	}
+	if response.StatusCode != http.StatusCreated {
+		return "", "", fmt.Errorf("origin answered with %v: %s", response.Status, bytes.TrimSpace(body))
+	}
+	location, err := base.Parse(response.Header.Get("Location"))
+	if err != nil || response.Header.Get("Location") == "" {
+		return "", "", errors.New("origin answer has no resource location")
+	}
+	return string(body), location.String(), nil
+}
+
+// forward the packets of an origin track to the local session
+func (l *OriginLink) readTrack(track *pwrtc.TrackRemote, peerConnection *pwrtc.PeerConnection) {
+	l.logger.Infof("link to origin started %v track %v (ssrc %v)", track.Kind(), track.Codec().MimeType, track.SSRC())
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				l.logger.Errorf("link to origin could not read ssrc %v: %v", track.SSRC(), err)
+			}
+			return
+		}
+		if err = writeRemotePacket(l.SessionID, track.Kind(), 0, false, packet, peerConnection); err != nil {
+			l.logger.Errorf("%v track of origin link writer got exception: %s", track.Kind(), err)
+		}
+	}
+}
+
+// close the current connection and leave the session on the origin
+func (l *OriginLink) disconnect() {
+	l.mu.Lock()
+	peerConnection, resource := l.peerConnection, l.resource
+	l.peerConnection, l.resource = nil, ""
+	l.mu.Unlock()
+	if peerConnection != nil {
+		peerConnection.Close()
+	}
+	if resource != "" {
+		deleteOriginResource(l.SessionID, resource)
+	}
+}
+
+// stop pulling the session
+func (l *OriginLink) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.stop)
+		l.disconnect()
+		l.logger.Infof("stopped pulling session from origin")
+	})
+	return nil
+}
+
+// end the whep session on the origin, errors are only logged since the origin times out the viewer anyway
+func deleteOriginResource(sessionID string, resource string) {
+	ctx, cancel := context.WithTimeout(context.Background(), originRequestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, resource, nil)
+	if err != nil {
+		return
+	}
+	authorizeOriginRequest(request, sessionID)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		logging.Warnf("could not delete whep resource %v on origin: %v", resource, err)
+		return
+	}
+	response.Body.Close()
+}
+
+// edges share HTTP_WS_TOKEN_SECRET with the origin and sign their own short lived whep tokens
+func authorizeOriginRequest(request *http.Request, sessionID string) {
+	if !auth.TokensRequired() {
+		return
+	}
+	token, err := auth.Issue(auth.Claims{Session: sessionID, User: "edge", Role: auth.RoleViewer, Expiry: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		return
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+}
@@ -0,0 +1,27 @@
+package webrtc
+
+import (
+	"pion-webrtc-sfu/configuration"
+	"strings"
+	"time"
+
+	pwrtc "github.com/pion/webrtc/v3"
+)
+
+// create setting engine with the port range, NAT IPs and ICE timeouts shared by all peerconnections
+func newSettingEngine(config *configuration.Configuration, disconnectTimeout, failedTimeout, keepaliveInterval time.Duration) *pwrtc.SettingEngine {
+	settingsEngine := &pwrtc.SettingEngine{}
+	// set valid port range
+	settingsEngine.SetEphemeralUDPPortRange(config.Server_ephemeral_udp_port_range.Start, config.Server_ephemeral_udp_port_range.End)
+	nips := strings.Split(config.Server_NAT_1to1_IPs, ",")
+	if nips[0] != "" {
+		settingsEngine.SetNAT1To1IPs(
+			nips,
+			pwrtc.ICECandidateTypeHost,
+		)
+	}
+	// assuming you have a static IP. simplifies things
+	settingsEngine.SetLite(true)
+	settingsEngine.SetICETimeouts(disconnectTimeout, failedTimeout, keepaliveInterval)
+	return settingsEngine
+}
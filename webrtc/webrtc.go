@@ -4,37 +4,59 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/metrics"
 	"pion-webrtc-sfu/sessions"
+	"pion-webrtc-sfu/tracks"
 	"pion-webrtc-sfu/user"
-	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/rtcp"
 	pwrtc "github.com/pion/webrtc/v3"
 )
 
 type WebrtcClient struct {
-	usr            *user.User               // contains all required info
-	peerConnection *pwrtc.PeerConnection    // peerconnection instance
-	videoRTPSender *pwrtc.RTPSender         // audio rtp sender for rtcp parsing
-	audioRTPSender *pwrtc.RTPSender         // vide rtp sender for rtcp parsing
-	currentOffer   pwrtc.SessionDescription // current offer
+	usr               *user.User                  // contains all required info
+	peerConnection    *pwrtc.PeerConnection       // peerconnection instance
+	videoRTPSender    *pwrtc.RTPSender            // audio rtp sender for rtcp parsing
+	audioRTPSender    *pwrtc.RTPSender            // vide rtp sender for rtcp parsing
+	currentOffer      pwrtc.SessionDescription    // current offer
+	session           *sessions.Session           // session the client is watching
+	video             atomic.Pointer[videoSender] // video sent to the client, read by the estimator callback
+	manualLayer       atomic.Bool                 // layer was selected by the user, no bandwidth based selection
+	estimator         cc.BandwidthEstimator       // transport-cc based bandwidth estimator of the peerconnection
+	estimatorMutex    sync.Mutex                  // estimator is set by the interceptor while stats are read
+	bandwidthEstimate atomic.Uint64               // latest bandwidth estimate in bits per second
+	minVideoBitrate   uint64                      // video is paused below this estimate, 0 never pauses
+	videoPaused       atomic.Bool                 // video is paused because of a low estimate
+	whep              bool                        // signaled over WHEP, the client makes the offer and there are no ice restarts
+	logger            *logging.Logger             // carries session and user of the client
 }
 
 // creates webrtc object for server-client communication
-func NewWebrtcClient(config *configuration.Configuration, usr *user.User, sessionID uint32) (*WebrtcClient, error) {
+func NewWebrtcClient(config *configuration.Configuration, usr *user.User, sessionID string) (*WebrtcClient, error) {
+	return newWebrtcClient(config, usr, sessionID, false)
+}
+
+func newWebrtcClient(config *configuration.Configuration, usr *user.User, sessionID string, whep bool) (*WebrtcClient, error) {
 	wrtcclient := WebrtcClient{
-		usr: usr,
+		usr:             usr,
+		minVideoBitrate: uint64(config.Rtc_bwe_min_video_bitrate),
+		whep:            whep,
+		logger:          logging.With("session_id", sessionID, "user_id", usr.Uuid),
 	}
+	wrtcclient.bandwidthEstimate.Store(uint64(config.Rtc_bwe_initial_bitrate))
 	// create peerconnection
 	err := wrtcclient.createPeerConnection(config, sessionID, usr.Uuid)
 	if err != nil {
 		// close peerconnection if it was created before error
 		if wrtcclient.peerConnection != nil {
 			if err := wrtcclient.peerConnection.Close(); err != nil {
-				log.Printf("user %v in session %v could not close pc: %v\n", usr.Uuid, sessionID, err)
+				wrtcclient.logger.Errorf("could not close pc: %v", err)
 			}
 		}
 		wrtcclient.usr.State.SetRtcState(user.Done)
@@ -56,22 +78,28 @@ func (wc *WebrtcClient) processVRTCP() {
 			continue
 		}
 		for _, p := range t {
+			countRTCP("video", p)
 			/*
 				some other RTCP types need to be managed without Pion
-				PIL for example needs to be communicated to the encoder directyly
+				PLI/FIR for example are communicated to the encoder directly
 			*/
 			switch p := p.(type) {
-			case *rtcp.PictureLossIndication:
-			case *rtcp.FullIntraRequest:
+			// forwarded to the rtp source, combined with requests of other viewers
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				wc.session.RequestKeyframe()
+			// select simulcast layer fitting the estimate
 			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				wc.onBandwidthEstimate(uint64(p.Bitrate))
 			case *rtcp.ReceiverReport:
 			case *rtcp.SenderReport:
 			case *rtcp.SliceLossIndication:
 			case *rtcp.TransportLayerNack:
+			// handled by the congestion control interceptor, sent by every pion based viewer (edges)
+			case *rtcp.TransportLayerCC:
 			default:
 				var pbyte []byte
 				p.Unmarshal(pbyte)
-				log.Printf("Could not parse rtp packet, skipping: (%v)\n", string(pbyte))
+				wc.logger.Warnf("Could not parse rtp packet, skipping: (%v)", string(pbyte))
 			}
 		}
 	}
@@ -90,51 +118,81 @@ func (wc *WebrtcClient) processARTCP() {
 			continue
 		}
 		for _, p := range t {
+			countRTCP("audio", p)
 			/*
 				some other RTCP types need to be managed without Pion
-				PIL for example needs to be communicated to the encoder directyly
+				PLI/FIR for example are communicated to the encoder directly
 			*/
 			switch p := p.(type) {
-			case *rtcp.PictureLossIndication:
-			case *rtcp.FullIntraRequest:
+			// forwarded to the rtp source, combined with requests of other viewers
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				wc.session.RequestKeyframe()
 			case *rtcp.ReceiverEstimatedMaximumBitrate:
 			case *rtcp.ReceiverReport:
 			case *rtcp.SenderReport:
 			case *rtcp.SliceLossIndication:
 			case *rtcp.TransportLayerNack:
+			// handled by the congestion control interceptor, sent by every pion based viewer (edges)
+			case *rtcp.TransportLayerCC:
 			default:
 				var pbyte []byte
 				p.Unmarshal(pbyte)
-				log.Printf("Could not parse rtp packet, skipping: (%v)\n", string(pbyte))
+				wc.logger.Warnf("Could not parse rtp packet, skipping: (%v)", string(pbyte))
 			}
 		}
 	}
 }
 
-func (wc *WebrtcClient) createPeerConnection(config *configuration.Configuration, sessionID uint32, userID string) error {
+// count rtcp of viewers by type, NACKs also by the number of requested packets
+func countRTCP(track string, p rtcp.Packet) {
+	var kind string
+	switch p := p.(type) {
+	case *rtcp.PictureLossIndication:
+		kind = "pli"
+	case *rtcp.FullIntraRequest:
+		kind = "fir"
+	case *rtcp.ReceiverEstimatedMaximumBitrate:
+		kind = "remb"
+	case *rtcp.ReceiverReport:
+		kind = "rr"
+	case *rtcp.SenderReport:
+		kind = "sr"
+	case *rtcp.SliceLossIndication:
+		kind = "sli"
+	case *rtcp.TransportLayerNack:
+		kind = "nack"
+		requested := 0
+		for _, pair := range p.Nacks {
+			requested += len(pair.PacketList())
+		}
+		metrics.NackedPackets.Add(float64(requested), track)
+	case *rtcp.TransportLayerCC:
+		kind = "twcc"
+	default:
+		kind = "other"
+	}
+	metrics.RTCPPackets.Inc(track, kind)
+}
+
+func (wc *WebrtcClient) createPeerConnection(config *configuration.Configuration, sessionID string, userID string) error {
 	var err error
 	//		create pion API		//
-	settingsEngine := &pwrtc.SettingEngine{}
-	// set valid port range
-	settingsEngine.SetEphemeralUDPPortRange(config.Server_ephemeral_udp_port_range.Start, config.Server_ephemeral_udp_port_range.End)
-	nips := strings.Split(config.Server_NAT_1to1_IPs, ",")
-	if nips[0] != "" {
-		settingsEngine.SetNAT1To1IPs(
-			nips,
-			pwrtc.ICECandidateTypeHost,
-		)
-	}
-	// assuming you have a static IP. simplifies things
-	settingsEngine.SetLite(true)
-	settingsEngine.SetICETimeouts(wc.usr.Settings.RTCDisconnectTimeout, wc.usr.Settings.RTCFailedTimeout, wc.usr.Settings.RTCKeepaliveInterval)
+	settingsEngine := newSettingEngine(config, wc.usr.Settings.RTCDisconnectTimeout, wc.usr.Settings.RTCFailedTimeout, wc.usr.Settings.RTCKeepaliveInterval)
 	mediaEngine := &pwrtc.MediaEngine{}
 	// register all available codecs -- might be neater to only register required ones
 	// take a look at the called function to learn exactly how
 	if err = mediaEngine.RegisterDefaultCodecs(); err != nil {
 		return err
 	}
-	// register default(all) interceptors - generating reports and NACK handling currently
 	interceptorRegistry := &interceptor.Registry{}
+	// bandwidth estimation from transport-wide congestion control feedback
+	if err = wc.registerCongestionControl(config, interceptorRegistry); err != nil {
+		return err
+	}
+	if err = pwrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, interceptorRegistry); err != nil {
+		return err
+	}
+	// register default(all) interceptors - generating reports and NACK handling currently
 	if err = pwrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
 		return err
 	}
@@ -152,25 +210,26 @@ func (wc *WebrtcClient) createPeerConnection(config *configuration.Configuration
 	}
 	//		set event handlers		//
 	wc.peerConnection.OnNegotiationNeeded(func() {
-		// logging if needed
+		wc.logger.Debugf("negotiation needed")
 	})
 	wc.peerConnection.OnICEConnectionStateChange(func(is pwrtc.ICEConnectionState) {
-		// logging if needed
+		wc.logger.Debugf("ice connection state has changed: %v", is)
 	})
 	wc.peerConnection.OnICEGatheringStateChange(func(is pwrtc.ICEGathererState) {
-		// logging if needed
+		wc.logger.Debugf("ice gathering state has changed: %v", is)
 	})
 	wc.peerConnection.OnSignalingStateChange(func(ss pwrtc.SignalingState) {
-		// logging if needed
+		wc.logger.Debugf("signaling state has changed: %v", ss)
 	})
 	// send generated ICE candidates to client buffer - which is later sent to the client over websocket
 	wc.peerConnection.OnICECandidate(func(i *pwrtc.ICECandidate) {
-		if i == nil {
+		// whep clients get all candidates with the answer
+		if i == nil || wc.whep {
 			return
 		}
 		iceCandidate, err := json.Marshal(i.ToJSON())
 		if err != nil {
-			log.Printf("user %v in session %v could not marshal icecandidate payload\n", wc.usr.Uuid, sessionID)
+			wc.logger.Errorf("could not marshal icecandidate payload")
 			return
 		}
 		// notify client
@@ -185,16 +244,29 @@ func (wc *WebrtcClient) createPeerConnection(config *configuration.Configuration
 	if sess == nil {
 		return errors.New("tracks do not exist in sessions")
 	}
+	wc.session = sess
 	// add tracks and set RTPSenders
 	wc.videoRTPSender, err = wc.peerConnection.AddTrack(sess.TrackGroup.VideoTrack)
 	if err != nil {
 		return err
 	}
+	// the estimator is already installed, the video is published to it once complete
+	wc.video.Store(&videoSender{
+		track:           sess.TrackGroup.VideoTrack,
+		ssrc:            wc.videoRTPSender.GetParameters().Encodings[0].SSRC,
+		requestKeyframe: sess.RequestKeyframe,
+	})
 	wc.audioRTPSender, err = wc.peerConnection.AddTrack(sess.TrackGroup.AudioTrack)
 	if err != nil {
 		return err
 	}
 	//		create offer		//
+	// whep clients send the offer themselves
+	if wc.whep {
+		wc.setConnectionStateHandler(sessionID, userID)
+		wc.usr.State.SetRtcState(user.AwaitingConnection)
+		return nil
+	}
 	offerOptions := pwrtc.OfferOptions{
 		OfferAnswerOptions: pwrtc.OfferAnswerOptions{
 			VoiceActivityDetection: false,
@@ -207,20 +279,31 @@ func (wc *WebrtcClient) createPeerConnection(config *configuration.Configuration
 		return err
 	}
 	wc.currentOffer = offer
-	/*
-		set the callback handler for peer connection state
-		+ notify websocket when the peer has connected/disconnected
-	*/
+	wc.setConnectionStateHandler(sessionID, userID)
+	wc.usr.State.SetRtcState(user.AwaitingConnection)
+	return nil
+}
+
+/*
+set the callback handler for peer connection state
++ notify websocket when the peer has connected/disconnected
+*/
+func (wc *WebrtcClient) setConnectionStateHandler(sessionID string, userID string) {
 	wc.peerConnection.OnConnectionStateChange(func(s pwrtc.PeerConnectionState) {
-		log.Printf("user %v in session %v pc state has changed: %v\n", userID, sessionID, s.String())
+		wc.logger.Infof("pc state has changed: %v", s.String())
+		metrics.PeerConnectionStates.Inc("viewer", s.String())
 		if s == pwrtc.PeerConnectionStateDisconnected {
+			// whep clients can not be sent a new offer, wait for ice to recover or fail
+			if wc.whep {
+				return
+			}
 			if wc.usr.State.GetRtcState() != user.Connected && wc.peerConnection.ConnectionState() != pwrtc.PeerConnectionStateClosed {
 				// not connected, dont need ice restart
 				return
 			}
 			// reset state and send new offer
 			wc.usr.State.SetRtcState(user.AwaitingConnection)
-			log.Printf("user %v in session %v pc attempting restart\n", userID, sessionID)
+			wc.logger.Infof("pc attempting restart")
 			// create new sdp
 			offerOptions := pwrtc.OfferOptions{
 				OfferAnswerOptions: pwrtc.OfferAnswerOptions{
@@ -230,36 +313,39 @@ func (wc *WebrtcClient) createPeerConnection(config *configuration.Configuration
 			}
 			offer, err := wc.peerConnection.CreateOffer(&offerOptions)
 			if err != nil {
-				log.Printf("user %v in session %v couldn't create offer for restart: %v\n", userID, sessionID, err)
+				wc.logger.Errorf("couldn't create offer for restart: %v", err)
 				return
 			}
 			wc.currentOffer = offer
 			// notify server
 			wc.usr.RtcMessageBuffer.PushToServerBuffer(user.Message{Type: user.MESSAGE_ICERESTART})
 		} else if s == pwrtc.PeerConnectionStateFailed {
-			log.Printf("user %v in session %v failed\n", userID, sessionID)
+			wc.logger.Warnf("pc failed")
 			// notify server
-			wc.usr.RtcMessageBuffer.PushToServerBuffer(user.Message{Type: user.MESSAGE_PCFAILED})
+			if !wc.whep {
+				wc.usr.RtcMessageBuffer.PushToServerBuffer(user.Message{Type: user.MESSAGE_PCFAILED})
+			}
 			wc.usr.State.KillRtc()
 		} else if s == pwrtc.PeerConnectionStateConnected {
 			wc.usr.State.SetRtcState(user.Connected)
 		}
 	})
-	wc.usr.State.SetRtcState(user.AwaitingConnection)
-	return nil
 }
 
 // close webrtc client and update user sessions
 func (wc *WebrtcClient) Close() error {
 	err := wc.peerConnection.Close()
 	wc.usr.State.SetRtcState(user.Done)
+	if wc.whep {
+		removeWhepClient(wc)
+	}
 	// update session and close if needed
 	sessions.UpdateSessions()
 	return err
 }
 
 // main loop
-func (wc *WebrtcClient) Loop(config *configuration.Configuration, sessionID uint32) {
+func (wc *WebrtcClient) Loop(config *configuration.Configuration, sessionID string) {
 	defer wc.Close()
 	// start rtcp readers
 	go wc.processVRTCP()
@@ -268,10 +354,10 @@ func (wc *WebrtcClient) Loop(config *configuration.Configuration, sessionID uint
 	for {
 		select {
 		case <-wc.usr.State.WsKilled():
-			log.Printf("user %v in session %v killed ws, also killing rtc\n", wc.usr.Uuid, sessionID)
+			wc.logger.Infof("killed ws, also killing rtc")
 			return
 		case <-wc.usr.State.RtcKilled():
-			log.Printf("user %v in session %v killed rtc\n", wc.usr.Uuid, sessionID)
+			wc.logger.Infof("killed rtc")
 			return
 		// requests made to the server by the server or client
 		case sockMsg := <-wc.usr.RtcMessageBuffer.ReadFromServerBuffer():
@@ -279,11 +365,11 @@ func (wc *WebrtcClient) Loop(config *configuration.Configuration, sessionID uint
 			// start webrtc - works by setting the local description and kickstarting the process
 			case user.MESSAGE_STARTRTC:
 				if wc.peerConnection.SignalingState() == pwrtc.SignalingStateHaveLocalOffer {
-					log.Printf("user %v in session %v ignoring startrtc because offer is already set\n", wc.usr.Uuid, sessionID)
+					wc.logger.Debugf("ignoring startrtc because offer is already set")
 					continue
 				}
 				if wc.peerConnection.ConnectionState() == pwrtc.PeerConnectionStateConnected {
-					log.Printf("user %v in session %v ignoring startrtc webrtc already connected\n", wc.usr.Uuid, sessionID)
+					wc.logger.Debugf("ignoring startrtc webrtc already connected")
 					continue
 				}
 				if err := wc.peerConnection.SetLocalDescription(wc.currentOffer); err != nil {
@@ -313,7 +399,7 @@ func (wc *WebrtcClient) Loop(config *configuration.Configuration, sessionID uint
 			case user.MESSAGE_SDP:
 				var sdp pwrtc.SessionDescription
 				if err := json.Unmarshal(sockMsg.RawPayload, &sdp); err != nil {
-					log.Printf("user %v in session %v could not unmarshal sdp payload\n", wc.usr.Uuid, sessionID)
+					wc.logger.Warnf("could not unmarshal sdp payload")
 					continue
 				}
 				if err := wc.peerConnection.SetRemoteDescription(sdp); err != nil {
@@ -328,10 +414,26 @@ func (wc *WebrtcClient) Loop(config *configuration.Configuration, sessionID uint
 			case user.MESSAGE_ICECANDIDATE:
 				var icecandidate pwrtc.ICECandidate
 				if err := json.Unmarshal(sockMsg.RawPayload, &icecandidate); err != nil {
-					log.Printf("user %v in session %v could not unmarshal icecandidate payload\n", wc.usr.Uuid, sessionID)
+					wc.logger.Warnf("could not unmarshal icecandidate payload")
 					continue
 				}
 				wc.peerConnection.AddICECandidate(icecandidate.ToJSON())
+			// server received layer selection (from remote client)
+			case user.MESSAGE_SETLAYER:
+				var layer user.SetLayerPayload
+				if err := json.Unmarshal(sockMsg.RawPayload, &layer); err != nil {
+					wc.logger.Warnf("could not unmarshal setlayer payload")
+					continue
+				}
+				wc.manualLayer.Store(!layer.Auto)
+				if video := wc.video.Load(); video != nil && !layer.Auto {
+					video.selectLayer(layer.Layer)
+					temporal := uint8(tracks.AllTemporalLayers)
+					if layer.Temporal != nil && *layer.Temporal >= 0 && *layer.Temporal < tracks.AllTemporalLayers {
+						temporal = uint8(*layer.Temporal)
+					}
+					video.track.SetTemporalLayer(video.ssrc, temporal)
+				}
 			// server received ice restart request (from connectionStateChange callback)
 			case user.MESSAGE_ICERESTART:
 				if err := wc.peerConnection.SetLocalDescription(wc.currentOffer); err != nil {
@@ -344,7 +446,7 @@ func (wc *WebrtcClient) Loop(config *configuration.Configuration, sessionID uint
 				}
 				offerjson, err := json.Marshal(*wc.peerConnection.LocalDescription())
 				if err != nil {
-					log.Printf("user %v in session %v could not marshal sdp payload\n", wc.usr.Uuid, sessionID)
+					wc.logger.Errorf("could not marshal sdp payload")
 					continue
 				}
 				// tell client the new offer
@@ -353,7 +455,7 @@ func (wc *WebrtcClient) Loop(config *configuration.Configuration, sessionID uint
 					RawPayload: offerjson,
 				})
 			default:
-				log.Printf("user %v in session %v got bad payload type in server\n", wc.usr.Uuid, sessionID)
+				wc.logger.Warnf("got bad payload type in server")
 			}
 		// requests to make to the client
 		case sockMsg := <-wc.usr.RtcMessageBuffer.ReadFromClientBuffer():
@@ -361,7 +463,7 @@ func (wc *WebrtcClient) Loop(config *configuration.Configuration, sessionID uint
 			// no datachannels opened at the moment.
 			// if datachannels are used client messages can be parsed and handled from here
 			default:
-				log.Printf("user %v in session %v got bad payload type in client\n", wc.usr.Uuid, sessionID)
+				wc.logger.Warnf("got bad payload type in client")
 			}
 		}
 	}
@@ -0,0 +1,110 @@
+package webrtc
+
+import (
+	"bufio"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/user"
+	"strings"
+	"sync"
+
+	pwrtc "github.com/pion/webrtc/v3"
+)
+
+// active whep clients by session and user id
+var whepClients = make(map[string]*WebrtcClient)
+
+// mutex for above map read/write
+var whepMutex sync.Mutex
+
+func whepKey(sessionID string, userID string) string {
+	return sessionID + "/" + userID
+}
+
+/*
+create a webrtc client answering the sdp offer of a WHEP player
+the answer contains all candidates since the server can not trickle them over WHEP
+*/
+func NewWhepClient(config *configuration.Configuration, usr *user.User, sessionID string, offer string) (*WebrtcClient, string, error) {
+	wc, err := newWebrtcClient(config, usr, sessionID, true)
+	if err != nil {
+		return nil, "", err
+	}
+	answer, err := wc.answer(offer)
+	if err != nil {
+		if err := wc.peerConnection.Close(); err != nil {
+			wc.logger.Errorf("could not close pc: %v", err)
+		}
+		wc.usr.State.SetRtcState(user.Done)
+		return nil, "", err
+	}
+	whepMutex.Lock()
+	whepClients[whepKey(sessionID, usr.Uuid)] = wc
+	whepMutex.Unlock()
+	return wc, answer, nil
+}
+
+// return whep client of user in session if it exists
+func GetWhepClient(sessionID string, userID string) *WebrtcClient {
+	whepMutex.Lock()
+	defer whepMutex.Unlock()
+	return whepClients[whepKey(sessionID, userID)]
+}
+
+// forget a closed whep client
+func removeWhepClient(wc *WebrtcClient) {
+	whepMutex.Lock()
+	defer whepMutex.Unlock()
+	for key, client := range whepClients {
+		if client == wc {
+			delete(whepClients, key)
+		}
+	}
+}
+
+// set remote offer and return the local answer after gathering all candidates
+func (wc *WebrtcClient) answer(offer string) (string, error) {
+	if err := wc.peerConnection.SetRemoteDescription(pwrtc.SessionDescription{Type: pwrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	answer, err := wc.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gatheringComplete := pwrtc.GatheringCompletePromise(wc.peerConnection)
+	if err = wc.peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gatheringComplete
+	return wc.peerConnection.LocalDescription().SDP, nil
+}
+
+/*
+add the candidates of a trickle ice sdp fragment (RFC 8840)
+candidates are assigned to the media section they are listed in
+*/
+func (wc *WebrtcClient) AddRemoteCandidates(fragment string) error {
+	mid := ""
+	scanner := bufio.NewScanner(strings.NewReader(fragment))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := pwrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				sdpMid := mid
+				candidate.SDPMid = &sdpMid
+			}
+			if err := wc.peerConnection.AddICECandidate(candidate); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// stop the client, its loop closes the peerconnection and leaves the session
+func (wc *WebrtcClient) Stop() {
+	wc.usr.State.KillRtc()
+}
@@ -0,0 +1,261 @@
+package webrtc
+
+import (
+	"errors"
+	"io"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/hls"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/metrics"
+	"pion-webrtc-sfu/recorder"
+	"pion-webrtc-sfu/relay"
+	"pion-webrtc-sfu/sessions"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/randutil"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	pwrtc "github.com/pion/webrtc/v3"
+)
+
+// characters of generated publisher ids
+const publisherIDCharset = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// returned if the session is already fed by another publisher
+var ErrSessionPublished = errors.New("session already has a publisher")
+
+// returned when a second backup publisher is added to a session
+var ErrSessionBackupPublished = errors.New("session already has a backup publisher")
+
+// simulcast rids commonly used by publishers, mapped to track layers
+var simulcastRIDLayers = map[string]int{
+	"q": 0, "l": 0, "low": 0,
+	"h": 1, "m": 1, "mid": 1,
+	"f": 2, "high": 2,
+}
+
+/*
+a WHIP publisher, a receive only peerconnection feeding the tracks of a session
+nack and pli handling is done by the peerconnection itself, so losses reach the publisher natively
+*/
+type WhipPublisher struct {
+	ID             string                // id of the publisher resource
+	SessionID      string                // session the publisher feeds
+	Backup         bool                  // only forwarded while the primary of the session is silent
+	peerConnection *pwrtc.PeerConnection // receiving peerconnection
+	logger         *logging.Logger       // carries session and publisher
+	closeOnce      sync.Once
+}
+
+// active publishers by id
+var publishers = make(map[string]*WhipPublisher)
+
+// mutex for above map read/write
+var publishersMutex sync.Mutex
+
+/*
+create a publisher from the sdp offer and return it with the sdp answer
+a session has one primary and can have one backup publisher
+candidates are gathered before answering since trickle ice is not supported
+*/
+func NewWhipPublisher(config *configuration.Configuration, sessionID string, backup bool, offer string) (*WhipPublisher, string, error) {
+	id, err := randutil.GenerateCryptoRandomString(16, publisherIDCharset)
+	if err != nil {
+		return nil, "", err
+	}
+	publisher := &WhipPublisher{
+		ID:        id,
+		SessionID: sessionID,
+		Backup:    backup,
+		logger:    logging.With("session_id", sessionID, "publisher_id", id),
+	}
+	publishersMutex.Lock()
+	for _, p := range publishers {
+		if p.SessionID == sessionID && p.Backup == backup {
+			publishersMutex.Unlock()
+			if backup {
+				return nil, "", ErrSessionBackupPublished
+			}
+			return nil, "", ErrSessionPublished
+		}
+	}
+	publishers[id] = publisher
+	publishersMutex.Unlock()
+	answer, err := publisher.createPeerConnection(config, offer)
+	if err != nil {
+		publisher.Close()
+		return nil, "", err
+	}
+	return publisher, answer, nil
+}
+
+// true if a whip publisher feeds the session
+func HasWhipPublisher(sessionID string) bool {
+	publishersMutex.Lock()
+	defer publishersMutex.Unlock()
+	for _, p := range publishers {
+		if p.SessionID == sessionID {
+			return true
+		}
+	}
+	return false
+}
+
+// close all publishers, used on shutdown
+func CloseWhipPublishers() {
+	publishersMutex.Lock()
+	closing := make([]*WhipPublisher, 0, len(publishers))
+	for _, p := range publishers {
+		closing = append(closing, p)
+	}
+	publishersMutex.Unlock()
+	for _, p := range closing {
+		p.Close()
+	}
+}
+
+// return publisher with id if it exists
+func GetWhipPublisher(id string) *WhipPublisher {
+	publishersMutex.Lock()
+	defer publishersMutex.Unlock()
+	return publishers[id]
+}
+
+func (p *WhipPublisher) createPeerConnection(config *configuration.Configuration, offer string) (string, error) {
+	var err error
+	//		create pion API		//
+	settingsEngine := newSettingEngine(
+		config,
+		time.Second*time.Duration(config.Rtc_disconnect_timeout_seconds),
+		time.Second*time.Duration(config.Rtc_failed_timeout_seconds),
+		time.Second*time.Duration(config.Rtc_keepalive_interval_seconds),
+	)
+	mediaEngine := &pwrtc.MediaEngine{}
+	if err = registerIngestCodecs(mediaEngine, config.Rtc_video_codec, config.Rtc_audio_codec); err != nil {
+		return "", err
+	}
+	// mid and rid extensions are needed to receive simulcast
+	for _, extension := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		if err = mediaEngine.RegisterHeaderExtension(pwrtc.RTPHeaderExtensionCapability{URI: extension}, pwrtc.RTPCodecTypeVideo); err != nil {
+			return "", err
+		}
+	}
+	interceptorRegistry := &interceptor.Registry{}
+	// register default(all) interceptors - receiver reports, NACK generation and transport-cc feedback
+	if err = pwrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return "", err
+	}
+	api := pwrtc.NewAPI(pwrtc.WithMediaEngine(mediaEngine), pwrtc.WithSettingEngine(*settingsEngine), pwrtc.WithInterceptorRegistry(interceptorRegistry))
+	if p.peerConnection, err = api.NewPeerConnection(pwrtc.Configuration{
+		BundlePolicy:  pwrtc.BundlePolicyMaxBundle,
+		RTCPMuxPolicy: pwrtc.RTCPMuxPolicyRequire,
+	}); err != nil {
+		return "", err
+	}
+	//		set event handlers		//
+	p.peerConnection.OnTrack(func(track *pwrtc.TrackRemote, receiver *pwrtc.RTPReceiver) {
+		go p.readTrack(track)
+	})
+	p.peerConnection.OnConnectionStateChange(func(s pwrtc.PeerConnectionState) {
+		p.logger.Infof("pc state has changed: %v", s.String())
+		metrics.PeerConnectionStates.Inc("publisher", s.String())
+		if s == pwrtc.PeerConnectionStateFailed || s == pwrtc.PeerConnectionStateClosed {
+			p.Close()
+		}
+	})
+	//		answer offer		//
+	if err = p.peerConnection.SetRemoteDescription(pwrtc.SessionDescription{Type: pwrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	answer, err := p.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gatheringComplete := pwrtc.GatheringCompletePromise(p.peerConnection)
+	if err = p.peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gatheringComplete
+	return p.peerConnection.LocalDescription().SDP, nil
+}
+
+/*
+write packets of a remote track to the tracks of the session
+the session is looked up for every packet, the ingest creates it and creates it again if it was idle collected
+*/
+func (p *WhipPublisher) readTrack(track *pwrtc.TrackRemote) {
+	layer := simulcastRIDLayers[track.RID()]
+	ssrc := uint32(track.SSRC())
+	p.logger.Infof("started %v track %v (ssrc %v, rid %q)", track.Kind(), track.Codec().MimeType, ssrc, track.RID())
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				p.logger.Errorf("could not read ssrc %v: %v", ssrc, err)
+			}
+			return
+		}
+		// keyframe requests of viewers are sent through the peerconnection
+		if err = writeRemotePacket(p.SessionID, track.Kind(), layer, p.Backup, packet, p.peerConnection); err != nil {
+			p.logger.Errorf("%v track writer got exception: %s", track.Kind(), err)
+		}
+	}
+}
+
+/*
+write a packet received by a peerconnection to the session, tapped for recording, hls and relays first
+packets of a backup are dropped while the primary of the session is forwarded
+video keyframe requests of the viewers are sent to feedback
+*/
+func writeRemotePacket(sessionID string, kind pwrtc.RTPCodecType, layer int, backup bool, packet *rtp.Packet, feedback sessions.RTCPWriter) error {
+	// extension ids were negotiated with the remote peer, not with the viewers
+	packet.Header.Extension = false
+	packet.Header.ExtensionProfile = 0
+	packet.Header.Extensions = nil
+	sess := sessions.IngestSession(sessionID, kind)
+	if sess != nil {
+		if kind == pwrtc.RTPCodecTypeVideo {
+			sess.SetVideoFeedback(packet.SSRC, backup, feedback)
+		}
+		if !sess.FailoverRTP(kind, layer, backup, packet) {
+			return nil
+		}
+	}
+	recorder.WriteRTP(sessionID, kind, layer, packet)
+	hls.WriteRTP(sessionID, kind, layer, packet)
+	relay.WriteRTP(sessionID, kind, layer, packet)
+	if sess == nil {
+		return nil
+	}
+	var err error
+	if kind == pwrtc.RTPCodecTypeVideo {
+		err = sess.TrackGroup.VideoTrack.WriteLayerRTP(layer, packet)
+	} else {
+		err = sess.TrackGroup.AudioTrack.WriteRTP(packet)
+	}
+	if errors.Is(err, io.ErrClosedPipe) {
+		return nil
+	}
+	return err
+}
+
+// close the peerconnection and forget the publisher
+func (p *WhipPublisher) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		publishersMutex.Lock()
+		delete(publishers, p.ID)
+		publishersMutex.Unlock()
+		if p.peerConnection != nil {
+			err = p.peerConnection.Close()
+		}
+		// the other publisher of the session keeps the stream going
+		if !HasWhipPublisher(p.SessionID) {
+			sessions.EndStream(p.SessionID)
+		}
+		p.logger.Infof("closed")
+	})
+	return err
+}
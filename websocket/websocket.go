@@ -2,9 +2,9 @@ package websocket
 
 import (
 	"encoding/json"
-	"log"
-	"net/http"
+	"pion-webrtc-sfu/auth"
 	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
 	"pion-webrtc-sfu/sessions"
 	"pion-webrtc-sfu/user"
 	"pion-webrtc-sfu/webrtc"
@@ -17,18 +17,17 @@ import (
 )
 
 type WebsocketClient struct {
-	usr  *user.User          // connected user
-	sock *gorillaSocket.Conn // websocket object used by client
-
+	usr    *user.User          // connected user
+	sock   *gorillaSocket.Conn // websocket object used by client
+	logger *logging.Logger     // carries session and user, set by Loop
 }
 
 func NewWebsocketClient(c *gin.Context, usr *user.User) (*WebsocketClient, error) {
-	// create websocket client
-	// TODO: origin check disabled, might need to enable in other situations
+	// create websocket client, the origin was already checked before the user was created
 	upgrader := gorillaSocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin: auth.OriginAllowed,
+		// answered to browsers passing the token as subprotocol
+		Subprotocols: []string{auth.Subprotocol},
 	}
 	sock, err := upgrader.Upgrade((*c).Writer, (*c).Request, nil)
 	if err != nil {
@@ -37,8 +36,9 @@ func NewWebsocketClient(c *gin.Context, usr *user.User) (*WebsocketClient, error
 	}
 	usr.State.SetWsState(user.Connected)
 	return &WebsocketClient{
-		usr:  usr,
-		sock: sock,
+		usr:    usr,
+		sock:   sock,
+		logger: logging.With("user_id", usr.Uuid),
 	}, nil
 }
 
@@ -72,7 +72,8 @@ func (ws *WebsocketClient) pong() error {
 }
 
 // main loop
-func (ws *WebsocketClient) Loop(config *configuration.Configuration, sessionID uint32) {
+func (ws *WebsocketClient) Loop(config *configuration.Configuration, sessionID string) {
+	ws.logger = logging.With("session_id", sessionID, "user_id", ws.usr.Uuid)
 	// close properly
 	defer ws.Close()
 	// start reading from ws and write outputs to channel,
@@ -80,7 +81,7 @@ func (ws *WebsocketClient) Loop(config *configuration.Configuration, sessionID u
 		for ws.usr.State.GetWsState() == user.Connected {
 			_, message, err := ws.sock.ReadMessage()
 			if err != nil {
-				log.Printf("user %v in session %v got error from websocket: %v\n", ws.usr.Uuid, sessionID, err)
+				ws.logger.Infof("got error from websocket: %v", err)
 				ws.usr.State.KillWs()
 				break
 			}
@@ -90,24 +91,28 @@ func (ws *WebsocketClient) Loop(config *configuration.Configuration, sessionID u
 			}
 			ws.usr.WsMessageBuffer.PushToServerBuffer(parsedMsg)
 		}
-		log.Printf("user %v in session %v exit from ws readr\n", ws.usr.Uuid, sessionID)
+		ws.logger.Debugf("exit from ws readr")
 	}()
 	// new empty webrtc client + connection
 	rtcClient, err := webrtc.NewWebrtcClient(config, ws.usr, sessionID)
 	if err != nil {
 		// error creating rtc, no need for sock either
-		log.Printf("user %v in session %v got error creating rtc client: %v\n", ws.usr.Uuid, sessionID, err)
+		ws.logger.Errorf("got error creating rtc client: %v", err)
 		return
 	}
 	// start rtc loop
 	go rtcClient.Loop(config, sessionID)
+	// viewers of sessions without live stream are told to wait for streamstarted
+	if sess := sessions.ReturnSessionByIdIfExists(sessionID); sess != nil && !sess.Live() {
+		ws.SendToClient(user.Message{Type: user.MESSAGE_WAITING})
+	}
 	for {
 		select {
 		case <-ws.usr.State.WsKilled():
-			log.Printf("user %v in session %v killed ws\n", ws.usr.Uuid, sessionID)
+			ws.logger.Infof("killed ws")
 			return
 		case <-ws.usr.State.RtcKilled():
-			log.Printf("user %v in session %v killed rtc, also killing ws\n", ws.usr.Uuid, sessionID)
+			ws.logger.Infof("killed rtc, also killing ws")
 			return
 		// send pong every few seconds
 		case <-time.After(5 * time.Second):
@@ -123,7 +128,7 @@ func (ws *WebsocketClient) Loop(config *configuration.Configuration, sessionID u
 			case user.MESSAGE_SDP:
 				var sdp pwrtc.SessionDescription
 				if err := json.Unmarshal(sockMsg.RawPayload, &sdp); err != nil {
-					log.Printf("user %v in session %v sent bad sdp\n", ws.usr.Uuid, sessionID)
+					ws.logger.Warnf("sent bad sdp")
 					continue
 				}
 				// forward to webrtc buffer
@@ -131,13 +136,21 @@ func (ws *WebsocketClient) Loop(config *configuration.Configuration, sessionID u
 			case user.MESSAGE_ICECANDIDATE:
 				var icecandidate pwrtc.ICECandidate
 				if err := json.Unmarshal(sockMsg.RawPayload, &icecandidate); err != nil {
-					log.Printf("user %v in session %v sent bad icecandidate\n", ws.usr.Uuid, sessionID)
+					ws.logger.Warnf("sent bad icecandidate")
+					continue
+				}
+				// forward to webrtc buffer
+				ws.usr.RtcMessageBuffer.PushToServerBuffer(sockMsg)
+			case user.MESSAGE_SETLAYER:
+				var layer user.SetLayerPayload
+				if err := json.Unmarshal(sockMsg.RawPayload, &layer); err != nil {
+					ws.logger.Warnf("sent bad setlayer")
 					continue
 				}
 				// forward to webrtc buffer
 				ws.usr.RtcMessageBuffer.PushToServerBuffer(sockMsg)
 			default:
-				log.Printf("user %v in session %v got bad payload type in server\n", ws.usr.Uuid, sessionID)
+				ws.logger.Warnf("got bad payload type in server")
 			}
 		// requests to make to the client
 		case sockMsg := <-ws.usr.WsMessageBuffer.ReadFromClientBuffer():
@@ -145,8 +158,15 @@ func (ws *WebsocketClient) Loop(config *configuration.Configuration, sessionID u
 			// forward to client
 			case user.MESSAGE_SDP, user.MESSAGE_ICECANDIDATE, user.MESSAGE_PCFAILED:
 				ws.SendToClient(sockMsg)
+			// stream state changes
+			case user.MESSAGE_WAITING, user.MESSAGE_STREAMSTARTED, user.MESSAGE_STREAMSTALLED, user.MESSAGE_STREAMRESUMED, user.MESSAGE_STREAMENDED:
+				ws.SendToClient(sockMsg)
+			// server is going away, the connection is closed after the message
+			case user.MESSAGE_SHUTDOWN:
+				ws.SendToClient(sockMsg)
+				ws.sock.WriteControl(gorillaSocket.CloseMessage, gorillaSocket.FormatCloseMessage(gorillaSocket.CloseGoingAway, "server is shutting down"), time.Now().Add(time.Second))
 			default:
-				log.Printf("user %v in session %v got bad payload type in client\n", ws.usr.Uuid, sessionID)
+				ws.logger.Warnf("got bad payload type in client")
 			}
 		}
 	}
@@ -0,0 +1,215 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// amf0 type markers
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0EcmaArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0A
+	amf0Date        = 0x0B
+	amf0LongString  = 0x0C
+)
+
+// amf0 object, keys are kept in order when encoding
+type amfObject []amfProperty
+
+type amfProperty struct {
+	key   string
+	value interface{}
+}
+
+// value of key, nil if it does not exist
+func (o amfObject) get(key string) interface{} {
+	for _, p := range o {
+		if p.key == key {
+			return p.value
+		}
+	}
+	return nil
+}
+
+var errAmfShort = errors.New("amf0 value truncated")
+
+// nesting of objects and arrays accepted, deeper values are rejected instead of exhausting the stack
+const amfMaxDepth = 32
+
+/*
+decode all amf0 values of a command message
+numbers decode to float64, strings to string, objects and ecma arrays to amfObject,
+null and undefined to nil
+*/
+func decodeAmf0(data []byte) ([]interface{}, error) {
+	values := make([]interface{}, 0)
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		value, err := decodeAmf0Value(r, 0)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func decodeAmf0Value(r *bytes.Reader, depth int) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, errAmfShort
+	}
+	if depth >= amfMaxDepth && (marker == amf0Object || marker == amf0EcmaArray || marker == amf0StrictArray) {
+		return nil, errors.New("amf0 values nested too deep")
+	}
+	switch marker {
+	case amf0Number:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, errAmfShort
+		}
+		return math.Float64frombits(bits), nil
+	case amf0Boolean:
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errAmfShort
+		}
+		return b != 0, nil
+	case amf0String:
+		return decodeAmf0String(r, 2)
+	case amf0LongString:
+		return decodeAmf0String(r, 4)
+	case amf0Object:
+		return decodeAmf0Properties(r, depth+1)
+	case amf0EcmaArray:
+		// approximate count, the array is terminated like an object
+		if r.Len() < 4 {
+			return nil, errAmfShort
+		}
+		r.Seek(4, io.SeekCurrent)
+		return decodeAmf0Properties(r, depth+1)
+	case amf0StrictArray:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, errAmfShort
+		}
+		if int(count) > r.Len() {
+			return nil, errAmfShort
+		}
+		array := make([]interface{}, 0, count)
+		for i := uint32(0); i < count; i++ {
+			value, err := decodeAmf0Value(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		return array, nil
+	case amf0Date:
+		// 8 byte milliseconds and 2 byte timezone
+		if r.Len() < 10 {
+			return nil, errAmfShort
+		}
+		r.Seek(10, io.SeekCurrent)
+		return nil, nil
+	case amf0Null, amf0Undefined:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported amf0 marker %#x", marker)
+}
+
+func decodeAmf0String(r *bytes.Reader, lengthSize int) (string, error) {
+	var length uint32
+	if lengthSize == 2 {
+		var short uint16
+		if err := binary.Read(r, binary.BigEndian, &short); err != nil {
+			return "", errAmfShort
+		}
+		length = uint32(short)
+	} else if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", errAmfShort
+	}
+	if int64(length) > int64(r.Len()) {
+		return "", errAmfShort
+	}
+	s := make([]byte, length)
+	r.Read(s)
+	return string(s), nil
+}
+
+// properties until the object end marker
+func decodeAmf0Properties(r *bytes.Reader, depth int) (amfObject, error) {
+	object := amfObject{}
+	for {
+		key, err := decodeAmf0String(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, errAmfShort
+			}
+			if marker == amf0ObjectEnd {
+				return object, nil
+			}
+			r.UnreadByte()
+		}
+		value, err := decodeAmf0Value(r, depth)
+		if err != nil {
+			return nil, err
+		}
+		object = append(object, amfProperty{key, value})
+	}
+}
+
+// encode values, supports float64, int, bool, string, amfObject and nil
+func encodeAmf0(values ...interface{}) []byte {
+	var b bytes.Buffer
+	for _, value := range values {
+		encodeAmf0Value(&b, value)
+	}
+	return b.Bytes()
+}
+
+func encodeAmf0Value(b *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case float64:
+		b.WriteByte(amf0Number)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case int:
+		encodeAmf0Value(b, float64(v))
+	case bool:
+		b.WriteByte(amf0Boolean)
+		if v {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	case string:
+		b.WriteByte(amf0String)
+		binary.Write(b, binary.BigEndian, uint16(len(v)))
+		b.WriteString(v)
+	case amfObject:
+		b.WriteByte(amf0Object)
+		for _, p := range v {
+			binary.Write(b, binary.BigEndian, uint16(len(p.key)))
+			b.WriteString(p.key)
+			encodeAmf0Value(b, p.value)
+		}
+		b.Write([]byte{0, 0, amf0ObjectEnd})
+	default:
+		b.WriteByte(amf0Null)
+	}
+}
@@ -0,0 +1,145 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestAmf0RoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []interface{}
+		want   []interface{}
+	}{
+		{"number", []interface{}{1.5}, []interface{}{1.5}},
+		{"int becomes number", []interface{}{42}, []interface{}{42.0}},
+		{"special numbers", []interface{}{math.Inf(-1), -0.0, math.MaxFloat64}, []interface{}{math.Inf(-1), -0.0, math.MaxFloat64}},
+		{"booleans", []interface{}{true, false}, []interface{}{true, false}},
+		{"strings", []interface{}{"", "publish", "stream key with spaces ü"}, []interface{}{"", "publish", "stream key with spaces ü"}},
+		{"null", []interface{}{nil}, []interface{}{nil}},
+		{"unsupported types become null", []interface{}{uint8(1), []byte{1}}, []interface{}{nil, nil}},
+		{"object keeps key order", []interface{}{amfObject{{"b", 1}, {"a", "x"}, {"c", true}}}, []interface{}{amfObject{{"b", 1.0}, {"a", "x"}, {"c", true}}}},
+		{"empty object", []interface{}{amfObject{}}, []interface{}{amfObject{}}},
+		{"nested objects", []interface{}{amfObject{{"outer", amfObject{{"inner", amfObject{{"n", 3}}}}}}},
+			[]interface{}{amfObject{{"outer", amfObject{{"inner", amfObject{{"n", 3.0}}}}}}}},
+		{"connect command", []interface{}{"connect", 1, amfObject{{"app", "live"}, {"tcUrl", "rtmp://localhost/live"}}, nil},
+			[]interface{}{"connect", 1.0, amfObject{{"app", "live"}, {"tcUrl", "rtmp://localhost/live"}}, nil}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeAmf0(encodeAmf0(test.values...))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+// amf0 encodings the encoder does not produce but publishers send
+func TestAmf0Decode(t *testing.T) {
+	longString := []byte{amf0LongString, 0, 0, 0, 3, 'a', 'b', 'c'}
+	ecmaArray := append([]byte{amf0EcmaArray, 0, 0, 0, 1, 0, 1, 'k', amf0Boolean, 1}, 0, 0, amf0ObjectEnd)
+	strictArray := []byte{amf0StrictArray, 0, 0, 0, 2, amf0Null, amf0Boolean, 0}
+	date := []byte{amf0Date, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0}
+	tests := []struct {
+		name string
+		data []byte
+		want []interface{}
+	}{
+		{"empty", nil, []interface{}{}},
+		{"long string", longString, []interface{}{"abc"}},
+		{"ecma array", ecmaArray, []interface{}{amfObject{{"k", true}}}},
+		{"strict array", strictArray, []interface{}{[]interface{}{nil, false}}},
+		{"date is skipped", date, []interface{}{nil}},
+		{"undefined", []byte{amf0Undefined}, []interface{}{nil}},
+		{"values after a date", append(date, amf0Boolean, 1), []interface{}{nil, true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeAmf0(test.data)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAmf0Malformed(t *testing.T) {
+	nested := bytes.Repeat([]byte{amf0Object, 0, 1, 'k'}, 100000)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"unsupported marker", []byte{0x11}},
+		{"reference marker", []byte{0x07, 0, 1}},
+		{"string longer than the data", []byte{amf0String, 0xFF, 0xFF, 'a'}},
+		{"long string longer than the data", []byte{amf0LongString, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"strict array count larger than the data", []byte{amf0StrictArray, 0xFF, 0xFF, 0xFF, 0xFF, amf0Null}},
+		{"object without end", []byte{amf0Object, 0, 1, 'k', amf0Null}},
+		{"ecma array without count", []byte{amf0EcmaArray, 0, 0}},
+		{"date without timezone", []byte{amf0Date, 1, 2, 3, 4, 5, 6, 7, 8}},
+		{"deeply nested objects", nested},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodeAmf0(test.data); err == nil {
+				t.Error("decoded without error")
+			}
+		})
+	}
+}
+
+// every prefix of a valid command decodes without panicking, incomplete values fail
+func TestAmf0Truncated(t *testing.T) {
+	data := encodeAmf0("publish", 5, nil, "demo", amfObject{{"type", "live"}, {"nested", amfObject{{"n", 1}}}})
+	var offsets []int
+	for r := bytes.NewReader(data); r.Len() > 0; {
+		offsets = append(offsets, len(data)-r.Len())
+		if _, err := decodeAmf0Value(r, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for size := 0; size < len(data); size++ {
+		values, err := decodeAmf0(data[:size])
+		complete := 0
+		for _, offset := range offsets[1:] {
+			if offset <= size {
+				complete++
+			}
+		}
+		boundary := size == 0
+		for _, offset := range offsets {
+			boundary = boundary || offset == size
+		}
+		if boundary != (err == nil) {
+			t.Errorf("%v of %v bytes: error %v", size, len(data), err)
+		}
+		if len(values) != complete {
+			t.Errorf("%v of %v bytes: %v values decoded, want %v", size, len(data), len(values), complete)
+		}
+	}
+}
+
+func TestAmf0ObjectGet(t *testing.T) {
+	object := amfObject{{"app", "live"}, {"flashVer", "FMLE/3.0"}}
+	if got := object.get("flashVer"); got != "FMLE/3.0" {
+		t.Errorf("get returned %v", got)
+	}
+	if got := object.get("missing"); got != nil {
+		t.Errorf("get of a missing key returned %v", got)
+	}
+	// numbers are big endian doubles
+	encoded := encodeAmf0(2.0)
+	if encoded[0] != amf0Number || binary.BigEndian.Uint64(encoded[1:]) != math.Float64bits(2) {
+		t.Errorf("2.0 encoded as %x", encoded)
+	}
+}
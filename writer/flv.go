@@ -0,0 +1,213 @@
+package writer
+
+import (
+	"encoding/binary"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/sessions"
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// flv codec ids and packet types
+const (
+	flvVideoCodecAVC = 7
+	flvVideoKeyframe = 1
+	flvAVCSequence   = 0
+	flvAVCNalu       = 1
+	flvAudioAAC      = 10
+	flvAudioExHeader = 9 // enhanced rtmp, followed by a fourcc
+	flvAACSequence   = 0
+	flvAACRaw        = 1
+	flvExCodedFrames = 1
+	flvVideoExHeader = 0x80
+	flvOpusFourCC    = "Opus"
+)
+
+/*
+repacketizes the flv audio and video tags of a publisher into rtp packets for a session
+h264 is converted from avcc to rtp with sps/pps in front of keyframes,
+aac (RFC 3640) and opus (enhanced rtmp) are forwarded if they match the configured audio codec
+*/
+type flvPublisher struct {
+	sessionID     string
+	backup        bool
+	videoCodec    string
+	audioCodec    string
+	payloader     codecs.H264Payloader
+	sps           []byte
+	pps           []byte
+	nalLengthSize int
+	video         *packetizedStream
+	audio         *packetizedStream
+	aacSampleRate uint32 // 0 until the aac sequence header was received
+	warned        map[string]bool
+}
+
+func newFlvPublisher(sessionID string, backup bool, videoCodec string, audioCodec string) *flvPublisher {
+	return &flvPublisher{
+		sessionID:     sessionID,
+		backup:        backup,
+		videoCodec:    videoCodec,
+		audioCodec:    audioCodec,
+		nalLengthSize: 4,
+		video:         newPacketizedStream(packetizedVideoPayloadType),
+		audio:         newPacketizedStream(packetizedAudioPayloadType),
+		warned:        make(map[string]bool),
+	}
+}
+
+// log a problem with the stream once
+func (fp *flvPublisher) warnOnce(message string) {
+	if fp.warned[message] {
+		return
+	}
+	fp.warned[message] = true
+	logging.With("session_id", fp.sessionID).Warnf("rtmp publisher: %v", message)
+}
+
+// handle a video tag body, timestamp is the decoding time in milliseconds
+func (fp *flvPublisher) writeVideo(timestamp uint32, data []byte) {
+	if len(data) < 5 {
+		return
+	}
+	if data[0]&flvVideoExHeader != 0 || data[0]&0x0F != flvVideoCodecAVC {
+		fp.warnOnce("only h264 video is supported, dropping video")
+		return
+	}
+	if !strings.EqualFold(fp.videoCodec, webrtc.MimeTypeH264) {
+		fp.warnOnce("h264 video does not match RTC_VIDEO_CODEC, dropping video")
+		return
+	}
+	keyframe := data[0]>>4 == flvVideoKeyframe
+	// signed 24 bit composition time offset
+	compositionTime := int32(uint32(data[2])<<16|uint32(data[3])<<8|uint32(data[4])) << 8 >> 8
+	switch data[1] {
+	case flvAVCSequence:
+		fp.parseDecoderConfiguration(data[5:])
+	case flvAVCNalu:
+		// presentation time in the 90kHz clock
+		rtpTimestamp := uint32(int64(int32(timestamp)+compositionTime) * 90)
+		fp.writeAccessUnit(data[5:], keyframe, rtpTimestamp)
+	}
+}
+
+// AVCDecoderConfigurationRecord with nal length size and the sps/pps
+func (fp *flvPublisher) parseDecoderConfiguration(record []byte) {
+	if len(record) < 7 {
+		return
+	}
+	fp.nalLengthSize = int(record[4]&0x03) + 1
+	count := int(record[5] & 0x1F)
+	offset := 6
+	for kind := 0; kind < 2; kind++ {
+		for i := 0; i < count; i++ {
+			if offset+2 > len(record) {
+				return
+			}
+			size := int(binary.BigEndian.Uint16(record[offset:]))
+			offset += 2
+			if offset+size > len(record) {
+				return
+			}
+			if kind == 0 {
+				fp.sps = append([]byte(nil), record[offset:offset+size]...)
+			} else {
+				fp.pps = append([]byte(nil), record[offset:offset+size]...)
+			}
+			offset += size
+		}
+		// number of pps follows the sps
+		if offset >= len(record) {
+			return
+		}
+		count = int(record[offset])
+		offset++
+	}
+}
+
+// convert length prefixed nal units of a frame to rtp packets
+func (fp *flvPublisher) writeAccessUnit(avcc []byte, keyframe bool, rtpTimestamp uint32) {
+	annexB := make([]byte, 0, len(avcc)+len(fp.sps)+len(fp.pps)+16)
+	startCode := []byte{0, 0, 0, 1}
+	if keyframe && fp.sps != nil && fp.pps != nil {
+		annexB = append(append(annexB, startCode...), fp.sps...)
+		annexB = append(append(annexB, startCode...), fp.pps...)
+	}
+	for offset := 0; offset+fp.nalLengthSize <= len(avcc); {
+		size := 0
+		for i := 0; i < fp.nalLengthSize; i++ {
+			size = size<<8 | int(avcc[offset+i])
+		}
+		offset += fp.nalLengthSize
+		if size <= 0 || offset+size > len(avcc) {
+			break
+		}
+		annexB = append(append(annexB, startCode...), avcc[offset:offset+size]...)
+		offset += size
+	}
+	payloads := fp.payloader.Payload(rtpPacketMTU, annexB)
+	for i, payload := range payloads {
+		packet := fp.video.packet(rtpTimestamp, i == len(payloads)-1, payload)
+		if err := writeToSession(fp.sessionID, webrtc.RTPCodecTypeVideo, fp.backup, packet, nil); err != nil {
+			logging.With("session_id", fp.sessionID).Errorf("video track of rtmp publisher writer got exception: %s", err)
+		}
+	}
+}
+
+// handle an audio tag body, timestamp in milliseconds
+func (fp *flvPublisher) writeAudio(timestamp uint32, data []byte) {
+	if len(data) < 2 {
+		return
+	}
+	switch format := data[0] >> 4; {
+	case format == flvAudioAAC:
+		if !strings.EqualFold(fp.audioCodec, mimeTypeAAC) {
+			fp.warnOnce("aac audio does not match RTC_AUDIO_CODEC, dropping audio")
+			return
+		}
+		fp.writeAAC(timestamp, data[1], data[2:])
+	case format == flvAudioExHeader && len(data) >= 5 && string(data[1:5]) == flvOpusFourCC:
+		if !strings.EqualFold(fp.audioCodec, webrtc.MimeTypeOpus) {
+			fp.warnOnce("opus audio does not match RTC_AUDIO_CODEC, dropping audio")
+			return
+		}
+		if data[0]&0x0F != flvExCodedFrames {
+			return
+		}
+		// opus always uses a 48kHz clock
+		fp.writeAudioPacket(timestamp*48, append([]byte(nil), data[5:]...))
+	default:
+		fp.warnOnce("only aac and opus audio are supported, dropping audio")
+	}
+}
+
+// aac sequence header (AudioSpecificConfig) or raw access unit
+func (fp *flvPublisher) writeAAC(timestamp uint32, packetType byte, data []byte) {
+	switch packetType {
+	case flvAACSequence:
+		if len(data) < 2 {
+			return
+		}
+		// object type(5) frequency index(4)
+		index := int(data[0]&0x07)<<1 | int(data[1]>>7)
+		if index < len(aacSampleRates) {
+			fp.aacSampleRate = aacSampleRates[index]
+		}
+		sessions.SetAACConfig(fp.sessionID, data)
+	case flvAACRaw:
+		payload := aacPayload(data)
+		if fp.aacSampleRate == 0 || payload == nil {
+			return
+		}
+		fp.writeAudioPacket(uint32(uint64(timestamp)*uint64(fp.aacSampleRate)/1000), payload)
+	}
+}
+
+func (fp *flvPublisher) writeAudioPacket(rtpTimestamp uint32, payload []byte) {
+	packet := fp.audio.packet(rtpTimestamp, true, payload)
+	if err := writeToSession(fp.sessionID, webrtc.RTPCodecTypeAudio, fp.backup, packet, nil); err != nil {
+		logging.With("session_id", fp.sessionID).Errorf("audio track of rtmp publisher writer got exception: %s", err)
+	}
+}
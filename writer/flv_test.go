@@ -0,0 +1,104 @@
+package writer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestFlvDecoderConfiguration(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xC0, 0x1F, 0xDA}
+	pps := []byte{0x68, 0xCE, 0x3C, 0x80}
+	// version, profile, compatibility, level, length size, sps count, sps, pps count, pps
+	record := append(append([]byte{1, 0x42, 0xC0, 0x1F, 0xFF, 0xE1, 0, byte(len(sps))}, sps...), append([]byte{1, 0, byte(len(pps))}, pps...)...)
+	tests := []struct {
+		name           string
+		record         []byte
+		wantSps        []byte
+		wantPps        []byte
+		wantLengthSize int
+	}{
+		{"complete", record, sps, pps, 4},
+		{"two byte nal lengths", append([]byte{1, 0x42, 0xC0, 0x1F, 0xFD}, record[5:]...), sps, pps, 2},
+		{"without pps", record[:8+len(sps)], sps, nil, 4},
+		{"truncated sps", record[:10], nil, nil, 4},
+		{"truncated pps", record[:len(record)-1], sps, nil, 4},
+		{"pps count without pps", record[:8+len(sps)+1], sps, nil, 4},
+		{"too short", record[:6], nil, nil, 4},
+		{"empty", nil, nil, nil, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fp := newFlvPublisher("flv", false, webrtc.MimeTypeH264, webrtc.MimeTypeOpus)
+			fp.parseDecoderConfiguration(test.record)
+			if !bytes.Equal(fp.sps, test.wantSps) || !bytes.Equal(fp.pps, test.wantPps) || fp.nalLengthSize != test.wantLengthSize {
+				t.Errorf("sps %x, pps %x, nal length size %v, want %x, %x, %v", fp.sps, fp.pps, fp.nalLengthSize, test.wantSps, test.wantPps, test.wantLengthSize)
+			}
+		})
+	}
+}
+
+// truncated and malformed tags are dropped without panicking
+func TestFlvMalformedTags(t *testing.T) {
+	setupTestSessions(t)
+	sequenceHeader := []byte{0x17, flvAVCSequence, 0, 0, 0, 1, 0x42, 0xC0, 0x1F, 0xFF, 0xE1, 0, 2, 0x67, 0x42, 1, 0, 1, 0x68}
+	keyframe := []byte{0x17, flvAVCNalu, 0, 0, 0, 0, 0, 0, 3, 0x65, 0x88, 0x84, 0, 0, 0, 2, 0x41, 0x9A}
+	aacSequence := []byte{flvAudioAAC<<4 | 0x0F, flvAACSequence, 0x12, 0x10}
+	aacRaw := []byte{flvAudioAAC<<4 | 0x0F, flvAACRaw, 0x21, 0x10, 0x04}
+	opus := append([]byte{flvAudioExHeader<<4 | flvExCodedFrames}, append([]byte(flvOpusFourCC), 0xFC, 0xFF, 0xFE)...)
+	video := map[string][]byte{
+		"sequence header": sequenceHeader,
+		"keyframe":        keyframe,
+		// nal lengths beyond the tag with a negative composition time, zero nal lengths
+		"oversized nal":    {0x27, flvAVCNalu, 0xFF, 0xFF, 0xFF, 0x7F, 0xFF, 0xFF, 0xFF, 0x41},
+		"zero nal length":  {0x27, flvAVCNalu, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x41},
+		"enhanced rtmp":    {0x90 | 0x17, 'h', 'v', 'c', '1', 0},
+		"unknown codec":    {0x12, 0, 0, 0, 0, 0},
+		"unknown avc type": {0x17, 9, 0, 0, 0},
+	}
+	audio := map[string][]byte{
+		"aac sequence header":        aacSequence,
+		"aac raw":                    aacRaw,
+		"aac sequence header short":  aacSequence[:3],
+		"aac sample rate index 15":   {flvAudioAAC<<4 | 0x0F, flvAACSequence, 0x17, 0x80},
+		"opus":                       opus,
+		"opus without frame":         opus[:5],
+		"ex header without fourcc":   {flvAudioExHeader << 4, 'O'},
+		"unsupported audio":          {0x2F, 0},
+		"aac without packet payload": {flvAudioAAC<<4 | 0x0F, flvAACRaw},
+	}
+	for _, codecs := range [][2]string{{webrtc.MimeTypeH264, webrtc.MimeTypeOpus}, {webrtc.MimeTypeH264, mimeTypeAAC}, {webrtc.MimeTypeVP8, webrtc.MimeTypeOpus}} {
+		fp := newFlvPublisher("flv", false, codecs[0], codecs[1])
+		for _, tag := range video {
+			for size := 0; size <= len(tag); size++ {
+				fp.writeVideo(uint32(size)*33, tag[:size])
+			}
+		}
+		for _, tag := range audio {
+			for size := 0; size <= len(tag); size++ {
+				fp.writeAudio(uint32(size)*20, tag[:size])
+			}
+		}
+	}
+}
+
+func TestFlvAACSampleRate(t *testing.T) {
+	setupTestSessions(t)
+	tests := []struct {
+		config []byte
+		want   uint32
+	}{
+		{[]byte{0x12, 0x10}, 44100}, // aac lc, index 4
+		{[]byte{0x11, 0x90}, 48000}, // index 3
+		{[]byte{0x15, 0x88}, 8000},  // index 11
+		{[]byte{0x17, 0x80}, 0},     // index 15, explicit rate is not supported
+	}
+	for _, test := range tests {
+		fp := newFlvPublisher("flv", false, webrtc.MimeTypeH264, mimeTypeAAC)
+		fp.writeAudio(0, append([]byte{flvAudioAAC<<4 | 0x0F, flvAACSequence}, test.config...))
+		if fp.aacSampleRate != test.want {
+			t.Errorf("config %x: sample rate %v, want %v", test.config, fp.aacSampleRate, test.want)
+		}
+	}
+}
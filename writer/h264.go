@@ -0,0 +1,113 @@
+package writer
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+
+	"github.com/pion/rtp"
+)
+
+// h264 nal unit types
+const (
+	h264NaluIDR   = 5
+	h264NaluSPS   = 7
+	h264NaluPPS   = 8
+	h264NaluSTAPA = 24
+	h264NaluFUA   = 28
+)
+
+/*
+latest sps/pps of an h264 rtp stream
+many cameras only announce them in the sdp, so they are inserted as a STAP-A
+in front of idr frames arriving without them. later sequence numbers are shifted accordingly
+*/
+type h264ParameterSets struct {
+	sps       []byte
+	pps       []byte
+	lastTs    uint32 // timestamp of the frame the parameter sets were last seen or sent with
+	seen      bool   // parameter sets were seen or sent at least once
+	seqOffset uint16 // number of inserted packets
+}
+
+// parameter sets from the sprop-parameter-sets of an sdp fmtp line
+func newH264ParameterSets(fmtp string) *h264ParameterSets {
+	ps := &h264ParameterSets{}
+	for _, param := range strings.Split(fmtp, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if key != "sprop-parameter-sets" {
+			continue
+		}
+		for _, set := range strings.Split(value, ",") {
+			nalu, err := base64.StdEncoding.DecodeString(set)
+			if err != nil || len(nalu) == 0 {
+				continue
+			}
+			ps.remember(nalu)
+		}
+	}
+	return ps
+}
+
+// store nalu if it is a parameter set
+func (ps *h264ParameterSets) remember(nalu []byte) bool {
+	switch nalu[0] & 0x1F {
+	case h264NaluSPS:
+		ps.sps = append(ps.sps[:0], nalu...)
+		return true
+	case h264NaluPPS:
+		ps.pps = append(ps.pps[:0], nalu...)
+		return true
+	}
+	return false
+}
+
+// return the packets to forward for p, with the parameter sets inserted if needed
+func (ps *h264ParameterSets) process(p *rtp.Packet) []*rtp.Packet {
+	p.SequenceNumber += ps.seqOffset
+	if len(p.Payload) < 1 {
+		return []*rtp.Packet{p}
+	}
+	idrStart := false
+	switch p.Payload[0] & 0x1F {
+	case h264NaluSPS, h264NaluPPS:
+		ps.remember(p.Payload)
+		ps.lastTs, ps.seen = p.Timestamp, true
+	case h264NaluSTAPA:
+		// 1 byte stap-a header followed by 2 byte size prefixed nal units
+		for offset := 1; offset+2 < len(p.Payload); {
+			size := int(binary.BigEndian.Uint16(p.Payload[offset:]))
+			offset += 2
+			if size == 0 || offset+size > len(p.Payload) {
+				break
+			}
+			nalu := p.Payload[offset : offset+size]
+			if ps.remember(nalu) {
+				ps.lastTs, ps.seen = p.Timestamp, true
+			} else if nalu[0]&0x1F == h264NaluIDR {
+				idrStart = true
+			}
+			offset += size
+		}
+	case h264NaluIDR:
+		idrStart = true
+	case h264NaluFUA:
+		idrStart = len(p.Payload) > 1 && p.Payload[1]&0x80 != 0 && p.Payload[1]&0x1F == h264NaluIDR
+	}
+	if !idrStart || (ps.seen && ps.lastTs == p.Timestamp) || ps.sps == nil || ps.pps == nil {
+		return []*rtp.Packet{p}
+	}
+	// stap-a with the nri of the sps
+	payload := make([]byte, 0, 5+len(ps.sps)+len(ps.pps))
+	payload = append(payload, ps.sps[0]&0x60|h264NaluSTAPA)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(ps.sps)))
+	payload = append(payload, ps.sps...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(ps.pps)))
+	payload = append(payload, ps.pps...)
+	parameterSets := &rtp.Packet{Header: p.Header.Clone(), Payload: payload}
+	parameterSets.Marker = false
+	ps.seqOffset++
+	p.SequenceNumber++
+	ps.lastTs, ps.seen = p.Timestamp, true
+	return []*rtp.Packet{parameterSets, p}
+}
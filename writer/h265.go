@@ -0,0 +1,49 @@
+package writer
+
+// h265 nal unit types
+const (
+	h265NaluAUD = 35
+	h265NaluFU  = 49
+)
+
+/*
+rtp payloads of the nal units of an h265 access unit (RFC 7798)
+units larger than mtu are split into fragmentation units, smaller ones are sent as they are
+*/
+func h265Payloads(mtu int, nalus [][]byte) [][]byte {
+	payloads := make([][]byte, 0, len(nalus))
+	for _, nalu := range nalus {
+		if len(nalu) < 3 {
+			continue
+		}
+		naluType := nalu[0] >> 1 & 0x3F
+		// access unit delimiters are implied by the rtp timestamp
+		if naluType == h265NaluAUD {
+			continue
+		}
+		if len(nalu) <= mtu {
+			payloads = append(payloads, nalu)
+			continue
+		}
+		// payload header with type 49 and the layer/tid of the unit, fu header with the original type
+		header := [3]byte{nalu[0]&0x81 | h265NaluFU<<1, nalu[1], naluType}
+		data := nalu[2:]
+		for first := true; len(data) > 0; first = false {
+			size := mtu - len(header)
+			if size > len(data) {
+				size = len(data)
+			}
+			payload := make([]byte, 0, len(header)+size)
+			payload = append(payload, header[:]...)
+			if first {
+				payload[2] |= 0x80
+			}
+			if size == len(data) {
+				payload[2] |= 0x40
+			}
+			payloads = append(payloads, append(payload, data[:size]...))
+			data = data[size:]
+		}
+	}
+	return payloads
+}
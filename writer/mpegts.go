@@ -0,0 +1,249 @@
+package writer
+
+import (
+	"encoding/binary"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	tsPidPAT     = 0x0000
+	tsPidNull    = 0x1FFF
+	tsMaxPesSize = 4 << 20 // larger pes packets are dropped
+)
+
+// pmt stream types
+const (
+	tsStreamAAC     = 0x0F // adts
+	tsStreamH264    = 0x1B
+	tsStreamH265    = 0x24
+	tsStreamPrivate = 0x06 // opus, identified by its registration descriptor
+)
+
+// pmt descriptor tags
+const (
+	tsDescriptorRegistration = 0x05
+)
+
+// a pes packet of an elementary stream
+type tsPes struct {
+	pid     uint16
+	pts     int64 // 90kHz, -1 if the packet had none
+	payload []byte
+}
+
+// elementary stream announced in a pmt
+type tsElementaryStream struct {
+	pid        uint16
+	streamType uint8
+	opus       bool // private stream with an "Opus" registration descriptor
+	pes        []byte
+	started    bool // a payload unit start was seen, pes holds a partial packet
+}
+
+/*
+demuxes a single program of an mpeg-ts stream
+programNumber 0 selects the first program of the pat
+complete pes packets of the streams in the pmt are passed to onPes
+*/
+type tsDemuxer struct {
+	programNumber uint16
+	pmtPid        uint16 // 0 until found in the pat
+	pmtVersion    int    // -1 until a pmt was parsed
+	streams       map[uint16]*tsElementaryStream
+	sections      map[uint16][]byte // psi sections being assembled by pid
+	onPmt         func(streams []*tsElementaryStream)
+	onPes         func(stream *tsElementaryStream, pes tsPes)
+}
+
+func newTsDemuxer(programNumber uint16) *tsDemuxer {
+	return &tsDemuxer{
+		programNumber: programNumber,
+		pmtVersion:    -1,
+		streams:       make(map[uint16]*tsElementaryStream),
+		sections:      make(map[uint16][]byte),
+	}
+}
+
+// demux all 188 byte packets of a datagram, partial packets are ignored
+func (d *tsDemuxer) write(data []byte) {
+	for offset := 0; offset+tsPacketSize <= len(data); offset += tsPacketSize {
+		d.packet(data[offset : offset+tsPacketSize])
+	}
+}
+
+func (d *tsDemuxer) packet(packet []byte) {
+	if packet[0] != tsSyncByte || packet[1]&0x80 != 0 {
+		return
+	}
+	unitStart := packet[1]&0x40 != 0
+	pid := binary.BigEndian.Uint16(packet[1:3]) & 0x1FFF
+	adaptation := packet[3] >> 4 & 0x03
+	payload := packet[4:]
+	if adaptation&0x02 != 0 {
+		if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+			return
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+	if adaptation&0x01 == 0 || len(payload) == 0 || pid == tsPidNull {
+		return
+	}
+	switch {
+	case pid == tsPidPAT:
+		if section := d.section(pid, unitStart, payload); section != nil {
+			d.parsePAT(section)
+		}
+	case pid == d.pmtPid && d.pmtPid != 0:
+		if section := d.section(pid, unitStart, payload); section != nil {
+			d.parsePMT(section)
+		}
+	default:
+		if stream, ok := d.streams[pid]; ok {
+			d.writePes(stream, unitStart, payload)
+		}
+	}
+}
+
+// assemble a psi section, returns it once complete (without the crc)
+func (d *tsDemuxer) section(pid uint16, unitStart bool, payload []byte) []byte {
+	if unitStart {
+		pointer := int(payload[0])
+		if pointer+1 > len(payload) {
+			return nil
+		}
+		d.sections[pid] = append([]byte(nil), payload[1+pointer:]...)
+	} else if buf, ok := d.sections[pid]; ok {
+		d.sections[pid] = append(buf, payload...)
+	} else {
+		return nil
+	}
+	buf := d.sections[pid]
+	if len(buf) < 3 {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(buf[1:3]) & 0x0FFF)
+	if len(buf) < 3+length {
+		return nil
+	}
+	delete(d.sections, pid)
+	if length < 9 {
+		return nil
+	}
+	return buf[:3+length-4]
+}
+
+// program association table, finds the pmt pid of the program
+func (d *tsDemuxer) parsePAT(section []byte) {
+	// table id, length, transport stream id, version, section numbers
+	for offset := 8; offset+4 <= len(section); offset += 4 {
+		number := binary.BigEndian.Uint16(section[offset:])
+		pid := binary.BigEndian.Uint16(section[offset+2:]) & 0x1FFF
+		// program 0 is the network information table
+		if number == 0 || (d.programNumber != 0 && number != d.programNumber) {
+			continue
+		}
+		if d.pmtPid != pid {
+			d.pmtPid, d.pmtVersion = pid, -1
+		}
+		return
+	}
+}
+
+// program map table, lists the elementary streams of the program
+func (d *tsDemuxer) parsePMT(section []byte) {
+	if len(section) < 12 {
+		return
+	}
+	version := int(section[5] >> 1 & 0x1F)
+	if version == d.pmtVersion {
+		return
+	}
+	d.pmtVersion = version
+	programInfoLength := int(binary.BigEndian.Uint16(section[10:12]) & 0x0FFF)
+	streams := make(map[uint16]*tsElementaryStream)
+	list := make([]*tsElementaryStream, 0)
+	for offset := 12 + programInfoLength; offset+5 <= len(section); {
+		stream := &tsElementaryStream{
+			pid:        binary.BigEndian.Uint16(section[offset+1:]) & 0x1FFF,
+			streamType: section[offset],
+		}
+		infoLength := int(binary.BigEndian.Uint16(section[offset+3:]) & 0x0FFF)
+		offset += 5
+		if offset+infoLength > len(section) {
+			break
+		}
+		descriptors := section[offset : offset+infoLength]
+		offset += infoLength
+		for i := 0; i+2 <= len(descriptors); {
+			tag, length := descriptors[i], int(descriptors[i+1])
+			if i+2+length > len(descriptors) {
+				break
+			}
+			if tag == tsDescriptorRegistration && length >= 4 && string(descriptors[i+2:i+6]) == "Opus" {
+				stream.opus = true
+			}
+			i += 2 + length
+		}
+		// keep partially assembled pes of streams that did not change
+		if previous, ok := d.streams[stream.pid]; ok && previous.streamType == stream.streamType {
+			stream = previous
+		}
+		streams[stream.pid] = stream
+		list = append(list, stream)
+	}
+	d.streams = streams
+	if d.onPmt != nil {
+		d.onPmt(list)
+	}
+}
+
+// assemble pes packets, a packet is complete at the next payload unit start or once its length is reached
+func (d *tsDemuxer) writePes(stream *tsElementaryStream, unitStart bool, payload []byte) {
+	if unitStart {
+		d.flushPes(stream)
+		stream.started = true
+	}
+	if !stream.started {
+		return
+	}
+	if len(stream.pes)+len(payload) > tsMaxPesSize {
+		stream.pes, stream.started = stream.pes[:0], false
+		return
+	}
+	stream.pes = append(stream.pes, payload...)
+	if len(stream.pes) >= 6 {
+		if length := int(binary.BigEndian.Uint16(stream.pes[4:6])); length != 0 && len(stream.pes) >= 6+length {
+			stream.pes = stream.pes[:6+length]
+			d.flushPes(stream)
+		}
+	}
+}
+
+// parse the pes header of the assembled packet and pass it on
+func (d *tsDemuxer) flushPes(stream *tsElementaryStream) {
+	buf := stream.pes
+	stream.pes, stream.started = stream.pes[:0], false
+	// start code prefix, stream id, length, flags and header length
+	if len(buf) < 9 || buf[0] != 0 || buf[1] != 0 || buf[2] != 1 {
+		return
+	}
+	headerLength := int(buf[8])
+	if 9+headerLength > len(buf) {
+		return
+	}
+	pes := tsPes{pid: stream.pid, pts: -1}
+	if buf[7]&0x80 != 0 && headerLength >= 5 {
+		pes.pts = parseTsTimestamp(buf[9:14])
+	}
+	// copied since the buffer is reused for the next packet
+	pes.payload = append([]byte(nil), buf[9+headerLength:]...)
+	if d.onPes != nil && len(pes.payload) > 0 {
+		d.onPes(stream, pes)
+	}
+}
+
+// 33 bit timestamp split by marker bits
+func parseTsTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
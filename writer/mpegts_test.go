@@ -0,0 +1,377 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// split a payload into ts packets of a pid, the last packet is padded with adaptation field stuffing
+func testTsPackets(pid uint16, payload []byte) []byte {
+	data := []byte{}
+	for offset, counter := 0, 0; offset < len(payload); counter++ {
+		header := []byte{tsSyncByte, byte(pid >> 8 & 0x1F), byte(pid), 0x10 | byte(counter&0x0F)}
+		if offset == 0 {
+			header[1] |= 0x40
+		}
+		size := len(payload) - offset
+		if size >= tsPacketSize-4 {
+			size = tsPacketSize - 4
+		} else {
+			// adaptation field length, flags and stuffing
+			header[3] |= 0x20
+			stuffing := tsPacketSize - 4 - size - 1
+			header = append(header, byte(stuffing))
+			if stuffing > 0 {
+				header = append(header, 0)
+				header = append(header, bytes.Repeat([]byte{0xFF}, stuffing-1)...)
+			}
+		}
+		data = append(append(data, header...), payload[offset:offset+size]...)
+		offset += size
+	}
+	return data
+}
+
+// psi section with a pointer field and a crc the demuxer does not check
+func testTsSection(tableID uint8, idExtension uint16, version uint8, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xB0 | byte(length>>8), byte(length), byte(idExtension >> 8), byte(idExtension), 0xC1 | version<<1, 0, 0}
+	return append(append(section, body...), 0, 0, 0, 0)
+}
+
+// pat of programs mapped to their pmt pids
+func testTsPAT(programs ...[2]uint16) []byte {
+	body := []byte{}
+	for _, program := range programs {
+		body = binary.BigEndian.AppendUint16(body, program[0])
+		body = binary.BigEndian.AppendUint16(body, 0xE000|program[1])
+	}
+	return testTsPackets(tsPidPAT, testTsSection(0x00, 1, 0, body))
+}
+
+type testTsStream struct {
+	streamType  uint8
+	pid         uint16
+	descriptors []byte
+}
+
+func testTsPMT(pmtPid uint16, programNumber uint16, version uint8, streams ...testTsStream) []byte {
+	// pcr pid, program info length
+	body := []byte{0xE1, 0x00, 0xF0, 0x00}
+	for _, stream := range streams {
+		body = append(body, stream.streamType, 0xE0|byte(stream.pid>>8), byte(stream.pid), 0xF0|byte(len(stream.descriptors)>>8), byte(len(stream.descriptors)))
+		body = append(body, stream.descriptors...)
+	}
+	return testTsPackets(pmtPid, testTsSection(0x02, programNumber, version, body))
+}
+
+// 33 bit timestamp with marker bits, prefix 0010 for a pts only
+func testTsTimestamp(pts int64) []byte {
+	return []byte{
+		0x21 | byte(pts>>29&0x0E),
+		byte(pts >> 22),
+		byte(pts>>14) | 0x01,
+		byte(pts >> 7),
+		byte(pts<<1) | 0x01,
+	}
+}
+
+// pes packet with an optional pts, unbounded packets have a length of 0 and end at the next payload unit start
+func testTsPes(streamID uint8, pts int64, payload []byte, bounded bool) []byte {
+	header := []byte{0x80, 0x00, 0x00}
+	if pts >= 0 {
+		header = append([]byte{0x80, 0x80, 5}, testTsTimestamp(pts)...)
+	}
+	length := 0
+	if bounded {
+		length = len(header) + len(payload)
+	}
+	pes := []byte{0, 0, 1, streamID, byte(length >> 8), byte(length)}
+	return append(append(pes, header...), payload...)
+}
+
+// demuxer with an h264 and an opus stream in program 1
+func testTsDemuxer(t *testing.T) (*tsDemuxer, *[]tsPes, []byte) {
+	setup := append(testTsPAT([2]uint16{1, 0x1000}), testTsPMT(0x1000, 1, 0,
+		testTsStream{tsStreamH264, 0x100, nil},
+		testTsStream{tsStreamPrivate, 0x101, []byte{tsDescriptorRegistration, 4, 'O', 'p', 'u', 's'}},
+	)...)
+	d := newTsDemuxer(0)
+	received := &[]tsPes{}
+	d.onPes = func(stream *tsElementaryStream, pes tsPes) {
+		if stream.pid != pes.pid {
+			t.Errorf("pes of pid %v passed with stream %v", pes.pid, stream.pid)
+		}
+		*received = append(*received, pes)
+	}
+	return d, received, setup
+}
+
+// fields of a stream announced in the pmt
+type testTsSelected struct {
+	pid        uint16
+	streamType uint8
+	opus       bool
+}
+
+func TestTsPmt(t *testing.T) {
+	tests := []struct {
+		name    string
+		program uint16
+		data    []byte
+		want    []testTsSelected
+	}{
+		{
+			"first program",
+			0,
+			append(append(testTsPAT([2]uint16{0, 0x10}, [2]uint16{3, 0x1000}, [2]uint16{4, 0x1001}),
+				testTsPMT(0x1000, 3, 0, testTsStream{tsStreamH264, 0x100, nil}, testTsStream{tsStreamAAC, 0x101, nil})...),
+				testTsPMT(0x1001, 4, 0, testTsStream{tsStreamH265, 0x200, nil})...),
+			[]testTsSelected{{pid: 0x100, streamType: tsStreamH264}, {pid: 0x101, streamType: tsStreamAAC}},
+		},
+		{
+			"program by number",
+			4,
+			append(append(testTsPAT([2]uint16{3, 0x1000}, [2]uint16{4, 0x1001}),
+				testTsPMT(0x1000, 3, 0, testTsStream{tsStreamH264, 0x100, nil})...),
+				testTsPMT(0x1001, 4, 0, testTsStream{tsStreamH265, 0x200, nil})...),
+			[]testTsSelected{{pid: 0x200, streamType: tsStreamH265}},
+		},
+		{
+			"opus registration descriptor after another descriptor",
+			0,
+			append(testTsPAT([2]uint16{1, 0x1000}), testTsPMT(0x1000, 1, 0,
+				testTsStream{tsStreamPrivate, 0x101, []byte{0x0A, 4, 'e', 'n', 'g', 0, tsDescriptorRegistration, 4, 'O', 'p', 'u', 's'}},
+				testTsStream{tsStreamPrivate, 0x102, []byte{tsDescriptorRegistration, 4, 'A', 'C', '-', '3'}})...),
+			[]testTsSelected{{pid: 0x101, streamType: tsStreamPrivate, opus: true}, {pid: 0x102, streamType: tsStreamPrivate}},
+		},
+		{
+			"pmt before pat is ignored",
+			0,
+			append(testTsPMT(0x1000, 1, 0, testTsStream{tsStreamH264, 0x100, nil}), testTsPAT([2]uint16{1, 0x1000})...),
+			nil,
+		},
+		{
+			"missing program",
+			5,
+			append(testTsPAT([2]uint16{3, 0x1000}), testTsPMT(0x1000, 3, 0, testTsStream{tsStreamH264, 0x100, nil})...),
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTsDemuxer(test.program)
+			var got []testTsSelected
+			d.onPmt = func(streams []*tsElementaryStream) {
+				got = got[:0]
+				for _, stream := range streams {
+					got = append(got, testTsSelected{pid: stream.pid, streamType: stream.streamType, opus: stream.opus})
+				}
+			}
+			d.write(test.data)
+			if len(got) != len(test.want) {
+				t.Fatalf("got streams %+v, want %+v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("stream %v is %+v, want %+v", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+// a new pmt version replaces the streams, repeated versions are ignored
+func TestTsPmtVersion(t *testing.T) {
+	d := newTsDemuxer(0)
+	calls := 0
+	d.onPmt = func(streams []*tsElementaryStream) { calls++ }
+	d.write(testTsPAT([2]uint16{1, 0x1000}))
+	d.write(testTsPMT(0x1000, 1, 0, testTsStream{tsStreamH264, 0x100, nil}))
+	d.write(testTsPMT(0x1000, 1, 0, testTsStream{tsStreamH264, 0x100, nil}))
+	d.write(testTsPMT(0x1000, 1, 1, testTsStream{tsStreamH265, 0x200, nil}))
+	if calls != 2 {
+		t.Errorf("onPmt called %v times, want 2", calls)
+	}
+	if _, ok := d.streams[0x100]; ok || d.streams[0x200] == nil {
+		t.Errorf("streams %v after the new version", d.streams)
+	}
+}
+
+// pes packets of every size are reassembled from the ts packets they are split across
+func TestTsPesSplit(t *testing.T) {
+	// a pes header with a pts is 14 bytes, 170 payload bytes fill one ts packet
+	for _, size := range []int{1, 169, 170, 171, 184, 354, 355, 1000, 65400, 100000} {
+		for _, bounded := range []bool{true, false} {
+			if bounded && size > 0xFFFF-8 {
+				continue
+			}
+			d, received, setup := testTsDemuxer(t)
+			d.write(setup)
+			video := testPayload(size, 1)
+			d.write(testTsPackets(0x100, testTsPes(0xE0, 1<<32|12345, video, bounded)))
+			// an unbounded packet is only complete at the next payload unit start
+			d.write(testTsPackets(0x100, testTsPes(0xE0, -1, []byte{9}, bounded)))
+			if len(*received) == 0 {
+				t.Fatalf("size %v, bounded %v: no pes received", size, bounded)
+			}
+			pes := (*received)[0]
+			if pes.pid != 0x100 || pes.pts != 1<<32|12345 || !bytes.Equal(pes.payload, video) {
+				t.Errorf("size %v, bounded %v: pes of pid %v at %v with %v bytes, want pid 256 at %v with %v bytes",
+					size, bounded, pes.pid, pes.pts, len(pes.payload), int64(1<<32|12345), size)
+			}
+			if bounded && (len(*received) != 2 || (*received)[1].pts != -1) {
+				t.Errorf("size %v: second bounded pes %+v, want one without a pts", size, (*received)[1:])
+			}
+		}
+	}
+}
+
+// pes packets of the audio and video pid interleaved packet by packet
+func TestTsInterleavedPes(t *testing.T) {
+	d, received, setup := testTsDemuxer(t)
+	d.write(setup)
+	video := testTsPackets(0x100, testTsPes(0xE0, 3000, testPayload(1000, 1), true))
+	audio := testTsPackets(0x101, testTsPes(0xBD, 1800, testPayload(500, 2), true))
+	data := []byte{}
+	for len(video) > 0 || len(audio) > 0 {
+		if len(video) > 0 {
+			data, video = append(data, video[:tsPacketSize]...), video[tsPacketSize:]
+		}
+		if len(audio) > 0 {
+			data, audio = append(data, audio[:tsPacketSize]...), audio[tsPacketSize:]
+		}
+	}
+	d.write(data)
+	if len(*received) != 2 {
+		t.Fatalf("received %v pes packets, want 2", len(*received))
+	}
+	for _, pes := range *received {
+		want := map[uint16]tsPes{0x100: {0x100, 3000, testPayload(1000, 1)}, 0x101: {0x101, 1800, testPayload(500, 2)}}[pes.pid]
+		if pes.pts != want.pts || !bytes.Equal(pes.payload, want.payload) {
+			t.Errorf("pid %v: pes at %v with %v bytes, want %v with %v", pes.pid, pes.pts, len(pes.payload), want.pts, len(want.payload))
+		}
+	}
+}
+
+func TestTsTimestamp(t *testing.T) {
+	for _, pts := range []int64{0, 1, 90000, 1<<30 - 1, 1 << 30, 1<<32 + 7, 1<<33 - 1} {
+		if got := parseTsTimestamp(testTsTimestamp(pts)); got != pts {
+			t.Errorf("parsed %v, want %v", got, pts)
+		}
+	}
+}
+
+// truncated and malformed packets are dropped without panicking
+func TestTsMalformed(t *testing.T) {
+	d, received, setup := testTsDemuxer(t)
+	d.write(setup)
+	pes := testTsPackets(0x100, testTsPes(0xE0, 0, testPayload(400, 1), true))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"bad sync byte", append([]byte{0x46}, pes[1:]...)},
+		{"transport error", append([]byte{tsSyncByte, pes[1] | 0x80}, pes[2:]...)},
+		{"adaptation field longer than the packet", append([]byte{tsSyncByte, 0x41, 0x00, 0x30, 184}, make([]byte, 183)...)},
+		{"adaptation field without payload", append([]byte{tsSyncByte, 0x41, 0x00, 0x20, 183}, make([]byte, 183)...)},
+		{"continuation without a start", pes[tsPacketSize:]},
+		{"not a pes start code", testTsPackets(0x100, append([]byte{0, 0, 2}, testTsPes(0xE0, 0, testPayload(10, 1), true)[3:]...))},
+		{"pes header length beyond the packet", testTsPackets(0x100, []byte{0, 0, 1, 0xE0, 0, 4, 0x80, 0x80, 0xFF})},
+		{"pes shorter than its header", testTsPackets(0x100, []byte{0, 0, 1, 0xE0, 0, 2, 0x80, 0x80})},
+		{"pes without payload", testTsPackets(0x100, testTsPes(0xE0, 0, nil, true))},
+		{"partial ts packet", pes[:tsPacketSize-1]},
+		{"pointer field beyond the packet", append([]byte{tsSyncByte, 0x40, 0x00, 0x10, 184}, make([]byte, 183)...)},
+		{"section length below the header", testTsPackets(tsPidPAT, []byte{0, 0x00, 0xB0, 0x03, 0, 1, 0xC1})},
+		{"pmt with a stream longer than the section", testTsPackets(0x1000, testTsSection(0x02, 1, 5, []byte{0xE1, 0x00, 0xF0, 0x00, tsStreamH264, 0xE1, 0x00, 0xF0, 0x20, 1}))},
+		{"pmt with program info longer than the section", testTsPackets(0x1000, testTsSection(0x02, 1, 6, []byte{0xE1, 0x00, 0xFF, 0xFF}))},
+		{"pmt with a descriptor longer than its stream", testTsPackets(0x1000, testTsSection(0x02, 1, 7, []byte{0xE1, 0x00, 0xF0, 0x00, tsStreamPrivate, 0xE1, 0x01, 0xF0, 0x03, tsDescriptorRegistration, 4, 'O'}))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*received = (*received)[:0]
+			d.write(test.data)
+			if len(*received) != 0 {
+				t.Errorf("received %+v", *received)
+			}
+		})
+	}
+	// every byte of a valid stream corrupted in turn
+	stream := append(append([]byte{}, setup...), pes...)
+	for i := range stream {
+		for _, b := range []byte{0x00, 0xFF, stream[i] ^ 0x40} {
+			corrupted := append([]byte{}, stream...)
+			corrupted[i] = b
+			d, _, _ := testTsDemuxer(t)
+			d.write(corrupted)
+			d.write(pes)
+		}
+	}
+}
+
+// pes packets beyond the size limit are dropped, the next packet is received
+func TestTsPesTooLarge(t *testing.T) {
+	d, received, setup := testTsDemuxer(t)
+	d.write(setup)
+	d.write(testTsPackets(0x100, testTsPes(0xE0, 0, make([]byte, tsMaxPesSize), false)))
+	d.write(testTsPackets(0x100, testTsPes(0xE0, 90, testPayload(10, 1), true)))
+	if len(*received) != 1 || (*received)[0].pts != 90 {
+		t.Errorf("received %+v, want only the packet after the oversized one", *received)
+	}
+}
+
+func TestTsIngestAudio(t *testing.T) {
+	setupTestSessions(t)
+	// opus control header without trims or extension, then the au
+	opusAU := func(size int) []byte {
+		header := []byte{0x7F, 0xE0}
+		remaining := size
+		for ; remaining >= 0xFF; remaining -= 0xFF {
+			header = append(header, 0xFF)
+		}
+		return append(append(header, byte(remaining), 0xFC), make([]byte, size-1)...)
+	}
+	// adts header without crc for a frame of the given size, 48kHz stereo
+	adts := func(payload []byte) []byte {
+		size := 7 + len(payload)
+		header := []byte{0xFF, 0xF1, 0x4C, 0x80 | byte(size>>11), byte(size >> 3), byte(size<<5) | 0x1F, 0xFC}
+		return append(header, payload...)
+	}
+	opusFrames := append(append(opusAU(1), opusAU(1)...), opusAU(300)...)
+	tests := []struct {
+		name    string
+		opus    bool
+		payload []byte
+		packets uint16
+	}{
+		{"opus access units", true, opusFrames, 3},
+		{"opus with trims and extension", true, []byte{0x7F, 0xFC, 1, 0, 0, 0, 0, 2, 0xAA, 0xBB, 0xFC}, 1},
+		{"opus bad prefix", true, []byte{0x7E, 0xE0, 1, 0xFC}, 0},
+		{"opus au beyond the payload", true, []byte{0x7F, 0xE0, 5, 0xFC}, 0},
+		{"opus size bytes beyond the payload", true, []byte{0x7F, 0xE0, 0xFF, 0xFF}, 0},
+		{"opus extension beyond the payload", true, []byte{0x7F, 0xE4, 0, 9}, 0},
+		{"adts frames", false, append(adts([]byte{1, 2, 3}), adts([]byte{4})...), 2},
+		{"adts with a truncated second frame", false, append(adts([]byte{1, 2, 3}), adts([]byte{4, 5})[:8]...), 1},
+		{"adts bad sync", false, append([]byte{0xFE}, adts([]byte{1})[1:]...), 0},
+		{"adts frame shorter than its header", false, []byte{0xFF, 0xF1, 0x4C, 0x80, 0x00, 0x1F, 0xFC}, 0},
+		{"adts without payload", false, adts(nil), 0},
+		{"adts sample rate index 15", false, []byte{0xFF, 0xF1, 0x7C, 0x80, 0x01, 0x1F, 0xFC, 1}, 0},
+		{"short", false, []byte{0xFF, 0xF1}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ti := newTsIngest(tsBinding{sessionID: "mpegts"}, "video/H264", "audio/opus")
+			stream := &tsElementaryStream{pid: 0x101, streamType: tsStreamAAC, opus: test.opus}
+			if test.opus {
+				stream.streamType = tsStreamPrivate
+			}
+			ti.audioPid = stream.pid
+			seq := ti.audio.seq
+			ti.writePes(stream, tsPes{pid: stream.pid, pts: 90000, payload: test.payload})
+			if packets := ti.audio.seq - seq; packets != test.packets {
+				t.Errorf("%v rtp packets, want %v", packets, test.packets)
+			}
+		})
+	}
+}
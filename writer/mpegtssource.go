@@ -0,0 +1,323 @@
+package writer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/sessions"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// mpeg-ts over udp is usually sent in datagrams of 7 ts packets, read buffer allows for jumbo datagrams
+const tsReadBufferSize = 64 * 1024
+
+// session fed by a program of the mpeg-ts stream received on a port, program 0 selects the first program
+type tsBinding struct {
+	sessionID     string
+	programNumber uint16
+	backup        bool // forwarded only while the primary of the session is silent
+}
+
+// sessions fed by mpeg-ts sources, fixed at startup
+var mpegtsSessions = make(map[string]bool)
+
+// start a listener for every port of the mpeg-ts sources in configuration
+func StartMpegtsSources(config *configuration.Configuration) error {
+	bindings, err := parseMpegtsSources(config.Rtc_mpegts_sources)
+	if err != nil {
+		return err
+	}
+	for port, portBindings := range bindings {
+		listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: int(port)})
+		if err != nil {
+			return fmt.Errorf("could not open UDP port %v for mpeg-ts listener: %v", port, err)
+		}
+		ingests := make([]*tsIngest, 0, len(portBindings))
+		for _, binding := range portBindings {
+			ingests = append(ingests, newTsIngest(binding, config.Rtc_video_codec, config.Rtc_audio_codec))
+			mpegtsSessions[binding.sessionID] = true
+		}
+		addListener(listener)
+		go readMpegts(listener, port, ingests)
+	}
+	return nil
+}
+
+// true if an mpeg-ts source feeds the session
+func HasMpegtsSource(sessionID string) bool {
+	return mpegtsSessions[sessionID]
+}
+
+// every datagram is demuxed for all programs bound to the port
+func readMpegts(listener *net.UDPConn, port uint16, ingests []*tsIngest) {
+	buf := make([]byte, tsReadBufferSize)
+	for {
+		n, _, err := listener.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			logging.Infof("mpeg-ts UDP listener on port %v closed", port)
+			return
+		}
+		if err != nil {
+			logging.Errorf("error trying to read from mpeg-ts UDP listener on port %v: %v", port, err)
+			continue
+		}
+		for _, ingest := range ingests {
+			ingest.demuxer.write(buf[:n])
+		}
+	}
+}
+
+/*
+repacketizes the pes packets of one program into rtp packets for a session
+the first video and audio streams matching the configured codecs are forwarded:
+h264/h265 video, opus and adts aac audio. rtp timestamps are derived from the pes pts
+*/
+type tsIngest struct {
+	tsBinding
+	videoCodec string
+	audioCodec string
+	demuxer    *tsDemuxer
+	videoPid   uint16 // 0 if no stream is forwarded
+	audioPid   uint16
+	h264       codecs.H264Payloader
+	video      *packetizedStream
+	audio      *packetizedStream
+	lastPts    map[uint16]int64 // of pes packets without a pts
+	aacConfig  []byte
+	warned     map[string]bool
+}
+
+func newTsIngest(binding tsBinding, videoCodec string, audioCodec string) *tsIngest {
+	ti := &tsIngest{
+		tsBinding:  binding,
+		videoCodec: videoCodec,
+		audioCodec: audioCodec,
+		demuxer:    newTsDemuxer(binding.programNumber),
+		video:      newPacketizedStream(packetizedVideoPayloadType),
+		audio:      newPacketizedStream(packetizedAudioPayloadType),
+		lastPts:    make(map[uint16]int64),
+		warned:     make(map[string]bool),
+	}
+	ti.demuxer.onPmt = ti.selectStreams
+	ti.demuxer.onPes = ti.writePes
+	return ti
+}
+
+// log a problem with the stream once
+func (ti *tsIngest) warnOnce(message string) {
+	if ti.warned[message] {
+		return
+	}
+	ti.warned[message] = true
+	logging.With("session_id", ti.sessionID).Warnf("mpeg-ts ingest: %v", message)
+}
+
+// mime type of an elementary stream, empty if it is not supported
+func tsStreamMimeType(stream *tsElementaryStream) (string, webrtc.RTPCodecType) {
+	switch {
+	case stream.streamType == tsStreamH264:
+		return webrtc.MimeTypeH264, webrtc.RTPCodecTypeVideo
+	case stream.streamType == tsStreamH265:
+		return webrtc.MimeTypeH265, webrtc.RTPCodecTypeVideo
+	case stream.streamType == tsStreamAAC:
+		return mimeTypeAAC, webrtc.RTPCodecTypeAudio
+	case stream.streamType == tsStreamPrivate && stream.opus:
+		return webrtc.MimeTypeOpus, webrtc.RTPCodecTypeAudio
+	}
+	return "", 0
+}
+
+// pick the streams to forward whenever the pmt changes
+func (ti *tsIngest) selectStreams(streams []*tsElementaryStream) {
+	ti.videoPid, ti.audioPid = 0, 0
+	for _, stream := range streams {
+		mimeType, kind := tsStreamMimeType(stream)
+		switch {
+		case kind == webrtc.RTPCodecTypeVideo && ti.videoPid == 0 && strings.EqualFold(mimeType, ti.videoCodec):
+			ti.videoPid = stream.pid
+		case kind == webrtc.RTPCodecTypeAudio && ti.audioPid == 0 && strings.EqualFold(mimeType, ti.audioCodec):
+			ti.audioPid = stream.pid
+		default:
+			logging.With("session_id", ti.sessionID).Infof("mpeg-ts ingest: ignoring stream type %#x on pid %v", stream.streamType, stream.pid)
+			continue
+		}
+		logging.With("session_id", ti.sessionID).Infof("mpeg-ts ingest: forwarding %v from pid %v", mimeType, stream.pid)
+	}
+	if ti.videoPid == 0 && ti.audioPid == 0 {
+		ti.warnOnce(fmt.Sprintf("no stream with codec %v or %v", ti.videoCodec, ti.audioCodec))
+	}
+}
+
+func (ti *tsIngest) writePes(stream *tsElementaryStream, pes tsPes) {
+	if pes.pid != ti.videoPid && pes.pid != ti.audioPid {
+		return
+	}
+	// keep the previous timestamp for packets without one
+	if pes.pts < 0 {
+		pes.pts = ti.lastPts[pes.pid]
+	}
+	ti.lastPts[pes.pid] = pes.pts
+	switch {
+	case pes.pid == ti.videoPid && stream.streamType == tsStreamH264:
+		ti.writeVideo(ti.h264.Payload(rtpPacketMTU, pes.payload), uint32(pes.pts))
+	case pes.pid == ti.videoPid:
+		ti.writeVideo(h265Payloads(rtpPacketMTU, annexBNalus(pes.payload)), uint32(pes.pts))
+	case stream.opus:
+		ti.writeOpus(pes)
+	default:
+		ti.writeAAC(pes)
+	}
+}
+
+// video access unit, the pts already uses the 90kHz rtp clock
+func (ti *tsIngest) writeVideo(payloads [][]byte, rtpTimestamp uint32) {
+	for i, payload := range payloads {
+		packet := ti.video.packet(rtpTimestamp, i == len(payloads)-1, payload)
+		if err := writeToSession(ti.sessionID, webrtc.RTPCodecTypeVideo, ti.backup, packet, nil); err != nil {
+			logging.With("session_id", ti.sessionID).Errorf("video track of mpeg-ts ingest writer got exception: %s", err)
+		}
+	}
+}
+
+func (ti *tsIngest) writeAudio(rtpTimestamp uint32, payload []byte) {
+	packet := ti.audio.packet(rtpTimestamp, true, payload)
+	if err := writeToSession(ti.sessionID, webrtc.RTPCodecTypeAudio, ti.backup, packet, nil); err != nil {
+		logging.With("session_id", ti.sessionID).Errorf("audio track of mpeg-ts ingest writer got exception: %s", err)
+	}
+}
+
+/*
+opus access units, each preceded by a control header (ETSI TS 102 366 annex)
+11 bit prefix, trim and extension flags, then the au size as a sum of bytes ending below 255
+*/
+func (ti *tsIngest) writeOpus(pes tsPes) {
+	// opus always uses a 48kHz clock
+	timestamp := uint32(pes.pts * 48000 / 90000)
+	data := pes.payload
+	for len(data) >= 2 {
+		if data[0] != 0x7F || data[1]&0xE0 != 0xE0 {
+			ti.warnOnce("invalid opus control header, dropping audio")
+			return
+		}
+		flags := data[1]
+		offset := 2
+		size := 0
+		for offset < len(data) {
+			b := data[offset]
+			offset++
+			size += int(b)
+			if b != 0xFF {
+				break
+			}
+		}
+		// start and end trim
+		if flags&0x10 != 0 {
+			offset += 2
+		}
+		if flags&0x08 != 0 {
+			offset += 2
+		}
+		if flags&0x04 != 0 && offset < len(data) {
+			offset += 1 + int(data[offset])
+		}
+		if offset+size > len(data) {
+			return
+		}
+		packet := append([]byte(nil), data[offset:offset+size]...)
+		ti.writeAudio(timestamp, packet)
+		timestamp += opusPacketSamples(packet)
+		data = data[offset+size:]
+	}
+}
+
+// adts frames, converted to RFC 3640 access units
+func (ti *tsIngest) writeAAC(pes tsPes) {
+	data := pes.payload
+	var timestamp uint32
+	for first := true; len(data) >= 7; first = false {
+		if data[0] != 0xFF || data[1]&0xF0 != 0xF0 {
+			ti.warnOnce("invalid adts header, dropping audio")
+			return
+		}
+		headerSize := 7
+		// crc follows the header
+		if data[1]&0x01 == 0 {
+			headerSize = 9
+		}
+		frameSize := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+		index := int(data[2] >> 2 & 0x0F)
+		if frameSize < headerSize || frameSize > len(data) || index >= len(aacSampleRates) {
+			return
+		}
+		sampleRate := aacSampleRates[index]
+		if first {
+			ti.setAACConfig(data)
+			timestamp = uint32(pes.pts * int64(sampleRate) / 90000)
+		}
+		if payload := aacPayload(data[headerSize:frameSize]); payload != nil {
+			ti.writeAudio(timestamp, payload)
+		}
+		// 1024 samples per raw data block
+		timestamp += 1024 * uint32(data[6]&0x03+1)
+		data = data[frameSize:]
+	}
+}
+
+// AudioSpecificConfig from an adts header, object type(5) frequency index(4) channels(4)
+func (ti *tsIngest) setAACConfig(adts []byte) {
+	objectType := adts[2]>>6 + 1
+	index := adts[2] >> 2 & 0x0F
+	channels := adts[2]&0x01<<2 | adts[3]>>6
+	config := []byte{objectType<<3 | index>>1, index<<7 | channels<<3}
+	if !bytes.Equal(config, ti.aacConfig) {
+		ti.aacConfig = config
+		sessions.SetAACConfig(ti.sessionID, config)
+	}
+}
+
+/*
+parse mpeg-ts sources of the form "name=port;name2=port/program"
+a port either feeds a single session from its first program
+or several sessions selected by program number, a "|backup" suffix makes it the backup of its session
+*/
+func parseMpegtsSources(value string) (map[uint16][]tsBinding, error) {
+	bindings := make(map[uint16][]tsBinding)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, binding, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid mpeg-ts source %q", entry)
+		}
+		backup := strings.HasSuffix(binding, "|backup")
+		binding = strings.TrimSuffix(binding, "|backup")
+		rawPort, rawProgram, hasProgram := strings.Cut(binding, "/")
+		port, err := strconv.ParseUint(rawPort, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port in mpeg-ts source %q", entry)
+		}
+		var program uint64
+		if hasProgram {
+			program, err = strconv.ParseUint(rawProgram, 10, 16)
+			if err != nil || program == 0 {
+				return nil, fmt.Errorf("invalid program number in mpeg-ts source %q", entry)
+			}
+		}
+		for _, existing := range bindings[uint16(port)] {
+			if existing.programNumber == 0 || program == 0 || existing.programNumber == uint16(program) {
+				return nil, fmt.Errorf("mpeg-ts source %q conflicts with %v on port %v", entry, existing.sessionID, port)
+			}
+		}
+		bindings[uint16(port)] = append(bindings[uint16(port)], tsBinding{name, uint16(program), backup})
+	}
+	return bindings, nil
+}
@@ -0,0 +1,126 @@
+package writer
+
+import (
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/pion/rtp"
+)
+
+// largest rtp payload produced when packetizing frames
+const rtpPacketMTU = 1200
+
+// mime type of aac (RFC 3640), not defined by pion
+const mimeTypeAAC = "audio/MPEG4-GENERIC"
+
+// payload types of packetized streams, rewritten by the tracks for every viewer
+const (
+	packetizedVideoPayloadType = 96
+	packetizedAudioPayloadType = 111
+)
+
+// bits of a single RFC 3640 AU header
+const aacAUHeadersLength = 16
+
+// sampling rates by aac sampling frequency index
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// ssrc and sequence numbers of a stream packetized by the server
+type packetizedStream struct {
+	payloadType uint8
+	ssrc        uint32
+	seq         uint16
+}
+
+func newPacketizedStream(payloadType uint8) *packetizedStream {
+	return &packetizedStream{
+		payloadType: payloadType,
+		ssrc:        rand.Uint32(),
+		seq:         uint16(rand.Uint32()),
+	}
+}
+
+// next packet of the stream
+func (s *packetizedStream) packet(timestamp uint32, marker bool, payload []byte) *rtp.Packet {
+	s.seq++
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         marker,
+			PayloadType:    s.payloadType,
+			SequenceNumber: s.seq,
+			Timestamp:      timestamp,
+			SSRC:           s.ssrc,
+		},
+		Payload: payload,
+	}
+}
+
+// RFC 3640 payload of a single aac access unit, nil if it is too large for the 13 bit size
+func aacPayload(au []byte) []byte {
+	if len(au) == 0 || len(au) >= 1<<13 {
+		return nil
+	}
+	// AU-headers-length, then one AU header of size(13) index(3)
+	payload := make([]byte, 4, 4+len(au))
+	binary.BigEndian.PutUint16(payload, aacAUHeadersLength)
+	binary.BigEndian.PutUint16(payload[2:], uint16(len(au))<<3)
+	return append(payload, au...)
+}
+
+// split an annex b byte stream into nal units without start codes
+func annexBNalus(data []byte) [][]byte {
+	nalus := make([][]byte, 0)
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			// 4 byte start code
+			if end > start && data[end-1] == 0 {
+				end--
+			}
+			if end > start {
+				nalus = append(nalus, data[start:end])
+			}
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+/*
+number of 48kHz samples in an opus packet (RFC 6716 section 3.1)
+the toc byte selects the frame duration, the code the number of frames
+*/
+func opusPacketSamples(packet []byte) uint32 {
+	if len(packet) < 1 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frameSamples uint32
+	switch {
+	case config < 12: // silk 10/20/40/60ms
+		frameSamples = []uint32{480, 960, 1920, 2880}[config%4]
+	case config < 16: // hybrid 10/20ms
+		frameSamples = []uint32{480, 960}[config%2]
+	default: // celt 2.5/5/10/20ms
+		frameSamples = []uint32{120, 240, 480, 960}[config%4]
+	}
+	switch packet[0] & 0x03 {
+	case 0:
+		return frameSamples
+	case 1, 2:
+		return 2 * frameSamples
+	}
+	if len(packet) < 2 {
+		return 0
+	}
+	return uint32(packet[1]&0x3F) * frameSamples
+}
@@ -0,0 +1,515 @@
+package writer
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/sessions"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rtmpVersion          = 3
+	rtmpHandshakeSize    = 1536
+	rtmpDefaultChunkSize = 128
+	rtmpServerChunkSize  = 4096     // chunk size used for messages sent by the server
+	rtmpWindowAckSize    = 2500000  // acknowledgement window announced to clients
+	rtmpMaxMessageSize   = 16 << 20 // larger messages close the connection
+	rtmpTimeout          = 10 * time.Second
+)
+
+// rtmp message types
+const (
+	rtmpMsgSetChunkSize     = 1
+	rtmpMsgAbort            = 2
+	rtmpMsgAck              = 3
+	rtmpMsgUserControl      = 4
+	rtmpMsgWindowAckSize    = 5
+	rtmpMsgSetPeerBandwidth = 6
+	rtmpMsgAudio            = 8
+	rtmpMsgVideo            = 9
+	rtmpMsgDataAmf3         = 15
+	rtmpMsgCommandAmf3      = 17
+	rtmpMsgDataAmf0         = 18
+	rtmpMsgCommandAmf0      = 20
+)
+
+// chunk stream ids used by the server
+const (
+	rtmpCsidControl = 2
+	rtmpCsidCommand = 3
+	rtmpCsidStatus  = 5
+)
+
+// session and role of an rtmp publisher, a session has one primary and can have one backup publisher
+type rtmpPublication struct {
+	sessionID string
+	backup    bool
+}
+
+// publications currently active over rtmp
+var rtmpPublishing = make(map[rtmpPublication]bool)
+
+// mutex for above map read/write
+var rtmpMutex sync.Mutex
+
+/*
+accept rtmp publishers (OBS and other broadcast encoders)
+the stream key of the publisher is the name of the session it feeds and has to be a registered stream key,
+since viewers know the session name the publish token has to be appended as ?token=<token>
+*/
+func StartRtmpServer(config *configuration.Configuration) {
+	if config.Rtc_rtmp_receive_port == 0 {
+		logging.Infof("RTC_RTMP_RECEIVE_PORT not set, rtmp ingest is disabled")
+		return
+	}
+	if config.Rtc_rtmp_publish_token == "" {
+		logging.Infof("RTC_RTMP_PUBLISH_TOKEN not set, rtmp ingest is disabled")
+		return
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: int(config.Rtc_rtmp_receive_port)})
+	if err != nil {
+		logging.Fatalf("could not open TCP port for rtmp listener: (%v)", err)
+	}
+	addListener(listener)
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			logging.Infof("rtmp listener closed")
+			return
+		}
+		if err != nil {
+			logging.Errorf("error trying to accept from rtmp listener: %v", err)
+			// e.g. out of file descriptors, do not spin
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go func() {
+			rc := newRtmpConn(conn, config)
+			err := rc.serve()
+			rc.close()
+			if err != nil && !errors.Is(err, io.EOF) {
+				logging.Infof("rtmp connection from %v closed: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// state of a chunk stream, later chunks only carry what changed
+type rtmpChunkStream struct {
+	timestamp uint32 // absolute timestamp of the current message
+	delta     uint32 // timestamp delta of the last header
+	extended  bool   // timestamps are sent as extended timestamps
+	length    uint32
+	typeID    uint8
+	streamID  uint32
+	payload   []byte // message assembled so far
+}
+
+type rtmpMessage struct {
+	typeID    uint8
+	streamID  uint32
+	timestamp uint32 // milliseconds
+	payload   []byte
+}
+
+// counts bytes read for acknowledgements
+type rtmpCountingReader struct {
+	reader io.Reader
+	count  uint64
+}
+
+func (r *rtmpCountingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += uint64(n)
+	return n, err
+}
+
+// a single rtmp client connection
+type rtmpConn struct {
+	conn         net.Conn
+	counter      *rtmpCountingReader
+	reader       *bufio.Reader
+	config       *configuration.Configuration
+	chunkSize    uint32 // chunk size of incoming messages
+	chunkStreams map[uint32]*rtmpChunkStream
+	ackWindow    uint32 // acknowledgement window set by the client
+	lastAck      uint64 // bytes received at the last acknowledgement
+	sessionID    string // session published to, empty before publish
+	backup       bool
+	publisher    *flvPublisher
+}
+
+func newRtmpConn(conn net.Conn, config *configuration.Configuration) *rtmpConn {
+	counter := &rtmpCountingReader{reader: conn}
+	return &rtmpConn{
+		conn:         conn,
+		counter:      counter,
+		reader:       bufio.NewReader(counter),
+		config:       config,
+		chunkSize:    rtmpDefaultChunkSize,
+		chunkStreams: make(map[uint32]*rtmpChunkStream),
+	}
+}
+
+// release the published session and close the connection
+func (rc *rtmpConn) close() {
+	if rc.sessionID != "" {
+		rtmpMutex.Lock()
+		delete(rtmpPublishing, rtmpPublication{rc.sessionID, rc.backup})
+		// the other publisher of the session keeps the stream going
+		other := rtmpPublishing[rtmpPublication{rc.sessionID, !rc.backup}]
+		rtmpMutex.Unlock()
+		logging.With("session_id", rc.sessionID).Infof("rtmp publisher stopped")
+		// a reconnecting encoder or another ingest may take over as primary right away
+		if sess := sessions.ReturnSessionByIdIfExists(rc.sessionID); sess != nil && !rc.backup {
+			sess.PrimaryStopped()
+		}
+		if !other {
+			sessions.EndStream(rc.sessionID)
+		}
+	}
+	rc.conn.Close()
+}
+
+// handshake and handle messages until the client disconnects
+func (rc *rtmpConn) serve() error {
+	if err := rc.handshake(); err != nil {
+		return fmt.Errorf("handshake failed: %v", err)
+	}
+	for {
+		// publishers send continuously, idle connections are dropped
+		rc.conn.SetReadDeadline(time.Now().Add(rtmpTimeout))
+		msg, err := rc.readMessage()
+		if err != nil {
+			return err
+		}
+		if err := rc.acknowledge(); err != nil {
+			return err
+		}
+		if err := rc.handleMessage(msg); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+simple handshake: C0+C1 are answered with S0+S1+S2, S2 echoes C1
+clients using the digest handshake accept this as well
+*/
+func (rc *rtmpConn) handshake() error {
+	rc.conn.SetDeadline(time.Now().Add(rtmpTimeout))
+	defer rc.conn.SetDeadline(time.Time{})
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(rc.reader, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != rtmpVersion {
+		return fmt.Errorf("unsupported rtmp version %v", c0c1[0])
+	}
+	s0s1s2 := make([]byte, 1+2*rtmpHandshakeSize)
+	s0s1s2[0] = rtmpVersion
+	// s1: time, zero, random bytes
+	binary.BigEndian.PutUint32(s0s1s2[1:], uint32(time.Now().Unix()))
+	if _, err := rand.Read(s0s1s2[9 : 1+rtmpHandshakeSize]); err != nil {
+		return err
+	}
+	copy(s0s1s2[1+rtmpHandshakeSize:], c0c1[1:])
+	if _, err := rc.conn.Write(s0s1s2); err != nil {
+		return err
+	}
+	c2 := make([]byte, rtmpHandshakeSize)
+	_, err := io.ReadFull(rc.reader, c2)
+	return err
+}
+
+// read chunks until a message is complete
+func (rc *rtmpConn) readMessage() (*rtmpMessage, error) {
+	header := make([]byte, 11)
+	for {
+		// basic header: fmt(2) csid(6), csid 0 and 1 are followed by one or two more bytes
+		b, err := rc.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		format := b >> 6
+		csid := uint32(b & 0x3F)
+		switch csid {
+		case 0:
+			next, err := rc.reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(next)
+		case 1:
+			if _, err := io.ReadFull(rc.reader, header[:2]); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(header[0]) + uint32(header[1])*256
+		}
+		cs, ok := rc.chunkStreams[csid]
+		if !ok {
+			cs = &rtmpChunkStream{}
+			rc.chunkStreams[csid] = cs
+		}
+		newMessage := len(cs.payload) == 0
+		// message header, its size depends on the format
+		headerSize := [4]int{11, 7, 3, 0}[format]
+		if _, err := io.ReadFull(rc.reader, header[:headerSize]); err != nil {
+			return nil, err
+		}
+		if format <= 2 {
+			timestamp := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+			cs.extended = timestamp == 0xFFFFFF
+			if cs.extended {
+				if timestamp, err = rc.readUint32(); err != nil {
+					return nil, err
+				}
+			}
+			if format == 0 {
+				cs.timestamp = timestamp
+				cs.delta = 0
+				cs.streamID = binary.LittleEndian.Uint32(header[7:11])
+			} else {
+				cs.delta = timestamp
+				cs.timestamp += timestamp
+			}
+			if format <= 1 {
+				cs.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+				cs.typeID = header[6]
+			}
+		} else {
+			if cs.extended {
+				// repeated extended timestamp
+				if _, err := rc.readUint32(); err != nil {
+					return nil, err
+				}
+			}
+			if newMessage {
+				cs.timestamp += cs.delta
+			}
+		}
+		if cs.length > rtmpMaxMessageSize {
+			return nil, fmt.Errorf("message of %v bytes too large", cs.length)
+		}
+		if newMessage && cap(cs.payload) < int(cs.length) {
+			cs.payload = make([]byte, 0, cs.length)
+		}
+		size := cs.length - uint32(len(cs.payload))
+		if size > rc.chunkSize {
+			size = rc.chunkSize
+		}
+		start := len(cs.payload)
+		cs.payload = cs.payload[:start+int(size)]
+		if _, err := io.ReadFull(rc.reader, cs.payload[start:]); err != nil {
+			return nil, err
+		}
+		if uint32(len(cs.payload)) == cs.length {
+			msg := &rtmpMessage{
+				typeID:    cs.typeID,
+				streamID:  cs.streamID,
+				timestamp: cs.timestamp,
+				payload:   cs.payload,
+			}
+			// the payload is handed out, the next message gets a new buffer
+			cs.payload = nil
+			return msg, nil
+		}
+	}
+}
+
+func (rc *rtmpConn) readUint32() (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(rc.reader, b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// send an acknowledgement once a window of bytes was received
+func (rc *rtmpConn) acknowledge() error {
+	received := rc.counter.count - uint64(rc.reader.Buffered())
+	if rc.ackWindow == 0 || received-rc.lastAck < uint64(rc.ackWindow) {
+		return nil
+	}
+	rc.lastAck = received
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(received))
+	return rc.writeMessage(rtmpCsidControl, rtmpMsgAck, 0, payload)
+}
+
+// write a message split into chunks of the server chunk size
+func (rc *rtmpConn) writeMessage(csid uint8, typeID uint8, streamID uint32, payload []byte) error {
+	buf := make([]byte, 0, 12+len(payload)+len(payload)/rtmpServerChunkSize)
+	// format 0 header with timestamp 0
+	buf = append(buf, csid&0x3F, 0, 0, 0, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)), typeID)
+	buf = binary.LittleEndian.AppendUint32(buf, streamID)
+	for offset := 0; offset < len(payload); offset += rtmpServerChunkSize {
+		if offset > 0 {
+			// format 3 continuation
+			buf = append(buf, 0xC0|csid&0x3F)
+		}
+		end := offset + rtmpServerChunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		buf = append(buf, payload[offset:end]...)
+	}
+	rc.conn.SetWriteDeadline(time.Now().Add(rtmpTimeout))
+	_, err := rc.conn.Write(buf)
+	return err
+}
+
+func (rc *rtmpConn) handleMessage(msg *rtmpMessage) error {
+	switch msg.typeID {
+	case rtmpMsgSetChunkSize:
+		if len(msg.payload) < 4 {
+			return errors.New("short set chunk size message")
+		}
+		size := binary.BigEndian.Uint32(msg.payload) & 0x7FFFFFFF
+		if size == 0 || size > rtmpMaxMessageSize {
+			return fmt.Errorf("invalid chunk size %v", size)
+		}
+		rc.chunkSize = size
+	case rtmpMsgAbort:
+		if len(msg.payload) >= 4 {
+			if cs, ok := rc.chunkStreams[binary.BigEndian.Uint32(msg.payload)]; ok {
+				cs.payload = nil
+			}
+		}
+	case rtmpMsgWindowAckSize:
+		if len(msg.payload) >= 4 {
+			rc.ackWindow = binary.BigEndian.Uint32(msg.payload)
+		}
+	case rtmpMsgCommandAmf0, rtmpMsgCommandAmf3:
+		payload := msg.payload
+		// amf3 commands start with a format byte followed by amf0 values
+		if msg.typeID == rtmpMsgCommandAmf3 && len(payload) > 0 {
+			payload = payload[1:]
+		}
+		values, err := decodeAmf0(payload)
+		if err != nil && len(values) < 2 {
+			return fmt.Errorf("bad command: %v", err)
+		}
+		// name and transaction id
+		if len(values) < 2 {
+			return errors.New("bad command: missing transaction id")
+		}
+		return rc.handleCommand(msg, values)
+	case rtmpMsgAudio:
+		if rc.publisher != nil {
+			rc.publisher.writeAudio(msg.timestamp, msg.payload)
+		}
+	case rtmpMsgVideo:
+		if rc.publisher != nil {
+			rc.publisher.writeVideo(msg.timestamp, msg.payload)
+		}
+	}
+	// acknowledgements, user control, peer bandwidth and metadata are not needed
+	return nil
+}
+
+// handle connect, createStream, publish and the other commands of publishers
+func (rc *rtmpConn) handleCommand(msg *rtmpMessage, values []interface{}) error {
+	name, _ := values[0].(string)
+	transaction, _ := values[1].(float64)
+	switch name {
+	case "connect":
+		windowAckSize := make([]byte, 4)
+		binary.BigEndian.PutUint32(windowAckSize, rtmpWindowAckSize)
+		if err := rc.writeMessage(rtmpCsidControl, rtmpMsgWindowAckSize, 0, windowAckSize); err != nil {
+			return err
+		}
+		// dynamic limit type
+		peerBandwidth := append(append([]byte(nil), windowAckSize...), 2)
+		if err := rc.writeMessage(rtmpCsidControl, rtmpMsgSetPeerBandwidth, 0, peerBandwidth); err != nil {
+			return err
+		}
+		chunkSize := make([]byte, 4)
+		binary.BigEndian.PutUint32(chunkSize, rtmpServerChunkSize)
+		if err := rc.writeMessage(rtmpCsidControl, rtmpMsgSetChunkSize, 0, chunkSize); err != nil {
+			return err
+		}
+		return rc.writeMessage(rtmpCsidCommand, rtmpMsgCommandAmf0, 0, encodeAmf0(
+			"_result", transaction,
+			amfObject{{"fmsVer", "FMS/3,0,1,123"}, {"capabilities", 31}},
+			amfObject{{"level", "status"}, {"code", "NetConnection.Connect.Success"}, {"description", "Connection succeeded."}, {"objectEncoding", 0}},
+		))
+	case "createStream":
+		// every connection publishes on message stream 1
+		return rc.writeMessage(rtmpCsidCommand, rtmpMsgCommandAmf0, 0, encodeAmf0("_result", transaction, nil, 1))
+	case "releaseStream", "FCPublish", "FCUnpublish", "getStreamLength":
+		return rc.writeMessage(rtmpCsidCommand, rtmpMsgCommandAmf0, 0, encodeAmf0("_result", transaction, nil))
+	case "publish":
+		var streamKey string
+		if len(values) > 3 {
+			streamKey, _ = values[3].(string)
+		}
+		// the publish token and for a backup encoder backup=true are appended as query, other parameters are ignored
+		streamKey, rawQuery, _ := strings.Cut(streamKey, "?")
+		query, _ := url.ParseQuery(rawQuery)
+		return rc.publish(msg.streamID, streamKey, query.Get("token"), query.Get("backup") == "true")
+	case "deleteStream", "closeStream":
+		return io.EOF
+	}
+	return nil
+}
+
+/*
+start publishing to the session named by the stream key, a backup is forwarded only while the primary is silent
+a primary is declined while another ingest (rtp, whip, rtsp, mpeg-ts) feeds the session
+*/
+func (rc *rtmpConn) publish(streamID uint32, streamKey string, token string, backup bool) error {
+	if rc.sessionID != "" {
+		return rc.sendStatus(streamID, "error", "NetStream.Publish.BadName", "already publishing")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(rc.config.Rtc_rtmp_publish_token)) != 1 {
+		logging.Warnf("rtmp publisher %v used invalid publish token, declining", rc.conn.RemoteAddr())
+		rc.sendStatus(streamID, "error", "NetStream.Publish.BadName", "invalid publish token")
+		return errors.New("invalid publish token")
+	}
+	if _, ok := sessions.GetStreamKey(streamKey); !ok {
+		logging.Warnf("rtmp publisher %v used unknown stream key, declining", rc.conn.RemoteAddr())
+		rc.sendStatus(streamID, "error", "NetStream.Publish.BadName", "unknown stream key")
+		return errors.New("unknown stream key")
+	}
+	publication := rtmpPublication{streamKey, backup}
+	rtmpMutex.Lock()
+	if rtmpPublishing[publication] {
+		rtmpMutex.Unlock()
+		logging.With("session_id", streamKey).Warnf("session already has an rtmp publisher, declining %v", rc.conn.RemoteAddr())
+		rc.sendStatus(streamID, "error", "NetStream.Publish.BadName", "stream key is already publishing")
+		return errors.New("stream key is already publishing")
+	}
+	if sess := sessions.ReturnSessionByIdIfExists(streamKey); sess != nil && !backup && sess.PrimaryLive() {
+		rtmpMutex.Unlock()
+		logging.With("session_id", streamKey).Warnf("session is fed by another ingest, declining rtmp publisher %v", rc.conn.RemoteAddr())
+		rc.sendStatus(streamID, "error", "NetStream.Publish.BadName", "session is fed by another ingest")
+		return errors.New("session is fed by another ingest")
+	}
+	rtmpPublishing[publication] = true
+	rtmpMutex.Unlock()
+	rc.sessionID = streamKey
+	rc.backup = backup
+	rc.publisher = newFlvPublisher(streamKey, backup, rc.config.Rtc_video_codec, rc.config.Rtc_audio_codec)
+	logging.With("session_id", streamKey, "backup", backup).Infof("rtmp publisher %v started session", rc.conn.RemoteAddr())
+	return rc.sendStatus(streamID, "status", "NetStream.Publish.Start", "publishing")
+}
+
+// send an onStatus command
+func (rc *rtmpConn) sendStatus(streamID uint32, level string, code string, description string) error {
+	return rc.writeMessage(rtmpCsidStatus, rtmpMsgCommandAmf0, streamID, encodeAmf0(
+		"onStatus", 0, nil,
+		amfObject{{"level", level}, {"code", code}, {"description", description}},
+	))
+}
@@ -0,0 +1,348 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/sessions"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// chunk header formats
+const (
+	testChunkFull     = 0 // timestamp, length, type and stream id
+	testChunkSameID   = 1 // timestamp delta, length and type
+	testChunkSameSize = 2 // timestamp delta
+	testChunkSame     = 3 // nothing, continues the previous message header
+)
+
+// basic header of a chunk, csid 2..63 in one byte, up to 319 in two and up to 65599 in three bytes
+func testChunkBasicHeader(format byte, csid uint32) []byte {
+	switch {
+	case csid < 64:
+		return []byte{format<<6 | byte(csid)}
+	case csid < 320:
+		return []byte{format << 6, byte(csid - 64)}
+	}
+	return []byte{format<<6 | 1, byte((csid - 64) & 0xFF), byte((csid - 64) >> 8)}
+}
+
+/*
+split a message into chunks of chunkSize, the first chunk uses format
+timestamp is absolute for format 0 and the delta otherwise, values from 0xFFFFFF on are sent extended
+*/
+func testChunks(format byte, csid uint32, typeID uint8, streamID uint32, timestamp uint32, payload []byte, chunkSize int) []byte {
+	extended := timestamp >= 0xFFFFFF
+	field := timestamp
+	if extended {
+		field = 0xFFFFFF
+	}
+	b := testChunkBasicHeader(format, csid)
+	if format <= testChunkSameSize {
+		b = append(b, byte(field>>16), byte(field>>8), byte(field))
+	}
+	if format <= testChunkSameID {
+		b = append(b, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)), typeID)
+	}
+	if format == testChunkFull {
+		b = binary.LittleEndian.AppendUint32(b, streamID)
+	}
+	if extended {
+		b = binary.BigEndian.AppendUint32(b, timestamp)
+	}
+	for offset := 0; ; offset += chunkSize {
+		if offset > 0 {
+			b = append(b, testChunkBasicHeader(testChunkSame, csid)...)
+			if extended {
+				b = binary.BigEndian.AppendUint32(b, timestamp)
+			}
+		}
+		end := offset + chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		b = append(b, payload[offset:end]...)
+		if end == len(payload) {
+			return b
+		}
+	}
+}
+
+// connection reading data, chunkSize is the chunk size announced by the client
+func testRtmpConn(data []byte, chunkSize uint32) *rtmpConn {
+	return &rtmpConn{
+		reader:       bufio.NewReader(bytes.NewReader(data)),
+		chunkSize:    chunkSize,
+		chunkStreams: make(map[uint32]*rtmpChunkStream),
+	}
+}
+
+func testPayload(size int, seed byte) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = seed + byte(i*7)
+	}
+	return payload
+}
+
+func TestRtmpChunkReassembly(t *testing.T) {
+	type message struct {
+		format    byte
+		typeID    uint8
+		timestamp uint32 // absolute for format 0, delta otherwise
+	}
+	type want struct {
+		typeID    uint8
+		timestamp uint32
+	}
+	// the following messages inherit the header fields their format leaves out
+	sequence := []message{
+		{testChunkFull, rtmpMsgVideo, 1000},
+		{testChunkSameID, rtmpMsgAudio, 33},
+		{testChunkSameSize, 0, 33},
+		{testChunkSame, 0, 0},
+	}
+	wants := []want{
+		{rtmpMsgVideo, 1000},
+		{rtmpMsgAudio, 1033},
+		{rtmpMsgAudio, 1066},
+		{rtmpMsgAudio, 1099},
+	}
+	for _, chunkSize := range []int{1, 128, 4096, 65536} {
+		for _, size := range []int{1, 127, 128, 129, 5000} {
+			for _, csid := range []uint32{3, 64, 319, 320, 65599} {
+				data := []byte{}
+				for i, m := range sequence {
+					// formats 0 and 1 set the length, it is kept for formats 2 and 3
+					messageSize := size
+					if i > 0 {
+						messageSize = size + 1
+					}
+					data = append(data, testChunks(m.format, csid, m.typeID, 1, m.timestamp, testPayload(messageSize, byte(i)), chunkSize)...)
+				}
+				rc := testRtmpConn(data, uint32(chunkSize))
+				for i, w := range wants {
+					msg, err := rc.readMessage()
+					if err != nil {
+						t.Fatalf("chunk size %v, size %v, csid %v: message %v: %v", chunkSize, size, csid, i, err)
+					}
+					wantSize := size
+					if i > 0 {
+						wantSize = size + 1
+					}
+					if msg.typeID != w.typeID || msg.timestamp != w.timestamp || msg.streamID != 1 || !bytes.Equal(msg.payload, testPayload(wantSize, byte(i))) {
+						t.Fatalf("chunk size %v, size %v, csid %v: message %v is type %v at %v on stream %v with %v bytes, want type %v at %v on stream 1 with %v bytes",
+							chunkSize, size, csid, i, msg.typeID, msg.timestamp, msg.streamID, len(msg.payload), w.typeID, w.timestamp, wantSize)
+					}
+				}
+				if _, err := rc.readMessage(); !errors.Is(err, io.EOF) {
+					t.Fatalf("chunk size %v, size %v, csid %v: read after the last message returned %v", chunkSize, size, csid, err)
+				}
+			}
+		}
+	}
+}
+
+func TestRtmpExtendedTimestamp(t *testing.T) {
+	payload := testPayload(300, 1)
+	data := testChunks(testChunkFull, 4, rtmpMsgVideo, 1, 0x1000000, payload, 128)
+	data = append(data, testChunks(testChunkSameSize, 4, 0, 0, 0xFFFFFF, payload, 128)...)
+	rc := testRtmpConn(data, 128)
+	for _, want := range []uint32{0x1000000, 0x1FFFFFF} {
+		msg, err := rc.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.timestamp != want || !bytes.Equal(msg.payload, payload) {
+			t.Errorf("message at %#x with %v bytes, want %#x with %v", msg.timestamp, len(msg.payload), want, len(payload))
+		}
+	}
+}
+
+// chunks of audio and video messages arrive interleaved and are reassembled per chunk stream
+func TestRtmpInterleavedChunkStreams(t *testing.T) {
+	video := testChunks(testChunkFull, 6, rtmpMsgVideo, 1, 40, testPayload(300, 1), 128)
+	audio := testChunks(testChunkFull, 4, rtmpMsgAudio, 1, 20, testPayload(200, 2), 128)
+	// video: header+128, 1+128, 1+44; audio: header+128, 1+72
+	videoChunks := [][]byte{video[:12+128], video[12+128 : 12+128+129], video[12+128+129:]}
+	audioChunks := [][]byte{audio[:12+128], audio[12+128:]}
+	data := append(append(append(append(append([]byte{}, videoChunks[0]...), audioChunks[0]...), videoChunks[1]...), audioChunks[1]...), videoChunks[2]...)
+	rc := testRtmpConn(data, 128)
+	for _, want := range []struct {
+		typeID  uint8
+		payload []byte
+	}{{rtmpMsgAudio, testPayload(200, 2)}, {rtmpMsgVideo, testPayload(300, 1)}} {
+		msg, err := rc.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.typeID != want.typeID || !bytes.Equal(msg.payload, want.payload) {
+			t.Errorf("got type %v with %v bytes, want type %v with %v", msg.typeID, len(msg.payload), want.typeID, len(want.payload))
+		}
+	}
+}
+
+// the client raises its chunk size with a control message, later chunks use the new size
+func TestRtmpSetChunkSize(t *testing.T) {
+	setChunkSize := binary.BigEndian.AppendUint32(nil, 4096)
+	data := testChunks(testChunkFull, 2, rtmpMsgSetChunkSize, 0, 0, setChunkSize, 128)
+	data = append(data, testChunks(testChunkFull, 6, rtmpMsgVideo, 1, 0, testPayload(5000, 3), 4096)...)
+	rc := testRtmpConn(data, rtmpDefaultChunkSize)
+	msg, err := rc.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.handleMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if rc.chunkSize != 4096 {
+		t.Fatalf("chunk size %v after set chunk size", rc.chunkSize)
+	}
+	msg, err = rc.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.payload, testPayload(5000, 3)) {
+		t.Errorf("video message with %v bytes not reassembled at the new chunk size", len(msg.payload))
+	}
+}
+
+// an abort message drops the partial message of a chunk stream
+func TestRtmpAbort(t *testing.T) {
+	partial := testChunks(testChunkFull, 6, rtmpMsgVideo, 1, 0, testPayload(300, 1), 128)[:12+128]
+	abort := testChunks(testChunkFull, 2, rtmpMsgAbort, 0, 0, binary.BigEndian.AppendUint32(nil, 6), 128)
+	next := testChunks(testChunkFull, 6, rtmpMsgVideo, 1, 40, testPayload(100, 2), 128)
+	rc := testRtmpConn(append(append(append([]byte{}, partial...), abort...), next...), 128)
+	msg, err := rc.readMessage()
+	if err != nil || msg.typeID != rtmpMsgAbort {
+		t.Fatalf("read %+v, %v, want the abort message", msg, err)
+	}
+	if err := rc.handleMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	msg, err = rc.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.timestamp != 40 || !bytes.Equal(msg.payload, testPayload(100, 2)) {
+		t.Errorf("message at %v with %v bytes after abort, want the next message", msg.timestamp, len(msg.payload))
+	}
+}
+
+// every truncation of a valid stream ends in an error instead of a panic or a partial message
+func TestRtmpTruncated(t *testing.T) {
+	data := testChunks(testChunkFull, 320, rtmpMsgVideo, 1, 0x1000000, testPayload(300, 1), 128)
+	for size := 0; size < len(data); size++ {
+		rc := testRtmpConn(data[:size], 128)
+		if msg, err := rc.readMessage(); err == nil {
+			t.Fatalf("%v of %v bytes returned a message of %v bytes", size, len(data), len(msg.payload))
+		}
+	}
+}
+
+func TestRtmpMalformed(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		chunkSize uint32
+	}{
+		{"set chunk size 0", testChunks(testChunkFull, 2, rtmpMsgSetChunkSize, 0, 0, []byte{0, 0, 0, 0}, 128), 128},
+		{"set chunk size too large", testChunks(testChunkFull, 2, rtmpMsgSetChunkSize, 0, 0, []byte{0x7F, 0xFF, 0xFF, 0xFF}, 128), 128},
+		{"short set chunk size", testChunks(testChunkFull, 2, rtmpMsgSetChunkSize, 0, 0, []byte{0, 1}, 128), 128},
+		{"command without values", testChunks(testChunkFull, 3, rtmpMsgCommandAmf0, 0, 0, nil, 128), 128},
+		{"command without transaction id", testChunks(testChunkFull, 3, rtmpMsgCommandAmf0, 0, 0, encodeAmf0("connect"), 128), 128},
+		{"amf3 command without values", testChunks(testChunkFull, 3, rtmpMsgCommandAmf3, 0, 0, []byte{0}, 128), 128},
+		{"command with bad amf", testChunks(testChunkFull, 3, rtmpMsgCommandAmf0, 0, 0, []byte{amf0String, 0, 9, 'x'}, 128), 128},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rc := testRtmpConn(test.data, test.chunkSize)
+			msg, err := rc.readMessage()
+			if err == nil {
+				err = rc.handleMessage(msg)
+			}
+			if err == nil || errors.Is(err, io.EOF) {
+				t.Errorf("got %v, want an error", err)
+			}
+		})
+	}
+}
+
+// connection of a publisher, everything written by the server is discarded
+func testRtmpPublisher(t *testing.T, config *configuration.Configuration) *rtmpConn {
+	server, client := net.Pipe()
+	go io.Copy(io.Discard, client)
+	t.Cleanup(func() { client.Close() })
+	return newRtmpConn(server, config)
+}
+
+// publishers need the publish token, a primary is declined while another ingest feeds the session
+func TestRtmpPublish(t *testing.T) {
+	config := *setupTestSessions(t)
+	config.Rtc_rtmp_publish_token = "publish-secret"
+	for _, name := range []string{"rtmp-publish", "rtmp-fed"} {
+		if err := sessions.RegisterStreamKey(sessions.StreamKey{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+		defer sessions.RemoveStreamKey(name)
+		defer sessions.CloseSession(name)
+	}
+	publish := func(streamKey string) (*rtmpConn, error) {
+		rc := testRtmpPublisher(t, &config)
+		return rc, rc.handleCommand(&rtmpMessage{typeID: rtmpMsgCommandAmf0, streamID: 1}, []interface{}{"publish", 5.0, nil, streamKey, "live"})
+	}
+	for _, streamKey := range []string{
+		"rtmp-publish",
+		"rtmp-publish?token=",
+		"rtmp-publish?token=publish-secre",
+		"rtmp-publish?backup=true",
+		"unknown?token=publish-secret",
+	} {
+		rc, err := publish(streamKey)
+		if err == nil || rc.publisher != nil {
+			t.Errorf("publishing to %q accepted", streamKey)
+		}
+		rc.close()
+	}
+	primary, err := publish("rtmp-publish?token=publish-secret")
+	if err != nil || primary.publisher == nil || primary.backup {
+		t.Fatalf("primary declined: %v", err)
+	}
+	if rc, err := publish("rtmp-publish?token=publish-secret"); err == nil {
+		rc.close()
+		t.Error("second primary accepted")
+	}
+	backup, err := publish("rtmp-publish?backup=true&token=publish-secret")
+	if err != nil || !backup.backup {
+		t.Fatalf("backup declined: %v", err)
+	}
+	backup.close()
+	// the primary fed the session, an encoder reconnecting after it stopped is accepted right away
+	sess := sessions.IngestSession("rtmp-publish", webrtc.RTPCodecTypeAudio)
+	sess.FailoverRTP(webrtc.RTPCodecTypeAudio, 0, false, &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{1}})
+	primary.close()
+	reconnected, err := publish("rtmp-publish?token=publish-secret")
+	if err != nil {
+		t.Fatalf("reconnecting primary declined: %v", err)
+	}
+	reconnected.close()
+	// the primary of another ingest is not interleaved with an rtmp primary, a backup can still join
+	sess = sessions.IngestSession("rtmp-fed", webrtc.RTPCodecTypeVideo)
+	sess.FailoverRTP(webrtc.RTPCodecTypeVideo, 0, false, &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: []byte{1}})
+	if rc, err := publish("rtmp-fed?token=publish-secret"); err == nil {
+		rc.close()
+		t.Error("rtmp primary accepted while another ingest feeds the session")
+	}
+	backup, err = publish("rtmp-fed?token=publish-secret&backup=true")
+	if err != nil {
+		t.Fatalf("backup of a session fed by another ingest declined: %v", err)
+	}
+	backup.close()
+}
@@ -0,0 +1,476 @@
+package writer
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// default port of rtsp urls without one
+const rtspDefaultPort = "554"
+
+// timeout of rtsp requests and of the stream, the camera is reconnected if nothing arrives for this long
+const rtspTimeout = 10 * time.Second
+
+// largest interleaved frame or response body accepted
+const rtspMaxBody = 1 << 16
+
+// response of the rtsp server
+type rtspResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// a media section of the described stream
+type rtspTrack struct {
+	kind        webrtc.RTPCodecType
+	mimeType    string // e.g. video/H264, built from the rtpmap encoding name
+	payloadType uint8
+	clockRate   uint32
+	control     string // absolute url used for SETUP
+	fmtp        string
+	channel     byte         // interleaved rtp channel, rtcp uses the next one
+	rtpConn     *net.UDPConn // udp transport only
+	rtcpConn    *net.UDPConn // udp transport only
+	serverRTCP  *net.UDPAddr // where rtcp is sent to in udp transport
+}
+
+/*
+minimal rtsp client connection (RFC 2326)
+supports basic and digest authentication, interleaved tcp and udp transport
+*/
+type rtspConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	url     *url.URL // url without credentials
+	user    *url.Userinfo
+	cseq    int
+	session string        // session id returned by SETUP
+	timeout time.Duration // session timeout announced by the server
+	auth    string        // authorization scheme requested by the server
+	realm   string
+	nonce   string
+	writeMu sync.Mutex // requests and interleaved rtcp are written from different goroutines
+}
+
+// connect to the rtsp server of rawURL
+func dialRtsp(rawURL string) (*rtspConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), rtspDefaultPort)
+	}
+	conn, err := net.DialTimeout("tcp", host, rtspTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &rtspConn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		user:    u.User,
+		timeout: 60 * time.Second,
+	}
+	u.User = nil
+	c.url = u
+	return c, nil
+}
+
+func (c *rtspConn) close() error {
+	return c.conn.Close()
+}
+
+// write a request without waiting for the response
+func (c *rtspConn) send(method string, uri string, headers map[string]string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(&b, "CSeq: %d\r\n", c.cseq)
+	b.WriteString("User-Agent: pion-webrtc-sfu\r\n")
+	if authorization := c.authorization(method, uri); authorization != "" {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", authorization)
+	}
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", c.session)
+	}
+	for key, value := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	b.WriteString("\r\n")
+	c.conn.SetWriteDeadline(time.Now().Add(rtspTimeout))
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// send a request and read its response, authenticating once if the server asks for it
+func (c *rtspConn) request(method string, uri string, headers map[string]string) (*rtspResponse, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.send(method, uri, headers); err != nil {
+			return nil, err
+		}
+		c.conn.SetReadDeadline(time.Now().Add(rtspTimeout))
+		res, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if res.status == 401 && attempt == 0 && c.user != nil {
+			if err := c.parseAuthenticate(res.header.Values("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if res.status != 200 {
+			return nil, fmt.Errorf("%s returned status %d", method, res.status)
+		}
+		return res, nil
+	}
+}
+
+// read a response, interleaved frames before it are skipped
+func (c *rtspConn) readResponse() (*rtspResponse, error) {
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] != '$' {
+			break
+		}
+		if _, _, err := c.readFrame(); err != nil {
+			return nil, err
+		}
+	}
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	// RTSP/1.0 200 OK
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+		return nil, fmt.Errorf("bad response line %q", line)
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad response status %q", parts[1])
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && !(errors.Is(err, io.EOF) && header != nil) {
+		return nil, err
+	}
+	res := &rtspResponse{status: status, header: header}
+	if length := header.Get("Content-Length"); length != "" {
+		size, err := strconv.Atoi(length)
+		if err != nil || size < 0 || size > rtspMaxBody {
+			return nil, fmt.Errorf("bad content length %q", length)
+		}
+		res.body = make([]byte, size)
+		if _, err := io.ReadFull(c.reader, res.body); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+/*
+read the next interleaved frame, responses in between (keepalives) are skipped
+the returned payload is newly allocated
+*/
+func (c *rtspConn) readFrame() (byte, []byte, error) {
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if first[0] != '$' {
+			if _, err := c.readResponse(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		// $ channel length(2)
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return 0, nil, err
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return 0, nil, err
+		}
+		return header[1], payload, nil
+	}
+}
+
+// write an interleaved frame on channel
+func (c *rtspConn) writeFrame(channel byte, payload []byte) error {
+	if len(payload) > 0xFFFF {
+		return errors.New("interleaved frame too large")
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	frame := make([]byte, 4+len(payload))
+	frame[0] = '$'
+	frame[1] = channel
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	copy(frame[4:], payload)
+	c.conn.SetWriteDeadline(time.Now().Add(rtspTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// remember the authentication scheme, realm and nonce requested by the server, digest is preferred
+func (c *rtspConn) parseAuthenticate(headers []string) error {
+	if len(headers) == 0 {
+		return errors.New("server requires authentication without a scheme")
+	}
+	header := headers[0]
+	for _, h := range headers {
+		if strings.HasPrefix(strings.ToLower(h), "digest") {
+			header = h
+		}
+	}
+	scheme, params, _ := strings.Cut(header, " ")
+	c.auth = strings.ToLower(scheme)
+	if c.auth != "basic" && c.auth != "digest" {
+		return fmt.Errorf("unsupported authentication %q", scheme)
+	}
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(key) {
+		case "realm":
+			c.realm = value
+		case "nonce":
+			c.nonce = value
+		}
+	}
+	return nil
+}
+
+// authorization header of a request, empty before the server asked for credentials
+func (c *rtspConn) authorization(method string, uri string) string {
+	if c.user == nil || c.auth == "" {
+		return ""
+	}
+	username := c.user.Username()
+	password, _ := c.user.Password()
+	if c.auth == "basic" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	ha1 := md5Hex(username + ":" + c.realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	response := md5Hex(ha1 + ":" + c.nonce + ":" + ha2)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, username, c.realm, c.nonce, uri, response)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// describe the stream and return its media sections
+func (c *rtspConn) describe() ([]*rtspTrack, error) {
+	res, err := c.request("DESCRIBE", c.url.String(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, err
+	}
+	base := c.url.String()
+	if contentBase := res.header.Get("Content-Base"); contentBase != "" {
+		base = contentBase
+	}
+	description := sdp.SessionDescription{}
+	if err := description.Unmarshal(res.body); err != nil {
+		return nil, err
+	}
+	// session level control applies to all media without their own
+	if control, ok := description.Attribute("control"); ok {
+		base = resolveControl(base, control)
+	}
+	tracks := make([]*rtspTrack, 0, len(description.MediaDescriptions))
+	for _, media := range description.MediaDescriptions {
+		track := parseRtspTrack(media, base)
+		if track != nil {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks, nil
+}
+
+// parse codec, payload type and control url of a media section, nil if not audio/video
+func parseRtspTrack(media *sdp.MediaDescription, base string) *rtspTrack {
+	track := &rtspTrack{control: base}
+	switch media.MediaName.Media {
+	case "video":
+		track.kind = webrtc.RTPCodecTypeVideo
+	case "audio":
+		track.kind = webrtc.RTPCodecTypeAudio
+	default:
+		return nil
+	}
+	if len(media.MediaName.Formats) == 0 {
+		return nil
+	}
+	payloadType, err := strconv.ParseUint(media.MediaName.Formats[0], 10, 7)
+	if err != nil {
+		return nil
+	}
+	track.payloadType = uint8(payloadType)
+	prefix := media.MediaName.Formats[0] + " "
+	for _, attribute := range media.Attributes {
+		switch attribute.Key {
+		case "rtpmap":
+			// 96 H264/90000
+			if !strings.HasPrefix(attribute.Value, prefix) {
+				continue
+			}
+			encoding := strings.Split(strings.TrimPrefix(attribute.Value, prefix), "/")
+			track.mimeType = track.kind.String() + "/" + encoding[0]
+			if len(encoding) > 1 {
+				if clockRate, err := strconv.ParseUint(encoding[1], 10, 32); err == nil {
+					track.clockRate = uint32(clockRate)
+				}
+			}
+		case "fmtp":
+			if strings.HasPrefix(attribute.Value, prefix) {
+				track.fmtp = strings.TrimPrefix(attribute.Value, prefix)
+			}
+		case "control":
+			track.control = resolveControl(base, attribute.Value)
+		}
+	}
+	// static payload types without rtpmap
+	if track.mimeType == "" {
+		switch track.payloadType {
+		case 0:
+			track.mimeType, track.clockRate = webrtc.MimeTypePCMU, 8000
+		case 8:
+			track.mimeType, track.clockRate = webrtc.MimeTypePCMA, 8000
+		case 9:
+			track.mimeType, track.clockRate = webrtc.MimeTypeG722, 8000
+		default:
+			return nil
+		}
+	}
+	return track
+}
+
+// resolve a control attribute against the base url
+func resolveControl(base string, control string) string {
+	switch {
+	case control == "*" || control == "":
+		return base
+	case strings.HasPrefix(control, "rtsp://"):
+		return control
+	case strings.HasSuffix(base, "/"):
+		return base + control
+	}
+	return base + "/" + control
+}
+
+/*
+setup a track, interleaved over the rtsp connection for tcp
+or on two new local udp ports otherwise
+*/
+func (c *rtspConn) setup(track *rtspTrack, index int, tcp bool) error {
+	var transport string
+	if tcp {
+		track.channel = byte(index * 2)
+		transport = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", track.channel, track.channel+1)
+	} else {
+		var err error
+		if track.rtpConn, err = net.ListenUDP("udp", &net.UDPAddr{}); err != nil {
+			return err
+		}
+		if track.rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{}); err != nil {
+			return err
+		}
+		transport = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d",
+			track.rtpConn.LocalAddr().(*net.UDPAddr).Port, track.rtcpConn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	res, err := c.request("SETUP", track.control, map[string]string{"Transport": transport})
+	if err != nil {
+		return err
+	}
+	// Session: 12345678;timeout=60
+	if session := res.header.Get("Session"); session != "" {
+		id, params, _ := strings.Cut(session, ";")
+		c.session = strings.TrimSpace(id)
+		if value := strings.TrimSpace(params); strings.HasPrefix(value, "timeout=") {
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(value, "timeout=")); err == nil && seconds > 0 {
+				c.timeout = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	for _, param := range strings.Split(res.header.Get("Transport"), ";") {
+		key, value, _ := strings.Cut(param, "=")
+		switch key {
+		case "interleaved":
+			if channel, err := strconv.ParseUint(strings.Split(value, "-")[0], 10, 8); err == nil && tcp {
+				track.channel = byte(channel)
+			}
+		case "server_port":
+			// rtp-rtcp port pair
+			ports := strings.Split(value, "-")
+			if port, err := strconv.Atoi(ports[len(ports)-1]); err == nil && !tcp {
+				host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+				track.serverRTCP = &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+			}
+		}
+	}
+	return nil
+}
+
+// start streaming of all tracks that were setup
+func (c *rtspConn) play() error {
+	_, err := c.request("PLAY", c.url.String(), map[string]string{"Range": "npt=0.000-"})
+	return err
+}
+
+/*
+rtcp feedback (keyframe requests) to an rtsp track
+sent interleaved on the rtcp channel or to the rtcp port of the server
+*/
+type rtspFeedback struct {
+	conn  *rtspConn
+	track *rtspTrack
+	tcp   bool
+}
+
+func (rf *rtspFeedback) WriteRTCP(pkts []rtcp.Packet) error {
+	payload, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return err
+	}
+	if rf.tcp {
+		return rf.conn.writeFrame(rf.track.channel+1, payload)
+	}
+	if rf.track.serverRTCP == nil {
+		return nil
+	}
+	_, err = rf.track.rtcpConn.WriteTo(payload, rf.track.serverRTCP)
+	return err
+}
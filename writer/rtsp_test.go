@@ -0,0 +1,516 @@
+package writer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/sessions"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	testRtspUser     = "admin"
+	testRtspPassword = "secret"
+	testRtspRealm    = "camera"
+	testRtspNonce    = "0123456789abcdef"
+	testRtspSession  = "4f3a2b1c"
+)
+
+// description of the test camera, a vp8 video and an opus audio track
+const testRtspSdp = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=camera\r\n" +
+	"t=0 0\r\n" +
+	"a=control:*\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n" +
+	"a=control:trackID=0\r\n" +
+	"m=audio 0 RTP/AVP 111\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"a=control:trackID=1\r\n"
+
+var testRtspPayloadTypes = []uint8{96, 111}
+
+/*
+in-process rtsp camera serving testRtspSdp
+after PLAY it sends packetsPerTrack rtp packets per track, interleaved or to the udp ports of the client
+*/
+type testRtspServer struct {
+	t               *testing.T
+	listener        net.Listener
+	auth            string   // "", "basic" or "digest"
+	dropAfter       []string // method after which the server closes the connection, by connection index, the last one applies to later connections
+	packetsPerTrack int
+
+	mu           sync.Mutex
+	methods      []string
+	uris         []string
+	accepted     []time.Time
+	unauthorized int
+}
+
+func newTestRtspServer(t *testing.T, auth string) *testRtspServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testRtspServer{t: t, listener: listener, auth: auth, packetsPerTrack: 5}
+	t.Cleanup(func() { listener.Close() })
+	go s.accept()
+	return s
+}
+
+// url of the stream, with credentials if user is not empty
+func (s *testRtspServer) url(user string, password string) string {
+	credentials := ""
+	if user != "" {
+		credentials = user + ":" + password + "@"
+	}
+	return "rtsp://" + credentials + s.listener.Addr().String() + "/stream"
+}
+
+func (s *testRtspServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		index := len(s.accepted)
+		s.accepted = append(s.accepted, time.Now())
+		s.mu.Unlock()
+		go s.serve(conn, index)
+	}
+}
+
+func (s *testRtspServer) acceptedAt() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.accepted...)
+}
+
+func (s *testRtspServer) requests() ([]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.methods...), append([]string(nil), s.uris...)
+}
+
+func (s *testRtspServer) serve(conn net.Conn, index int) {
+	defer conn.Close()
+	dropAfter := ""
+	if len(s.dropAfter) > 0 {
+		dropAfter = s.dropAfter[len(s.dropAfter)-1]
+		if index < len(s.dropAfter) {
+			dropAfter = s.dropAfter[index]
+		}
+	}
+	reader := bufio.NewReader(conn)
+	var clientPorts []int
+	tcp := false
+	for {
+		// interleaved rtcp of the client
+		if first, err := reader.Peek(1); err == nil && first[0] == '$' {
+			header := make([]byte, 4)
+			if _, err := reader.Read(header); err != nil {
+				return
+			}
+			reader.Discard(int(header[2])<<8 | int(header[3]))
+			continue
+		}
+		tp := textproto.NewReader(reader)
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		method, uri, _ := strings.Cut(line, " ")
+		uri, _, _ = strings.Cut(uri, " ")
+		s.mu.Lock()
+		s.methods = append(s.methods, method)
+		s.uris = append(s.uris, uri)
+		s.mu.Unlock()
+		cseq := header.Get("CSeq")
+		if !s.authorized(method, uri, header.Get("Authorization")) {
+			s.mu.Lock()
+			s.unauthorized++
+			s.mu.Unlock()
+			challenge := `Basic realm="` + testRtspRealm + `"`
+			if s.auth == "digest" {
+				challenge = `Digest realm="` + testRtspRealm + `", nonce="` + testRtspNonce + `"`
+			}
+			fmt.Fprintf(conn, "RTSP/1.0 401 Unauthorized\r\nCSeq: %s\r\nWWW-Authenticate: %s\r\n\r\n", cseq, challenge)
+			continue
+		}
+		switch method {
+		case "DESCRIBE":
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nContent-Base: %s/\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s",
+				cseq, s.url("", ""), len(testRtspSdp), testRtspSdp)
+		case "SETUP":
+			transport := header.Get("Transport")
+			tcp = strings.Contains(transport, "interleaved=")
+			if !tcp {
+				for _, param := range strings.Split(transport, ";") {
+					if strings.HasPrefix(param, "client_port=") {
+						port, _ := strconv.Atoi(strings.Split(strings.TrimPrefix(param, "client_port="), "-")[0])
+						clientPorts = append(clientPorts, port)
+					}
+				}
+				transport += ";server_port=6970-6971"
+			}
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nSession: %s;timeout=30\r\nTransport: %s\r\n\r\n", cseq, testRtspSession, transport)
+		default:
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\n\r\n", cseq)
+		}
+		if method == "PLAY" {
+			s.sendPackets(conn, tcp, clientPorts)
+		}
+		if method == dropAfter {
+			return
+		}
+	}
+}
+
+// check the authorization header of a request against the test credentials
+func (s *testRtspServer) authorized(method string, uri string, authorization string) bool {
+	switch s.auth {
+	case "basic":
+		return authorization == "Basic "+base64.StdEncoding.EncodeToString([]byte(testRtspUser+":"+testRtspPassword))
+	case "digest":
+		scheme, params, _ := strings.Cut(authorization, " ")
+		if scheme != "Digest" {
+			return false
+		}
+		values := map[string]string{}
+		for _, param := range strings.Split(params, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			values[key] = strings.Trim(value, `"`)
+		}
+		ha1 := md5Hex(testRtspUser + ":" + testRtspRealm + ":" + testRtspPassword)
+		ha2 := md5Hex(method + ":" + uri)
+		return values["username"] == testRtspUser && values["uri"] == uri && values["response"] == md5Hex(ha1+":"+testRtspNonce+":"+ha2)
+	}
+	return true
+}
+
+func (s *testRtspServer) sendPackets(conn net.Conn, tcp bool, clientPorts []int) {
+	for i := 0; i < s.packetsPerTrack; i++ {
+		for track, payloadType := range testRtspPayloadTypes {
+			packet := &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					PayloadType:    payloadType,
+					SequenceNumber: uint16(i),
+					Timestamp:      uint32(i * 3000),
+					SSRC:           uint32(1000 + track),
+					Marker:         true,
+				},
+				// vp8 keyframe descriptor and opus toc, the content does not matter here
+				Payload: []byte{0x10, 0x00, 0x9d, 0x01, 0x2a},
+			}
+			raw, err := packet.Marshal()
+			if err != nil {
+				s.t.Error(err)
+				return
+			}
+			if tcp {
+				frame := append([]byte{'$', byte(track * 2), byte(len(raw) >> 8), byte(len(raw))}, raw...)
+				if _, err := conn.Write(frame); err != nil {
+					return
+				}
+				continue
+			}
+			if track >= len(clientPorts) {
+				continue
+			}
+			udp, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", clientPorts[track]))
+			if err != nil {
+				s.t.Error(err)
+				return
+			}
+			udp.Write(raw)
+			udp.Close()
+		}
+	}
+}
+
+// describe, setup and play the test camera, returns the connection and the described tracks
+func playTestRtsp(t *testing.T, rawURL string, tcp bool) (*rtspConn, []*rtspTrack) {
+	conn, err := dialRtsp(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.close()
+	})
+	tracks, err := conn.describe()
+	if err != nil {
+		t.Fatalf("describe: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, track := range tracks {
+			if track.rtpConn != nil {
+				track.rtpConn.Close()
+				track.rtcpConn.Close()
+			}
+		}
+	})
+	for i, track := range tracks {
+		if err := conn.setup(track, i, tcp); err != nil {
+			t.Fatalf("setup of track %v: %v", i, err)
+		}
+	}
+	if err := conn.play(); err != nil {
+		t.Fatalf("play: %v", err)
+	}
+	return conn, tracks
+}
+
+func TestRtspPlay(t *testing.T) {
+	for _, tcp := range []bool{true, false} {
+		name := "udp"
+		if tcp {
+			name = "tcp"
+		}
+		t.Run(name, func(t *testing.T) {
+			server := newTestRtspServer(t, "")
+			conn, tracks := playTestRtsp(t, server.url("", ""), tcp)
+			if len(tracks) != 2 {
+				t.Fatalf("got %v tracks, want 2", len(tracks))
+			}
+			want := []struct {
+				kind     webrtc.RTPCodecType
+				mimeType string
+				control  string
+			}{
+				{webrtc.RTPCodecTypeVideo, "video/VP8", server.url("", "") + "/trackID=0"},
+				{webrtc.RTPCodecTypeAudio, "audio/opus", server.url("", "") + "/trackID=1"},
+			}
+			for i, track := range tracks {
+				if track.kind != want[i].kind || track.mimeType != want[i].mimeType || track.payloadType != testRtspPayloadTypes[i] || track.control != want[i].control {
+					t.Errorf("track %v is %v %v pt %v control %v, want %v %v pt %v control %v", i,
+						track.kind, track.mimeType, track.payloadType, track.control,
+						want[i].kind, want[i].mimeType, testRtspPayloadTypes[i], want[i].control)
+				}
+			}
+			if conn.session != testRtspSession || conn.timeout != 30*time.Second {
+				t.Errorf("session %q with timeout %v, want %q with 30s", conn.session, conn.timeout, testRtspSession)
+			}
+			methods, uris := server.requests()
+			if got := strings.Join(methods, ","); got != "DESCRIBE,SETUP,SETUP,PLAY" {
+				t.Errorf("requests %v, want DESCRIBE,SETUP,SETUP,PLAY", got)
+			}
+			if uris[1] != want[0].control || uris[2] != want[1].control {
+				t.Errorf("setup uris %v and %v, want the track controls", uris[1], uris[2])
+			}
+			// every track receives its packets on its own channel or port
+			received := make([]int, len(tracks))
+			for total := 0; total < server.packetsPerTrack*len(tracks); total++ {
+				index, payload := readTestRtspPacket(t, conn, tracks, tcp, total)
+				packet := &rtp.Packet{}
+				if err := packet.Unmarshal(payload); err != nil {
+					t.Fatal(err)
+				}
+				if packet.PayloadType != tracks[index].payloadType {
+					t.Errorf("packet with pt %v for track with pt %v", packet.PayloadType, tracks[index].payloadType)
+				}
+				received[index]++
+			}
+			for i, count := range received {
+				if count != server.packetsPerTrack {
+					t.Errorf("track %v received %v packets, want %v", i, count, server.packetsPerTrack)
+				}
+			}
+			if tcp && (tracks[0].channel != 0 || tracks[1].channel != 2) {
+				t.Errorf("interleaved channels %v and %v, want 0 and 2", tracks[0].channel, tracks[1].channel)
+			}
+		})
+	}
+}
+
+/*
+read the n-th packet sent by the test camera, returns the index of its track
+interleaved frames are matched to tracks by channel, udp packets are read track by track
+*/
+func readTestRtspPacket(t *testing.T, conn *rtspConn, tracks []*rtspTrack, tcp bool, n int) (int, []byte) {
+	if tcp {
+		conn.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		channel, frame, err := conn.readFrame()
+		if err != nil {
+			t.Fatalf("reading interleaved frames: %v", err)
+		}
+		for i, track := range tracks {
+			if track.channel == channel {
+				return i, frame
+			}
+		}
+		t.Fatalf("frame on unknown channel %v", channel)
+	}
+	index := n % len(tracks)
+	buf := make([]byte, 1500)
+	tracks[index].rtpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	size, _, err := tracks[index].rtpConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("reading udp of track %v: %v", index, err)
+	}
+	return index, buf[:size]
+}
+
+func TestRtspAuthentication(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     string
+		user     string
+		password string
+		wantErr  bool
+	}{
+		{"basic", "basic", testRtspUser, testRtspPassword, false},
+		{"digest", "digest", testRtspUser, testRtspPassword, false},
+		{"basic with wrong password", "basic", testRtspUser, "wrong", true},
+		{"digest with wrong password", "digest", testRtspUser, "wrong", true},
+		{"without credentials", "digest", "", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestRtspServer(t, test.auth)
+			conn, err := dialRtsp(server.url(test.user, test.password))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.close()
+			_, err = conn.describe()
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "401") {
+					t.Fatalf("describe returned %v, want a 401 error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("describe: %v", err)
+			}
+			// the credentials are sent right away once the scheme is known
+			if err := conn.play(); err != nil {
+				t.Fatalf("play: %v", err)
+			}
+			methods, _ := server.requests()
+			server.mu.Lock()
+			unauthorized := server.unauthorized
+			server.mu.Unlock()
+			if got := strings.Join(methods, ","); got != "DESCRIBE,DESCRIBE,PLAY" || unauthorized != 1 {
+				t.Errorf("requests %v with %v unauthorized, want DESCRIBE,DESCRIBE,PLAY with 1", got, unauthorized)
+			}
+			if strings.Contains(conn.url.String(), test.password) {
+				t.Errorf("url %v still contains the password", conn.url)
+			}
+		})
+	}
+}
+
+func TestParseRtspSources(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []RtspSource
+		wantErr bool
+	}{
+		{"", []RtspSource{}, false},
+		{"cam1=rtsp://host/stream", []RtspSource{{Name: "cam1", URL: "rtsp://host/stream"}}, false},
+		{"cam1=rtsp://host/a|udp; cam2=rtsp://u:p@host/b|tcp", []RtspSource{
+			{Name: "cam1", URL: "rtsp://host/a", Transport: RtspTransportUDP},
+			{Name: "cam2", URL: "rtsp://u:p@host/b", Transport: RtspTransportTCP},
+		}, false},
+		{"cam1=rtsp://host/a|backup", []RtspSource{{Name: "cam1", URL: "rtsp://host/a", Backup: true}}, false},
+		{"cam1=rtsp://host/a|udp|backup;cam2=rtsp://host/b|backup|tcp", []RtspSource{
+			{Name: "cam1", URL: "rtsp://host/a", Transport: RtspTransportUDP, Backup: true},
+			{Name: "cam2", URL: "rtsp://host/b", Transport: RtspTransportTCP, Backup: true},
+		}, false},
+		// invalid transports are rejected when the source is added
+		{"cam1=rtsp://host/a|sctp", []RtspSource{{Name: "cam1", URL: "rtsp://host/a", Transport: "sctp"}}, false},
+		{"cam1=rtsp://host/a|udp|tcp", nil, true},
+		{"rtsp://host/a", nil, true},
+		{"=rtsp://host/a", nil, true},
+		{"cam1=", nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseRtspSources(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseRtspSources(%q) returned error %v", test.value, err)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("parseRtspSources(%q) = %+v, want %+v", test.value, got, test.want)
+		}
+	}
+}
+
+var initTestSessions sync.Once
+
+// sessions fed by the source under test, created with the default configuration
+func setupTestSessions(t *testing.T) *configuration.Configuration {
+	config, err := configuration.CreateConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initTestSessions.Do(func() {
+		if err := sessions.InitSessions(config); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return config
+}
+
+func TestRtspSourceReconnect(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the reconnect backoff")
+	}
+	config := setupTestSessions(t)
+	server := newTestRtspServer(t, "")
+	// two failed attempts double the backoff, a stream that played resets it
+	server.dropAfter = []string{"DESCRIBE", "DESCRIBE", "PLAY", "DESCRIBE"}
+	if err := AddRtspSource(config, RtspSource{Name: "reconnect", URL: server.url("", ""), Transport: RtspTransportTCP}); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveRtspSource("reconnect")
+	deadline := time.Now().Add(10 * time.Second)
+	for len(server.acceptedAt()) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %v connections before the deadline", len(server.acceptedAt()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	accepted := server.acceptedAt()
+	wantGaps := []time.Duration{rtspMinBackoff, 2 * rtspMinBackoff, rtspMinBackoff}
+	for i, want := range wantGaps {
+		gap := accepted[i+1].Sub(accepted[i])
+		if gap < want-100*time.Millisecond || gap > want+900*time.Millisecond {
+			t.Errorf("reconnect %v after %v, want about %v", i+1, gap, want)
+		}
+	}
+	status, ok := GetRtspSource("reconnect")
+	if !ok {
+		t.Fatal("source is gone")
+	}
+	if status.Reconnects < 3 || status.Packets != uint64(server.packetsPerTrack*len(testRtspPayloadTypes)) || status.LastError == "" {
+		t.Errorf("status %+v, want 3 reconnects, %v packets and the last error", status, server.packetsPerTrack*len(testRtspPayloadTypes))
+	}
+	if !RemoveRtspSource("reconnect") {
+		t.Error("source could not be removed")
+	}
+	if _, ok := GetRtspSource("reconnect"); ok {
+		t.Error("source still listed after removal")
+	}
+}
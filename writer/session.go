@@ -0,0 +1,47 @@
+package writer
+
+import (
+	"errors"
+	"io"
+	"pion-webrtc-sfu/hls"
+	"pion-webrtc-sfu/recorder"
+	"pion-webrtc-sfu/relay"
+	"pion-webrtc-sfu/sessions"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+/*
+write a packet of a stream pulled or pushed by name to the tracks of the session with that name
+the session is created with the first packet, packets are recorded, relayed and segmented for hls first
+packets of a backup are dropped while the primary of the session is forwarded
+keyframe requests of the viewers are sent to feedback if it is not nil
+*/
+func writeToSession(sessionID string, kind webrtc.RTPCodecType, backup bool, packet *rtp.Packet, feedback sessions.RTCPWriter) error {
+	sess := sessions.IngestSession(sessionID, kind)
+	if sess != nil {
+		if kind == webrtc.RTPCodecTypeVideo && feedback != nil {
+			sess.SetVideoFeedback(packet.SSRC, backup, feedback)
+		}
+		if !sess.FailoverRTP(kind, 0, backup, packet) {
+			return nil
+		}
+	}
+	recorder.WriteRTP(sessionID, kind, 0, packet)
+	hls.WriteRTP(sessionID, kind, 0, packet)
+	relay.WriteRTP(sessionID, kind, 0, packet)
+	if sess == nil {
+		return nil
+	}
+	var err error
+	if kind == webrtc.RTPCodecTypeVideo {
+		err = sess.TrackGroup.VideoTrack.WriteRTP(packet)
+	} else {
+		err = sess.TrackGroup.AudioTrack.WriteRTP(packet)
+	}
+	if errors.Is(err, io.ErrClosedPipe) {
+		return nil
+	}
+	return err
+}
@@ -4,36 +4,109 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 	"net"
 	"pion-webrtc-sfu/configuration"
+	"pion-webrtc-sfu/hls"
+	"pion-webrtc-sfu/logging"
+	"pion-webrtc-sfu/metrics"
+	"pion-webrtc-sfu/recorder"
+	"pion-webrtc-sfu/relay"
 	"pion-webrtc-sfu/sessions"
+	"strconv"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
 )
 
+// size of the fixed rtp header up to and including the ssrc
+const rtpHeaderSize = 12
+
+// ingest listeners, closed on shutdown
+var listeners = make([]io.Closer, 0)
+
+// mutex for above list read/write
+var listenersMutex sync.Mutex
+
+// remember a listener so that StopIngest can close it
+func addListener(listener io.Closer) {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	listeners = append(listeners, listener)
+}
+
+/*
+stop receiving streams, used on shutdown
+closes the udp, mpeg-ts and rtmp listeners and stops pulling rtsp sources
+*/
+func StopIngest() {
+	listenersMutex.Lock()
+	closing := listeners
+	listeners = make([]io.Closer, 0)
+	listenersMutex.Unlock()
+	for _, listener := range closing {
+		listener.Close()
+	}
+	for _, source := range ListRtspSources() {
+		RemoveRtspSource(source.Name)
+	}
+}
+
 // write incoming video UDP packets to video track
 func StartVideoWriterLoop(config *configuration.Configuration) {
 	inboundRTPPacket := make([]byte, config.Rtc_receive_rtp_buffsize) // UDP MTU
 	// open UDP listener
 	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: int(config.Rtc_video_tracks_receive_port)})
 	if err != nil {
-		log.Fatalf("could not open UDP port for video listener: (%v)\n", err)
+		logging.Fatalf("could not open UDP port for video listener: (%v)", err)
 	}
-	// read from listener and write to track if ssrc matches an existing session
+	addListener(listener)
+	portLabel := strconv.Itoa(int(config.Rtc_video_tracks_receive_port))
+	// read from listener and write to track if ssrc on this port is bound to a session
 	for {
-		n, _, err := listener.ReadFrom(inboundRTPPacket)
+		n, addr, err := listener.ReadFrom(inboundRTPPacket)
+		if errors.Is(err, net.ErrClosed) {
+			logging.Infof("video UDP listener closed")
+			return
+		}
 		if err != nil {
-			log.Fatalf("error trying to read from video UDP listener: %v\n", err)
+			logging.Errorf("error trying to read from video UDP listener: %v", err)
+			continue
+		}
+		// anything shorter than the fixed rtp header can't be bound to a session
+		if n < rtpHeaderSize {
+			metrics.IngestMalformed.Inc(portLabel)
+			continue
 		}
 		// extract ssrc from bytestream
 		stream_ssrc := binary.BigEndian.Uint32(inboundRTPPacket[:n][8:12])
-		// write to session track if exists
-		sess := sessions.ReturnSessionByIdIfExists(stream_ssrc)
+		sessions.RecordIngest(config.Rtc_video_tracks_receive_port, stream_ssrc, addr, n)
+		name, binding, bound := sessions.ReturnIngestBinding(config.Rtc_video_tracks_receive_port, stream_ssrc)
+		metrics.IngestPackets.Inc(portLabel, name)
+		metrics.IngestBytes.Add(float64(n), portLabel, name)
+		if !bound {
+			metrics.IngestUnknownSSRC.Inc(portLabel)
+			continue
+		}
+		// the session is created with the first packet
+		sess := sessions.IngestSession(name, webrtc.RTPCodecTypeVideo)
+		if sess != nil {
+			// remember where the stream comes from for keyframe requests, backups need them before taking over
+			sess.SetVideoSource(listener, addr, stream_ssrc, binding.Backup)
+			if !sess.FailoverPacket(webrtc.RTPCodecTypeVideo, binding.Layer, binding.Backup, inboundRTPPacket[:n]) {
+				continue
+			}
+		}
+		// recorded, segmented and relayed even while nobody is watching
+		recorder.Write(name, webrtc.RTPCodecTypeVideo, binding.Layer, inboundRTPPacket[:n])
+		hls.Write(name, webrtc.RTPCodecTypeVideo, binding.Layer, inboundRTPPacket[:n])
+		relay.Write(name, webrtc.RTPCodecTypeVideo, binding.Layer, inboundRTPPacket[:n])
+		// write to session track
 		if sess != nil {
-			if _, err = sess.TrackGroup.VideoTrack.Write(inboundRTPPacket[:n]); err != nil {
+			if _, err = sess.TrackGroup.VideoTrack.WriteLayer(binding.Layer, inboundRTPPacket[:n]); err != nil {
 				if errors.Is(err, io.ErrClosedPipe) {
 					continue
 				}
-				log.Printf("video track of session %v writer got exception: %s\n", stream_ssrc, err)
+				logging.With("session_id", name).Errorf("video track of ssrc %v writer got exception: %s", stream_ssrc, err)
 			}
 		}
 	}
@@ -45,24 +118,52 @@ func StartAudioWriterLoop(config *configuration.Configuration) {
 	// open UDP listener
 	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: int(config.Rtc_audio_tracks_receive_port)})
 	if err != nil {
-		log.Fatalf("could not open UDP port for audio listener: (%v)\n", err)
+		logging.Fatalf("could not open UDP port for audio listener: (%v)", err)
 	}
-	// read from listener and write to track if ssrc matches an existing session
+	addListener(listener)
+	portLabel := strconv.Itoa(int(config.Rtc_audio_tracks_receive_port))
+	// read from listener and write to track if ssrc on this port is bound to a session
 	for {
-		n, _, err := listener.ReadFrom(inboundRTPPacket)
+		n, addr, err := listener.ReadFrom(inboundRTPPacket)
+		if errors.Is(err, net.ErrClosed) {
+			logging.Infof("audio UDP listener closed")
+			return
+		}
 		if err != nil {
-			log.Fatalf("error trying to read from audio UDP listener: %v\n", err)
+			logging.Errorf("error trying to read from audio UDP listener: %v", err)
+			continue
+		}
+		// anything shorter than the fixed rtp header can't be bound to a session
+		if n < rtpHeaderSize {
+			metrics.IngestMalformed.Inc(portLabel)
+			continue
 		}
 		// extract ssrc from bytestream
 		stream_ssrc := binary.BigEndian.Uint32(inboundRTPPacket[:n][8:12])
-		// write to session track if exists
-		sess := sessions.ReturnSessionByIdIfExists(stream_ssrc)
+		sessions.RecordIngest(config.Rtc_audio_tracks_receive_port, stream_ssrc, addr, n)
+		name, binding, bound := sessions.ReturnIngestBinding(config.Rtc_audio_tracks_receive_port, stream_ssrc)
+		metrics.IngestPackets.Inc(portLabel, name)
+		metrics.IngestBytes.Add(float64(n), portLabel, name)
+		if !bound {
+			metrics.IngestUnknownSSRC.Inc(portLabel)
+			continue
+		}
+		// the session is created with the first packet
+		sess := sessions.IngestSession(name, webrtc.RTPCodecTypeAudio)
+		if sess != nil && !sess.FailoverPacket(webrtc.RTPCodecTypeAudio, 0, binding.Backup, inboundRTPPacket[:n]) {
+			continue
+		}
+		// recorded, segmented and relayed even while nobody is watching
+		recorder.Write(name, webrtc.RTPCodecTypeAudio, 0, inboundRTPPacket[:n])
+		hls.Write(name, webrtc.RTPCodecTypeAudio, 0, inboundRTPPacket[:n])
+		relay.Write(name, webrtc.RTPCodecTypeAudio, 0, inboundRTPPacket[:n])
+		// write to session track
 		if sess != nil {
 			if _, err = sess.TrackGroup.AudioTrack.Write(inboundRTPPacket[:n]); err != nil {
 				if errors.Is(err, io.ErrClosedPipe) {
 					continue
 				}
-				log.Printf("audio track of session %v writer got exception: %s\n", stream_ssrc, err)
+				logging.With("session_id", name).Errorf("audio track of ssrc %v writer got exception: %s", stream_ssrc, err)
 			}
 		}
 	}